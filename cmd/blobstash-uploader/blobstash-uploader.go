@@ -1,27 +1,137 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
 
 	"a4.io/blobstash/pkg/client/blobstore"
 	"a4.io/blobstash/pkg/client/clientutil"
 	"a4.io/blobstash/pkg/client/filetree"
 	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader"
 	"a4.io/blobstash/pkg/filetree/writer"
 )
 
 func usage() {
 	fmt.Printf("Usage: %s [OPTIONS] [FSNAME] [DIRPATH]\n", os.Args[0])
+	fmt.Printf("       %s -restore [OPTIONS] [FSNAME] [DESTPATH]\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
 var snapMessage string
+var dryRun, quiet bool
+var cacheDir string
+var noCache bool
+var ignore string
+
+// Restore mode flags
+var restore bool
+var include, exclude string
+var asOf int64
+var workers int
+
+func printProgress(wr *writer.WriteResult) {
+	fmt.Fprintf(os.Stderr, "\rscanned %d files (%s), uploaded %d files (%s)",
+		wr.FilesCount, humanize.Bytes(uint64(wr.Size)), wr.FilesUploaded, humanize.Bytes(uint64(wr.SizeUploaded)))
+}
+
+func formatStats(wr *writer.WriteResult) string {
+	return fmt.Sprintf("files=%d\nfiles_uploaded=%d\nfiles_skipped=%d\nfiles_excluded=%d\n"+
+		"dirs=%d\ndirs_uploaded=%d\ndirs_skipped=%d\nblobs=%d\nblobs_uploaded=%d\n"+
+		"size=%s\nsize_uploaded=%s\nsize_skipped=%s\n",
+		wr.FilesCount, wr.FilesUploaded, wr.FilesSkipped, wr.FilesExcluded,
+		wr.DirsCount, wr.DirsUploaded, wr.DirsSkipped, wr.BlobsCount, wr.BlobsUploaded,
+		humanize.Bytes(uint64(wr.Size)), humanize.Bytes(uint64(wr.SizeUploaded)), humanize.Bytes(uint64(wr.SizeSkipped)))
+}
+
+func splitPatterns(s string) []string {
+	out := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// isEmptyDir returns true if the path does not exist or is an empty directory
+func isEmptyDir(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+func doRestore(bs *blobstore.BlobStore, ft *filetree.Filetree, fsName, dstPath string) {
+	empty, err := isEmptyDir(dstPath)
+	if err != nil {
+		fmt.Printf("failed to check destination: %v\n", err)
+		os.Exit(1)
+	}
+	if !empty {
+		fmt.Printf("destination \"%s\" is not empty\n", dstPath)
+		os.Exit(1)
+	}
+
+	ref, err := ft.FSRoot(fsName, asOf)
+	if err != nil {
+		if err == clientutil.ErrNotFound {
+			fmt.Printf("snapshot not found\n")
+			os.Exit(1)
+		}
+		fmt.Printf("failed to fetch the snapshot: %v\n", err)
+		os.Exit(1)
+	}
+
+	rs := reader.NewRestorer(bs)
+	rs.Include = splitPatterns(include)
+	rs.Exclude = splitPatterns(exclude)
+	if workers > 0 {
+		rs.Workers = workers
+	}
+	res, err := rs.Restore(context.TODO(), ref, dstPath)
+	if err != nil {
+		fmt.Printf("failed to restore: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Restore successful,\nroot=%s\nfiles=%d\ndirs=%d\nsymlinks=%d\nsize=%d\n", ref, res.FilesCount, res.DirsCount, res.SymlinksCount, res.Size)
+	os.Exit(0)
+}
 
 func main() {
 	flag.Usage = usage
 	flag.StringVar(&snapMessage, "message", "", "Optional snapshot message")
+	flag.BoolVar(&restore, "restore", false, "Restore the FS snapshot to DESTPATH instead of performing a backup")
+	flag.Int64Var(&asOf, "as-of", 0, "Restore the snapshot as of the given version (defaults to the latest)")
+	flag.StringVar(&ignore, "ignore", "", "Comma-separated gitignore-style patterns of the paths to skip when backing up (appended to the .blobstashignore file, prefix with ! to re-include)")
+	flag.StringVar(&include, "include", "", "Comma-separated patterns (path.Match syntax) of the paths to restore, everything else is skipped")
+	flag.StringVar(&exclude, "exclude", "", "Comma-separated patterns (path.Match syntax) of the paths to skip when restoring")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only report the files that would be uploaded")
+	flag.BoolVar(&quiet, "quiet", false, "Disable the progress output")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Path of the local cache used to skip unchanged files (defaults to the user cache dir)")
+	flag.BoolVar(&noCache, "no-cache", false, "Disable the local cache (all the files will be read)")
+	flag.IntVar(&workers, "workers", 4, "Number of chunks downloaded in parallel when restoring")
 	flag.Parse()
 
 	if flag.NArg() != 2 {
@@ -29,6 +139,16 @@ func main() {
 		os.Exit(2)
 	}
 
+	// The backup patterns use the gitignore syntax, the restore ones use path.Match
+	if restore && ignore != "" {
+		fmt.Printf("-ignore is only supported for backups, use -include/-exclude when restoring\n")
+		os.Exit(2)
+	}
+	if !restore && (include != "" || exclude != "") {
+		fmt.Printf("-include/-exclude are only supported when restoring, use -ignore for backups\n")
+		os.Exit(2)
+	}
+
 	host := os.Getenv("BLOBSTASH_API_HOST")
 	apiKey := os.Getenv("BLOBSTASH_API_KEY")
 	fsName := flag.Arg(0)
@@ -57,6 +177,10 @@ func main() {
 	bs := blobstore.New(c)
 	ft := filetree.New(c)
 
+	if restore {
+		doRestore(bs, ft, fsName, dirPath)
+	}
+
 	// Src sanity check
 	finfo, err := os.Stat(dirPath)
 	switch {
@@ -75,14 +199,74 @@ func main() {
 
 	var m *rnode.RawNode
 	up := writer.NewUploader(bs)
+	up.DryRun = dryRun
+	if !noCache {
+		if cacheDir == "" {
+			userCacheDir, err := os.UserCacheDir()
+			if err != nil {
+				fmt.Printf("failed to locate the cache dir: %v\n", err)
+				os.Exit(1)
+			}
+			cacheDir = filepath.Join(userCacheDir, "blobstash-uploader")
+		}
+		// One cache per FS as the blobs are checked against the FS namespace
+		cache, err := writer.NewMetaCache(filepath.Join(cacheDir, fsName))
+		if err != nil {
+			fmt.Printf("failed to open the cache: %v\n", err)
+			os.Exit(1)
+		}
+		up.Cache = cache
+	}
+	up.Patterns = splitPatterns(ignore)
+	if dryRun {
+		up.OnFile = func(path string, uploaded bool) {
+			if uploaded {
+				fmt.Printf("would upload %s\n", path)
+			}
+		}
+	}
+
+	// Display the progress on stderr
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if !quiet {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.NewTicker(1 * time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					printProgress(up.Stats())
+				case <-stop:
+					printProgress(up.Stats())
+					fmt.Fprintf(os.Stderr, "\n")
+					return
+				}
+			}
+		}()
+	}
 
 	// Upload the tree
 	m, err = up.PutDir(dirPath)
+	close(stop)
+	wg.Wait()
+	if up.Cache != nil {
+		// Closed explicitly as `os.Exit` does not run the deferred calls
+		up.Cache.Close()
+	}
 	if err != nil {
 		fmt.Printf("failed to upload: %v\n", err)
 		os.Exit(1)
 	}
 
+	stats := up.Stats()
+	if dryRun {
+		fmt.Printf("Dry run,\nroot=%s\n%s", m.Hash, formatStats(stats))
+		os.Exit(0)
+	}
+
 	// Make a snaphot/create a FS entry for the given tree
 	rev, err := ft.MakeSnapshot(m.Hash, fsName, snapMessage)
 	if err != nil {
@@ -96,6 +280,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	fmt.Printf("Backup successful,\nroot=%s\nrev=%d\n", m.Hash, rev)
+	fmt.Printf("Backup successful,\nroot=%s\nrev=%d\n%s", m.Hash, rev, formatStats(stats))
 	os.Exit(0)
 }
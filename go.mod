@@ -42,6 +42,7 @@ require (
 	github.com/toqueteos/trie v0.0.0-20150530104557-56fed4a05683 // indirect
 	github.com/unrolled/secure v0.0.0-20181221173256-0d6b5bb13069
 	github.com/urfave/negroni v1.0.0 // indirect
+	github.com/valyala/gozstd v1.2.1
 	github.com/vmihailenco/msgpack v4.0.1+incompatible
 	github.com/xeonx/timeago v1.0.0-rc3
 	github.com/yuin/gopher-lua v0.0.0-20181214045814-db9ae37725ec
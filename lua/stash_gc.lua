@@ -35,3 +35,71 @@ function mark_filetree_node (ref)
   end
 end
 _G.mark_filetree_node = mark_filetree_node
+
+-- Mark all the snapshots of a FS, the pruned snapshots are not listed anymore so the blobs only referenced by them
+-- won't be kept
+function mark_filetree_fs (name)
+  local key = '_filetree:fs:' .. name
+  local cursor = '0'
+  while true do
+    local versions, next_cursor = kvstore.versions(key, cursor, 100)
+    for _, kv in ipairs(versions) do
+      mark_kv(key, kv.version)
+      mark_filetree_node(kv.ref)
+    end
+    if #versions < 100 or next_cursor == '' or next_cursor == '0' then
+      break
+    end
+    cursor = next_cursor
+  end
+end
+_G.mark_filetree_fs = mark_filetree_fs
+
+-- Mark the pointers found in a docstore document, `@blobstash/doc:` pointers are followed
+function mark_doc_pointers (doc, seen)
+  for _, v in pairs(doc) do
+    if type(v) == 'table' then
+      mark_doc_pointers(v, seen)
+    elseif type(v) == 'string' then
+      if v:sub(1, 15) == '@blobstash/doc:' then
+        local collection, _id = v:sub(16):match('^([^/]+)/(.+)$')
+        if collection ~= nil then
+          mark_doc(collection, _id, '0', seen)
+        end
+      elseif v:sub(1, 12) == '@blobs/json:' then
+        mark(v:sub(13))
+      elseif v:sub(1, 14) == '@filetree/ref:' then
+        mark_filetree_node(v:sub(15))
+      end
+    end
+  end
+end
+
+-- Mark a docstore document version (version '0' is the latest), and the documents it references
+function mark_doc (collection, _id, version, seen)
+  seen = seen or {}
+  local key = 'docstore:' .. collection .. ':' .. _id
+  local ok, data, _, doc_version = pcall(kvstore.get, key, version)
+  if not ok then
+    -- The referenced doc may have been purged, any other error must abort the GC (or blobs may not be marked)
+    if tostring(data):find('key not found', 1, true) then
+      return
+    end
+    error(data)
+  end
+  if seen[key .. '@' .. doc_version] then
+    return
+  end
+  seen[key .. '@' .. doc_version] = true
+  mark_kv(key, doc_version)
+  -- Deleted doc (flagDeleted)
+  if data:byte(1) == 1 then
+    return
+  end
+  -- Encrypted doc (purgeable collection), the pointers cannot be read without the key
+  if data:byte(2) == 0xc1 then
+    return
+  end
+  mark_doc_pointers(msgpack.decode(data:sub(2)), seen)
+end
+_G.mark_doc = mark_doc
@@ -15,6 +15,7 @@ import (
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
 	"github.com/yuin/gopher-lua"
+	"github.com/zpatrick/rbac"
 	git "gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
@@ -32,6 +33,7 @@ import (
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/hub"
 	kvLua "a4.io/blobstash/pkg/kvstore/lua"
+	"a4.io/blobstash/pkg/perms"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/gluapp"
 	"github.com/robfig/cron"
@@ -81,6 +83,7 @@ type App struct {
 	config     map[string]interface{}
 	scheduled  string
 	auth       func(*http.Request) bool
+	roles      rbac.Roles
 
 	proxyTarget *url.URL
 	proxy       *rhttputil.ReverseProxy
@@ -113,6 +116,14 @@ func (apps *Apps) newApp(appConf *config.AppConfig) (*App, error) {
 		app.auth = httputil.BasicAuthFunc(appConf.Username, appConf.Password)
 	}
 
+	if len(appConf.Roles) > 0 {
+		roles, err := perms.GetRoles(appConf.Roles)
+		if err != nil {
+			return nil, err
+		}
+		app.roles = roles
+	}
+
 	// If it's a remote app, clone the repo in a temp dir
 	if appConf.Remote != "" {
 		// Format of the remote is `<repo_url>#<commit_hash>`
@@ -175,7 +186,7 @@ func (apps *Apps) newApp(appConf *config.AppConfig) (*App, error) {
 				docstore.SetLuaGlobals(L)
 				blobstoreLua.Setup(context.TODO(), L, apps.bs)
 				filetreeLua.Setup(L, apps.ft, apps.bs)
-				docstoreLua.Setup(L, apps.docstore)
+				docstoreLua.Setup(L, apps.docstore, app.roles)
 				kvLua.Setup(L, apps.kvs, context.TODO())
 				gitserverLua.Setup(L, apps.gs)
 				// setup "apps"
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net/http"
 	"net/url"
 	"time"
 	// "reflect"
@@ -21,6 +22,9 @@ import (
 
 var ErrIDNotFound = errors.New("ID doest not exist")
 
+// ErrPreconditionFailed is returned when the document has been updated since it was fetched
+var ErrPreconditionFailed = errors.New("the document has been updated since it was fetched")
+
 var (
 	defaultServerAddr = "http://localhost:8050"
 	defaultUserAgent  = "DocStore Go client v1"
@@ -97,6 +101,12 @@ func New(client *clientutil.ClientUtil) *DocStore {
 	}
 }
 
+// IfMatch makes the update conditional, it will fail with `ErrPreconditionFailed` if the document has been updated
+// since the ETag (as returned by `GetID`) was fetched.
+func IfMatch(etag string) func(*http.Request) error {
+	return clientutil.WithHeader("If-Match", etag)
+}
+
 func (docstore *DocStore) Col(collection string) *Collection {
 	return &Collection{
 		docstore: docstore,
@@ -146,13 +156,13 @@ func (col *Collection) Insert(ctx context.Context, idoc interface{}, opts *Inser
 	}
 }
 
-// Update the whole document
-func (col *Collection) UpdateID(ctx context.Context, id string, doc interface{}) error {
+// Update the whole document, use the `IfMatch` option to make the update conditional.
+func (col *Collection) UpdateID(ctx context.Context, id string, doc interface{}, opts ...func(*http.Request) error) error {
 	js, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	resp, err := col.docstore.client.Do("POST", fmt.Sprintf("/api/docstore/%s/%s", col.col, id), bytes.NewReader(js))
+	resp, err := col.docstore.client.Do("POST", fmt.Sprintf("/api/docstore/%s/%s", col.col, id), bytes.NewReader(js), opts...)
 	if err != nil {
 		return err
 	}
@@ -160,6 +170,9 @@ func (col *Collection) UpdateID(ctx context.Context, id string, doc interface{})
 	switch resp.StatusCode {
 	case 200:
 		return nil
+	case 412:
+		// The doc must be fetched again
+		return ErrPreconditionFailed
 	default:
 		var body bytes.Buffer
 		body.ReadFrom(resp.Body)
@@ -167,26 +180,105 @@ func (col *Collection) UpdateID(ctx context.Context, id string, doc interface{})
 	}
 }
 
-// Get retrieve the document, `doc` must a map[string]interface{} or a struct pointer.
-func (col *Collection) GetID(ctx context.Context, id string, doc interface{}) error {
+// BulkOp is a single operation for `Bulk`, `Op` must be one of insert|update|patch|delete
+type BulkOp struct {
+	Op      string      `json:"op"`
+	ID      string      `json:"_id,omitempty"`
+	Doc     interface{} `json:"doc,omitempty"`
+	Patch   interface{} `json:"patch,omitempty"` // JSON-Patch (RFC6902) ops
+	IfMatch string      `json:"if_match,omitempty"`
+}
+
+// BulkResult holds the result of a single `BulkOp`
+type BulkResult struct {
+	Op      string `json:"op" msgpack:"op"`
+	ID      string `json:"_id" msgpack:"_id"`
+	Version string `json:"_version" msgpack:"_version"`
+	Status  int    `json:"status" msgpack:"status"`
+	Error   string `json:"error" msgpack:"error"`
+
+	// JSON Schema validation errors (path/message)
+	ValidationErrors []map[string]string `json:"errors" msgpack:"errors"`
+}
+
+// ErrBulkFailed is returned when at least one op failed (the results contains the details)
+var ErrBulkFailed = errors.New("bulk operation failed")
+
+// Bulk executes multiple operations in a single request, if `atomic` is set, either all the ops are executed, or none
+// (the writes are rolled back if one of them fails).
+func (col *Collection) Bulk(ctx context.Context, ops []*BulkOp, atomic bool) ([]*BulkResult, error) {
+	// Encode the ops as NDJSON
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := col.docstore.client.Do(
+		"POST",
+		fmt.Sprintf("/api/docstore/%s/_bulk?atomic=%v", col.col, atomic),
+		&buf,
+		clientutil.WithHeader("Content-Type", "application/x-ndjson"),
+		clientutil.WithHeader("Accept", "application/x-ndjson"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200, 422, 500:
+		if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+			break
+		}
+		// One result per line
+		results := []*BulkResult{}
+		var failed bool
+		dec := json.NewDecoder(resp.Body)
+		for {
+			res := &BulkResult{}
+			if err := dec.Decode(res); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if res.Status >= 400 || res.Error != "" {
+				failed = true
+			}
+			results = append(results, res)
+		}
+		if failed {
+			return results, ErrBulkFailed
+		}
+		return results, nil
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	return nil, fmt.Errorf("failed to execute bulk ops (%d): %v", resp.StatusCode, body.String())
+}
+
+// Get retrieve the document, `doc` must a map[string]interface{} or a struct pointer, returns the ETag of the
+// document (to be used with the `IfMatch` option for conditional updates).
+func (col *Collection) GetID(ctx context.Context, id string, doc interface{}) (string, error) {
 	resp, err := col.docstore.client.Get(fmt.Sprintf("/api/docstore/%s/%s", col.col, id))
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	defer resp.Body.Close()
 	if err := clientutil.ExpectStatusCode(resp, 200); err != nil {
 		if err.IsNotFound() {
-			return ErrIDNotFound
+			return "", ErrIDNotFound
 		}
-		return err
+		return "", err
 	}
 
 	if err := clientutil.Unmarshal(resp, doc); err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return resp.Header.Get("ETag"), nil
 }
 
 type Iter struct {
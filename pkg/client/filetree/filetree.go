@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 
 	"a4.io/blobstash/pkg/client/clientutil"
 )
@@ -56,6 +57,36 @@ func (f *Filetree) MakeSnapshot(ref, fs, message string) (int64, error) {
 	return snap.Version, nil
 }
 
+type fsRootResp struct {
+	Ref string `json:"ref"`
+}
+
+// FSRoot returns the ref of the root node of the FS as of the given version (the latest version if `asOf` is 0)
+func (f *Filetree) FSRoot(fs string, asOf int64) (string, error) {
+	resp, err := f.client.Get(
+		fmt.Sprintf("/api/filetree/fs/fs/%s/", fs),
+		clientutil.WithQueryArg("as_of", strconv.FormatInt(asOf, 10)),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := clientutil.ExpectStatusCode(resp, http.StatusOK); err != nil {
+		if err.IsNotFound() {
+			return "", clientutil.ErrNotFound
+		}
+		return "", err
+	}
+
+	root := &fsRootResp{}
+	if err := clientutil.Unmarshal(resp, root); err != nil {
+		return "", err
+	}
+
+	return root.Ref, nil
+}
+
 // GC performs a garbage collection to save the latest filetreee snapshot
 func (f *Filetree) GC(ns, name string, rev int64) error {
 	gcScript := fmt.Sprintf(`
@@ -29,6 +29,9 @@ type AppConfig struct {
 	Remote     string `yaml:"remote"`
 	Scheduled  string `yaml:"scheduled"`
 
+	// Roles used to check the permissions of the Lua APIs (full access if empty)
+	Roles []string `yaml:"roles"`
+
 	Config map[string]interface{} `yaml:"config"`
 }
 
@@ -119,6 +122,7 @@ type Config struct {
 
 	Apps          []*AppConfig    `yaml:"apps"`
 	Docstore      *DocstoreConfig `yaml:"docstore"`
+	Filetree      *FiletreeConfig `yaml:"filetree"`
 	Replication   *Replication    `yaml:"replication"`
 	ReplicateFrom *ReplicateFrom  `yaml:"replicate_from"`
 
@@ -140,8 +144,44 @@ func (c *Config) LogLvl() log15.Lvl {
 }
 
 type DocstoreConfig struct {
-	StoredQueries []*StoredQuery               `yaml:"stored_queries"`
-	Hooks         map[string]map[string]string `yaml:"hooks"`
+	StoredQueries   []*StoredQuery               `yaml:"stored_queries"`
+	Hooks           map[string]map[string]string `yaml:"hooks"`
+	FullTextIndexes map[string][]string          `yaml:"fulltext_indexes"`
+	Schemas         map[string]string            `yaml:"schemas"`
+
+	// Collections whose docs can be purged (i.e. erased), each doc is encrypted using its own key (stored locally in
+	// the data dir and deleted when purging the doc). The keys are not stored in the blobstore, if they're lost, the
+	// docs of these collections cannot be read anymore.
+	PurgeableCollections []string `yaml:"purgeable_collections"`
+}
+
+type FiletreeConfig struct {
+	// Retention policies for the FS snapshots (by FS name)
+	Retention map[string]*RetentionPolicy `yaml:"retention"`
+
+	// Persistent search index for the FS nodes (disabled if nil)
+	SearchIndex *FiletreeSearchIndexConfig `yaml:"search_index"`
+
+	// Number of hours an upload session can stay inactive before being removed (defaults to 24)
+	UploadSessionTTL int `yaml:"upload_session_ttl"`
+}
+
+// FiletreeSearchIndexConfig defines which FS must be indexed
+type FiletreeSearchIndexConfig struct {
+	// Names of the FS to index (all the FS are indexed if empty)
+	FS []string `yaml:"fs"`
+
+	// Extract and index the text of the text files smaller than `MaxTextSize` (defaults to 1MB)
+	FullText    bool `yaml:"fulltext"`
+	MaxTextSize int  `yaml:"max_text_size"`
+}
+
+// RetentionPolicy defines which FS snapshots must be kept when pruning
+type RetentionPolicy struct {
+	KeepLast    int `yaml:"keep_last" json:"keep_last"`
+	KeepDaily   int `yaml:"keep_daily" json:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly" json:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly" json:"keep_monthly"`
 }
 
 type StoredQuery struct {
@@ -0,0 +1,435 @@
+package docstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/maputil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Supported accumulators for the group stage
+var accumulators = map[string]struct{}{
+	"count":    struct{}{},
+	"sum":      struct{}{},
+	"avg":      struct{}{},
+	"min":      struct{}{},
+	"max":      struct{}{},
+	"distinct": struct{}{},
+}
+
+// JSON input for the aggregate endpoint, the stages are executed in this order: match → group → sort → limit
+type aggregateInput struct {
+	// Lua expression (like the `query` query arg)
+	Match string `json:"match"`
+
+	Group *struct {
+		By     []string                     `json:"by"`
+		Fields map[string]map[string]string `json:"fields"` // {"<output field>": {"<accumulator>": "<field path>"}}
+	} `json:"group"`
+
+	Sort  []string `json:"sort"` // Output field, prefixed with a `-` for descending order
+	Limit int      `json:"limit"`
+}
+
+type accState struct {
+	count    int
+	sum      float64
+	min, max interface{}
+	distinct map[string]interface{}
+}
+
+type groupState struct {
+	key  []interface{}
+	accs map[string]*accState
+}
+
+// aggregation holds the partial results of a group stage
+type aggregation struct {
+	input  *aggregateInput
+	groups map[string]*groupState
+}
+
+func newAggregation(input *aggregateInput) *aggregation {
+	return &aggregation{
+		input:  input,
+		groups: map[string]*groupState{},
+	}
+}
+
+// toFloat converts any number to a float64
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// compareValues compares numbers and strings (numbers are sorted before strings, then the other types)
+func compareValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		if _, ok := toFloat(v); ok {
+			return 0
+		}
+		if _, ok := v.(string); ok {
+			return 1
+		}
+		if v == nil {
+			return 3
+		}
+		return 2
+	}
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch ra {
+	case 0:
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+	case 1:
+		return strings.Compare(a.(string), b.(string))
+	}
+	return 0
+}
+
+func (agg *aggregation) add(doc map[string]interface{}) error {
+	var by []string
+	var fields map[string]map[string]string
+	if agg.input.Group != nil {
+		by = agg.input.Group.By
+		fields = agg.input.Group.Fields
+	}
+
+	key := make([]interface{}, len(by))
+	for i, path := range by {
+		if v, err := maputil.GetPath(path, doc); err == nil {
+			key[i] = v
+		}
+	}
+	rawKey, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	group, ok := agg.groups[string(rawKey)]
+	if !ok {
+		group = &groupState{key: key, accs: map[string]*accState{}}
+		agg.groups[string(rawKey)] = group
+	}
+
+	for name, spec := range fields {
+		acc, ok := group.accs[name]
+		if !ok {
+			acc = &accState{distinct: map[string]interface{}{}}
+			group.accs[name] = acc
+		}
+		for op, path := range spec {
+			var v interface{}
+			var found bool
+			if path != "" && path != "*" {
+				if v, err = maputil.GetPath(path, doc); err == nil {
+					found = true
+				}
+			}
+			switch op {
+			case "count":
+				if path == "" || path == "*" || found {
+					acc.count++
+				}
+			case "sum", "avg":
+				if f, ok := toFloat(v); found && ok {
+					acc.sum += f
+					acc.count++
+				}
+			case "min":
+				if found && (acc.min == nil || compareValues(v, acc.min) < 0) {
+					acc.min = v
+				}
+			case "max":
+				if found && (acc.max == nil || compareValues(v, acc.max) > 0) {
+					acc.max = v
+				}
+			case "distinct":
+				if found {
+					js, err := json.Marshal(v)
+					if err != nil {
+						return err
+					}
+					acc.distinct[string(js)] = v
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// merge merges the partial results from another worker
+func (agg *aggregation) merge(other *aggregation) {
+	for k, ogroup := range other.groups {
+		group, ok := agg.groups[k]
+		if !ok {
+			agg.groups[k] = ogroup
+			continue
+		}
+		for name, oacc := range ogroup.accs {
+			acc, ok := group.accs[name]
+			if !ok {
+				group.accs[name] = oacc
+				continue
+			}
+			acc.count += oacc.count
+			acc.sum += oacc.sum
+			if oacc.min != nil && (acc.min == nil || compareValues(oacc.min, acc.min) < 0) {
+				acc.min = oacc.min
+			}
+			if oacc.max != nil && (acc.max == nil || compareValues(oacc.max, acc.max) > 0) {
+				acc.max = oacc.max
+			}
+			for dk, dv := range oacc.distinct {
+				acc.distinct[dk] = dv
+			}
+		}
+	}
+}
+
+// finalize computes the output rows, then apply the sort and limit stages
+func (agg *aggregation) finalize() []map[string]interface{} {
+	var by []string
+	var fields map[string]map[string]string
+	if agg.input.Group != nil {
+		by = agg.input.Group.By
+		fields = agg.input.Group.Fields
+	}
+
+	rows := []map[string]interface{}{}
+	for _, group := range agg.groups {
+		row := map[string]interface{}{}
+		for i, path := range by {
+			row[path] = group.key[i]
+		}
+		for name, spec := range fields {
+			acc, ok := group.accs[name]
+			if !ok {
+				acc = &accState{}
+			}
+			for op := range spec {
+				switch op {
+				case "count":
+					row[name] = acc.count
+				case "sum":
+					row[name] = acc.sum
+				case "avg":
+					if acc.count > 0 {
+						row[name] = acc.sum / float64(acc.count)
+					} else {
+						row[name] = nil
+					}
+				case "min":
+					row[name] = acc.min
+				case "max":
+					row[name] = acc.max
+				case "distinct":
+					keys := []string{}
+					for k := range acc.distinct {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					values := []interface{}{}
+					for _, k := range keys {
+						values = append(values, acc.distinct[k])
+					}
+					row[name] = values
+				}
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	sortFields := agg.input.Sort
+	if len(sortFields) == 0 {
+		// Default to the group fields to get a deterministic output
+		sortFields = by
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, field := range sortFields {
+			desc := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			c := compareValues(rows[i][field], rows[j][field])
+			if c == 0 {
+				continue
+			}
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	if agg.input.Limit > 0 && len(rows) > agg.input.Limit {
+		rows = rows[:agg.input.Limit]
+	}
+	return rows
+}
+
+func (input *aggregateInput) check() error {
+	if input.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", input.Limit)
+	}
+	if input.Group == nil {
+		return fmt.Errorf("missing group stage")
+	}
+	outputs := map[string]struct{}{}
+	for _, path := range input.Group.By {
+		outputs[path] = struct{}{}
+	}
+	for name, spec := range input.Group.Fields {
+		if _, ok := outputs[name]; ok {
+			return fmt.Errorf("field %q is already used by the group key", name)
+		}
+		outputs[name] = struct{}{}
+		if len(spec) != 1 {
+			return fmt.Errorf("field %q must have exactly one accumulator", name)
+		}
+		for op, path := range spec {
+			if _, ok := accumulators[op]; !ok {
+				return fmt.Errorf("unknown accumulator %q", op)
+			}
+			if op != "count" && (path == "" || path == "*") {
+				return fmt.Errorf("accumulator %q requires a field", op)
+			}
+		}
+	}
+	for _, field := range input.Sort {
+		if _, ok := outputs[strings.TrimPrefix(field, "-")]; !ok {
+			return fmt.Errorf("cannot sort on unknown field %q", field)
+		}
+	}
+	return nil
+}
+
+// HTTP handler for the aggregation pipeline
+func (docstore *DocStore) aggregateHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := httputil.NewQuery(r.URL.Query())
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Query, collection) {
+			return
+		}
+
+		input := &aggregateInput{}
+		if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid JSON input")
+			return
+		}
+		if err := input.check(); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		asOf, err := parseAsOf(q)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tstart := time.Now()
+		root := newAggregation(input)
+		var mu sync.Mutex // guards root
+
+		// Process the batches in parallel, like for map reduce
+		inFlight := 6
+		limiter := make(chan struct{}, inFlight)
+		var wg sync.WaitGroup
+		var workerErr error
+
+		var examined int
+		var cursor string
+		// Batch size
+		limit := 50
+		mq := &query{basicQuery: input.Match}
+		for {
+			docs, _, stats, err := docstore.query(nil, collection, mq, cursor, limit, 0, asOf, nil)
+			if err != nil {
+				docstore.logger.Error("query failed", "err", err)
+				httputil.Error(w, err)
+				return
+			}
+			examined += stats.TotalDocsExamined
+
+			wg.Add(1)
+			limiter <- struct{}{}
+			go func(docs []map[string]interface{}) {
+				defer func() {
+					wg.Done()
+					<-limiter
+				}()
+				agg := newAggregation(input)
+				for _, doc := range docs {
+					if err := agg.add(doc); err != nil {
+						mu.Lock()
+						workerErr = err
+						mu.Unlock()
+						return
+					}
+				}
+				mu.Lock()
+				root.merge(agg)
+				mu.Unlock()
+			}(docs)
+
+			if stats.NReturned < limit {
+				break
+			}
+			cursor = vkv.PrevKey(stats.LastID)
+		}
+		wg.Wait()
+
+		if workerErr != nil {
+			docstore.logger.Error("aggregation failed", "err", workerErr)
+			httputil.Error(w, workerErr)
+			return
+		}
+
+		rows := root.finalize()
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": rows,
+			"stats": map[string]interface{}{
+				"totalDocsExamined": examined,
+				"groups":            len(root.groups),
+				"executionTimeNano": time.Since(tstart).Nanoseconds(),
+			},
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package docstore
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAggregation(t *testing.T) {
+	input := &aggregateInput{}
+	if err := json.Unmarshal([]byte(`{
+  "group": {
+    "by": ["author"],
+    "fields": {
+      "n": {"count": "*"},
+      "total": {"sum": "meta.price"},
+      "avg": {"avg": "meta.price"},
+      "min": {"min": "meta.price"},
+      "max": {"max": "meta.price"},
+      "tags": {"distinct": "tag"}
+    }
+  },
+  "sort": ["-total"],
+  "limit": 2
+}`), input); err != nil {
+		panic(err)
+	}
+	if err := input.check(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	docs := []map[string]interface{}{
+		{"author": "a", "tag": "x", "meta": map[string]interface{}{"price": int64(10)}},
+		{"author": "a", "tag": "y", "meta": map[string]interface{}{"price": 5.5}},
+		{"author": "b", "tag": "x", "meta": map[string]interface{}{"price": uint8(30)}},
+		{"author": "c", "tag": "x"},
+	}
+
+	// Simulate two workers
+	root := newAggregation(input)
+	for _, batch := range [][]map[string]interface{}{docs[:2], docs[2:]} {
+		agg := newAggregation(input)
+		for _, doc := range batch {
+			if err := agg.add(doc); err != nil {
+				panic(err)
+			}
+		}
+		root.merge(agg)
+	}
+
+	expected := []map[string]interface{}{
+		{"author": "b", "n": 1, "total": 30.0, "avg": 30.0, "min": uint8(30), "max": uint8(30), "tags": []interface{}{"x"}},
+		{"author": "a", "n": 2, "total": 15.5, "avg": 7.75, "min": 5.5, "max": int64(10), "tags": []interface{}{"x", "y"}},
+	}
+	rows := root.finalize()
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("unexpected result, got %+v, expected %+v", rows, expected)
+	}
+}
+
+func TestAggregationCheck(t *testing.T) {
+	for _, js := range []string{
+		`{}`,
+		`{"group": {"fields": {"n": {"nope": "a"}}}}`,
+		`{"group": {"fields": {"n": {"sum": "*"}}}}`,
+		`{"group": {"by": ["n"], "fields": {"n": {"count": "*"}}}}`,
+		`{"group": {"fields": {"n": {"count": "*"}}}, "sort": ["x"]}`,
+	} {
+		input := &aggregateInput{}
+		if err := json.Unmarshal([]byte(js), input); err != nil {
+			panic(err)
+		}
+		if err := input.check(); err == nil {
+			t.Errorf("expected an error for %s", js)
+		}
+	}
+}
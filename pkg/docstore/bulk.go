@@ -0,0 +1,671 @@
+package docstore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/evanphx/json-patch"
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/docstore/jsonschema"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/stash/store"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrDocNotFound is returned when the document does not exist (or is deleted)
+var ErrDocNotFound = errors.New("document not found")
+
+// ErrPreconditionFailed is returned when the `If-Match` ETag does not match the current version
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// docWrite is a single write operation, that has been checked and is ready to be committed
+type docWrite struct {
+	collection string
+	op         string
+	_id        *id.ID
+	doc        map[string]interface{} // nil for a delete
+	version    int64
+}
+
+// fetchLatest fetches the current version of the given doc, returns `ErrDocNotFound` if it is deleted
+func (docstore *DocStore) fetchLatest(collection, sid string) (*id.ID, map[string]interface{}, error) {
+	return docstore.fetchVersion(collection, sid, -1)
+}
+
+// fetchVersion fetches the given version of the doc, returns `ErrDocNotFound` if the version does not exist or is deleted
+func (docstore *DocStore) fetchVersion(collection, sid string, version int64) (*id.ID, map[string]interface{}, error) {
+	_id, err := id.FromHex(sid)
+	if err != nil {
+		return nil, nil, ErrDocNotFound
+	}
+	kv, err := docstore.kvStore.Get(context.TODO(), fmt.Sprintf(keyFmt, collection, sid), version)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, nil, ErrDocNotFound
+		}
+		return nil, nil, err
+	}
+	if len(kv.Data) == 0 || kv.Data[0] == flagDeleted {
+		return nil, nil, ErrDocNotFound
+	}
+	doc := map[string]interface{}{}
+	if err := docstore.decodeDoc(sid, kv.Data[1:], &doc); err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, nil, ErrDocNotFound
+		}
+		return nil, nil, err
+	}
+	_id.SetFlag(kv.Data[0])
+	_id.SetVersion(kv.Version)
+	return _id, doc, nil
+}
+
+// removeReservedKeys removes the keys starting with a `_` from the doc
+func removeReservedKeys(doc map[string]interface{}) {
+	for k := range doc {
+		if _, ok := reservedKeys[k]; ok {
+			delete(doc, k)
+		}
+	}
+}
+
+// checkIfMatch checks the `If-Match` header value (a list of ETags, or `*`) against the current version of the doc
+func checkIfMatch(_id *id.ID, ifMatch string) error {
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	for _, etag := range strings.Split(ifMatch, ",") {
+		if strings.Trim(strings.TrimSpace(etag), `"`) == _id.VersionString() {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// prepareInsert executes the insert hook and assigns an ID to the new doc
+func (docstore *DocStore) prepareInsert(collection string, doc map[string]interface{}) (*docWrite, error) {
+	// If there's already an "_id" field in the doc, remove it
+	if _, ok := doc["_id"]; ok {
+		delete(doc, "_id")
+	}
+
+	doc, err := docstore.executeHook(collection, hookInsert, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := docstore.validate(collection, doc); err != nil {
+		return nil, err
+	}
+
+	// Build the ID and add some meta data
+	now := time.Now().UTC()
+	_id, err := id.New(now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	_id.SetFlag(flagNoop)
+
+	return &docWrite{
+		collection: collection,
+		op:         ChangeInsert,
+		_id:        _id,
+		doc:        doc,
+		version:    now.UnixNano(),
+	}, nil
+}
+
+// prepareUpdate checks that the doc can be replaced by `newDoc`
+func (docstore *DocStore) prepareUpdate(collection, sid string, newDoc map[string]interface{}, ifMatch string) (*docWrite, error) {
+	_id, _, err := docstore.fetchLatest(collection, sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIfMatch(_id, ifMatch); err != nil {
+		return nil, err
+	}
+
+	// Field/key starting with `_` are forbidden, remove them
+	removeReservedKeys(newDoc)
+
+	newDoc, err = docstore.executeHook(collection, hookUpdate, newDoc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := docstore.validate(collection, newDoc); err != nil {
+		return nil, err
+	}
+
+	return &docWrite{
+		collection: collection,
+		op:         ChangeUpdate,
+		_id:        _id,
+		doc:        newDoc,
+		version:    -1,
+	}, nil
+}
+
+// preparePatch applies the JSON-Patch (RFC6902) to the current version of the doc
+func (docstore *DocStore) preparePatch(collection, sid string, rawPatch []byte, ifMatch string) (*docWrite, error) {
+	_id, doc, err := docstore.fetchLatest(collection, sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIfMatch(_id, ifMatch); err != nil {
+		return nil, err
+	}
+
+	patch, err := jsonpatch.DecodePatch(rawPatch)
+	if err != nil {
+		return nil, httputil.NewPublicErrorFmt("invalid patch: %v", err)
+	}
+	docstore.logger.Debug("patch decoded", "patch", patch)
+
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	pdata, err := patch.Apply(js)
+	if err != nil {
+		return nil, httputil.NewPublicErrorFmt("failed to apply patch: %v", err)
+	}
+
+	ndoc := map[string]interface{}{}
+	if err := json.Unmarshal(pdata, &ndoc); err != nil {
+		return nil, err
+	}
+	removeReservedKeys(ndoc)
+
+	ndoc, err = docstore.executeHook(collection, hookPatch, ndoc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := docstore.validate(collection, ndoc); err != nil {
+		return nil, err
+	}
+
+	return &docWrite{
+		collection: collection,
+		op:         ChangeUpdate,
+		_id:        _id,
+		doc:        ndoc,
+		version:    -1,
+	}, nil
+}
+
+// prepareDelete checks that the doc can be deleted
+func (docstore *DocStore) prepareDelete(collection, sid, ifMatch string) (*docWrite, error) {
+	_id, doc, err := docstore.fetchLatest(collection, sid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIfMatch(_id, ifMatch); err != nil {
+		return nil, err
+	}
+
+	// The hook receives the current version of the doc, and can only prevent the deletion
+	if _, err := docstore.executeHook(collection, hookDelete, doc); err != nil {
+		return nil, err
+	}
+
+	return &docWrite{
+		collection: collection,
+		op:         ChangeDelete,
+		_id:        _id,
+		version:    -1,
+	}, nil
+}
+
+// commit actually writes the doc (along with its change)
+func (docstore *DocStore) commit(dw *docWrite) error {
+	data := []byte{flagDeleted}
+	if dw.op != ChangeDelete {
+		encoded, err := docstore.encodeDoc(dw.collection, dw._id.String(), dw.doc)
+		if err != nil {
+			return err
+		}
+		data = append([]byte{dw._id.Flag()}, encoded...)
+	}
+
+	// The version must be known before the write as the change is recorded first
+	version := dw.version
+	if version <= 0 {
+		version = time.Now().UTC().UnixNano()
+	}
+	if err := docstore.notifyChange(dw.collection, dw.op, dw._id.String(), version, dw.doc, func() error {
+		kv, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(keyFmt, dw.collection, dw._id.String()), "", data, version)
+		if err != nil {
+			return err
+		}
+		dw._id.SetVersion(kv.Version)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// The write is committed, the full-text index can be rebuilt if it fails
+	if err := docstore.indexText(dw.collection, dw._id.String(), dw.doc); err != nil {
+		docstore.logger.Error("failed to update the full-text index", "collection", dw.collection, "_id", dw._id.String(), "err", err)
+	}
+	return nil
+}
+
+// errorStatus returns the HTTP status code for the given write error
+func errorStatus(err error) int {
+	switch err {
+	case ErrDocNotFound:
+		return http.StatusNotFound
+	case ErrPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case ErrNotDeleted, ErrNotPurgeable, store.ErrPurgeFromRoot:
+		return http.StatusConflict
+	case ErrUnprocessableEntity:
+		return http.StatusUnprocessableEntity
+	}
+	switch err.(type) {
+	case *jsonschema.ValidationError:
+		return http.StatusUnprocessableEntity
+	case httputil.PublicErrorer:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// writeDocError outputs the write error as JSON (with the validation errors details if any), panics on internal errors
+func writeDocError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		panic(err)
+	}
+	if verr, ok := err.(*jsonschema.ValidationError); ok {
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"error":  verr.Error(),
+			"errors": verr.Errors,
+		}, httputil.WithStatusCode(status))
+		return
+	}
+	httputil.WriteJSONError(w, status, err.Error())
+}
+
+// Operation for the bulk endpoint
+type bulkOp struct {
+	Op      string                 `json:"op" msgpack:"op"` // insert|update|patch|delete
+	ID      string                 `json:"_id,omitempty" msgpack:"_id,omitempty"`
+	Doc     map[string]interface{} `json:"doc,omitempty" msgpack:"doc,omitempty"`
+	Patch   json.RawMessage        `json:"patch,omitempty" msgpack:"-"`
+	IfMatch string                 `json:"if_match,omitempty" msgpack:"if_match,omitempty"`
+
+	// msgpack encoded patch, must contains the JSON-Patch encoded as a string
+	MsgpackPatch string `json:"-" msgpack:"patch,omitempty"`
+}
+
+type bulkResult struct {
+	Op      string `json:"op" msgpack:"op"`
+	ID      string `json:"_id,omitempty" msgpack:"_id,omitempty"`
+	Version string `json:"_version,omitempty" msgpack:"_version,omitempty"`
+	Status  int    `json:"status" msgpack:"status"`
+	Error   string `json:"error,omitempty" msgpack:"error,omitempty"`
+
+	// Details of the JSON Schema validation errors
+	ValidationErrors []*jsonschema.Error `json:"errors,omitempty" msgpack:"errors,omitempty"`
+}
+
+// Max number of ops in atomic mode (all the ops must be kept in memory until they're all committed)
+const maxAtomicOps = 10000
+
+// bulkDecoder decodes the NDJSON (or msgpack) stream of operations one op at a time
+type bulkDecoder struct {
+	next func(*bulkOp) error
+	n    int
+}
+
+func newBulkDecoder(r *http.Request) *bulkDecoder {
+	if r.Header.Get("Content-Type") == "application/msgpack" {
+		dec := msgpack.NewDecoder(bufio.NewReader(r.Body))
+		return &bulkDecoder{next: func(op *bulkOp) error {
+			if err := dec.Decode(op); err != nil {
+				return err
+			}
+			if op.MsgpackPatch != "" {
+				op.Patch = json.RawMessage(op.MsgpackPatch)
+			}
+			return nil
+		}}
+	}
+	dec := json.NewDecoder(r.Body)
+	return &bulkDecoder{next: func(op *bulkOp) error {
+		return dec.Decode(op)
+	}}
+}
+
+// Next returns the next op, or `io.EOF` once all the ops have been decoded
+func (d *bulkDecoder) Next() (*bulkOp, error) {
+	op := &bulkOp{}
+	if err := d.next(op); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, httputil.NewPublicErrorFmt("failed to decode op #%d: %v", d.n, err)
+	}
+	d.n++
+	return op, nil
+}
+
+func (docstore *DocStore) prepareBulkOp(collection string, op *bulkOp) (*docWrite, error) {
+	switch op.Op {
+	case "insert":
+		if op.Doc == nil {
+			return nil, httputil.NewPublicErrorFmt("missing doc")
+		}
+		removeReservedKeys(op.Doc)
+		return docstore.prepareInsert(collection, op.Doc)
+	case "update":
+		if op.Doc == nil {
+			return nil, httputil.NewPublicErrorFmt("missing doc")
+		}
+		return docstore.prepareUpdate(collection, op.ID, op.Doc, op.IfMatch)
+	case "patch":
+		return docstore.preparePatch(collection, op.ID, op.Patch, op.IfMatch)
+	case "delete":
+		return docstore.prepareDelete(collection, op.ID, op.IfMatch)
+	default:
+		return nil, httputil.NewPublicErrorFmt("unknown op %q", op.Op)
+	}
+}
+
+// newBulkResult returns the result for the op
+func newBulkResult(op *bulkOp, dw *docWrite, err error) *bulkResult {
+	res := &bulkResult{Op: op.Op, ID: op.ID, Status: http.StatusOK}
+	if err != nil {
+		res.Status = errorStatus(err)
+		res.Error = err.Error()
+		if verr, ok := err.(*jsonschema.ValidationError); ok {
+			res.ValidationErrors = verr.Errors
+		}
+		return res
+	}
+	res.ID = dw._id.String()
+	res.Version = dw._id.VersionString()
+	if dw.op == ChangeInsert {
+		res.Status = http.StatusCreated
+	}
+	return res
+}
+
+// bulkResultWriter writes the results as NDJSON (or as a msgpack stream if requested via the `Accept` header), the
+// headers are only sent along with the first result
+type bulkResultWriter struct {
+	w       http.ResponseWriter
+	ctype   string
+	encode  func(*bulkResult) error
+	started bool
+}
+
+func newBulkResultWriter(w http.ResponseWriter, r *http.Request) *bulkResultWriter {
+	if r.Header.Get("Accept") == "application/msgpack" {
+		enc := msgpack.NewEncoder(w)
+		return &bulkResultWriter{w: w, ctype: "application/msgpack", encode: func(res *bulkResult) error {
+			return enc.Encode(res)
+		}}
+	}
+	enc := json.NewEncoder(w)
+	return &bulkResultWriter{w: w, ctype: "application/x-ndjson", encode: func(res *bulkResult) error {
+		return enc.Encode(res)
+	}}
+}
+
+// Write writes a single result, `status` is only used for the first one
+func (bw *bulkResultWriter) Write(res *bulkResult, status int) error {
+	if !bw.started {
+		bw.w.Header().Set("Content-Type", bw.ctype)
+		bw.w.WriteHeader(status)
+		bw.started = true
+	}
+	return bw.encode(res)
+}
+
+// Bulk executes the ops one by one as they're decoded, and outputs each result as soon as the op is executed (an op
+// failure does not stop the other ops, but an invalid op stops the decoding). An error is only returned if nothing
+// has been output yet.
+func (docstore *DocStore) Bulk(collection string, dec *bulkDecoder, out func(*bulkResult) error) error {
+	var n int
+	for {
+		op, err := dec.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if _, ok := err.(httputil.PublicErrorer); ok && n > 0 {
+				// Some ops have already been written, report the error along with the results
+				return out(&bulkResult{Status: http.StatusBadRequest, Error: err.Error()})
+			}
+			return err
+		}
+		if op.ID != "" {
+			docstore.locker.Lock(op.ID)
+		}
+		dw, err := docstore.prepareBulkOp(collection, op)
+		if err == nil {
+			err = docstore.commit(dw)
+		}
+		if op.ID != "" {
+			docstore.locker.Unlock(op.ID)
+		}
+		res := newBulkResult(op, dw, err)
+		if res.Status == http.StatusInternalServerError {
+			docstore.logger.Error("bulk op failed", "collection", collection, "op", op.Op, "err", err)
+		}
+		if err := out(res); err != nil {
+			return err
+		}
+		n++
+	}
+}
+
+// BulkAtomic executes the ops in all-or-nothing mode: all the ops are checked before writing anything, and if a
+// write fails, the versions already written are removed (the change log records a `rollback` change for each of them,
+// the async hooks of the rolled back writes may have already been executed).
+// Returns true if the ops were rolled back (or not executed).
+func (docstore *DocStore) BulkAtomic(collection string, dec *bulkDecoder) ([]*bulkResult, bool, error) {
+	ops := []*bulkOp{}
+	for {
+		op, err := dec.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, false, err
+		}
+		if len(ops) == maxAtomicOps {
+			return nil, false, httputil.NewPublicErrorFmt("too many ops for the atomic mode (max %d)", maxAtomicOps)
+		}
+		ops = append(ops, op)
+	}
+
+	// Lock all the docs (sorted to prevent deadlocks) for the whole operation
+	sids := []string{}
+	seen := map[string]bool{}
+	for _, op := range ops {
+		if op.ID != "" && !seen[op.ID] {
+			seen[op.ID] = true
+			sids = append(sids, op.ID)
+		}
+	}
+	sort.Strings(sids)
+	for _, sid := range sids {
+		docstore.locker.Lock(sid)
+		defer docstore.locker.Unlock(sid)
+	}
+
+	notExecuted := func(op *bulkOp, msg string) *bulkResult {
+		return &bulkResult{Op: op.Op, ID: op.ID, Status: http.StatusFailedDependency, Error: msg}
+	}
+
+	// Check all the ops before writing anything
+	results := make([]*bulkResult, len(ops))
+	dws := make([]*docWrite, len(ops))
+	used := map[string]bool{}
+	var failed bool
+	for i, op := range ops {
+		// Only one op per doc is allowed, as the ops are checked against the current version
+		var err error
+		if op.ID != "" && used[op.ID] {
+			err = httputil.NewPublicErrorFmt("multiple ops for the same doc in atomic mode")
+		}
+		used[op.ID] = true
+		if err == nil {
+			dws[i], err = docstore.prepareBulkOp(collection, op)
+		}
+		if err != nil {
+			failed = true
+			results[i] = newBulkResult(op, nil, err)
+		}
+	}
+	if failed {
+		for i, res := range results {
+			if res == nil {
+				results[i] = notExecuted(ops[i], "not executed")
+			}
+		}
+		return results, true, nil
+	}
+
+	for i, dw := range dws {
+		if err := docstore.commit(dw); err != nil {
+			docstore.logger.Error("bulk op failed, rolling back", "collection", collection, "op", ops[i].Op, "err", err)
+			results[i] = newBulkResult(ops[i], nil, err)
+			for j := i + 1; j < len(ops); j++ {
+				results[j] = notExecuted(ops[j], "not executed")
+			}
+			// Rollback the previous writes (most recent first), the ops that cannot be rolled back keep their
+			// successful status (along with the rollback error)
+			for j := i - 1; j >= 0; j-- {
+				if err := docstore.rollback(dws[j]); err != nil {
+					docstore.logger.Error("bulk op rollback failed", "collection", collection, "op", ops[j].Op, "err", err)
+					results[j].Error = fmt.Sprintf("rollback failed: %v", err)
+					continue
+				}
+				results[j] = notExecuted(ops[j], "rolled back")
+			}
+			return results, true, nil
+		}
+		results[i] = newBulkResult(ops[i], dw, nil)
+	}
+	return results, false, nil
+}
+
+// rollback removes the version written by the committed op, and restores the full-text index to the previous version
+func (docstore *DocStore) rollback(dw *docWrite) error {
+	sid := dw._id.String()
+	version := dw._id.Version()
+	if err := docstore.notifyChange(dw.collection, ChangeRollback, sid, version, nil, func() error {
+		return docstore.kvStore.DeleteVersion(context.TODO(), fmt.Sprintf(keyFmt, dw.collection, sid), version)
+	}); err != nil {
+		return err
+	}
+	_, doc, err := docstore.fetchLatest(dw.collection, sid)
+	if err != nil && err != ErrDocNotFound {
+		return err
+	}
+	if err := docstore.indexText(dw.collection, sid, doc); err != nil {
+		docstore.logger.Error("failed to update the full-text index", "collection", dw.collection, "_id", sid, "err", err)
+	}
+	return nil
+}
+
+// HTTP handler for executing multiple operations in a single request, the results are output as NDJSON (one result
+// per op, in the same order)
+func (docstore *DocStore) bulkHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := httputil.NewQuery(r.URL.Query())
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Write, collection) {
+			return
+		}
+
+		// In atomic mode, either all the ops are executed, or none
+		atomic, err := q.GetBoolDefault("atomic", false)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+
+		dec := newBulkDecoder(r)
+		bw := newBulkResultWriter(w, r)
+		if !atomic {
+			if err := docstore.Bulk(collection, dec, func(res *bulkResult) error {
+				return bw.Write(res, http.StatusOK)
+			}); err != nil {
+				if bw.started {
+					// The client is gone
+					docstore.logger.Error("failed to output the bulk results", "collection", collection, "err", err)
+					return
+				}
+				if _, ok := err.(httputil.PublicErrorer); ok {
+					httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				panic(err)
+			}
+			if !bw.started {
+				w.Header().Set("Content-Type", bw.ctype)
+				w.WriteHeader(http.StatusOK)
+			}
+			return
+		}
+
+		results, failed, err := docstore.BulkAtomic(collection, dec)
+		if err != nil {
+			if _, ok := err.(httputil.PublicErrorer); ok {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			panic(err)
+		}
+		status := http.StatusOK
+		if failed {
+			status = http.StatusUnprocessableEntity
+			for _, res := range results {
+				// A write failed after the checks (the previous writes were rolled back)
+				if res.Status == http.StatusInternalServerError {
+					status = http.StatusInternalServerError
+					break
+				}
+			}
+		}
+		if len(results) == 0 {
+			w.Header().Set("Content-Type", bw.ctype)
+			w.WriteHeader(status)
+			return
+		}
+		for _, res := range results {
+			if err := bw.Write(res, status); err != nil {
+				docstore.logger.Error("failed to output the bulk results", "collection", collection, "err", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package docstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/id"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	_id, err := id.New(10)
+	if err != nil {
+		panic(err)
+	}
+	_id.SetVersion(20)
+
+	for _, tdata := range []struct {
+		ifMatch  string
+		expected error
+	}{
+		{"", nil},
+		{"*", nil},
+		{"20", nil},
+		{`"20"`, nil},
+		{`"10", "20"`, nil},
+		{"10", ErrPreconditionFailed},
+		{`"2"`, ErrPreconditionFailed},
+	} {
+		if err := checkIfMatch(_id, tdata.ifMatch); err != tdata.expected {
+			t.Errorf("If-Match %q: expected %v, got %v", tdata.ifMatch, tdata.expected, err)
+		}
+	}
+}
+
+func bulkRequest(t *testing.T, docstore *DocStore, query string, ops ...string) (int, []*bulkResult) {
+	r := httptest.NewRequest("POST", "/notes/_bulk"+query, strings.NewReader(strings.Join(ops, "\n")))
+	r = mux.SetURLVars(r, map[string]string{"collection": "notes"})
+	w := httptest.NewRecorder()
+	docstore.bulkHandler()(w, r)
+	if ctype := w.Header().Get("Content-Type"); ctype != "application/x-ndjson" {
+		t.Fatalf("bad content type %q", ctype)
+	}
+	results := []*bulkResult{}
+	dec := json.NewDecoder(w.Body)
+	for {
+		res := &bulkResult{}
+		if err := dec.Decode(res); err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+		}
+		results = append(results, res)
+	}
+	return w.Code, results
+}
+
+func TestBulk(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	status, results := bulkRequest(t, docstore, "",
+		`{"op": "insert", "doc": {"i": 1}}`,
+		`{"op": "insert", "doc": {"i": 2}}`,
+		`{"op": "delete", "_id": "nope"}`,
+	)
+	if status != http.StatusOK || len(results) != 3 {
+		t.Fatalf("bad results %d %+v", status, results)
+	}
+	if results[0].Status != http.StatusCreated || results[1].Status != http.StatusCreated || results[2].Status != http.StatusNotFound {
+		t.Errorf("bad results %+v", results)
+	}
+	id1, id2, v1 := results[0].ID, results[1].ID, results[0].Version
+
+	// The ops are executed as they're decoded, an invalid op stops the decoding
+	status, results = bulkRequest(t, docstore, "",
+		`{"op": "update", "_id": "`+id1+`", "doc": {"i": 10}}`,
+		`{"op": "update", "_id": "`+id1+`", "doc": {"i": 11}, "if_match": "`+v1+`"}`,
+		`{"op": `,
+	)
+	if status != http.StatusOK || len(results) != 3 {
+		t.Fatalf("bad results %d %+v", status, results)
+	}
+	if results[0].Status != http.StatusOK || results[1].Status != http.StatusPreconditionFailed || results[2].Status != http.StatusBadRequest {
+		t.Errorf("bad results %+v", results)
+	}
+	if _, doc, err := docstore.fetchLatest("notes", id1); err != nil || fmt.Sprint(doc["i"]) != "10" {
+		t.Errorf("bad doc %+v %v", doc, err)
+	}
+
+	// The delete op is conditional too
+	status, results = bulkRequest(t, docstore, "",
+		`{"op": "delete", "_id": "`+id1+`", "if_match": "`+v1+`"}`,
+	)
+	if status != http.StatusOK || len(results) != 1 || results[0].Status != http.StatusPreconditionFailed {
+		t.Fatalf("bad results %d %+v", status, results)
+	}
+
+	// In atomic mode, nothing is written if an op fails the checks
+	status, results = bulkRequest(t, docstore, "?atomic=1",
+		`{"op": "patch", "_id": "`+id2+`", "patch": [{"op": "replace", "path": "/i", "value": 20}]}`,
+		`{"op": "delete", "_id": "`+id1+`"}`,
+		`{"op": "update", "_id": "`+id1+`", "doc": {"i": 12}}`,
+	)
+	if status != http.StatusUnprocessableEntity || len(results) != 3 {
+		t.Fatalf("bad results %d %+v", status, results)
+	}
+	if results[0].Status != http.StatusFailedDependency || results[1].Status != http.StatusFailedDependency || results[2].Status != http.StatusBadRequest {
+		t.Errorf("bad results %+v", results)
+	}
+	if _, doc, err := docstore.fetchLatest("notes", id2); err != nil || fmt.Sprint(doc["i"]) != "2" {
+		t.Errorf("bad doc %+v %v", doc, err)
+	}
+
+	status, results = bulkRequest(t, docstore, "?atomic=1",
+		`{"op": "patch", "_id": "`+id2+`", "patch": [{"op": "replace", "path": "/i", "value": 20}]}`,
+		`{"op": "delete", "_id": "`+id1+`"}`,
+	)
+	if status != http.StatusOK || len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusOK {
+		t.Fatalf("bad results %d %+v", status, results)
+	}
+	if _, doc, err := docstore.fetchLatest("notes", id2); err != nil || fmt.Sprint(doc["i"]) != "20" {
+		t.Errorf("bad doc %+v %v", doc, err)
+	}
+	if _, _, err := docstore.fetchLatest("notes", id1); err != ErrDocNotFound {
+		t.Errorf("the doc should be deleted, got %v", err)
+	}
+}
+
+func TestBulkRollback(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	doc := map[string]interface{}{"i": 1}
+	_id, err := docstore.Insert("notes", &doc)
+	if err != nil {
+		panic(err)
+	}
+	update, err := docstore.prepareUpdate("notes", _id.String(), map[string]interface{}{"i": 2}, "")
+	if err != nil {
+		panic(err)
+	}
+	insert, err := docstore.prepareInsert("notes", map[string]interface{}{"i": 3})
+	if err != nil {
+		panic(err)
+	}
+	for _, dw := range []*docWrite{update, insert} {
+		if err := docstore.commit(dw); err != nil {
+			panic(err)
+		}
+	}
+
+	// The rolled back versions are removed
+	for _, dw := range []*docWrite{insert, update} {
+		if err := docstore.rollback(dw); err != nil {
+			panic(err)
+		}
+	}
+	if _, doc, err := docstore.fetchLatest("notes", _id.String()); err != nil || fmt.Sprint(doc["i"]) != "1" {
+		t.Errorf("bad doc %+v %v", doc, err)
+	}
+	if _, _, err := docstore.fetchLatest("notes", insert._id.String()); err != ErrDocNotFound {
+		t.Errorf("the inserted doc should not exist, got %v", err)
+	}
+
+	// And the change log records the rollbacks
+	changes, err := docstore.Changes("notes", 0, 10, true)
+	if err != nil {
+		panic(err)
+	}
+	if len(changes) != 5 {
+		t.Fatalf("expected 5 changes, got %d", len(changes))
+	}
+	for i, expected := range []*docWrite{insert, update} {
+		change := changes[3+i]
+		if change.Op != ChangeRollback || change.ID != expected._id.String() || change.DocVersion != expected._id.Version() || change.Doc != nil {
+			t.Errorf("bad rollback change %+v", change)
+		}
+	}
+}
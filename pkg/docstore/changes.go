@@ -0,0 +1,455 @@
+package docstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// The change log of each collection is stored as one kv entry per change, keyed by a sequence number (monotonic for
+// the collection), this way the changes following a cursor can be fetched using a range scan.
+var changesKeyFmt = "docstore-changes:%s:%019d"
+
+// changesRange returns the key range of the changes that happened after the given sequence number
+func changesRange(collection string, since int64) (string, string) {
+	return fmt.Sprintf(changesKeyFmt, collection, since+1), fmt.Sprintf("docstore-changes:%s:\xff", collection)
+}
+
+// Change operations
+const (
+	ChangeInsert   = "insert"
+	ChangeUpdate   = "update"
+	ChangeDelete   = "delete"
+	ChangeUndelete = "undelete"
+	ChangePurge    = "purge"
+
+	// A version written by an atomic bulk operation has been removed (`doc_version` is the removed version)
+	ChangeRollback = "rollback"
+)
+
+// Name of the Lua hook called (asynchronously) for each change
+const changeHook = "change"
+
+// Max number of changes buffered for a live client before it gets disconnected
+// (it can resume using the last received cursor)
+const changeClientBuffer = 128
+
+// Change represents a single change in a collection, the version is the cursor of the change in the change log
+type Change struct {
+	Op         string                 `json:"op" msgpack:"op"`
+	ID         string                 `json:"_id" msgpack:"_id"`
+	Version    string                 `json:"version" msgpack:"-"`
+	DocVersion int64                  `json:"doc_version,omitempty" msgpack:"v"`
+	Doc        map[string]interface{} `json:"doc,omitempty" msgpack:"-"`
+
+	collection string
+	version    int64
+}
+
+// changeFeed dispatches the changes to the live clients, each client follows a single collection
+type changeFeed struct {
+	log     log.Logger
+	clients map[chan *Change]string
+	mu      sync.Mutex // for guarding clients
+
+	seqs  map[string]int64 // last sequence number of each collection
+	seqMu sync.Mutex       // for guarding seqs, held until the change is recorded
+}
+
+func newChangeFeed(logger log.Logger) *changeFeed {
+	return &changeFeed{
+		log:     logger,
+		clients: map[chan *Change]string{},
+		seqs:    map[string]int64{},
+	}
+}
+
+func (f *changeFeed) subscribe(collection string) chan *Change {
+	c := make(chan *Change, changeClientBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.clients[c] = collection
+	f.log.Debug("added new client", "collection", collection)
+	return c
+}
+
+func (f *changeFeed) unsubscribe(c chan *Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.clients[c]; ok {
+		delete(f.clients, c)
+		close(c)
+		f.log.Debug("removed client")
+	}
+}
+
+func (f *changeFeed) publish(change *Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c, collection := range f.clients {
+		if collection != change.collection {
+			continue
+		}
+		select {
+		case c <- change:
+		default:
+			// The client is too slow, drop it
+			delete(f.clients, c)
+			close(c)
+			f.log.Info("dropped slow client", "collection", collection)
+		}
+	}
+}
+
+// lastChangeSeq returns the sequence number of the last change of the collection (0 if there's no change), must be
+// called with the seq lock held
+func (docstore *DocStore) lastChangeSeq(collection string) (int64, error) {
+	if seq, ok := docstore.changes.seqs[collection]; ok {
+		return seq, nil
+	}
+	var seq int64
+	start, end := changesRange(collection, 0)
+	res, _, err := docstore.kvStore.ReverseKeys(context.TODO(), start, end, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) > 0 {
+		seq, err = changeSeq(res[0].Key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	docstore.changes.seqs[collection] = seq
+	return seq, nil
+}
+
+// changeSeq extracts the sequence number from the change key
+func changeSeq(key string) (int64, error) {
+	i := strings.LastIndex(key, ":")
+	if i == -1 {
+		return 0, fmt.Errorf("invalid change key %q", key)
+	}
+	return strconv.ParseInt(key[i+1:], 10, 64)
+}
+
+// notifyChange records the change in the collection change log, executes the write, and notifies the live clients
+// and the Lua hooks.
+//
+// The change is recorded before the write, and both happen while holding the seq lock: the change log cannot miss a
+// committed write (the change is only removed if the write did not happen), and the change log readers never see a
+// change before its write.
+func (docstore *DocStore) notifyChange(collection, op, sid string, version int64, doc map[string]interface{}, write func() error) error {
+	change := &Change{
+		Op:         op,
+		ID:         sid,
+		DocVersion: version,
+		Doc:        doc,
+		collection: collection,
+	}
+	if err := docstore.recordChange(change, write); err != nil {
+		return err
+	}
+
+	// The Lua hooks are executed asynchronously by the hooks worker, this way they cannot slow down the writes (the
+	// write is committed at this point, a failure must not be reported to the caller)
+	if err := docstore.enqueueAsyncHooks(collection, map[string]interface{}{
+		"op":      change.Op,
+		"_id":     change.ID,
+		"version": change.Version,
+		"doc":     change.Doc,
+	}); err != nil {
+		docstore.logger.Error("failed to enqueue the async hooks", "collection", collection, "_id", sid, "err", err)
+	}
+	return nil
+}
+
+// recordChange records the change and executes the write while holding the seq lock (this way a change cannot be
+// recorded with a lower sequence number than one already seen by a client)
+func (docstore *DocStore) recordChange(change *Change, write func() error) error {
+	data, err := msgpack.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	docstore.changes.seqMu.Lock()
+	defer docstore.changes.seqMu.Unlock()
+	last, err := docstore.lastChangeSeq(change.collection)
+	if err != nil {
+		return err
+	}
+	// The sequence number is close to the change timestamp (but always increasing)
+	seq := time.Now().UTC().UnixNano()
+	if seq <= last {
+		seq = last + 1
+	}
+	key := fmt.Sprintf(changesKeyFmt, change.collection, seq)
+	kv, err := docstore.kvStore.Put(context.TODO(), key, "", data, -1)
+	if err != nil {
+		return err
+	}
+	docstore.changes.seqs[change.collection] = seq
+
+	if err := write(); err != nil {
+		// Only remove the change if the write did not happen (a change referencing a missing version is safer than a
+		// missing change)
+		written, werr := docstore.written(change)
+		if werr == nil && !written {
+			werr = docstore.kvStore.DeleteVersion(context.TODO(), key, kv.Version)
+		}
+		if werr != nil {
+			docstore.logger.Error("failed to cleanup the change of a failed write", "key", key, "err", werr)
+		}
+		return err
+	}
+
+	change.version = seq
+	change.Version = strconv.FormatInt(seq, 10)
+	docstore.changes.publish(change)
+	return nil
+}
+
+// written returns true if the write of the change has been committed
+func (docstore *DocStore) written(change *Change) (bool, error) {
+	key := fmt.Sprintf(keyFmt, change.collection, change.ID)
+	version := change.DocVersion
+	if change.Op == ChangePurge {
+		version = -1
+	}
+	// The purge and the rollback remove versions
+	removal := change.Op == ChangePurge || change.Op == ChangeRollback
+	_, err := docstore.kvStore.Get(context.TODO(), key, version)
+	switch err {
+	case nil:
+		return !removal, nil
+	case vkv.ErrNotFound:
+		return removal, nil
+	default:
+		return false, err
+	}
+}
+
+// Changes returns at most `limit` changes that happened after the given cursor (`since`), oldest first
+func (docstore *DocStore) Changes(collection string, since int64, limit int, fetchDocs bool) ([]*Change, error) {
+	changes := []*Change{}
+	start, end := changesRange(collection, since)
+	// The seq lock is held while reading, this way the changes whose write is in progress are not returned
+	docstore.changes.seqMu.Lock()
+	res, _, err := docstore.kvStore.Keys(context.TODO(), start, end, limit)
+	docstore.changes.seqMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range res {
+		change := &Change{}
+		if err := msgpack.Unmarshal(kv.Data, change); err != nil {
+			return nil, err
+		}
+		seq, err := changeSeq(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		change.collection = collection
+		change.version = seq
+		change.Version = strconv.FormatInt(seq, 10)
+		changes = append(changes, change)
+	}
+
+	if fetchDocs {
+		for _, change := range changes {
+			if err := docstore.fetchChangeDoc(change); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+// fetchChangeDoc fetches the version of the doc referenced by the change (if not already set)
+func (docstore *DocStore) fetchChangeDoc(change *Change) error {
+	if change.Doc != nil || change.Op == ChangeDelete || change.Op == ChangePurge || change.Op == ChangeRollback {
+		return nil
+	}
+	doc := map[string]interface{}{}
+	if _, _, err := docstore.Fetch(change.collection, change.ID, &doc, 0, change.DocVersion, nil); err != nil {
+		// The doc has been purged since
+		if err == vkv.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+	change.Doc = doc
+	return nil
+}
+
+// HTTP handler for the collection change feed (as Server-Sent Events, or as JSON if `stream=0`)
+func (docstore *DocStore) changesHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := httputil.NewQuery(r.URL.Query())
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Read, collection) {
+			return
+		}
+
+		// The cursor can also be sent via the standard SSE header when the client reconnects
+		cursor := r.Header.Get("Last-Event-ID")
+		if cursor == "" {
+			cursor = q.GetDefault("cursor", "0")
+		}
+		since, err := strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		// A negative cursor means "only the new changes"
+		if since < 0 {
+			docstore.changes.seqMu.Lock()
+			since, err = docstore.lastChangeSeq(collection)
+			docstore.changes.seqMu.Unlock()
+			if err != nil {
+				panic(err)
+			}
+		}
+		fetchDocs, err := q.GetBoolDefault("include_docs", false)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+		stream, err := q.GetBoolDefault("stream", true)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+
+		if !stream {
+			limit, err := q.GetInt("limit", 50, 1000)
+			if err != nil {
+				httputil.Error(w, err)
+				return
+			}
+			changes, err := docstore.Changes(collection, since, limit+1, fetchDocs)
+			if err != nil {
+				panic(err)
+			}
+			var hasMore bool
+			if len(changes) > limit {
+				hasMore = true
+				changes = changes[:limit]
+			}
+			nextCursor := cursor
+			if len(changes) > 0 {
+				nextCursor = changes[len(changes)-1].Version
+			}
+			httputil.MarshalAndWrite(r, w, map[string]interface{}{
+				"data": changes,
+				"pagination": map[string]interface{}{
+					"cursor":   nextCursor,
+					"has_more": hasMore,
+					"count":    len(changes),
+					"per_page": limit,
+				},
+			})
+			return
+		}
+
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			return
+		}
+
+		// Subscribe before fetching the change log, this way no change can be missed
+		changeChan := docstore.changes.subscribe(collection)
+		defer docstore.changes.unsubscribe(changeChan)
+
+		// Set the headers related to event streaming.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		// Send an initial heartbeat
+		fmt.Fprintf(w, "event: heartbeat\ndata: \n\n")
+		f.Flush()
+
+		writeChange := func(change *Change) {
+			// Skip changes already sent while replaying the change log
+			if change.version <= since {
+				return
+			}
+			// The change may be shared with other clients, don't modify it
+			out := &Change{Op: change.Op, ID: change.ID, Version: change.Version, DocVersion: change.DocVersion, collection: collection}
+			if fetchDocs {
+				out.Doc = change.Doc
+				if err := docstore.fetchChangeDoc(out); err != nil {
+					panic(err)
+				}
+			}
+			js, err := json.Marshal(out)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(w, "id: %s\n", change.Version)
+			fmt.Fprintf(w, "event: %s\n", change.Op)
+			fmt.Fprintf(w, "data: %s\n\n", js)
+			since = change.version
+		}
+
+		// Replay the changes since the cursor (page by page)
+		for {
+			changes, err := docstore.Changes(collection, since, 100, fetchDocs)
+			if err != nil {
+				panic(err)
+			}
+			for _, change := range changes {
+				writeChange(change)
+			}
+			f.Flush()
+			if len(changes) < 100 {
+				break
+			}
+		}
+
+		heartbeat := time.NewTicker(20 * time.Second)
+		defer heartbeat.Stop()
+		notify := w.(http.CloseNotifier).CloseNotify()
+
+		for {
+			select {
+			case <-notify:
+				return
+			case <-heartbeat.C:
+				fmt.Fprintf(w, "event: heartbeat\ndata: \n\n")
+				f.Flush()
+			case change, open := <-changeChan:
+				if !open {
+					// The client has been dropped (too slow), it will reconnect with the last ID
+					return
+				}
+				writeChange(change)
+				f.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		doc := map[string]interface{}{"i": i}
+		_id, err := docstore.Insert("notes", &doc)
+		if err != nil {
+			panic(err)
+		}
+		ids = append(ids, _id.String())
+	}
+	dw, err := docstore.prepareDelete("notes", ids[0], "")
+	if err != nil {
+		panic(err)
+	}
+	if err := docstore.commit(dw); err != nil {
+		panic(err)
+	}
+	// Changes recorded in the same nanosecond must not overwrite each other
+	for i := 0; i < 3; i++ {
+		if err := docstore.notifyChange("notes", ChangeUpdate, ids[1], 1, nil, func() error { return nil }); err != nil {
+			panic(err)
+		}
+	}
+
+	// Page through the change log
+	all := []*Change{}
+	var since int64
+	for {
+		changes, err := docstore.Changes("notes", since, 2, false)
+		if err != nil {
+			panic(err)
+		}
+		all = append(all, changes...)
+		if len(changes) < 2 {
+			break
+		}
+		since = changes[len(changes)-1].version
+	}
+	if len(all) != 9 {
+		t.Fatalf("expected 9 changes, got %d", len(all))
+	}
+	for i, change := range all {
+		if i > 0 && change.version <= all[i-1].version {
+			t.Errorf("the changes are not sorted: %+v", all)
+		}
+		if change.Version != strconv.FormatInt(change.version, 10) {
+			t.Errorf("bad version %+v", change)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if all[i].Op != ChangeInsert || all[i].ID != ids[i] {
+			t.Errorf("bad change %d: %+v", i, all[i])
+		}
+	}
+	if all[5].Op != ChangeDelete || all[5].ID != ids[0] {
+		t.Errorf("bad delete change: %+v", all[5])
+	}
+
+	// The docs are fetched at the version of the change
+	changes, err := docstore.Changes("notes", 0, 1, true)
+	if err != nil {
+		panic(err)
+	}
+	if len(changes) != 1 || fmt.Sprint(changes[0].Doc["i"]) != "0" {
+		t.Errorf("bad change doc %+v", changes[0].Doc)
+	}
+
+	// The sequence is restored from the change log
+	docstore.changes.seqs = map[string]int64{}
+	last, err := docstore.lastChangeSeq("notes")
+	if err != nil {
+		panic(err)
+	}
+	if last != all[8].version {
+		t.Errorf("expected last seq to be %d, got %d", all[8].version, last)
+	}
+
+	// The change log is moved along with the collection
+	if _, err := docstore.RenameCollection("notes", "notes2"); err != nil {
+		panic(err)
+	}
+	changes, err = docstore.Changes("notes", 0, 10, false)
+	if err != nil {
+		panic(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("expected no changes, got %+v", changes)
+	}
+	changes, err = docstore.Changes("notes2", 0, 10, false)
+	if err != nil {
+		panic(err)
+	}
+	if len(changes) != 9 || changes[8].version != all[8].version {
+		t.Errorf("expected 9 changes, got %+v", changes)
+	}
+}
+
+func TestChangesCommittedWrites(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	// Concurrent writes
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ids := []string{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				doc := map[string]interface{}{"i": i, "j": j}
+				_id, err := docstore.Insert("notes", &doc)
+				if err != nil {
+					panic(err)
+				}
+				dw, err := docstore.prepareUpdate("notes", _id.String(), map[string]interface{}{"j": j + 1}, "")
+				if err != nil {
+					panic(err)
+				}
+				if err := docstore.commit(dw); err != nil {
+					panic(err)
+				}
+				if j%2 == 0 {
+					dw, err := docstore.prepareDelete("notes", _id.String(), "")
+					if err != nil {
+						panic(err)
+					}
+					if err := docstore.commit(dw); err != nil {
+						panic(err)
+					}
+				}
+				mu.Lock()
+				ids = append(ids, _id.String())
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// A failed write is not recorded, but a write that happened is (even if an error is returned)
+	if err := docstore.notifyChange("notes", ChangeUpdate, ids[0], 1, nil, func() error {
+		return errors.New("failed")
+	}); err == nil {
+		t.Errorf("the write error should be returned")
+	}
+	if err := docstore.notifyChange("notes", ChangeUpdate, ids[0], 2, nil, func() error {
+		if _, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(keyFmt, "notes", ids[0]), "", []byte{flagDeleted}, 2); err != nil {
+			panic(err)
+		}
+		return errors.New("failed after the write")
+	}); err == nil {
+		t.Errorf("the write error should be returned")
+	}
+
+	// The change log contains every committed version
+	changes, err := docstore.Changes("notes", 0, 1000, false)
+	if err != nil {
+		panic(err)
+	}
+	feed := map[string]bool{}
+	for _, change := range changes {
+		feed[fmt.Sprintf("%s@%d", change.ID, change.DocVersion)] = true
+	}
+	written := map[string]bool{}
+	for _, sid := range ids {
+		kvv, _, err := docstore.kvStore.Versions(context.TODO(), fmt.Sprintf(keyFmt, "notes", sid), "0", 100)
+		if err != nil {
+			panic(err)
+		}
+		for _, kv := range kvv.Versions {
+			written[fmt.Sprintf("%s@%d", sid, kv.Version)] = true
+		}
+	}
+	if len(written) != 40*2+20+1 {
+		t.Errorf("expected %d versions, got %d", 40*2+20+1, len(written))
+	}
+	if len(feed) != len(changes) || len(feed) != len(written) {
+		t.Errorf("expected %d changes, got %d (%d unique)", len(written), len(changes), len(feed))
+	}
+	for v := range written {
+		if !feed[v] {
+			t.Errorf("missing change for %s", v)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package docstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/textsearch"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrCollectionNotFound is returned when the collection has no docs
+var ErrCollectionNotFound = errors.New("collection not found")
+
+// ErrCollectionExists is returned when trying to rename a collection to an existing one
+var ErrCollectionExists = errors.New("collection already exists")
+
+// CollectionStats holds the size of a collection
+type CollectionStats struct {
+	Collection   string                       `json:"collection"`
+	DocsCount    int                          `json:"docs_count"`
+	DeletedCount int                          `json:"deleted_docs_count"`
+	TotalBytes   int64                        `json:"total_bytes"`
+	Indexes      map[string]*textsearch.Stats `json:"indexes"`
+}
+
+// checkCollectionName ensures the name can be used as a collection name
+func checkCollectionName(name string) error {
+	if name == "" || strings.HasPrefix(name, "_") || strings.ContainsAny(name, ":/") {
+		return httputil.NewPublicErrorFmt("invalid collection name %q", name)
+	}
+	return nil
+}
+
+// iterCollectionKeys calls `fn` for the kv entries of all the docs of the collection (including the deleted ones),
+// one page at a time, and returns the number of entries
+func (docstore *DocStore) iterCollectionKeys(collection string, fn func(*vkv.KeyValue) error) (int, error) {
+	var n int
+	start := fmt.Sprintf(keyFmt, collection, "")
+	end := fmt.Sprintf(keyFmt, collection, "\xff")
+	for {
+		res, cursor, err := docstore.kvStore.Keys(context.TODO(), start, end, 100)
+		if err != nil {
+			return n, err
+		}
+		for _, kv := range res {
+			if err := fn(kv); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if len(res) < 100 {
+			break
+		}
+		start = cursor
+	}
+	return n, nil
+}
+
+// collectionExists returns true if the collection contains at least one doc (deleted or not)
+func (docstore *DocStore) collectionExists(collection string) (bool, error) {
+	res, _, err := docstore.kvStore.Keys(context.TODO(), fmt.Sprintf(keyFmt, collection, ""), fmt.Sprintf(keyFmt, collection, "\xff"), 1)
+	if err != nil {
+		return false, err
+	}
+	return len(res) > 0, nil
+}
+
+// copyVersions copies all the versions of the `src` key to the `dst` key
+func (docstore *DocStore) copyVersions(src, dst string) error {
+	start := "0"
+	for {
+		kvv, cursor, err := docstore.kvStore.Versions(context.TODO(), src, start, 100)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+		for _, kv := range kvv.Versions {
+			if _, err := docstore.kvStore.Put(context.TODO(), dst, kv.HexHash(), kv.Data, kv.Version); err != nil {
+				return err
+			}
+		}
+		if len(kvv.Versions) < 100 || cursor == "" || cursor == "0" {
+			return nil
+		}
+		start = cursor
+	}
+}
+
+// moveChanges moves the change log of the collection to the `dst` collection (or removes it if `dst` is empty)
+func (docstore *DocStore) moveChanges(collection, dst string) error {
+	docstore.changes.seqMu.Lock()
+	defer docstore.changes.seqMu.Unlock()
+	for {
+		start, end := changesRange(collection, 0)
+		res, _, err := docstore.kvStore.Keys(context.TODO(), start, end, 100)
+		if err != nil {
+			return err
+		}
+		for _, kv := range res {
+			if dst != "" {
+				seq, err := changeSeq(kv.Key)
+				if err != nil {
+					return err
+				}
+				if _, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(changesKeyFmt, dst, seq), "", kv.Data, kv.Version); err != nil {
+					return err
+				}
+			}
+			if err := docstore.purgeKey(kv.Key); err != nil {
+				return err
+			}
+		}
+		if len(res) < 100 {
+			break
+		}
+	}
+	delete(docstore.changes.seqs, collection)
+	delete(docstore.changes.seqs, dst)
+	return nil
+}
+
+// purgeKey removes all the versions of the key (if it exists)
+func (docstore *DocStore) purgeKey(key string) error {
+	if _, err := docstore.kvStore.Purge(context.TODO(), key); err != nil && err != vkv.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// CollectionStats returns the number of docs and the size of the collection
+func (docstore *DocStore) CollectionStats(collection string) (*CollectionStats, error) {
+	stats := &CollectionStats{
+		Collection: collection,
+		Indexes:    map[string]*textsearch.Stats{},
+	}
+	n, err := docstore.iterCollectionKeys(collection, func(kv *vkv.KeyValue) error {
+		if len(kv.Data) == 0 || kv.Data[0] == flagDeleted {
+			stats.DeletedCount++
+			return nil
+		}
+		stats.DocsCount++
+		stats.TotalBytes += int64(len(kv.Data) - 1)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrCollectionNotFound
+	}
+	if docstore.textIndex != nil {
+		textStats, err := docstore.textIndex.Stats(collection)
+		if err != nil {
+			return nil, err
+		}
+		stats.Indexes["fulltext"] = textStats
+	}
+	return stats, nil
+}
+
+// DropCollection erases all the docs (and all their versions) of the collection, along with its change log,
+// its schema and its indexes, returns the number of removed docs.
+// Like `Purge`, it returns `ErrNotPurgeable` (and nothing is removed) if any version of a doc is not encrypted, as
+// the plaintext blobs would still be readable from the blobstore.
+// The collection writes are not blocked while the collection is dropped.
+func (docstore *DocStore) DropCollection(collection string) (int, error) {
+	// Ensure all the docs can be erased before removing anything
+	n, err := docstore.iterCollectionKeys(collection, func(kv *vkv.KeyValue) error {
+		return docstore.checkErasable(kv.Key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrCollectionNotFound
+	}
+
+	n, err = docstore.iterCollectionKeys(collection, func(kv *vkv.KeyValue) error {
+		if docstore.keys != nil {
+			_id, err := idFromKey(collection, kv.Key)
+			if err != nil {
+				return err
+			}
+			if err := docstore.keys.delete(_id.String()); err != nil {
+				return err
+			}
+		}
+		return docstore.purgeKey(kv.Key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrCollectionNotFound
+	}
+	if err := docstore.moveChanges(collection, ""); err != nil {
+		return 0, err
+	}
+	if _, ok := docstore.confSchemas[collection]; !ok {
+		docstore.schemasMu.Lock()
+		delete(docstore.schemas, collection)
+		err := docstore.purgeKey(fmt.Sprintf(schemaKeyFmt, collection))
+		docstore.schemasMu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if docstore.textIndex != nil {
+		if err := docstore.textIndex.Drop(collection); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// RenameCollection moves all the docs (with their versions), the change log and the schema of the collection
+// to a new collection, returns the number of moved docs.
+// The collection writes are not blocked while the collection is renamed.
+func (docstore *DocStore) RenameCollection(collection, name string) (int, error) {
+	if err := checkCollectionName(name); err != nil {
+		return 0, err
+	}
+	exists, err := docstore.collectionExists(name)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, ErrCollectionExists
+	}
+
+	n, err := docstore.iterCollectionKeys(collection, func(kv *vkv.KeyValue) error {
+		_id, err := idFromKey(collection, kv.Key)
+		if err != nil {
+			return err
+		}
+		if err := docstore.copyVersions(kv.Key, fmt.Sprintf(keyFmt, name, _id.String())); err != nil {
+			return err
+		}
+		return docstore.purgeKey(kv.Key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrCollectionNotFound
+	}
+
+	// Move the change log
+	if err := docstore.moveChanges(collection, name); err != nil {
+		return 0, err
+	}
+
+	// Move the schema (unless it's defined in the config)
+	if _, ok := docstore.confSchemas[collection]; !ok {
+		docstore.schemasMu.Lock()
+		delete(docstore.schemas, collection)
+		delete(docstore.schemas, name)
+		schemaKey := fmt.Sprintf(schemaKeyFmt, collection)
+		err := docstore.copyVersions(schemaKey, fmt.Sprintf(schemaKeyFmt, name))
+		if err == nil {
+			err = docstore.purgeKey(schemaKey)
+		}
+		docstore.schemasMu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Re-build the full-text index for the new collection (if it's configured for full-text indexing)
+	if docstore.textIndex != nil {
+		if err := docstore.textIndex.Drop(collection); err != nil {
+			return 0, err
+		}
+		if docstore.textIndexFields(name) != nil {
+			if err := docstore.RebuildTextIndex(name); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// collectionErrorStatus returns the HTTP status code for the collection management errors
+func collectionErrorStatus(err error) int {
+	switch err {
+	case ErrCollectionNotFound:
+		return http.StatusNotFound
+	case ErrCollectionExists:
+		return http.StatusConflict
+	}
+	if _, ok := err.(httputil.PublicErrorer); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// HTTP handler for the collection stats
+func (docstore *DocStore) collectionStatsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Stat, collection) {
+			return
+		}
+
+		stats, err := docstore.CollectionStats(collection)
+		if err != nil {
+			if status := collectionErrorStatus(err); status != http.StatusInternalServerError {
+				httputil.WriteJSONError(w, status, err.Error())
+				return
+			}
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, stats)
+	}
+}
+
+// JSON input for the rename endpoint
+type renameInput struct {
+	Name string `json:"name"`
+}
+
+// HTTP handler for renaming a collection
+func (docstore *DocStore) collectionRenameHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		input := &renameInput{}
+		if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid JSON input")
+			return
+		}
+
+		// The rename permission is needed for both the source and the destination collection
+		for _, col := range []string{collection, input.Name} {
+			if !canCollection(w, r, perms.Rename, col) {
+				return
+			}
+		}
+
+		n, err := docstore.RenameCollection(collection, input.Name)
+		if err != nil {
+			if status := collectionErrorStatus(err); status != http.StatusInternalServerError {
+				httputil.WriteJSONError(w, status, err.Error())
+				return
+			}
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"collection": input.Name,
+			"docs_count": n,
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package docstore
+
+import (
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestCollections(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, &config.Config{
+		Docstore: &config.DocstoreConfig{
+			FullTextIndexes:      map[string][]string{"notes": {"content"}},
+			PurgeableCollections: []string{"secrets"},
+		},
+	})
+	defer cleanup()
+
+	// More docs than a single page of keys
+	var last string
+	for i := 0; i < 150; i++ {
+		doc := map[string]interface{}{"content": "hello"}
+		_id, err := docstore.Insert("notes", &doc)
+		if err != nil {
+			panic(err)
+		}
+		last = _id.String()
+	}
+	dw, err := docstore.prepareDelete("notes", last, "")
+	if err != nil {
+		panic(err)
+	}
+	if err := docstore.commit(dw); err != nil {
+		panic(err)
+	}
+
+	stats, err := docstore.CollectionStats("notes")
+	if err != nil {
+		panic(err)
+	}
+	if stats.DocsCount != 149 || stats.DeletedCount != 1 {
+		t.Errorf("bad stats %+v", stats)
+	}
+	if _, err := docstore.CollectionStats("nope"); err != ErrCollectionNotFound {
+		t.Errorf("expected ErrCollectionNotFound, got %v", err)
+	}
+
+	// The new name is not configured for full-text indexing
+	n, err := docstore.RenameCollection("notes", "notes2")
+	if err != nil {
+		panic(err)
+	}
+	if n != 150 {
+		t.Errorf("expected 150 moved docs, got %d", n)
+	}
+	if _, err := docstore.CollectionStats("notes"); err != ErrCollectionNotFound {
+		t.Errorf("expected ErrCollectionNotFound, got %v", err)
+	}
+	if _, err := docstore.RenameCollection("notes2", "notes2"); err != ErrCollectionExists {
+		t.Errorf("expected ErrCollectionExists, got %v", err)
+	}
+
+	// The plaintext docs cannot be erased
+	if _, err := docstore.DropCollection("notes2"); err != ErrNotPurgeable {
+		t.Errorf("expected ErrNotPurgeable, got %v", err)
+	}
+	if stats, err := docstore.CollectionStats("notes2"); err != nil || stats.DocsCount != 149 {
+		t.Errorf("the collection should not have been dropped: %+v %v", stats, err)
+	}
+
+	var sids []string
+	for i := 0; i < 3; i++ {
+		doc := map[string]interface{}{"content": "s3cr3t"}
+		_id, err := docstore.Insert("secrets", &doc)
+		if err != nil {
+			panic(err)
+		}
+		sids = append(sids, _id.String())
+	}
+	n, err = docstore.DropCollection("secrets")
+	if err != nil {
+		panic(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 dropped docs, got %d", n)
+	}
+	if _, err := docstore.CollectionStats("secrets"); err != ErrCollectionNotFound {
+		t.Errorf("expected ErrCollectionNotFound, got %v", err)
+	}
+	// The keys are gone too
+	for _, sid := range sids {
+		if key, err := docstore.keys.get(sid); err != nil || key != nil {
+			t.Errorf("the key of %s should have been deleted: %v", sid, err)
+		}
+	}
+	if _, err := docstore.DropCollection("secrets"); err != ErrCollectionNotFound {
+		t.Errorf("expected ErrCollectionNotFound, got %v", err)
+	}
+}
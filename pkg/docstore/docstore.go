@@ -35,18 +35,21 @@ import (
 	"sync"
 	"time"
 
-	"github.com/evanphx/json-patch"
 	"github.com/gorilla/mux"
 	log "github.com/inconshreveable/log15"
 	logext "github.com/inconshreveable/log15/ext"
-	"github.com/vmihailenco/msgpack"
 	"github.com/yuin/gopher-lua"
 
+	"a4.io/blobstash/pkg/auth"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/docstore/jsonschema"
+	"a4.io/blobstash/pkg/docstore/textsearch"
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/httputil"
 	"a4.io/blobstash/pkg/httputil/bewit"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/queue"
 	"a4.io/blobstash/pkg/stash/store"
 	"a4.io/blobstash/pkg/vkv"
 )
@@ -79,6 +82,10 @@ var reservedKeys = map[string]struct{}{
 	"_created": struct{}{},
 	"_version": struct{}{},
 	"_hooks":   struct{}{},
+
+	// Full-text search special fields
+	"_score":      struct{}{},
+	"_highlights": struct{}{},
 }
 
 func idFromKey(col, key string) (*id.ID, error) {
@@ -100,6 +107,7 @@ const (
 	pointerBlobJSON = "@blobs/json:" // FIXME(tsileo): document the Pointer feature
 	// PointerBlobRef     = "@blobs/ref:"  // FIXME(tsileo): implements this like a @filetree/ref
 	pointerFiletreeRef = "@filetree/ref:"
+	pointerDocRef      = "@blobstash/doc:" // e.g. "@blobstash/doc:<collection>/<_id>"
 	//PointerURLInfo     = "@url/info:" // XXX(tsileo): fetch OG meta data or at least title, optionally screenshot???
 	// TODO(tsileo): implements PointerKvRef
 	// PointerKvRef = "@kv/ref:"
@@ -114,6 +122,7 @@ type executionStats struct {
 	TotalDocsExamined int    `json:"totalDocsExamined"`
 	ExecutionTimeNano int64  `json:"executionTimeNano"`
 	LastID            string `json:"-"`
+	Cursor            string `json:"-"`
 	Engine            string `json:"query_engine"`
 	Index             string `json:"index"`
 }
@@ -128,10 +137,31 @@ type DocStore struct {
 	// docIndex *index.HashIndexes
 
 	hooks         *LuaHooks
+	commitHooks   *LuaHooks // Post-commit hooks (nil until `SetupCommitHooks` is called)
+
+	// Queue of the async hooks (the `change` and the post-commit hooks) waiting to be executed by the worker
+	hooksQueue  *queue.Queue
+	hooksNotify chan struct{}
+	hooksStop   chan struct{}
+	hooksWg     sync.WaitGroup
 	storedQueries map[string]*storedQuery
 
 	locker *locker
 
+	// Full-text index (only opened if at least one collection has full-text indexing enabled)
+	textIndex *textsearch.Index
+
+	// Per-doc encryption keys for the purgeable collections (only opened if at least one collection is purgeable)
+	keys *docKeys
+
+	// Live clients of the collections change feed
+	changes *changeFeed
+
+	// JSON Schemas (the ones from the config cannot be updated via the API)
+	confSchemas map[string]*jsonschema.Schema
+	schemas     map[string]*jsonschema.Schema
+	schemasMu   sync.Mutex
+
 	logger log.Logger
 }
 
@@ -166,12 +196,20 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		}
 	}
 
-	hooks, err := newLuaHooks(conf, ft, blobStore)
+	hooks, err := newLuaHooks(conf, ft, blobStore, false)
 	if err != nil {
 		return nil, err
 	}
 
-	return &DocStore{
+	confSchemas := map[string]*jsonschema.Schema{}
+	if conf.Docstore != nil && conf.Docstore.Schemas != nil {
+		confSchemas, err = loadConfigSchemas(conf.Docstore.Schemas)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	docstore := &DocStore{
 		kvStore:       kvStore,
 		blobStore:     blobStore,
 		filetree:      ft,
@@ -179,19 +217,144 @@ func New(logger log.Logger, conf *config.Config, kvStore store.KvStore, blobStor
 		hooks:         hooks,
 		conf:          conf,
 		locker:        newLocker(),
+		changes:       newChangeFeed(logger.New("submodule", "changes")),
+		hooksNotify:   make(chan struct{}, 1),
+		hooksStop:     make(chan struct{}),
+		confSchemas:   confSchemas,
+		schemas:       map[string]*jsonschema.Schema{},
 		logger:        logger,
 		// docIndex:  docIndex,
-	}, nil
+	}
+
+	docstore.hooksQueue, err = queue.New(filepath.Join(conf.VarDir(), "docstore-hooks.queue"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the hooks queue: %v", err)
+	}
+	docstore.hooksWg.Add(1)
+	go docstore.hooksWorker()
+
+	// Open the encryption keys store if needed
+	if conf.Docstore != nil && len(conf.Docstore.PurgeableCollections) > 0 {
+		docstore.keys, err = newDocKeys(filepath.Join(conf.VarDir(), "docstore_keys"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the docs keys: %v", err)
+		}
+	}
+
+	// Open the full-text index if needed
+	if conf.Docstore != nil && len(conf.Docstore.FullTextIndexes) > 0 {
+		docstore.textIndex, err = textsearch.New(filepath.Join(conf.VarDir(), "docstore_fulltext"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the full-text index: %v", err)
+		}
+		// The index can always be rebuilt from the documents, rebuild the collections that have never been fully
+		// indexed (or indexed with different fields)
+		for collection, fields := range conf.Docstore.FullTextIndexes {
+			indexed, err := docstore.textIndex.Fields(collection)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the full-text index: %v", err)
+			}
+			if indexed != nil && strings.Join(indexed, "\x00") == strings.Join(fields, "\x00") {
+				continue
+			}
+			if err := docstore.RebuildTextIndex(collection); err != nil {
+				return nil, fmt.Errorf("failed to rebuild the full-text index for %s: %v", collection, err)
+			}
+		}
+	}
+
+	return docstore, nil
 }
 
 // Close closes all the open DB files.
 func (docstore *DocStore) Close() error {
+	docstore.hooksStop <- struct{}{}
+	docstore.hooksWg.Wait()
+	if err := docstore.hooksQueue.Close(); err != nil {
+		return err
+	}
 	// if err := docstore.docIndex.Close(); err != nil {
 	// 	return err
 	// }
+	if docstore.textIndex != nil {
+		if err := docstore.textIndex.Close(); err != nil {
+			return err
+		}
+	}
+	if docstore.keys != nil {
+		if err := docstore.keys.Close(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// textIndexFields returns the fields that must be full-text indexed for the given collection
+func (docstore *DocStore) textIndexFields(collection string) []string {
+	if docstore.textIndex == nil {
+		return nil
+	}
+	return docstore.conf.Docstore.FullTextIndexes[collection]
+}
+
+// indexText updates the full-text index for the given doc (if enabled for the collection)
+func (docstore *DocStore) indexText(collection, sid string, doc map[string]interface{}) error {
+	fields := docstore.textIndexFields(collection)
+	if len(fields) == 0 {
+		return nil
+	}
+	if doc == nil {
+		return docstore.textIndex.Remove(collection, sid)
+	}
+	return docstore.textIndex.Index(collection, sid, doc, fields)
+}
+
+// RebuildTextIndex re-indexes all the documents of the given collection in the full-text index
+func (docstore *DocStore) RebuildTextIndex(collection string) error {
+	fields := docstore.textIndexFields(collection)
+	if len(fields) == 0 {
+		return fmt.Errorf("full-text search is not enabled for collection %s", collection)
+	}
+	docstore.logger.Info("rebuilding full-text index", "collection", collection)
+	if err := docstore.textIndex.Drop(collection); err != nil {
+		return err
+	}
+	start := fmt.Sprintf(keyFmt, collection, "\xff")
+	end := fmt.Sprintf(keyFmt, collection, "")
+	for {
+		res, cursor, err := docstore.kvStore.ReverseKeys(context.TODO(), end, start, 100)
+		if err != nil {
+			return err
+		}
+		for _, kv := range res {
+			_id, err := idFromKey(collection, kv.Key)
+			if err != nil {
+				return err
+			}
+			doc := map[string]interface{}{}
+			if len(kv.Data) > 1 && kv.Data[0] != flagDeleted {
+				if err := docstore.decodeDoc(_id.String(), kv.Data[1:], &doc); err != nil {
+					if err == vkv.ErrNotFound {
+						continue
+					}
+					return err
+				}
+			} else {
+				doc = nil
+			}
+			if err := docstore.indexText(collection, _id.String(), doc); err != nil {
+				return err
+			}
+		}
+		if len(res) < 100 {
+			break
+		}
+		start = cursor
+	}
+	// Only mark the collection as indexed once all the docs have been indexed
+	return docstore.textIndex.SetFields(collection, fields)
+}
+
 // Register registers all the HTTP handlers for the extension
 func (docstore *DocStore) Register(r *mux.Router, basicAuth func(http.Handler) http.Handler) {
 	r.Handle("/", basicAuth(http.HandlerFunc(docstore.collectionsHandler())))
@@ -199,24 +362,50 @@ func (docstore *DocStore) Register(r *mux.Router, basicAuth func(http.Handler) h
 
 	r.Handle("/{collection}", basicAuth(http.HandlerFunc(docstore.docsHandler())))
 	r.Handle("/{collection}/_map_reduce", basicAuth(http.HandlerFunc(docstore.mapReduceHandler())))
+	r.Handle("/{collection}/_aggregate", basicAuth(http.HandlerFunc(docstore.aggregateHandler())))
+	r.Handle("/{collection}/_changes", basicAuth(http.HandlerFunc(docstore.changesHandler())))
+	r.Handle("/{collection}/_bulk", basicAuth(http.HandlerFunc(docstore.bulkHandler())))
+	r.Handle("/{collection}/_schema", basicAuth(http.HandlerFunc(docstore.schemaHandler())))
+	r.Handle("/{collection}/_deleted", basicAuth(http.HandlerFunc(docstore.deletedHandler())))
+	r.Handle("/{collection}/_stats", basicAuth(http.HandlerFunc(docstore.collectionStatsHandler())))
+	r.Handle("/{collection}/_rename", basicAuth(http.HandlerFunc(docstore.collectionRenameHandler())))
 	// r.Handle("/{collection}/_indexes", middlewares.Auth(http.HandlerFunc(docstore.indexesHandler())))
 	r.Handle("/{collection}/{_id}", basicAuth(http.HandlerFunc(docstore.docHandler())))
 	r.Handle("/{collection}/{_id}/_versions", basicAuth(http.HandlerFunc(docstore.docVersionsHandler())))
+	r.Handle("/{collection}/{_id}/_diff", basicAuth(http.HandlerFunc(docstore.docDiffHandler())))
+	r.Handle("/{collection}/{_id}/_restore", basicAuth(http.HandlerFunc(docstore.docRestoreHandler())))
+	r.Handle("/{collection}/{_id}/_undelete", basicAuth(http.HandlerFunc(docstore.docUndeleteHandler())))
+	r.Handle("/{collection}/{_id}/_purge", basicAuth(http.HandlerFunc(docstore.docPurgeHandler())))
+}
+
+// canCollection checks that the request can perform the action on the collection, and outputs a 403 if it cannot
+func canCollection(w http.ResponseWriter, r *http.Request, action perms.ActionType, collection string) bool {
+	if !auth.Can(
+		w,
+		r,
+		perms.Action(action, perms.Collection),
+		perms.ResourceWithID(perms.DocStore, perms.Collection, collection),
+	) {
+		auth.Forbidden(w)
+		return false
+	}
+	return true
 }
 
 // Expand a doc keys (fetch the blob as JSON, or a filesystem reference)
 // e.g: {"ref": "@blobstash/json:<hash>"}
 //      => {"ref": {"blob": "json decoded"}}
+// Docs references are resolved up to `depth` level, as of `asOf` (if > 0).
 // XXX(tsileo): expanded ref must also works for marking a blob during GC
 // FIXME(tsileo): rename this to "pointers" and return {"data":{[...]}, "pointers": {}}
-func (docstore *DocStore) fetchPointers(doc map[string]interface{}) (map[string]interface{}, error) {
+func (docstore *DocStore) fetchPointers(doc map[string]interface{}, depth int, asOf int64, canRead readChecker) (map[string]interface{}, error) {
 	pointers := map[string]interface{}{}
 	// docstore.logger.Info("expandKeys")
 
 	for _, v := range doc {
 		switch vv := v.(type) {
 		case map[string]interface{}:
-			docPointers, err := docstore.fetchPointers(vv)
+			docPointers, err := docstore.fetchPointers(vv, depth, asOf, canRead)
 			if err != nil {
 				return nil, err
 			}
@@ -272,6 +461,25 @@ func (docstore *DocStore) fetchPointers(doc map[string]interface{}) (map[string]
 				node.URL = u.String()
 
 				pointers[vv] = node
+			case strings.HasPrefix(vv, pointerDocRef):
+				if _, ok := pointers[vv]; ok {
+					// The reference has already been fetched
+					continue
+				}
+				ref, refPointers, err := docstore.fetchDocPointer(vv[len(pointerDocRef):], depth, asOf, canRead)
+				if err != nil {
+					return nil, err
+				}
+				// The referenced doc does not exist (or is deleted, or cannot be read), the pointer is left unresolved
+				if ref == nil {
+					continue
+				}
+				pointers[vv] = ref
+				for k, v := range refPointers {
+					if _, ok := pointers[k]; !ok {
+						pointers[k] = v
+					}
+				}
 			}
 
 		}
@@ -370,6 +578,15 @@ func (docstore *DocStore) storedQueriesHandler() func(http.ResponseWriter, *http
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.Collection),
+				perms.Resource(perms.DocStore, perms.Collection),
+			) {
+				auth.Forbidden(w)
+				return
+			}
 			httputil.WriteJSON(w, docstore.storedQueries)
 			return
 		default:
@@ -385,7 +602,15 @@ func (docstore *DocStore) collectionsHandler() func(http.ResponseWriter, *http.R
 		switch r.Method {
 		case "GET":
 			// Ensure the client has the needed permissions
-			// permissions.CheckPerms(r, PermCollectionName)
+			if !auth.Can(
+				w,
+				r,
+				perms.Action(perms.List, perms.Collection),
+				perms.Resource(perms.DocStore, perms.Collection),
+			) {
+				auth.Forbidden(w)
+				return
+			}
 
 			collections, err := docstore.Collections()
 			if err != nil {
@@ -489,49 +714,16 @@ func isQueryAll(q string) bool {
 // Insert the given doc (`*map[string]interface{}` for now) in the given collection
 func (docstore *DocStore) Insert(collection string, doc *map[string]interface{}) (*id.ID, error) {
 	// FIXME(tsileo): fix the pointer mess
-
-	docFlag := flagNoop
-
-	// If there's already an "_id" field in the doc, remove it
-	if _, ok := (*doc)["_id"]; ok {
-		delete(*doc, "_id")
-	}
-
-	// TODO(tsileo): track the hook execution time and log it
-	ok, newDoc, err := docstore.hooks.Execute(collection, "post", *doc)
+	dw, err := docstore.prepareInsert(collection, *doc)
 	if err != nil {
 		return nil, err
 	}
-
-	if ok && newDoc == nil {
-		return nil, ErrUnprocessableEntity
-	}
-
-	if ok {
-		*doc = newDoc
-	}
-
-	data, err := msgpack.Marshal(doc)
-	if err != nil {
-		return nil, err
-	}
-
-	// Build the ID and add some meta data
-	now := time.Now().UTC()
-	_id, err := id.New(now.UnixNano())
-	if err != nil {
-		return nil, err
-	}
-	_id.SetFlag(docFlag)
+	*doc = dw.doc
 
 	// Create a pointer in the key-value store
-	kv, err := docstore.kvStore.Put(
-		context.TODO(), fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{docFlag}, data...), now.UnixNano(),
-	)
-	if err != nil {
+	if err := docstore.commit(dw); err != nil {
 		return nil, err
 	}
-	_id.SetVersion(kv.Version)
 
 	// Index the doc if needed
 	// if err := docstore.IndexDoc(collection, _id, doc); err != nil {
@@ -539,10 +731,11 @@ func (docstore *DocStore) Insert(collection string, doc *map[string]interface{})
 	// 	return _id, httputil.NewPublicErrorFmt("Failed to index document")
 	// }
 
-	return _id, nil
+	return dw._id, nil
 }
 
 type query struct {
+	textQuery       string
 	storedQuery     string
 	storedQueryArgs interface{}
 	basicQuery      string
@@ -587,7 +780,7 @@ func (docstore *DocStore) LuaQuery(L *lua.LState, lfunc *lua.LFunction, collecti
 	query := &query{
 		lfunc: lfunc,
 	}
-	docs, pointers, stats, err := docstore.query(L, collection, query, cursor, limit, true, 0)
+	docs, pointers, stats, err := docstore.query(L, collection, query, cursor, limit, 1, 0, nil)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -596,7 +789,7 @@ func (docstore *DocStore) LuaQuery(L *lua.LState, lfunc *lua.LFunction, collecti
 
 // Query performs a query
 func (docstore *DocStore) Query(collection string, query *query, cursor string, limit int, asOf int64) ([]map[string]interface{}, map[string]interface{}, *executionStats, error) {
-	docs, pointers, stats, err := docstore.query(nil, collection, query, cursor, limit, true, asOf)
+	docs, pointers, stats, err := docstore.query(nil, collection, query, cursor, limit, 1, asOf, nil)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -606,7 +799,7 @@ func (docstore *DocStore) Query(collection string, query *query, cursor string,
 
 // query returns a JSON list as []byte for the given query
 // docs are unmarhsalled to JSON only when needed.
-func (docstore *DocStore) query(L *lua.LState, collection string, query *query, cursor string, limit int, fetchPointers bool, asOf int64) ([]map[string]interface{}, map[string]interface{}, *executionStats, error) {
+func (docstore *DocStore) query(L *lua.LState, collection string, query *query, cursor string, limit int, pointersDepth int, asOf int64, canRead readChecker) ([]map[string]interface{}, map[string]interface{}, *executionStats, error) {
 	// js := []byte("[")
 	tstart := time.Now()
 	stats := &executionStats{
@@ -640,6 +833,10 @@ func (docstore *DocStore) query(L *lua.LState, collection string, query *query,
 		fetchLimit = int(float64(limit) * 1.3)
 	}
 
+	if query.textQuery != "" {
+		return docstore.textSearch(L, collection, query, cursor, limit, pointersDepth, asOf, canRead, isMatchAll, stats, tstart)
+	}
+
 	qLogger := docstore.logger.New("query", query, "query_engine", stats.Engine, "id", logext.RandId(8))
 	qLogger.Info("new query")
 	docs := []map[string]interface{}{}
@@ -704,7 +901,7 @@ QUERY:
 			var err error
 			if asOf > 0 {
 				// FIXME(tsileo): should return a `[]*id.ID` to, and check the flag before selecting the doc
-				docVersions, allDocPointers, _, err := docstore.FetchVersions(collection, _id.String(), asOf, 1, fetchPointers)
+				docVersions, allDocPointers, _, err := docstore.FetchVersions(collection, _id.String(), asOf, 1, pointersDepth, canRead)
 				// FIXME(tsileo): check deleted
 				if err != nil {
 					panic(err)
@@ -717,7 +914,7 @@ QUERY:
 				}
 			} else {
 				// FIXME(tsileo): only fetch the pointers once the doc has been matched!
-				if _id, docPointers, err = docstore.Fetch(collection, _id.String(), &doc, fetchPointers, -1); err != nil {
+				if _id, docPointers, err = docstore.Fetch(collection, _id.String(), &doc, pointersDepth, -1, canRead); err != nil {
 
 					// The document is deleted skip it
 					if _id.Flag() == flagDeleted {
@@ -737,7 +934,7 @@ QUERY:
 			}
 			if ok {
 				addSpecialFields(doc, _id)
-				if fetchPointers {
+				if pointersDepth > 0 {
 					for k, v := range docPointers {
 						pointers[k] = v
 					}
@@ -762,6 +959,135 @@ QUERY:
 	return docs, pointers, stats, nil
 }
 
+// textSearch performs a full-text query, results are sorted by score (the cursor is the offset in the results)
+func (docstore *DocStore) textSearch(L *lua.LState, collection string, query *query, cursor string, limit int, pointersDepth int, asOf int64, canRead readChecker, isMatchAll bool, stats *executionStats, tstart time.Time) ([]map[string]interface{}, map[string]interface{}, *executionStats, error) {
+	fields := docstore.textIndexFields(collection)
+	if len(fields) == 0 {
+		return nil, nil, stats, httputil.NewPublicErrorFmt("full-text search is not enabled for collection %s", collection)
+	}
+	stats.Engine = "fulltext"
+	stats.Index = "fulltext"
+
+	var offset int
+	if cursor != "" {
+		var err error
+		offset, err = strconv.Atoi(cursor)
+		if err != nil {
+			return nil, nil, stats, httputil.NewPublicErrorFmt("invalid cursor %q", cursor)
+		}
+	}
+
+	qLogger := docstore.logger.New("query", query, "query_engine", stats.Engine, "id", logext.RandId(8))
+	qLogger.Info("new query")
+
+	results, err := docstore.textIndex.Search(collection, query.textQuery)
+	if err != nil {
+		return nil, nil, stats, err
+	}
+
+	// The full-text query can be combined with a "regular" query
+	var qmatcher QueryMatcher
+	if isMatchAll {
+		qmatcher = &MatchAllEngine{}
+	} else {
+		qmatcher, err = docstore.newLuaQueryEngine(L, query)
+		if err != nil {
+			return nil, nil, stats, err
+		}
+	}
+	defer qmatcher.Close()
+
+	pointers := map[string]interface{}{}
+	docs := []map[string]interface{}{}
+	for i := offset; i < len(results); i++ {
+		res := results[i]
+		stats.Cursor = strconv.Itoa(i + 1)
+
+		var _id *id.ID
+		var docPointers map[string]interface{}
+		doc := map[string]interface{}{}
+		if asOf > 0 {
+			docVersions, allDocPointers, _, err := docstore.FetchVersions(collection, res.ID, asOf, 1, pointersDepth, canRead)
+			if err != nil {
+				// The doc may have been purged since it was indexed
+				if err == vkv.ErrNotFound {
+					continue
+				}
+				return nil, nil, stats, err
+			}
+			if len(docVersions) == 0 {
+				continue
+			}
+			doc = docVersions[0]
+			docPointers = allDocPointers
+			_id = doc["_id"].(*id.ID)
+		} else {
+			if _id, docPointers, err = docstore.Fetch(collection, res.ID, &doc, pointersDepth, -1, canRead); err != nil {
+				// The doc may have been purged since it was indexed
+				if err == vkv.ErrNotFound {
+					continue
+				}
+				return nil, nil, stats, err
+			}
+			if _id.Flag() == flagDeleted {
+				continue
+			}
+		}
+
+		stats.TotalDocsExamined++
+		ok, err := qmatcher.Match(doc)
+		if err != nil {
+			return nil, nil, stats, err
+		}
+		if !ok {
+			continue
+		}
+
+		highlights := map[string]interface{}{}
+		for field, text := range textsearch.FieldsText(doc, fields) {
+			snippet, err := textsearch.Highlight(text, query.textQuery)
+			if err != nil {
+				return nil, nil, stats, err
+			}
+			if snippet != "" {
+				highlights[field] = snippet
+			}
+		}
+
+		addSpecialFields(doc, _id)
+		doc["_score"] = res.Score
+		doc["_highlights"] = highlights
+		if pointersDepth > 0 {
+			for k, v := range docPointers {
+				pointers[k] = v
+			}
+		}
+		docs = append(docs, doc)
+		stats.NReturned++
+		stats.LastID = _id.String()
+		if stats.NReturned == limit {
+			break
+		}
+	}
+
+	duration := time.Since(tstart)
+	qLogger.Debug("scan done", "duration", duration, "nReturned", stats.NReturned, "scanned", stats.TotalDocsExamined)
+	stats.ExecutionTimeNano = duration.Nanoseconds()
+	return docs, pointers, stats, nil
+}
+
+// parseAsOf parses the `as_of` (or `as_of_nano`) query arg, returns 0 if not set
+func parseAsOf(q *httputil.Query) (int64, error) {
+	if v := q.Get("as_of"); v != "" {
+		t, err := time.Parse("2006-1-2 15:4:5", v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid as_of: %v", err)
+		}
+		return t.UTC().UnixNano(), nil
+	}
+	return q.GetInt64Default("as_of_nano", 0)
+}
+
 // HTTP handler for the collection (handle listing+query+insert)
 func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -774,24 +1100,16 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 		}
 		switch r.Method {
 		case "GET", "HEAD":
-			// permissions.CheckPerms(r, PermCollectionName, collection, PermRead)
+			if !canCollection(w, r, perms.Query, collection) {
+				return
+			}
 
-			var asOf int64
-			var err error
 			// Parse the cursor
 			cursor := q.Get("cursor")
-			if v := q.Get("as_of"); v != "" {
-				t, err := time.Parse("2006-1-2 15:4:5", v)
-				if err != nil {
-					panic(err)
-				}
-				asOf = t.UTC().UnixNano()
-			}
-			if asOf == 0 {
-				asOf, err = q.GetInt64Default("as_of_nano", 0)
-				if err != nil {
-					panic(err)
-				}
+			asOf, err := parseAsOf(q)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
 			}
 
 			// Parse the query (JSON-encoded)
@@ -810,12 +1128,19 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 				return
 			}
 
+			pointersDepth, err := parsePointersDepth(q)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
 			docs, pointers, stats, err := docstore.query(nil, collection, &query{
+				textQuery:       q.Get("text_query"),
 				storedQueryArgs: queryArgs,
 				storedQuery:     q.Get("stored_query"),
 				script:          q.Get("script"),
 				basicQuery:      q.Get("query"),
-			}, cursor, limit, true, asOf)
+			}, cursor, limit, pointersDepth, asOf, canReadPointers(w, r))
 			if err != nil {
 				docstore.logger.Error("query failed", "err", err)
 				httputil.Error(w, err)
@@ -831,8 +1156,13 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 			if stats.NReturned == limit {
 				hasMore = true
 			}
+			nextCursor := vkv.PrevKey(stats.LastID)
+			if stats.Cursor != "" {
+				// Full-text search results are not sorted by ID
+				nextCursor = stats.Cursor
+			}
 			w.Header().Set("BlobStash-DocStore-Iter-Has-More", strconv.FormatBool(hasMore))
-			w.Header().Set("BlobStash-DocStore-Iter-Cursor", vkv.PrevKey(stats.LastID))
+			w.Header().Set("BlobStash-DocStore-Iter-Cursor", nextCursor)
 
 			// w.Header().Set("BlobStash-DocStore-Query-Optimizer", stats.Optimizer)
 			// if stats.Optimizer != optimizer.Linear {
@@ -857,14 +1187,16 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 				"pointers": pointers,
 				"data":     docs,
 				"pagination": map[string]interface{}{
-					"cursor":   vkv.PrevKey(stats.LastID),
+					"cursor":   nextCursor,
 					"has_more": hasMore,
 					"count":    stats.NReturned,
 					"per_page": limit,
 				},
 			})
 		case "POST":
-			// permissions.CheckPerms(r, PermCollectionName, collection, PermWrite)
+			if !canCollection(w, r, perms.Write, collection) {
+				return
+			}
 			// Read the whole body
 			blob, err := ioutil.ReadAll(r.Body)
 			if err != nil {
@@ -887,14 +1219,11 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 
 			// Actually insert the doc
 			_id, err := docstore.Insert(collection, &doc)
-			if err == ErrUnprocessableEntity {
+			if err != nil {
 				// FIXME(tsileo): returns an object with field errors (set via the Lua API in the hook)
-				w.WriteHeader(http.StatusUnprocessableEntity)
+				writeDocError(w, r, err)
 				return
 			}
-			if err != nil {
-				panic(err)
-			}
 
 			// Output some headers
 			w.Header().Set("BlobStash-DocStore-Doc-Id", _id.String())
@@ -910,6 +1239,24 @@ func (docstore *DocStore) docsHandler() func(http.ResponseWriter, *http.Request)
 			},
 				httputil.WithStatusCode(http.StatusCreated))
 			return
+		case "DELETE":
+			if !canCollection(w, r, perms.Destroy, collection) {
+				return
+			}
+
+			if _, err := docstore.DropCollection(collection); err != nil {
+				switch err {
+				case ErrCollectionNotFound:
+					w.WriteHeader(http.StatusNotFound)
+					return
+				case ErrNotPurgeable:
+					httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -937,25 +1284,18 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 		}
 		switch r.Method {
 		case "POST":
+			if !canCollection(w, r, perms.Query, collection) {
+				return
+			}
 			input := &mapReduceInput{}
 			if err := json.NewDecoder(r.Body).Decode(input); err != nil {
 				panic(httputil.NewPublicErrorFmt("Invalid JSON input"))
 			}
 
-			var asOf int64
-			var err error
-			if v := q.Get("as_of"); v != "" {
-				t, err := time.Parse("2006-1-2 15:4:5", v)
-				if err != nil {
-					panic(err)
-				}
-				asOf = t.UTC().UnixNano()
-			}
-			if asOf == 0 {
-				asOf, err = q.GetInt64Default("as_of_nano", 0)
-				if err != nil {
-					panic(err)
-				}
+			asOf, err := parseAsOf(q)
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
 			}
 
 			// Parse the query (JSON-encoded)
@@ -1032,7 +1372,7 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 						time.Sleep(50 * time.Millisecond)
 						break
 					}
-					docs, _, stats, err := docstore.query(nil, collection, q, cursor, limit, true, asOf)
+					docs, _, stats, err := docstore.query(nil, collection, q, cursor, limit, 0, asOf, nil)
 					if err != nil {
 						docstore.logger.Error("query failed", "err", err)
 						httputil.Error(w, err)
@@ -1111,7 +1451,8 @@ func (docstore *DocStore) mapReduceHandler() func(http.ResponseWriter, *http.Req
 }
 
 // FetchVersions returns all verions/revisions for the given doc ID
-func (docstore *DocStore) FetchVersions(collection, sid string, start int64, limit int, fetchPointers bool) ([]map[string]interface{}, map[string]interface{}, int64, error) {
+// (the pointers are resolved as of `start`)
+func (docstore *DocStore) FetchVersions(collection, sid string, start int64, limit int, pointersDepth int, canRead readChecker) ([]map[string]interface{}, map[string]interface{}, int64, error) {
 	var cursor int64
 	// TODO(tsileo): better output than a slice of `map[string]interface{}`
 	if collection == "" {
@@ -1141,7 +1482,10 @@ func (docstore *DocStore) FetchVersions(collection, sid string, start int64, lim
 		// kv.Value[1:len(kv.Value)]
 
 		// Build the doc
-		if err := msgpack.Unmarshal(kv.Data[1:], &doc); err != nil {
+		if err := docstore.decodeDoc(sid, kv.Data[1:], &doc); err != nil {
+			if err == vkv.ErrNotFound {
+				return nil, nil, cursor, err
+			}
 			return nil, nil, cursor, fmt.Errorf("failed to unmarshal blob")
 		}
 		_id, err := id.FromHex(sid)
@@ -1151,8 +1495,8 @@ func (docstore *DocStore) FetchVersions(collection, sid string, start int64, lim
 		_id.SetVersion(kv.Version)
 		addSpecialFields(doc, _id)
 
-		if fetchPointers {
-			docPointers, err := docstore.fetchPointers(doc)
+		if pointersDepth > 0 {
+			docPointers, err := docstore.fetchPointers(doc, pointersDepth, start, canRead)
 			if err != nil {
 				return nil, nil, cursor, err
 			}
@@ -1171,7 +1515,7 @@ func (docstore *DocStore) FetchVersions(collection, sid string, start int64, lim
 }
 
 // Fetch a single document into `res` and returns the `id.ID`
-func (docstore *DocStore) Fetch(collection, sid string, res interface{}, fetchPointers bool, version int64) (*id.ID, map[string]interface{}, error) {
+func (docstore *DocStore) Fetch(collection, sid string, res interface{}, pointersDepth int, version int64, canRead readChecker) (*id.ID, map[string]interface{}, error) {
 	if collection == "" {
 		return nil, nil, errors.New("missing collection query arg")
 	}
@@ -1199,12 +1543,20 @@ func (docstore *DocStore) Fetch(collection, sid string, res interface{}, fetchPo
 	case nil:
 		// Do nothing
 	case *map[string]interface{}:
-		if err := msgpack.Unmarshal(blob, idoc); err != nil {
+		if err := docstore.decodeDoc(sid, blob, idoc); err != nil {
+			if err == vkv.ErrNotFound {
+				return nil, nil, err
+			}
 			return nil, nil, fmt.Errorf("failed to unmarshal blob: %s", blob)
 		}
 		// TODO(tsileo): set the special fields _created/_updated/_hash
-		if fetchPointers {
-			pointers, err = docstore.fetchPointers(*idoc)
+		if pointersDepth > 0 {
+			// Resolve the pointers as of the requested version
+			var asOf int64
+			if version > 0 {
+				asOf = version
+			}
+			pointers, err = docstore.fetchPointers(*idoc, pointersDepth, asOf, canRead)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -1212,7 +1564,10 @@ func (docstore *DocStore) Fetch(collection, sid string, res interface{}, fetchPo
 	case *[]byte:
 		// Decode the doc and encode it to JSON
 		out := map[string]interface{}{}
-		if err := msgpack.Unmarshal(blob, &out); err != nil {
+		if err := docstore.decodeDoc(sid, blob, &out); err != nil {
+			if err == vkv.ErrNotFound {
+				return nil, nil, err
+			}
 			return nil, nil, fmt.Errorf("failed to unmarshal blob: %s", blob)
 		}
 		// TODO(tsileo): set the special fields _created/_updated/_hash
@@ -1243,16 +1598,57 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing _id in the URL")
 			return
 		}
+		// Ensure the client has the needed permissions
+		action := perms.Read
+		if r.Method != "GET" && r.Method != "HEAD" {
+			action = perms.Write
+		}
+		if !canCollection(w, r, action, collection) {
+			return
+		}
+
 		var _id *id.ID
 		var err error
 		switch r.Method {
 		case "GET", "HEAD":
 			// Serve the document JSON encoded
-			// permissions.CheckPerms(r, PermCollectionName, collection, PermRead)
 			// js := []byte{}
 			var doc, pointers map[string]interface{}
 
-			if _id, pointers, err = docstore.Fetch(collection, sid, &doc, true, -1); err != nil {
+			q := httputil.NewQuery(r.URL.Query())
+			var pointersDepth int
+			var asOf int64
+			if pointersDepth, err = parsePointersDepth(q); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if asOf, err = parseAsOf(q); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			// Select the version of the doc as of `asOf`
+			version := int64(-1)
+			fetchDepth := pointersDepth
+			if asOf > 0 {
+				kv, err := docstore.docAt(collection, sid, asOf)
+				if err != nil {
+					if err == vkv.ErrNotFound {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					panic(err)
+				}
+				if len(kv.Data) == 0 || kv.Data[0] == flagDeleted {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				version = kv.Version
+				// The pointers must be resolved as of `asOf` too (and not as of the version)
+				fetchDepth = 0
+			}
+
+			if _id, pointers, err = docstore.Fetch(collection, sid, &doc, fetchDepth, version, canReadPointers(w, r)); err != nil {
 				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
 					// Document doesn't exist, returns a status 404
 					w.WriteHeader(http.StatusNotFound)
@@ -1260,8 +1656,12 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 				}
 				panic(err)
 			}
+			if asOf > 0 && pointersDepth > 0 {
+				if pointers, err = docstore.fetchPointers(doc, pointersDepth, asOf, canReadPointers(w, r)); err != nil {
+					panic(err)
+				}
+			}
 
-			// FIXME(tsileo): fix-precondition, suport If-Match
 			if etag := r.Header.Get("If-None-Match"); etag != "" {
 				if etag == _id.VersionString() {
 					w.WriteHeader(http.StatusNotModified)
@@ -1286,60 +1686,22 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			docstore.locker.Lock(sid)
 			defer docstore.locker.Unlock(sid)
 
-			ctx := context.Background()
-
-			// Fetch the current doc
-			js := []byte{}
-			if _id, _, err = docstore.Fetch(collection, sid, &js, false, -1); err != nil {
-				if err == vkv.ErrNotFound {
-					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				panic(err)
-			}
-
-			// FIXME(tsileo): make it required?
-			if etag := r.Header.Get("If-Match"); etag != "" {
-				if etag != _id.VersionString() {
-					w.WriteHeader(http.StatusPreconditionFailed)
-					return
-				}
-			}
-
 			buf, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				panic(err)
 			}
 
-			patch, err := jsonpatch.DecodePatch(buf)
-			if err != nil {
-				panic(err)
-			}
-			docstore.logger.Debug("patch decoded", "patch", patch)
-
-			pdata, err := patch.Apply(js)
+			// FIXME(tsileo): make If-Match required?
+			dw, err := docstore.preparePatch(collection, sid, buf, r.Header.Get("If-Match"))
 			if err != nil {
-				panic(err)
-			}
-
-			// Back to msgpack
-			ndoc := map[string]interface{}{}
-			if err := json.Unmarshal(pdata, &ndoc); err != nil {
-				panic(err)
-			}
-			data, err := msgpack.Marshal(ndoc)
-			if err != nil {
-				panic(err)
+				writeDocError(w, r, err)
+				return
 			}
 
-			// TODO(tsileo): also check for reserved keys here
-
-			nkv, err := docstore.kvStore.Put(ctx, fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), -1)
-			if err != nil {
+			if err := docstore.commit(dw); err != nil {
 				panic(err)
 			}
-			_id.SetVersion(nkv.Version)
+			_id = dw._id
 
 			w.Header().Set("ETag", _id.VersionString())
 
@@ -1352,35 +1714,13 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			})
 
 			return
-		case "POST":
+		case "POST", "PUT":
 			// Update the whole document
 
 			// Lock the document before making any change to it
 			docstore.locker.Lock(sid)
 			defer docstore.locker.Unlock(sid)
 
-			// permissions.CheckPerms(r, PermCollectionName, collection, PermWrite)
-			ctx := context.Background()
-			// Fetch the actual doc
-			doc := map[string]interface{}{}
-			_id, _, err = docstore.Fetch(collection, sid, &doc, false, -1)
-			if err != nil {
-				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
-					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				panic(err)
-			}
-
-			// If-Match is optional for POST request
-			if etag := r.Header.Get("If-Match"); etag != "" {
-				if etag != _id.VersionString() {
-					w.WriteHeader(http.StatusPreconditionFailed)
-					return
-				}
-			}
-
 			data, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				panic(err)
@@ -1389,28 +1729,22 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			// Parse the update query
 			var newDoc map[string]interface{}
 			if err := json.Unmarshal(data, &newDoc); err != nil {
-				panic(err)
-			}
-
-			// Field/key starting with `_` are forbidden, remove them
-			for k := range newDoc {
-				if _, ok := reservedKeys[k]; ok {
-					delete(newDoc, k)
-				}
+				panic(httputil.NewPublicErrorFmt("Invalid JSON document"))
 			}
 
-			data, err = msgpack.Marshal(newDoc)
+			// If-Match is optional for POST request
+			dw, err := docstore.prepareUpdate(collection, sid, newDoc, r.Header.Get("If-Match"))
 			if err != nil {
-				panic(err)
+				writeDocError(w, r, err)
+				return
 			}
 
 			docstore.logger.Debug("Update", "_id", sid, "new_doc", newDoc)
 
-			kv, err := docstore.kvStore.Put(ctx, fmt.Sprintf(keyFmt, collection, _id.String()), "", append([]byte{_id.Flag()}, data...), -1)
-			if err != nil {
+			if err := docstore.commit(dw); err != nil {
 				panic(err)
 			}
-			_id.SetVersion(kv.Version)
+			_id = dw._id
 			w.Header().Set("ETag", _id.VersionString())
 
 			created := time.Unix(0, _id.Ts()).UTC().Format(time.RFC3339)
@@ -1426,30 +1760,24 @@ func (docstore *DocStore) docHandler() func(http.ResponseWriter, *http.Request)
 			docstore.locker.Lock(sid)
 			defer docstore.locker.Unlock(sid)
 
-			_id, _, err := docstore.Fetch(collection, sid, nil, false, -1)
+			// If-Match is optional for DELETE request
+			dw, err := docstore.prepareDelete(collection, sid, r.Header.Get("If-Match"))
 			if err != nil {
-				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
-					// Document doesn't exist, returns a status 404
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				panic(err)
+				writeDocError(w, r, err)
+				return
 			}
 
 			// FIXME(tsileo): empty the key, and hanlde it in the get/query
-			if _, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(keyFmt, collection, sid), "", []byte{flagDeleted}, -1); err != nil {
+			if err := docstore.commit(dw); err != nil {
 				panic(err)
 			}
 
 			// TODO(tsileo): handle index deletion for the given document
 			return
-
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-
-		// FIXME(tsileo): put these headers at the top as at this point, the status is already written
-		w.Header().Set("BlobStash-DocStore-Doc-Id", sid)
-		w.Header().Set("BlobStash-DocStore-Doc-Version", _id.VersionString())
-		w.Header().Set("BlobStash-DocStore-Doc-CreatedAt", strconv.FormatInt(_id.Ts(), 10))
 	}
 }
 
@@ -1470,6 +1798,9 @@ func (docstore *DocStore) docVersionsHandler() func(http.ResponseWriter, *http.R
 		var _id *id.ID
 		switch r.Method {
 		case "GET", "HEAD":
+			if !canCollection(w, r, perms.Read, collection) {
+				return
+			}
 			q := httputil.NewQuery(r.URL.Query())
 			limit, err := q.GetIntDefault("limit", 50)
 			if err != nil {
@@ -1481,17 +1812,16 @@ func (docstore *DocStore) docVersionsHandler() func(http.ResponseWriter, *http.R
 				httputil.Error(w, err)
 				return
 			}
-			fetchPointers, err := q.GetBoolDefault("fetch_pointers", true)
+			pointersDepth, err := parsePointersDepth(q)
 			if err != nil {
-				httputil.Error(w, err)
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
 				return
 			}
 
 			// Serve the document JSON encoded
-			// permissions.CheckPerms(r, PermCollectionName, collection, PermRead)
 			// js := []byte{}
 
-			docs, pointers, cursor, err := docstore.FetchVersions(collection, sid, cursor, limit, fetchPointers)
+			docs, pointers, cursor, err := docstore.FetchVersions(collection, sid, cursor, limit, pointersDepth, canReadPointers(w, r))
 			if err != nil {
 				if err == vkv.ErrNotFound || _id.Flag() == flagDeleted {
 					// Document doesn't exist, returns a status 404
@@ -0,0 +1,53 @@
+package docstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+)
+
+// newTestDocStore returns a docstore backed by a temporary root blobstore/kvstore, and a func to clean it up
+func newTestDocStore(t *testing.T, conf *config.Config) (*DocStore, func()) {
+	dir, err := ioutil.TempDir("", "blobstash_docstore_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	if conf == nil {
+		conf = &config.Config{}
+	}
+	conf.DataDir = dir
+
+	h := hub.New(logger.New("app", "hub"))
+	metaHandler, err := meta.New(logger.New("app", "meta"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := kvstore.New(logger.New("app", "kvstore"), dir, bs, metaHandler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docstore, err := New(logger.New("app", "docstore"), conf, kvs, bs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return docstore, func() {
+		docstore.Close()
+		kvs.Close()
+		bs.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,139 @@
+package docstore
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"a4.io/blobstash/pkg/rangedb"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrNotPurgeable is returned when trying to purge a doc that cannot be erased (i.e. some of its versions are not
+// encrypted, as the blobstore is append-only)
+var ErrNotPurgeable = errors.New("document cannot be erased (not stored in a purgeable collection)")
+
+// The encrypted docs are prefixed with a byte that cannot start a msgpack encoded doc
+const encryptedDocMarker byte = 0xc1
+
+// docKeys stores the per-doc encryption keys of the purgeable collections (outside of the blobstore, this way the
+// keys can be deleted, and the encrypted versions of the doc left in the blobstore become unreadable)
+type docKeys struct {
+	db *rangedb.RangeDB
+	mu sync.Mutex
+}
+
+func newDocKeys(path string) (*docKeys, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &docKeys{db: db}, nil
+}
+
+func (dk *docKeys) Close() error {
+	return dk.db.Close()
+}
+
+// get returns the key for the doc, nil if the doc has no key (or if it has been purged)
+func (dk *docKeys) get(sid string) (*[32]byte, error) {
+	data, err := dk.db.Get([]byte(sid))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	key := &[32]byte{}
+	copy(key[:], data)
+	return key, nil
+}
+
+// getOrCreate returns the key for the doc, a new key is generated if needed
+func (dk *docKeys) getOrCreate(sid string) (*[32]byte, error) {
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+	key, err := dk.get(sid)
+	if err != nil || key != nil {
+		return key, err
+	}
+	key = &[32]byte{}
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	if err := dk.db.Set([]byte(sid), key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (dk *docKeys) delete(sid string) error {
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+	return dk.db.Delete([]byte(sid))
+}
+
+// purgeable returns true if the docs of the collection must be encrypted
+func (docstore *DocStore) purgeable(collection string) bool {
+	if docstore.keys == nil {
+		return false
+	}
+	for _, col := range docstore.conf.Docstore.PurgeableCollections {
+		if col == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeDoc encodes the doc (the flag is not included), the docs of the purgeable collections are encrypted
+func (docstore *DocStore) encodeDoc(collection, sid string, doc map[string]interface{}) ([]byte, error) {
+	encoded, err := msgpack.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	if !docstore.purgeable(collection) {
+		return encoded, nil
+	}
+	key, err := docstore.keys.getOrCreate(sid)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	out := append([]byte{encryptedDocMarker}, nonce[:]...)
+	return secretbox.Seal(out, encoded, &nonce, key), nil
+}
+
+// decodeDoc decodes the doc into `out` (the flag must not be included), returns `vkv.ErrNotFound` if the doc is
+// encrypted and has been purged
+func (docstore *DocStore) decodeDoc(sid string, data []byte, out interface{}) error {
+	if len(data) == 0 || data[0] != encryptedDocMarker {
+		return msgpack.Unmarshal(data, out)
+	}
+	if docstore.keys == nil || len(data) < 25 {
+		return vkv.ErrNotFound
+	}
+	key, err := docstore.keys.get(sid)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return vkv.ErrNotFound
+	}
+	var nonce [24]byte
+	copy(nonce[:], data[1:25])
+	decrypted, ok := secretbox.Open(nil, data[25:], &nonce, key)
+	if !ok {
+		return errors.New("failed to decrypt doc")
+	}
+	return msgpack.Unmarshal(decrypted, out)
+}
+
+// isEncrypted returns true if the raw kv data contains an encrypted doc (or a delete marker)
+func isEncrypted(data []byte) bool {
+	return len(data) < 2 || data[1] == encryptedDocMarker
+}
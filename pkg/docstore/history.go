@@ -0,0 +1,135 @@
+package docstore
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/jsondiff"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// HTTP handler returning the JSON-Patch (RFC 6902) diff between two versions of a doc
+func (docstore *DocStore) docDiffHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		sid := vars["_id"]
+		if sid == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing _id in the URL")
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Read, collection) {
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		from, err := q.GetInt64Default("from", 0)
+		if err != nil || from <= 0 {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Missing or invalid from version")
+			return
+		}
+		// Default to the latest version
+		to, err := q.GetInt64Default("to", -1)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid to version")
+			return
+		}
+
+		fromID, fromDoc, err := docstore.fetchVersion(collection, sid, from)
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+		toID, toDoc, err := docstore.fetchVersion(collection, sid, to)
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+
+		patch, err := jsondiff.Diff(fromDoc, toDoc)
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"from":  fromID.VersionString(),
+			"to":    toID.VersionString(),
+			"patch": patch,
+		})
+	}
+}
+
+// HTTP handler for writing a new version of the doc equal to an old version
+func (docstore *DocStore) docRestoreHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		sid := vars["_id"]
+		if sid == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing _id in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Write, collection) {
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		version, err := q.GetInt64Default("version", 0)
+		if err != nil || version <= 0 {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Missing or invalid version")
+			return
+		}
+
+		docstore.locker.Lock(sid)
+		defer docstore.locker.Unlock(sid)
+
+		_, oldDoc, err := docstore.fetchVersion(collection, sid, version)
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+
+		// The restored version goes through the same checks as a regular update
+		dw, err := docstore.prepareUpdate(collection, sid, oldDoc, r.Header.Get("If-Match"))
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+		if err := docstore.commit(dw); err != nil {
+			panic(err)
+		}
+		_id := dw._id
+
+		w.Header().Set("ETag", _id.VersionString())
+		w.Header().Set("BlobStash-DocStore-Doc-Id", _id.String())
+		w.Header().Set("BlobStash-DocStore-Doc-Version", _id.VersionString())
+		w.Header().Set("BlobStash-DocStore-Doc-CreatedAt", strconv.FormatInt(_id.Ts(), 10))
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"_id":           _id.String(),
+			"_created":      time.Unix(0, _id.Ts()).UTC().Format(time.RFC3339),
+			"_version":      _id.VersionString(),
+			"restored_from": strconv.FormatInt(version, 10),
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package docstore
+
+import (
+	"errors"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Name of the Lua hooks executed before the write is committed, they can transform the doc or reject the write
+// (by returning nil)
+const (
+	hookInsert = "post"
+	hookUpdate = "put"
+	hookPatch  = "patch"
+	hookDelete = "delete"
+)
+
+// The post-commit hooks are named after the change operation (e.g. `after_insert`), they're executed asynchronously
+// and are retried on failure
+const commitHookPrefix = "after_"
+
+// Max number of retries for a failed async hook
+const asyncHookMaxRetries = 5
+
+// Delay before retrying a failed async hook (doubled after each failure)
+var asyncHookRetryDelay = 1 * time.Second
+
+// asyncHook is an async hook execution (the `change` hook or a post-commit hook) waiting in the hooks queue
+type asyncHook struct {
+	Collection string                 `json:"collection"`
+	Hook       string                 `json:"hook"`
+	Commit     bool                   `json:"commit"` // True if it's a post-commit hook
+	Data       map[string]interface{} `json:"data"`
+
+	Retries int   `json:"retries"`
+	NextTry int64 `json:"next_try"` // Don't execute it before this timestamp (in nanoseconds)
+}
+
+// executeHook executes the pre-commit hook (if any), and returns the doc that must be written
+func (docstore *DocStore) executeHook(collection, op string, doc map[string]interface{}) (map[string]interface{}, error) {
+	t := time.Now()
+	ok, newDoc, err := docstore.hooks.Execute(collection, op, doc)
+	if ok {
+		docstore.logger.Debug("hook executed", "collection", collection, "hook", op, "duration", time.Since(t))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ok && newDoc == nil {
+		return nil, ErrUnprocessableEntity
+	}
+
+	if ok {
+		return newDoc, nil
+	}
+
+	return doc, nil
+}
+
+// SetupCommitHooks loads the post-commit hooks, `setup` is called on the Lua state before loading the hooks (for
+// loading extra modules, like the `docstore` one, that cannot be loaded from this package)
+func (docstore *DocStore) SetupCommitHooks(setup func(*lua.LState)) error {
+	hooks, err := newLuaHooks(docstore.conf, docstore.filetree, docstore.blobStore, true, setup)
+	if err != nil {
+		return err
+	}
+	docstore.commitHooks = hooks
+	return nil
+}
+
+// enqueueAsyncHooks adds the `change` hook and the post-commit hook for the change (if they exist) to the hooks
+// queue, they will be executed by the hooks worker
+func (docstore *DocStore) enqueueAsyncHooks(collection string, data map[string]interface{}) error {
+	hooks := []*asyncHook{}
+	if docstore.hooks.Has(collection, changeHook) {
+		hooks = append(hooks, &asyncHook{Collection: collection, Hook: changeHook, Data: data})
+	}
+	op := commitHookPrefix + data["op"].(string)
+	if docstore.commitHooks != nil && docstore.commitHooks.Has(collection, op) {
+		hooks = append(hooks, &asyncHook{Collection: collection, Hook: op, Commit: true, Data: data})
+	}
+	for _, h := range hooks {
+		if _, err := docstore.hooksQueue.Enqueue(h); err != nil {
+			return err
+		}
+	}
+	if len(hooks) > 0 {
+		// Wake up the worker
+		select {
+		case docstore.hooksNotify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// executeAsyncHook executes the hook (the hook may have been removed since it was enqueued)
+func (docstore *DocStore) executeAsyncHook(h *asyncHook) error {
+	hooks := docstore.hooks
+	if h.Commit {
+		hooks = docstore.commitHooks
+	}
+	if hooks == nil {
+		// The post-commit hooks are loaded after the docstore is initialized
+		return errors.New("post-commit hooks not loaded")
+	}
+	t := time.Now()
+	ok, err := hooks.ExecuteNoResult(h.Collection, h.Hook, h.Data)
+	if ok {
+		docstore.logger.Debug("async hook executed", "collection", h.Collection, "hook", h.Hook, "_id", h.Data["_id"], "duration", time.Since(t))
+	}
+	return err
+}
+
+// hooksWorker executes the async hooks one at a time, the failed hooks are queued back (by their retry time) until the
+// max number of retries is reached
+func (docstore *DocStore) hooksWorker() {
+	defer docstore.hooksWg.Done()
+	log := docstore.logger.New("worker", "hooks_worker")
+	log.Debug("starting worker")
+L:
+	for {
+		select {
+		case <-docstore.hooksStop:
+			log.Debug("worker stopped")
+			break L
+		default:
+			h := &asyncHook{}
+			ok, deqFunc, err := docstore.hooksQueue.Dequeue(h)
+			if err != nil {
+				panic(err)
+			}
+			if !ok {
+				select {
+				case <-docstore.hooksNotify:
+				case <-docstore.hooksStop:
+					log.Debug("worker stopped")
+					break L
+				case <-time.After(1 * time.Second):
+				}
+				continue L
+			}
+
+			// The retries are queued by their due time, so the first hook is the next one to execute
+			if wait := time.Duration(h.NextTry - time.Now().UnixNano()); wait > 0 {
+				deqFunc(false)
+				select {
+				case <-docstore.hooksNotify:
+				case <-docstore.hooksStop:
+					log.Debug("worker stopped")
+					break L
+				case <-time.After(wait):
+				}
+				continue L
+			}
+
+			if err := docstore.executeAsyncHook(h); err != nil {
+				if h.Retries == asyncHookMaxRetries {
+					log.Error("async hook failed, giving up", "collection", h.Collection, "hook", h.Hook, "_id", h.Data["_id"], "err", err)
+				} else {
+					delay := asyncHookRetryDelay << uint(h.Retries)
+					log.Error("async hook failed, retrying", "collection", h.Collection, "hook", h.Hook, "_id", h.Data["_id"], "err", err, "delay", delay)
+					h.Retries++
+					nextTry := time.Now().Add(delay)
+					h.NextTry = nextTry.UnixNano()
+					if _, err := docstore.hooksQueue.EnqueueAt(h, nextTry); err != nil {
+						panic(err)
+					}
+				}
+			}
+			deqFunc(true)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package docstore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+
+	"a4.io/blobstash/pkg/config"
+)
+
+func TestAsyncHooks(t *testing.T) {
+	asyncHookRetryDelay = 10 * time.Millisecond
+	defer func() {
+		asyncHookRetryDelay = 1 * time.Second
+	}()
+
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	if err := docstore.hooks.Register("notes", changeHook, `
+changes = 0
+return function(data)
+  changes = changes + 1
+end`); err != nil {
+		panic(err)
+	}
+	commitHooks, err := newLuaHooks(&config.Config{}, nil, docstore.blobStore, true)
+	if err != nil {
+		panic(err)
+	}
+	// The post-commit hook fails twice before succeeding
+	if err := commitHooks.Register("notes", commitHookPrefix+ChangeInsert, `
+calls = 0
+return function(data)
+  calls = calls + 1
+  if calls < 3 then
+    error('failed')
+  end
+  inserted = data._id
+end`); err != nil {
+		panic(err)
+	}
+	docstore.commitHooks = commitHooks
+
+	doc := map[string]interface{}{"content": "hello"}
+	_id, err := docstore.Insert("notes", &doc)
+	if err != nil {
+		panic(err)
+	}
+
+	global := func(hooks *LuaHooks, name string) string {
+		hooks.Lock()
+		defer hooks.Unlock()
+		return hooks.L.GetGlobal(name).String()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for global(commitHooks, "inserted") != _id.String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the post-commit hook was not executed (calls=%s)", global(commitHooks, "calls"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if calls := global(commitHooks, "calls"); calls != "3" {
+		t.Errorf("expected the post-commit hook to be called 3 times, got %s", calls)
+	}
+	if changes := global(docstore.hooks, "changes"); changes != "1" {
+		t.Errorf("expected the change hook to be called once, got %s", changes)
+	}
+
+	// Nothing is left in the queue
+	ok, _, err := docstore.hooksQueue.Dequeue(&asyncHook{})
+	if err != nil {
+		panic(err)
+	}
+	if ok {
+		t.Errorf("the hooks queue should be empty")
+	}
+}
+
+func TestAsyncHooksWrite(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+
+	// The post-commit hook writes to a second collection (which triggers the post-commit hooks check too)
+	commitHooks, err := newLuaHooks(&config.Config{}, nil, docstore.blobStore, true, func(L *lua.LState) {
+		L.SetGlobal("insert_log", L.NewFunction(func(L *lua.LState) int {
+			doc := map[string]interface{}{"note": L.CheckString(1)}
+			if _, err := docstore.Insert("logs", &doc); err != nil {
+				L.RaiseError("failed to insert: %v", err)
+			}
+			return 0
+		}))
+	})
+	if err != nil {
+		panic(err)
+	}
+	if err := commitHooks.Register("notes", commitHookPrefix+ChangeInsert, `
+return function(data)
+  insert_log(data._id)
+end`); err != nil {
+		panic(err)
+	}
+	docstore.commitHooks = commitHooks
+
+	doc := map[string]interface{}{"content": "hello"}
+	if _, err := docstore.Insert("notes", &doc); err != nil {
+		panic(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		exists, err := docstore.collectionExists("logs")
+		if err != nil {
+			panic(err)
+		}
+		if exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the post-commit hook did not write the log")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cleanup()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the docstore was not closed")
+	}
+}
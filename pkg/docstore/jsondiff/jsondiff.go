@@ -0,0 +1,128 @@
+/*
+
+Package jsondiff generates JSON-Patch (RFC 6902) diffs between two JSON documents.
+
+The generated patch only uses the `add`, `remove` and `replace` operations.
+
+*/
+package jsondiff // import "a4.io/blobstash/pkg/docstore/jsondiff"
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Op is a single JSON-Patch operation
+type Op struct {
+	Op    string      `json:"op" msgpack:"op"`
+	Path  string      `json:"path" msgpack:"path"`
+	Value interface{} `json:"value,omitempty" msgpack:"value,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface (the `value` must be kept if nil for add/replace ops)
+func (o *Op) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(map[string]interface{}{"op": o.Op, "path": o.Path})
+	}
+	return json.Marshal(map[string]interface{}{"op": o.Op, "path": o.Path, "value": o.Value})
+}
+
+// Diff returns the JSON-Patch operations needed to transform `a` into `b`
+func Diff(a, b map[string]interface{}) ([]*Op, error) {
+	na, err := normalize(a)
+	if err != nil {
+		return nil, err
+	}
+	nb, err := normalize(b)
+	if err != nil {
+		return nil, err
+	}
+	return diff(na, nb, ""), nil
+}
+
+// normalize performs a JSON roundtrip to only deal with JSON types
+func normalize(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(js, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func escape(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func diff(a, b interface{}, path string) []*Op {
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	switch va := a.(type) {
+	case map[string]interface{}:
+		if vb, ok := b.(map[string]interface{}); ok {
+			return diffObject(va, vb, path)
+		}
+	case []interface{}:
+		if vb, ok := b.([]interface{}); ok {
+			return diffArray(va, vb, path)
+		}
+	}
+	return []*Op{&Op{Op: "replace", Path: path, Value: b}}
+}
+
+func diffObject(a, b map[string]interface{}, path string) []*Op {
+	ops := []*Op{}
+
+	// Sort the keys to output a deterministic patch
+	keys := []string{}
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		kpath := path + "/" + escape(k)
+		va, inA := a[k]
+		vb, inB := b[k]
+		switch {
+		case inA && !inB:
+			ops = append(ops, &Op{Op: "remove", Path: kpath})
+		case !inA && inB:
+			ops = append(ops, &Op{Op: "add", Path: kpath, Value: vb})
+		default:
+			ops = append(ops, diff(va, vb, kpath)...)
+		}
+	}
+	return ops
+}
+
+func diffArray(a, b []interface{}, path string) []*Op {
+	ops := []*Op{}
+	common := len(a)
+	if len(b) < common {
+		common = len(b)
+	}
+	for i := 0; i < common; i++ {
+		ops = append(ops, diff(a[i], b[i], fmt.Sprintf("%s/%d", path, i))...)
+	}
+	// Remove the extra items starting from the end, this way the indexes stay valid
+	for i := len(a) - 1; i >= common; i-- {
+		ops = append(ops, &Op{Op: "remove", Path: fmt.Sprintf("%s/%d", path, i)})
+	}
+	for i := common; i < len(b); i++ {
+		ops = append(ops, &Op{Op: "add", Path: path + "/-", Value: b[i]})
+	}
+	return ops
+}
@@ -0,0 +1,55 @@
+package jsondiff
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/evanphx/json-patch"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, tdata := range []struct {
+		a, b string
+		ops  int
+	}{
+		{`{"a": 1}`, `{"a": 1}`, 0},
+		{`{"a": 1}`, `{"a": 2}`, 1},
+		{`{"a": 1, "b": {"c": [1, 2, 3]}}`, `{"b": {"c": [1, 4]}, "d": null}`, 4},
+		{`{"a": [1]}`, `{"a": [1, {"x/y": "~"}, 3]}`, 2},
+		{`{"a": {"b": 1}}`, `{"a": [1]}`, 1},
+	} {
+		a := map[string]interface{}{}
+		b := map[string]interface{}{}
+		check(json.Unmarshal([]byte(tdata.a), &a))
+		check(json.Unmarshal([]byte(tdata.b), &b))
+
+		ops, err := Diff(a, b)
+		check(err)
+		if len(ops) != tdata.ops {
+			t.Errorf("expected %d ops for %s => %s, got %d", tdata.ops, tdata.a, tdata.b, len(ops))
+		}
+
+		// Ensure applying the patch gives the expected doc
+		js, err := json.Marshal(ops)
+		check(err)
+		patch, err := jsonpatch.DecodePatch(js)
+		check(err)
+		out, err := patch.Apply([]byte(tdata.a))
+		if err != nil {
+			t.Errorf("failed to apply %s: %v", js, err)
+			continue
+		}
+		res := map[string]interface{}{}
+		check(json.Unmarshal(out, &res))
+		if !reflect.DeepEqual(res, b) {
+			t.Errorf("bad patch %s, got %s, expected %s", js, out, tdata.b)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+/*
+
+Package jsonschema implements a subset of JSON Schema (draft 7) for validating documents.
+
+Supported keywords: type, enum, const, properties, required, additionalProperties, patternProperties,
+minProperties, maxProperties, items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern,
+minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf, allOf, anyOf, oneOf, not,
+and local references (`#/definitions/...`).
+
+References can be recursive as long as the value is traversed (e.g. a tree), references that would validate the same
+value again (e.g. `{"$ref": "#"}`) are rejected when compiling the schema.
+
+*/
+package jsonschema // import "a4.io/blobstash/pkg/docstore/jsonschema"
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error is a single validation error
+type Error struct {
+	Path    string `json:"path" msgpack:"path"` // JSON pointer to the invalid value
+	Message string `json:"message" msgpack:"message"`
+}
+
+// ValidationError is returned when a document does not match the schema
+type ValidationError struct {
+	Errors []*Error
+}
+
+// Error implements the error interface
+func (ve *ValidationError) Error() string {
+	msgs := []string{}
+	for _, e := range ve.Errors {
+		path := e.Path
+		if path == "" {
+			path = "/"
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", path, e.Message))
+	}
+	return "document validation failed: " + strings.Join(msgs, ", ")
+}
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+	raw      []byte
+}
+
+// New compiles the given JSON Schema
+func New(raw []byte) (*Schema, error) {
+	root := map[string]interface{}{}
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	s := &Schema{root: root, raw: raw, patterns: map[string]*regexp.Regexp{}}
+	// Compile all the patterns ahead of time, this also checks they're valid
+	if err := s.compilePatterns(root); err != nil {
+		return nil, err
+	}
+	if err := s.checkRefs(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Raw returns the JSON encoded schema
+func (s *Schema) Raw() []byte {
+	return s.raw
+}
+
+func (s *Schema) compilePatterns(v interface{}) error {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range vv {
+			if k == "pattern" {
+				if p, ok := child.(string); ok {
+					if err := s.compile(p); err != nil {
+						return err
+					}
+				}
+			}
+			if k == "patternProperties" {
+				if pp, ok := child.(map[string]interface{}); ok {
+					for p := range pp {
+						if err := s.compile(p); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range vv {
+			if err := s.compilePatterns(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subschemas returns the subschemas applied to the same value as the schema (the ones that would be validated
+// without traversing the value)
+func (s *Schema) subschemas(schema map[string]interface{}) ([]map[string]interface{}, error) {
+	if ref, ok := schema["$ref"].(string); ok {
+		sub, err := s.resolve(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %v", err)
+		}
+		return []map[string]interface{}{sub}, nil
+	}
+	out := []map[string]interface{}{}
+	for _, k := range []string{"allOf", "anyOf", "oneOf"} {
+		if subs, ok := schema[k].([]interface{}); ok {
+			for _, sub := range subs {
+				if m, ok := sub.(map[string]interface{}); ok {
+					out = append(out, m)
+				}
+			}
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok {
+		out = append(out, not)
+	}
+	return out, nil
+}
+
+// children returns all the direct subschemas of the schema
+func children(schema map[string]interface{}) []map[string]interface{} {
+	out := []map[string]interface{}{}
+	add := func(v interface{}) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			out = append(out, vv)
+		case []interface{}:
+			for _, sub := range vv {
+				if m, ok := sub.(map[string]interface{}); ok {
+					out = append(out, m)
+				}
+			}
+		}
+	}
+	for _, k := range []string{"properties", "patternProperties", "definitions"} {
+		if subs, ok := schema[k].(map[string]interface{}); ok {
+			for _, sub := range subs {
+				add(sub)
+			}
+		}
+	}
+	for _, k := range []string{"additionalProperties", "items", "additionalItems", "allOf", "anyOf", "oneOf", "not"} {
+		add(schema[k])
+	}
+	return out
+}
+
+// checkRefs ensures no reference cycle can validate the same value forever (i.e. a cycle of references that does not
+// traverse the value)
+func (s *Schema) checkRefs() error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[uintptr]int{}
+	var visit func(schema map[string]interface{}) error
+	visit = func(schema map[string]interface{}) error {
+		k := reflect.ValueOf(schema).Pointer()
+		switch state[k] {
+		case visiting:
+			return fmt.Errorf("invalid schema: circular reference")
+		case done:
+			return nil
+		}
+		state[k] = visiting
+		subs, err := s.subschemas(schema)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			if err := visit(sub); err != nil {
+				return err
+			}
+		}
+		state[k] = done
+		return nil
+	}
+
+	// Check all the subschemas
+	queue := []map[string]interface{}{s.root}
+	seen := map[uintptr]bool{}
+	for len(queue) > 0 {
+		schema := queue[0]
+		queue = queue[1:]
+		k := reflect.ValueOf(schema).Pointer()
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if err := visit(schema); err != nil {
+			return err
+		}
+		queue = append(queue, children(schema)...)
+	}
+	return nil
+}
+
+func (s *Schema) compile(p string) error {
+	if _, ok := s.patterns[p]; ok {
+		return nil
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return fmt.Errorf("invalid schema: bad pattern %q: %v", p, err)
+	}
+	s.patterns[p] = re
+	return nil
+}
+
+// Validate validates the doc against the schema, returns a `*ValidationError` if the doc is invalid
+func (s *Schema) Validate(doc interface{}) error {
+	errs := s.validate(s.root, normalize(doc), "", map[string]bool{})
+	if len(errs) > 0 {
+		return &ValidationError{errs}
+	}
+	return nil
+}
+
+// normalize converts the numbers to float64 and the maps/slices to their generic types (like `encoding/json` would do)
+func normalize(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, c := range vv {
+			out[k] = normalize(c)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, c := range vv {
+			out[fmt.Sprintf("%v", k)] = normalize(c)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, c := range vv {
+			out[i] = normalize(c)
+		}
+		return out
+	case nil, bool, string, float64:
+		return vv
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	case reflect.Slice, reflect.Array:
+		out := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			out[i] = normalize(rv.Index(i).Interface())
+		}
+		return out
+	}
+	// Fallback to a JSON roundtrip
+	js, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(js, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+func typeOf(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if vv == math.Trunc(vv) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func matchType(v interface{}, t string) bool {
+	vt := typeOf(v)
+	return vt == t || (t == "number" && vt == "integer")
+}
+
+func errf(path, msg string, args ...interface{}) []*Error {
+	return []*Error{&Error{Path: path, Message: fmt.Sprintf(msg, args...)}}
+}
+
+func escape(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func num(schema map[string]interface{}, key string) (float64, bool) {
+	v, ok := schema[key].(float64)
+	return v, ok
+}
+
+func (s *Schema) resolve(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported")
+	}
+	var cur interface{} = s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid reference %q", ref)
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, fmt.Errorf("invalid reference %q", ref)
+		}
+	}
+	out, ok := cur.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid reference %q", ref)
+	}
+	return out, nil
+}
+
+// validateSub handles the boolean schemas
+func (s *Schema) validateSub(sub interface{}, v interface{}, path string, refs map[string]bool) []*Error {
+	switch ss := sub.(type) {
+	case bool:
+		if !ss {
+			return errf(path, "not allowed")
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validate(ss, v, path, refs)
+	}
+	return nil
+}
+
+// validate validates the value against the schema, `refs` contains the references being resolved (along with the
+// path of the value), this way a reference cycle cannot validate the same value forever
+func (s *Schema) validate(schema map[string]interface{}, v interface{}, path string, refs map[string]bool) []*Error {
+	if ref, ok := schema["$ref"].(string); ok {
+		sub, err := s.resolve(ref)
+		if err != nil {
+			return errf(path, "%v", err)
+		}
+		k := ref + "\x00" + path
+		if refs[k] {
+			return errf(path, "circular reference %q", ref)
+		}
+		refs[k] = true
+		defer delete(refs, k)
+		return s.validate(sub, v, path, refs)
+	}
+
+	errs := []*Error{}
+
+	// Generic keywords
+	switch t := schema["type"].(type) {
+	case string:
+		if !matchType(v, t) {
+			return errf(path, "expected %s, got %s", t, typeOf(v))
+		}
+	case []interface{}:
+		var ok bool
+		types := []string{}
+		for _, it := range t {
+			if ts, isStr := it.(string); isStr {
+				types = append(types, ts)
+				if matchType(v, ts) {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			return errf(path, "expected %s, got %s", strings.Join(types, " or "), typeOf(v))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		var found bool
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, errf(path, "must be one of the enum values")...)
+		}
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		errs = append(errs, errf(path, "must be equal to the constant")...)
+	}
+
+	// Combinators
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, s.validateSub(sub, v, path, refs)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		var valid bool
+		for _, sub := range anyOf {
+			if len(s.validateSub(sub, v, path, refs)) == 0 {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			errs = append(errs, errf(path, "must match at least one schema of anyOf")...)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		var cnt int
+		for _, sub := range oneOf {
+			if len(s.validateSub(sub, v, path, refs)) == 0 {
+				cnt++
+			}
+		}
+		if cnt != 1 {
+			errs = append(errs, errf(path, "must match exactly one schema of oneOf (matched %d)", cnt)...)
+		}
+	}
+	if not, ok := schema["not"]; ok {
+		if len(s.validateSub(not, v, path, refs)) == 0 {
+			errs = append(errs, errf(path, "must not match the schema")...)
+		}
+	}
+
+	switch vv := v.(type) {
+	case string:
+		l := float64(utf8.RuneCountInString(vv))
+		if min, ok := num(schema, "minLength"); ok && l < min {
+			errs = append(errs, errf(path, "must be at least %v characters long", min)...)
+		}
+		if max, ok := num(schema, "maxLength"); ok && l > max {
+			errs = append(errs, errf(path, "must be at most %v characters long", max)...)
+		}
+		if p, ok := schema["pattern"].(string); ok && !s.patterns[p].MatchString(vv) {
+			errs = append(errs, errf(path, "must match the pattern %q", p)...)
+		}
+	case float64:
+		if min, ok := num(schema, "minimum"); ok && vv < min {
+			errs = append(errs, errf(path, "must be >= %v", min)...)
+		}
+		if max, ok := num(schema, "maximum"); ok && vv > max {
+			errs = append(errs, errf(path, "must be <= %v", max)...)
+		}
+		if min, ok := num(schema, "exclusiveMinimum"); ok && vv <= min {
+			errs = append(errs, errf(path, "must be > %v", min)...)
+		}
+		if max, ok := num(schema, "exclusiveMaximum"); ok && vv >= max {
+			errs = append(errs, errf(path, "must be < %v", max)...)
+		}
+		if m, ok := num(schema, "multipleOf"); ok && m > 0 {
+			if q := vv / m; q != math.Trunc(q) {
+				errs = append(errs, errf(path, "must be a multiple of %v", m)...)
+			}
+		}
+	case []interface{}:
+		l := float64(len(vv))
+		if min, ok := num(schema, "minItems"); ok && l < min {
+			errs = append(errs, errf(path, "must contain at least %v items", min)...)
+		}
+		if max, ok := num(schema, "maxItems"); ok && l > max {
+			errs = append(errs, errf(path, "must contain at most %v items", max)...)
+		}
+		if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		UNIQUE:
+			for i := range vv {
+				for j := i + 1; j < len(vv); j++ {
+					if reflect.DeepEqual(vv[i], vv[j]) {
+						errs = append(errs, errf(path, "items must be unique")...)
+						break UNIQUE
+					}
+				}
+			}
+		}
+		switch items := schema["items"].(type) {
+		case map[string]interface{}, bool:
+			for i, item := range vv {
+				errs = append(errs, s.validateSub(items, item, fmt.Sprintf("%s/%d", path, i), refs)...)
+			}
+		case []interface{}:
+			for i, item := range vv {
+				ipath := fmt.Sprintf("%s/%d", path, i)
+				if i < len(items) {
+					errs = append(errs, s.validateSub(items[i], item, ipath, refs)...)
+				} else if additional, ok := schema["additionalItems"]; ok {
+					errs = append(errs, s.validateSub(additional, item, ipath, refs)...)
+				}
+			}
+		}
+	case map[string]interface{}:
+		l := float64(len(vv))
+		if min, ok := num(schema, "minProperties"); ok && l < min {
+			errs = append(errs, errf(path, "must contain at least %v properties", min)...)
+		}
+		if max, ok := num(schema, "maxProperties"); ok && l > max {
+			errs = append(errs, errf(path, "must contain at most %v properties", max)...)
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if key, ok := r.(string); ok {
+					if _, ok := vv[key]; !ok {
+						errs = append(errs, errf(path+"/"+escape(key), "is required")...)
+					}
+				}
+			}
+		}
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		patternProperties, _ := schema["patternProperties"].(map[string]interface{})
+		additional, hasAdditional := schema["additionalProperties"]
+
+		// Iterate the keys in a deterministic order
+		keys := make([]string, 0, len(vv))
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			kpath := path + "/" + escape(k)
+			var matched bool
+			if sub, ok := properties[k]; ok {
+				matched = true
+				errs = append(errs, s.validateSub(sub, vv[k], kpath, refs)...)
+			}
+			for p, sub := range patternProperties {
+				if s.patterns[p].MatchString(k) {
+					matched = true
+					errs = append(errs, s.validateSub(sub, vv[k], kpath, refs)...)
+				}
+			}
+			if !matched && hasAdditional {
+				errs = append(errs, s.validateSub(additional, vv[k], kpath, refs)...)
+			}
+		}
+	}
+
+	return errs
+}
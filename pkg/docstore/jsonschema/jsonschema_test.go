@@ -0,0 +1,119 @@
+package jsonschema
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSchema = []byte(`{
+  "type": "object",
+  "required": ["title", "count"],
+  "additionalProperties": false,
+  "definitions": {
+    "tag": {"type": "string", "pattern": "^[a-z]+$"}
+  },
+  "properties": {
+    "title": {"type": "string", "minLength": 2},
+    "count": {"type": "integer", "minimum": 0},
+    "status": {"enum": ["draft", "published"]},
+    "tags": {"type": "array", "items": {"$ref": "#/definitions/tag"}, "uniqueItems": true},
+    "meta": {"type": ["object", "null"]}
+  }
+}`)
+
+func TestValidate(t *testing.T) {
+	s, err := New(testSchema)
+	if err != nil {
+		t.Fatalf("failed to compile schema: %v", err)
+	}
+
+	for _, tdata := range []struct {
+		doc      map[string]interface{}
+		expected []*Error
+	}{
+		{
+			doc: map[string]interface{}{"title": "ok", "count": int64(2), "tags": []interface{}{"a", "b"}, "meta": nil},
+		},
+		{
+			doc: map[string]interface{}{"title": "ok", "count": 1.5},
+			expected: []*Error{
+				&Error{Path: "/count", Message: "expected integer, got number"},
+			},
+		},
+		{
+			doc: map[string]interface{}{"title": "o", "status": "nope", "tags": []interface{}{"a", "B", "a"}, "extra": true},
+			expected: []*Error{
+				&Error{Path: "/count", Message: "is required"},
+				&Error{Path: "/extra", Message: "not allowed"},
+				&Error{Path: "/status", Message: "must be one of the enum values"},
+				&Error{Path: "/tags", Message: "items must be unique"},
+				&Error{Path: "/tags/1", Message: "must match the pattern \"^[a-z]+$\""},
+				&Error{Path: "/title", Message: "must be at least 2 characters long"},
+			},
+		},
+	} {
+		err := s.Validate(tdata.doc)
+		if tdata.expected == nil {
+			if err != nil {
+				t.Errorf("expected %+v to be valid, got %v", tdata.doc, err)
+			}
+			continue
+		}
+		verr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("expected a ValidationError for %+v, got %v", tdata.doc, err)
+			continue
+		}
+		if !reflect.DeepEqual(verr.Errors, tdata.expected) {
+			for _, e := range verr.Errors {
+				t.Logf("%+v", e)
+			}
+			t.Errorf("unexpected errors for %+v", tdata.doc)
+		}
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	if _, err := New([]byte(`{"pattern": "("}`)); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+	if _, err := New([]byte(`nope`)); err == nil {
+		t.Errorf("expected an error for an invalid JSON")
+	}
+}
+
+func TestCircularRefs(t *testing.T) {
+	for _, raw := range []string{
+		`{"$ref": "#"}`,
+		`{"definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"allOf": [{"$ref": "#/definitions/a"}]}}, "properties": {"x": {"$ref": "#/definitions/a"}}}`,
+		`{"definitions": {"a": {"not": {"$ref": "#/definitions/a"}}}}`,
+		`{"properties": {"x": {"$ref": "#/definitions/nope"}}}`,
+	} {
+		if _, err := New([]byte(raw)); err == nil {
+			t.Errorf("expected an error for %s", raw)
+		}
+	}
+
+	// Recursive schemas are allowed as long as the value is traversed
+	s, err := New([]byte(`{
+  "definitions": {
+    "node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/definitions/node"}}, "name": {"type": "string"}}}
+  },
+  "$ref": "#/definitions/node"
+}`))
+	if err != nil {
+		t.Fatalf("failed to compile schema: %v", err)
+	}
+	if err := s.Validate(map[string]interface{}{"children": []interface{}{map[string]interface{}{"name": "a"}}}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := s.Validate(map[string]interface{}{"children": []interface{}{map[string]interface{}{"name": 1}}}); err == nil {
+		t.Errorf("expected a validation error")
+	}
+
+	// The references being resolved are tracked when validating too
+	s.root = map[string]interface{}{"$ref": "#"}
+	if err := s.Validate(map[string]interface{}{}); err == nil {
+		t.Errorf("expected a circular reference error")
+	}
+}
@@ -75,9 +75,14 @@ func (h *LuaHook) Execute(doc map[string]interface{}) (map[string]interface{}, e
 		fmt.Printf("failed to call pre put hook func: %+v %+v\n", doc, err)
 		return nil, err
 	}
-	newDoc := luautil.TableToMap(h.L.Get(-1).(*lua.LTable))
+	ret := h.L.Get(-1)
 	h.L.Pop(1)
-	return newDoc, nil
+	// Returning nil means the doc is rejected
+	tbl, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, nil
+	}
+	return luautil.TableToMap(tbl), nil
 }
 
 func (h *LuaHook) ExecuteNoResult(doc map[string]interface{}) error {
@@ -277,10 +282,11 @@ func NewMapReduceEngine() *MapReduceEngine {
 }
 
 type LuaHooks struct {
-	hooks  map[string]map[string]*LuaHook
-	L      *lua.LState
-	config *config.Config
-	sync.Mutex
+	hooks      map[string]map[string]*LuaHook
+	hooksMu    sync.RWMutex // Guards the hooks map, so it can be checked while a hook is running
+	L          *lua.LState
+	config     *config.Config
+	sync.Mutex // Guards the Lua state
 }
 
 func setupCmd(cwd string) func(*lua.LState) int {
@@ -306,7 +312,14 @@ func setupCmd(cwd string) func(*lua.LState) int {
 	}
 }
 
-func newLuaHooks(conf *config.Config, ft *filetree.FileTree, bs store.BlobStore) (*LuaHooks, error) {
+// isCommitHook returns true if the hook must be executed (asynchronously) after the write is committed
+func isCommitHook(op string) bool {
+	return strings.HasPrefix(op, commitHookPrefix)
+}
+
+// newLuaHooks loads the hooks from the config, the post-commit hooks are loaded in a separate state (if `commit` is
+// true) as they can write in other collections (and trigger the pre-commit hooks)
+func newLuaHooks(conf *config.Config, ft *filetree.FileTree, bs store.BlobStore, commit bool, setups ...func(*lua.LState)) (*LuaHooks, error) {
 	hooks := &LuaHooks{
 		config: conf,
 		L:      lua.NewState(),
@@ -317,10 +330,16 @@ func newLuaHooks(conf *config.Config, ft *filetree.FileTree, bs store.BlobStore)
 	filetreeLua.Setup(hooks.L, ft, bs)
 	// FIXME(tsileo): better CWD
 	util.Setup(hooks.L, "/tmp")
+	for _, setup := range setups {
+		setup(hooks.L)
+	}
 	if c := conf.Docstore; c != nil {
 		if ch := c.Hooks; ch != nil {
 			for col, ops := range ch {
 				for op, path := range ops {
+					if isCommitHook(op) != commit {
+						continue
+					}
 					data, err := ioutil.ReadFile(path)
 					if err != nil {
 						return nil, err
@@ -339,15 +358,17 @@ func newLuaHooks(conf *config.Config, ft *filetree.FileTree, bs store.BlobStore)
 func (lh *LuaHooks) Register(col, op, code string) error {
 	lh.Lock()
 	defer lh.Unlock()
+	h, err := NewLuaHook(lh.L, code)
+	if err != nil {
+		return err
+	}
+	lh.hooksMu.Lock()
+	defer lh.hooksMu.Unlock()
 	ops, ok := lh.hooks[col]
 	if !ok {
 		lh.hooks[col] = map[string]*LuaHook{}
 		ops = lh.hooks[col]
 	}
-	h, err := NewLuaHook(lh.L, code)
-	if err != nil {
-		return err
-	}
 	ops[op] = h
 	fmt.Printf("RESGISTERED %+v\n", lh.hooks)
 	return nil
@@ -355,21 +376,20 @@ func (lh *LuaHooks) Register(col, op, code string) error {
 
 func (lh *LuaHooks) Execute(col, op string, doc map[string]interface{}) (bool, map[string]interface{}, error) {
 	fmt.Printf("HOOKS EXECUTE %v %v check\n", col, op)
-	lh.Lock()
-	defer lh.Unlock()
-	ops, ok := lh.hooks[col]
-	if !ok {
-		return false, nil, nil
-	}
-	h, ok := ops[op]
-	if !ok {
+	h := lh.get(col, op)
+	if h == nil {
 		return false, nil, nil
 	}
 
+	lh.Lock()
+	defer lh.Unlock()
 	newDoc, err := h.Execute(doc)
 	if err != nil {
 		return true, nil, err
 	}
+	if newDoc == nil {
+		return true, nil, nil
+	}
 
 	newDoc["_hooks"] = map[string]interface{}{
 		op: h.ID[:7],
@@ -379,6 +399,34 @@ func (lh *LuaHooks) Execute(col, op string, doc map[string]interface{}) (bool, m
 	return true, newDoc, nil
 }
 
+// get returns the given hook, or nil if it does not exist
+func (lh *LuaHooks) get(col, op string) *LuaHook {
+	lh.hooksMu.RLock()
+	defer lh.hooksMu.RUnlock()
+	return lh.hooks[col][op]
+}
+
+// Has returns true if the given hook exists (it does not wait for the running hook, so a hook can trigger writes)
+func (lh *LuaHooks) Has(col, op string) bool {
+	return lh.get(col, op) != nil
+}
+
+// ExecuteNoResult executes the given hook (if any) without expecting a result (used for notification hooks)
+func (lh *LuaHooks) ExecuteNoResult(col, op string, data map[string]interface{}) (bool, error) {
+	h := lh.get(col, op)
+	if h == nil {
+		return false, nil
+	}
+
+	lh.Lock()
+	defer lh.Unlock()
+	if err := h.ExecuteNoResult(data); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
 func (lh *LuaHooks) Close() error {
 	lh.L.Close()
 	return nil
@@ -2,19 +2,21 @@ package lua // import "a4.io/blobstash/pkg/docstore/lua"
 
 import (
 	"github.com/yuin/gopher-lua"
+	"github.com/zpatrick/rbac"
 
 	luautil "a4.io/blobstash/pkg/apps/luautil"
 	"a4.io/blobstash/pkg/docstore"
+	"a4.io/blobstash/pkg/perms"
 )
 
-func setupDocStore(dc *docstore.DocStore) func(*lua.LState) int {
+func setupDocStore(dc *docstore.DocStore, roles rbac.Roles) func(*lua.LState) int {
 	return func(L *lua.LState) int {
 		// register functions to the table
 		mod := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 			"col": func(L *lua.LState) int {
 				name := L.ToString(1)
 				ud := L.NewUserData()
-				ud.Value = &col{dc, name}
+				ud.Value = &col{dc, name, roles}
 				L.SetMetatable(ud, L.GetTypeMetatable("col"))
 				L.Push(ud)
 				return 1
@@ -26,18 +28,38 @@ func setupDocStore(dc *docstore.DocStore) func(*lua.LState) int {
 	}
 }
 
-func Setup(L *lua.LState, dc *docstore.DocStore) {
+// Setup loads the `docstore` module, the permissions are checked against `roles` (if not nil)
+func Setup(L *lua.LState, dc *docstore.DocStore, roles rbac.Roles) {
 	mtCol := L.NewTypeMetatable("col")
 	L.SetField(mtCol, "__index", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"insert": colInsert,
 		"query":  colQuery,
 	}))
-	L.PreloadModule("docstore", setupDocStore(dc))
+	L.PreloadModule("docstore", setupDocStore(dc, roles))
 }
 
 type col struct {
-	dc   *docstore.DocStore
-	name string
+	dc    *docstore.DocStore
+	name  string
+	roles rbac.Roles
+}
+
+// can raises a Lua error if the action is not allowed on the collection
+func (c *col) can(L *lua.LState, action perms.ActionType) bool {
+	if c.roles == nil {
+		return true
+	}
+	ok, err := c.roles.Can(
+		perms.Action(action, perms.Collection),
+		perms.ResourceWithID(perms.DocStore, perms.Collection, c.name),
+	)
+	if err != nil {
+		panic(err)
+	}
+	if !ok {
+		L.RaiseError("forbidden: cannot %s collection %s", action, c.name)
+	}
+	return ok
 }
 
 func checkCol(L *lua.LState) *col {
@@ -51,7 +73,7 @@ func checkCol(L *lua.LState) *col {
 
 func colInsert(L *lua.LState) int {
 	col := checkCol(L)
-	if col == nil {
+	if col == nil || !col.can(L, perms.Write) {
 		return 0
 	}
 	t := luautil.TableToMap(L.ToTable(2))
@@ -65,7 +87,7 @@ func colInsert(L *lua.LState) int {
 
 func colQuery(L *lua.LState) int {
 	col := checkCol(L)
-	if col == nil {
+	if col == nil || !col.can(L, perms.Query) {
 		return 0
 	}
 	cursor := L.ToString(2)
@@ -95,3 +117,11 @@ func colQuery(L *lua.LState) int {
 	L.Push(lua.LString(cursor))
 	return 3
 }
+
+// SetupHooks loads the post-commit hooks of the docstore, the hooks can use the `docstore` module (without any
+// permissions check) for maintaining derived data in other collections
+func SetupHooks(dc *docstore.DocStore) error {
+	return dc.SetupCommitHooks(func(L *lua.LState) {
+		Setup(L, dc, nil)
+	})
+}
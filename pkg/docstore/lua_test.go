@@ -126,3 +126,35 @@ func TestLuaMapReduce(t *testing.T) {
 		t.Errorf("expected 9, got %d\n", result3["data"]["count"])
 	}
 }
+
+func TestLuaHookReject(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	h, err := NewLuaHook(L, `
+function hook(doc)
+  if doc.count > 1 then
+    return nil
+  end
+  return doc
+end
+return hook`)
+	if err != nil {
+		panic(err)
+	}
+
+	doc, err := h.Execute(map[string]interface{}{"count": 1})
+	if err != nil {
+		panic(err)
+	}
+	if doc == nil {
+		t.Errorf("expected the doc to be accepted")
+	}
+	doc, err = h.Execute(map[string]interface{}{"count": 2})
+	if err != nil {
+		panic(err)
+	}
+	if doc != nil {
+		t.Errorf("expected the doc to be rejected, got %+v", doc)
+	}
+}
@@ -0,0 +1,125 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// Max depth for resolving the docs references (a referenced doc can contains references too)
+const maxPointersDepth = 5
+
+// parsePointersDepth returns the depth for resolving the pointers from the `fetch_pointers` and `pointers_depth`
+// query args (0 means the pointers must not be fetched)
+func parsePointersDepth(q *httputil.Query) (int, error) {
+	fetchPointers, err := q.GetBoolDefault("fetch_pointers", true)
+	if err != nil {
+		return 0, err
+	}
+	if !fetchPointers {
+		return 0, nil
+	}
+	depth, err := q.GetIntDefault("pointers_depth", 1)
+	if err != nil {
+		return 0, err
+	}
+	if depth < 0 || depth > maxPointersDepth {
+		return 0, httputil.NewPublicErrorFmt("pointers_depth must be between 0 and %d", maxPointersDepth)
+	}
+	return depth, nil
+}
+
+// readChecker returns true if the docs of the collection can be read (nil means all the collections are readable)
+type readChecker func(collection string) bool
+
+// canReadPointers returns a `readChecker` using the permissions of the request, the doc pointers to collections that
+// cannot be read by the client are not resolved
+func canReadPointers(w http.ResponseWriter, r *http.Request) readChecker {
+	checked := map[string]bool{}
+	return func(collection string) bool {
+		if can, ok := checked[collection]; ok {
+			return can
+		}
+		can := auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.Collection),
+			perms.ResourceWithID(perms.DocStore, perms.Collection, collection),
+		)
+		checked[collection] = can
+		return can
+	}
+}
+
+// docAt returns the KV entry for the version of the doc as of `asOf` (or the latest version if `asOf` is 0)
+func (docstore *DocStore) docAt(collection, sid string, asOf int64) (*vkv.KeyValue, error) {
+	key := fmt.Sprintf(keyFmt, collection, sid)
+	if asOf <= 0 {
+		return docstore.kvStore.Get(context.TODO(), key, -1)
+	}
+	kvv, _, err := docstore.kvStore.Versions(context.TODO(), key, strconv.FormatInt(asOf, 10), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(kvv.Versions) == 0 {
+		return nil, vkv.ErrNotFound
+	}
+	return kvv.Versions[0], nil
+}
+
+// fetchDocPointer resolves a `@blobstash/doc:<collection>/<_id>` pointer, returns a nil doc if the referenced doc
+// does not exist (or is deleted), or if the collection cannot be read
+func (docstore *DocStore) fetchDocPointer(ref string, depth int, asOf int64, canRead readChecker) (map[string]interface{}, map[string]interface{}, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid doc ref %q", ref)
+	}
+	collection, sid := parts[0], parts[1]
+	_id, err := id.FromHex(sid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid doc ref %q: %v", ref, err)
+	}
+	if canRead != nil && !canRead(collection) {
+		return nil, nil, nil
+	}
+
+	kv, err := docstore.docAt(collection, sid, asOf)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	if len(kv.Data) == 0 || kv.Data[0] == flagDeleted {
+		return nil, nil, nil
+	}
+
+	doc := map[string]interface{}{}
+	if err := docstore.decodeDoc(sid, kv.Data[1:], &doc); err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	_id.SetFlag(kv.Data[0])
+	_id.SetVersion(kv.Version)
+	addSpecialFields(doc, _id)
+
+	// Resolve the references of the referenced doc
+	var pointers map[string]interface{}
+	if depth > 1 {
+		if pointers, err = docstore.fetchPointers(doc, depth-1, asOf, canRead); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return doc, pointers, nil
+}
@@ -0,0 +1,62 @@
+package docstore
+
+import (
+	"testing"
+
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestDocAt(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	doc := map[string]interface{}{"hello": "world"}
+	_id, err := docstore.Insert("notes", &doc)
+	if err != nil {
+		panic(err)
+	}
+	kv, err := docstore.docAt("notes", _id.String(), _id.Version())
+	if err != nil {
+		panic(err)
+	}
+	if kv.Version != _id.Version() {
+		t.Errorf("expected version %d, got %d", _id.Version(), kv.Version)
+	}
+
+	// The doc did not exist yet
+	if _, err := docstore.docAt("notes", _id.String(), _id.Version()-1); err != vkv.ErrNotFound {
+		t.Errorf("expected vkv.ErrNotFound, got %v", err)
+	}
+}
+
+func TestFetchPointersPerms(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	secret := map[string]interface{}{"content": "s3cr3t"}
+	secretID, err := docstore.Insert("secrets", &secret)
+	if err != nil {
+		panic(err)
+	}
+	pointer := pointerDocRef + "secrets/" + secretID.String()
+	doc := map[string]interface{}{"ref": pointer}
+
+	pointers, err := docstore.fetchPointers(doc, 1, 0, nil)
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := pointers[pointer]; !ok {
+		t.Errorf("the pointer should have been resolved: %+v", pointers)
+	}
+
+	// The pointer is left unresolved if the collection cannot be read
+	pointers, err = docstore.fetchPointers(doc, 1, 0, func(collection string) bool {
+		return collection != "secrets"
+	})
+	if err != nil {
+		panic(err)
+	}
+	if _, ok := pointers[pointer]; ok {
+		t.Errorf("the pointer should not have been resolved: %+v", pointers)
+	}
+}
@@ -0,0 +1,166 @@
+package docstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/jsonschema"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// JSON Schemas set via the API are stored in the kv store (an empty value means no schema)
+var schemaKeyFmt = "docstore-schema:%s"
+
+// ErrSchemaFromConfig is returned when trying to update a schema defined in the config
+var ErrSchemaFromConfig = fmt.Errorf("the schema is defined in the config")
+
+// loadConfigSchemas loads the JSON Schemas defined in the config
+func loadConfigSchemas(paths map[string]string) (map[string]*jsonschema.Schema, error) {
+	schemas := map[string]*jsonschema.Schema{}
+	for collection, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		schema, err := jsonschema.New(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load schema for collection %s: %v", collection, err)
+		}
+		schemas[collection] = schema
+	}
+	return schemas, nil
+}
+
+// Schema returns the JSON Schema for the given collection (nil if the collection has no schema)
+func (docstore *DocStore) Schema(collection string) (*jsonschema.Schema, error) {
+	if schema, ok := docstore.confSchemas[collection]; ok {
+		return schema, nil
+	}
+
+	docstore.schemasMu.Lock()
+	defer docstore.schemasMu.Unlock()
+	if schema, ok := docstore.schemas[collection]; ok {
+		return schema, nil
+	}
+
+	var schema *jsonschema.Schema
+	kv, err := docstore.kvStore.Get(context.TODO(), fmt.Sprintf(schemaKeyFmt, collection), -1)
+	switch err {
+	case nil:
+		if len(kv.Data) > 0 {
+			schema, err = jsonschema.New(kv.Data)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case vkv.ErrNotFound:
+	default:
+		return nil, err
+	}
+	docstore.schemas[collection] = schema
+	return schema, nil
+}
+
+// SetSchema sets (or removes if `raw` is empty) the JSON Schema for the given collection
+func (docstore *DocStore) SetSchema(collection string, raw []byte) error {
+	if _, ok := docstore.confSchemas[collection]; ok {
+		return ErrSchemaFromConfig
+	}
+
+	var schema *jsonschema.Schema
+	if len(raw) > 0 {
+		var err error
+		schema, err = jsonschema.New(raw)
+		if err != nil {
+			return httputil.NewPublicErrorFmt("%v", err)
+		}
+	}
+
+	docstore.schemasMu.Lock()
+	defer docstore.schemasMu.Unlock()
+	if _, err := docstore.kvStore.Put(context.TODO(), fmt.Sprintf(schemaKeyFmt, collection), "", raw, -1); err != nil {
+		return err
+	}
+	docstore.schemas[collection] = schema
+	return nil
+}
+
+// validate checks the document against the collection JSON Schema (if any)
+func (docstore *DocStore) validate(collection string, doc map[string]interface{}) error {
+	schema, err := docstore.Schema(collection)
+	if err != nil {
+		return err
+	}
+	if schema == nil {
+		return nil
+	}
+	return schema.Validate(doc)
+}
+
+// HTTP handler for managing the JSON Schema of a collection
+func (docstore *DocStore) schemaHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			if !canCollection(w, r, perms.Read, collection) {
+				return
+			}
+			schema, err := docstore.Schema(collection)
+			if err != nil {
+				panic(err)
+			}
+			if schema == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == "GET" {
+				w.Write(schema.Raw())
+			}
+		case "PUT", "POST", "DELETE":
+			// The schema applies to all the writers, only the admins can change it
+			if !canCollection(w, r, perms.Admin, collection) {
+				return
+			}
+			var raw []byte
+			if r.Method != "DELETE" {
+				var err error
+				raw, err = ioutil.ReadAll(r.Body)
+				if err != nil {
+					panic(err)
+				}
+				if len(raw) == 0 {
+					httputil.WriteJSONError(w, http.StatusBadRequest, "Missing schema")
+					return
+				}
+			}
+			if err := docstore.SetSchema(collection, raw); err != nil {
+				if err == ErrSchemaFromConfig {
+					httputil.WriteJSONError(w, http.StatusConflict, err.Error())
+					return
+				}
+				// The schema cannot be compiled (e.g. invalid pattern or circular reference)
+				if perr, ok := err.(httputil.PublicErrorer); ok {
+					httputil.WriteJSONError(w, http.StatusUnprocessableEntity, perr.Error())
+					return
+				}
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
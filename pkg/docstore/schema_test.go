@@ -0,0 +1,73 @@
+package docstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/perms"
+)
+
+func TestSchemaHandlerPerms(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, nil)
+	defer cleanup()
+
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	resource := perms.ResourceWithID(perms.DocStore, perms.Collection, "notes")
+	if err := auth.Setup(&config.Config{
+		Roles: []*config.Role{
+			&config.Role{Name: "schema-test-writer", Perms: []*config.Perm{
+				&config.Perm{Action: perms.Action(perms.Read, perms.Collection), Resource: resource},
+				&config.Perm{Action: perms.Action(perms.Write, perms.Collection), Resource: resource},
+			}},
+			&config.Role{Name: "schema-test-admin", Perms: []*config.Perm{
+				&config.Perm{Action: perms.Action(perms.Admin, perms.Collection), Resource: resource},
+			}},
+		},
+		Auth: []*config.BasicAuth{
+			&config.BasicAuth{ID: "writer", Roles: []string{"schema-test-writer"}, Username: "writer", Password: "writer"},
+			&config.BasicAuth{ID: "admin", Roles: []string{"schema-test-admin"}, Username: "admin", Password: "admin"},
+		},
+	}, logger); err != nil {
+		panic(err)
+	}
+
+	request := func(user, method, body string) int {
+		r := httptest.NewRequest(method, "/notes/_schema", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"collection": "notes"})
+		r.SetBasicAuth(user, user)
+		if !auth.Check(r) {
+			t.Fatalf("auth failed for %s", user)
+		}
+		w := httptest.NewRecorder()
+		docstore.schemaHandler()(w, r)
+		return w.Code
+	}
+	schema := `{"type": "object", "required": ["title"]}`
+
+	// A writer cannot change the schema
+	for _, method := range []string{"PUT", "DELETE"} {
+		if status := request("writer", method, schema); status != http.StatusForbidden {
+			t.Errorf("%s by a writer: expected 403, got %d", method, status)
+		}
+	}
+	if status := request("admin", "PUT", schema); status != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", status)
+	}
+	if status := request("writer", "DELETE", ""); status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", status)
+	}
+	if status := request("writer", "GET", ""); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+	if status := request("admin", "DELETE", ""); status != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", status)
+	}
+}
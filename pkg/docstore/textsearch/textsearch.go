@@ -0,0 +1,509 @@
+/*
+
+Package textsearch implements a basic full-text inverted index for the document store.
+
+The index is stored locally (in a `rangedb`) and can always be rebuilt from the documents.
+
+For each indexed doc:
+
+	IndexPosting + {collection} + 0x00 + {term} + 0x00 + {_id} => {term frequency}
+	IndexDoc + {collection} + 0x00 + {_id} => msgpack encoded `docEntry` (needed to update/remove the postings)
+	IndexStats + {collection} => msgpack encoded `colStats` (needed for the ranking)
+
+And for each indexed collection:
+
+	IndexState + {collection} => msgpack encoded list of the indexed fields (used to detect the collections to rebuild)
+
+Terms are extracted using a word segmenter and stemmed (Porter stemmer), results are ranked using BM25.
+
+*/
+package textsearch // import "a4.io/blobstash/pkg/docstore/textsearch"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/segment"
+	"github.com/reiver/go-porterstemmer"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/docstore/maputil"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Define namespaces for raw key sorted in db.
+const (
+	Empty byte = iota
+	IndexPosting
+	IndexDoc
+	IndexStats
+	IndexState
+)
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+const (
+	highlightStart = "<em>"
+	highlightEnd   = "</em>"
+
+	// Max length (in bytes) of the highlighted snippet
+	snippetSize = 160
+)
+
+type docEntry struct {
+	Terms  map[string]int `msgpack:"t"`
+	Length int            `msgpack:"l"`
+}
+
+type colStats struct {
+	Docs        int `msgpack:"d"`
+	TotalLength int `msgpack:"l"`
+}
+
+// Result holds a matched document ID along with its score
+type Result struct {
+	ID    string
+	Score float64
+}
+
+// Index holds the full-text index for all the collections
+type Index struct {
+	db *rangedb.RangeDB
+	mu sync.Mutex
+}
+
+// New opens (or creates) the index at the given path
+func New(path string) (*Index, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the underlying DB
+func (idx *Index) Close() error {
+	return idx.db.Close()
+}
+
+func encodeKey(ns byte, parts ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(ns)
+	for i, p := range parts {
+		if i > 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(p)
+	}
+	return buf.Bytes()
+}
+
+func postingPrefix(collection, term string) []byte {
+	return append(encodeKey(IndexPosting, collection, term), 0)
+}
+
+// Tokenize splits the text into stemmed terms, and returns the number of occurrences for each term
+func Tokenize(text string) (map[string]int, int, error) {
+	out := map[string]int{}
+	var length int
+	segmenter := segment.NewWordSegmenter(strings.NewReader(text))
+	for segmenter.Segment() {
+		if segmenter.Type() == segment.Letter || segmenter.Type() == segment.Number {
+			out[porterstemmer.StemString(segmenter.Text())]++
+			length++
+		}
+	}
+	if err := segmenter.Err(); err != nil {
+		return nil, 0, err
+	}
+	return out, length, nil
+}
+
+// FieldsText extracts the text of the given fields (using the dotted notation for nested fields)
+func FieldsText(doc map[string]interface{}, fields []string) map[string]string {
+	out := map[string]string{}
+	for _, field := range fields {
+		val, err := maputil.GetPath(field, doc)
+		if err != nil {
+			continue
+		}
+		switch v := val.(type) {
+		case string:
+			out[field] = v
+		case []interface{}:
+			parts := []string{}
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					parts = append(parts, s)
+				}
+			}
+			out[field] = strings.Join(parts, " ")
+		}
+	}
+	return out
+}
+
+func (idx *Index) getStats(collection string) (*colStats, error) {
+	stats := &colStats{}
+	data, err := idx.db.Get(encodeKey(IndexStats, collection))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		if err := msgpack.Unmarshal(data, stats); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func (idx *Index) putStats(collection string, stats *colStats) error {
+	encoded, err := msgpack.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return idx.db.Set(encodeKey(IndexStats, collection), encoded)
+}
+
+// remove deletes the postings of the given document, must be called with the lock held
+func (idx *Index) remove(collection, _id string, stats *colStats) error {
+	dkey := encodeKey(IndexDoc, collection, _id)
+	data, err := idx.db.Get(dkey)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		// The document is not indexed
+		return nil
+	}
+	entry := &docEntry{}
+	if err := msgpack.Unmarshal(data, entry); err != nil {
+		return err
+	}
+	for term := range entry.Terms {
+		if err := idx.db.Delete(append(postingPrefix(collection, term), []byte(_id)...)); err != nil {
+			return err
+		}
+	}
+	stats.Docs--
+	stats.TotalLength -= entry.Length
+	return idx.db.Delete(dkey)
+}
+
+// Index (re-)indexes the given fields of the document
+func (idx *Index) Index(collection, _id string, doc map[string]interface{}, fields []string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	stats, err := idx.getStats(collection)
+	if err != nil {
+		return err
+	}
+
+	// Remove the previous version of the doc if any
+	if err := idx.remove(collection, _id, stats); err != nil {
+		return err
+	}
+
+	entry := &docEntry{Terms: map[string]int{}}
+	for _, text := range FieldsText(doc, fields) {
+		terms, length, err := Tokenize(text)
+		if err != nil {
+			return err
+		}
+		for term, cnt := range terms {
+			entry.Terms[term] += cnt
+		}
+		entry.Length += length
+	}
+
+	if len(entry.Terms) > 0 {
+		buf := make([]byte, binary.MaxVarintLen64)
+		for term, cnt := range entry.Terms {
+			n := binary.PutUvarint(buf, uint64(cnt))
+			if err := idx.db.Set(append(postingPrefix(collection, term), []byte(_id)...), buf[:n]); err != nil {
+				return err
+			}
+		}
+		encoded, err := msgpack.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := idx.db.Set(encodeKey(IndexDoc, collection, _id), encoded); err != nil {
+			return err
+		}
+		stats.Docs++
+		stats.TotalLength += entry.Length
+	}
+
+	return idx.putStats(collection, stats)
+}
+
+// Remove removes the document from the index
+func (idx *Index) Remove(collection, _id string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	stats, err := idx.getStats(collection)
+	if err != nil {
+		return err
+	}
+	if err := idx.remove(collection, _id, stats); err != nil {
+		return err
+	}
+	return idx.putStats(collection, stats)
+}
+
+// Stats holds the size of the index for a single collection
+type Stats struct {
+	Docs     int   `json:"docs"`
+	Postings int   `json:"postings"`
+	Size     int64 `json:"size"`
+}
+
+// iterCollection calls `fn` for each raw key/value of the collection, must be called with the lock held
+func (idx *Index) iterCollection(collection string, fn func(ns byte, k, v []byte) error) error {
+	for _, ns := range []byte{IndexPosting, IndexDoc} {
+		c := idx.db.PrefixRange(append(encodeKey(ns, collection), 0), false)
+		k, v, err := c.Next()
+		for ; err == nil; k, v, err = c.Next() {
+			if err := fn(ns, k, v); err != nil {
+				c.Close()
+				return err
+			}
+		}
+		c.Close()
+		if err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the index stats for the given collection
+func (idx *Index) Stats(collection string) (*Stats, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	stats := &Stats{}
+	if err := idx.iterCollection(collection, func(ns byte, k, v []byte) error {
+		if ns == IndexPosting {
+			stats.Postings++
+		} else {
+			stats.Docs++
+		}
+		stats.Size += int64(len(k) + len(v))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Fields returns the fields the collection has been fully indexed with (nil if the collection has never been fully
+// indexed)
+func (idx *Index) Fields(collection string) ([]string, error) {
+	data, err := idx.db.Get(encodeKey(IndexState, collection))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	fields := []string{}
+	if err := msgpack.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// SetFields marks the collection as fully indexed with the given fields
+func (idx *Index) SetFields(collection string, fields []string) error {
+	encoded, err := msgpack.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return idx.db.Set(encodeKey(IndexState, collection), encoded)
+}
+
+// Drop removes all the index entries for the given collection
+func (idx *Index) Drop(collection string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys := [][]byte{encodeKey(IndexStats, collection), encodeKey(IndexState, collection)}
+	if err := idx.iterCollection(collection, func(_ byte, k, _ []byte) error {
+		keys = append(keys, k)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := idx.db.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search returns the IDs of the documents matching at least one term of the query, sorted by score
+func (idx *Index) Search(collection, query string) ([]*Result, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	terms, _, err := Tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := idx.getStats(collection)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Docs == 0 {
+		return []*Result{}, nil
+	}
+	avgdl := float64(stats.TotalLength) / float64(stats.Docs)
+
+	docLengths := map[string]int{}
+	scores := map[string]float64{}
+	for term := range terms {
+		prefix := postingPrefix(collection, term)
+		postings := map[string]int{}
+		rg := idx.db.PrefixRange(prefix, false)
+		for {
+			k, v, err := rg.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			tf, _ := binary.Uvarint(v)
+			postings[string(k[len(prefix):])] = int(tf)
+		}
+		rg.Close()
+
+		df := float64(len(postings))
+		idf := math.Log(1 + (float64(stats.Docs)-df+0.5)/(df+0.5))
+		for _id, tf := range postings {
+			dl, ok := docLengths[_id]
+			if !ok {
+				dl, err = idx.docLength(collection, _id)
+				if err != nil {
+					return nil, err
+				}
+				docLengths[_id] = dl
+			}
+			ftf := float64(tf)
+			scores[_id] += idf * (ftf * (k1 + 1)) / (ftf + k1*(1-b+b*float64(dl)/avgdl))
+		}
+	}
+
+	results := []*Result{}
+	for _id, score := range scores {
+		results = append(results, &Result{ID: _id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			// Most recent docs first
+			return results[i].ID > results[j].ID
+		}
+		return results[i].Score > results[j].Score
+	})
+	return results, nil
+}
+
+func (idx *Index) docLength(collection, _id string) (int, error) {
+	data, err := idx.db.Get(encodeKey(IndexDoc, collection, _id))
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		return 0, fmt.Errorf("missing doc entry for %s/%s", collection, _id)
+	}
+	entry := &docEntry{}
+	if err := msgpack.Unmarshal(data, entry); err != nil {
+		return 0, err
+	}
+	return entry.Length, nil
+}
+
+// Highlight returns an HTML snippet of the text where the terms matching the query are wrapped in an `<em>` tag,
+// returns an empty string if nothing matched
+func Highlight(text, query string) (string, error) {
+	qterms, _, err := Tokenize(query)
+	if err != nil {
+		return "", err
+	}
+
+	type token struct {
+		start, end int
+		match      bool
+	}
+	tokens := []*token{}
+	firstMatch := -1
+	var offset int
+	segmenter := segment.NewWordSegmenter(strings.NewReader(text))
+	for segmenter.Segment() {
+		l := len(segmenter.Bytes())
+		t := &token{start: offset, end: offset + l}
+		if segmenter.Type() == segment.Letter || segmenter.Type() == segment.Number {
+			if _, ok := qterms[porterstemmer.StemString(segmenter.Text())]; ok {
+				t.match = true
+				if firstMatch == -1 {
+					firstMatch = offset
+				}
+			}
+		}
+		tokens = append(tokens, t)
+		offset += l
+	}
+	if err := segmenter.Err(); err != nil {
+		return "", err
+	}
+	if firstMatch == -1 {
+		return "", nil
+	}
+
+	// Select a window around the first match
+	start := firstMatch - snippetSize/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetSize
+
+	var buf bytes.Buffer
+	if start > 0 {
+		buf.WriteString("…")
+	}
+	var truncated bool
+	for _, t := range tokens {
+		if t.end <= start {
+			continue
+		}
+		if t.start >= end {
+			truncated = true
+			break
+		}
+		if t.match {
+			buf.WriteString(highlightStart)
+			buf.WriteString(html.EscapeString(text[t.start:t.end]))
+			buf.WriteString(highlightEnd)
+		} else {
+			buf.WriteString(html.EscapeString(text[t.start:t.end]))
+		}
+	}
+	if truncated {
+		buf.WriteString("…")
+	}
+	return buf.String(), nil
+}
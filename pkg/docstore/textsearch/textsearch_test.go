@@ -0,0 +1,108 @@
+package textsearch
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx, err := New("db_textsearch")
+	check(err)
+	defer os.RemoveAll("db_textsearch")
+	defer idx.Close()
+
+	fields := []string{"title", "meta.tags"}
+	check(idx.Index("notes", "1", map[string]interface{}{"title": "Running with the dogs"}, fields))
+	check(idx.Index("notes", "2", map[string]interface{}{"title": "A cat", "meta": map[string]interface{}{"tags": []interface{}{"dog"}}}, fields))
+	check(idx.Index("notes", "3", map[string]interface{}{"title": "Nothing to see here"}, fields))
+	check(idx.Index("other", "4", map[string]interface{}{"title": "dog"}, fields))
+
+	res, err := idx.Search("notes", "dog")
+	check(err)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	// The shortest doc should be ranked first
+	if res[0].ID != "2" || res[1].ID != "1" {
+		t.Errorf("bad ranking, got %s, %s", res[0].ID, res[1].ID)
+	}
+
+	// Re-index the doc without the term
+	check(idx.Index("notes", "2", map[string]interface{}{"title": "A cat"}, fields))
+	res, err = idx.Search("notes", "dogs")
+	check(err)
+	if len(res) != 1 || res[0].ID != "1" {
+		t.Errorf("expected only doc 1 to match, got %+v", res)
+	}
+
+	check(idx.Remove("notes", "1"))
+	res, err = idx.Search("notes", "dog")
+	check(err)
+	if len(res) != 0 {
+		t.Errorf("expected no results, got %+v", res)
+	}
+
+	stats, err := idx.Stats("notes")
+	check(err)
+	if stats.Docs != 2 || stats.Postings != 6 {
+		t.Errorf("bad stats, got %+v", stats)
+	}
+
+	// Track the collections that have been fully indexed
+	indexed, err := idx.Fields("notes")
+	check(err)
+	if indexed != nil {
+		t.Errorf("the collection should not be marked as indexed, got %v", indexed)
+	}
+	check(idx.SetFields("notes", fields))
+	indexed, err = idx.Fields("notes")
+	check(err)
+	if strings.Join(indexed, ",") != "title,meta.tags" {
+		t.Errorf("bad indexed fields, got %v", indexed)
+	}
+
+	// Dropping a collection must not affect the other ones
+	check(idx.Drop("notes"))
+	indexed, err = idx.Fields("notes")
+	check(err)
+	if indexed != nil {
+		t.Errorf("the dropped collection should not be marked as indexed, got %v", indexed)
+	}
+	stats, err = idx.Stats("notes")
+	check(err)
+	if stats.Docs != 0 || stats.Postings != 0 || stats.Size != 0 {
+		t.Errorf("expected an empty index, got %+v", stats)
+	}
+	res, err = idx.Search("other", "dog")
+	check(err)
+	if len(res) != 1 {
+		t.Errorf("expected 1 result, got %+v", res)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	out, err := Highlight("Running with the dogs <3", "run dog")
+	check(err)
+	if out != "<em>Running</em> with the <em>dogs</em> &lt;3" {
+		t.Errorf("bad highlight, got %q", out)
+	}
+
+	out, err = Highlight(strings.Repeat("lorem ipsum ", 50)+"dog", "dog")
+	check(err)
+	if !strings.HasPrefix(out, "…") || !strings.HasSuffix(out, "<em>dog</em>") {
+		t.Errorf("bad highlight, got %q", out)
+	}
+
+	out, err = Highlight("nothing", "dog")
+	check(err)
+	if out != "" {
+		t.Errorf("expected no highlight, got %q", out)
+	}
+}
@@ -0,0 +1,316 @@
+package docstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/docstore/id"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// ErrNotDeleted is returned when trying to undelete a doc that is not deleted
+var ErrNotDeleted = errors.New("document is not deleted")
+
+// Deleted returns the deleted docs of the collection (most recent _id first), along with the cursor for the next page
+func (docstore *DocStore) Deleted(collection, cursor string, limit int) ([]map[string]interface{}, string, error) {
+	start := fmt.Sprintf(keyFmt, collection, "\xff")
+	if cursor != "" {
+		start = fmt.Sprintf(keyFmt, collection, cursor)
+	}
+	end := fmt.Sprintf(keyFmt, collection, "")
+
+	out := []map[string]interface{}{}
+	var lastID string
+	for {
+		res, nextStart, err := docstore.kvStore.ReverseKeys(context.TODO(), end, start, 100)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, kv := range res {
+			_id, err := idFromKey(collection, kv.Key)
+			if err != nil {
+				return nil, "", err
+			}
+			lastID = _id.String()
+			if len(kv.Data) == 0 || kv.Data[0] != flagDeleted {
+				continue
+			}
+			out = append(out, map[string]interface{}{
+				"_id":      _id.String(),
+				"_created": time.Unix(0, _id.Ts()).UTC().Format(time.RFC3339),
+				"_deleted": time.Unix(0, kv.Version).UTC().Format(time.RFC3339),
+				"_version": strconv.FormatInt(kv.Version, 10),
+			})
+			if len(out) == limit {
+				return out, vkv.PrevKey(lastID), nil
+			}
+		}
+		if len(res) < 100 {
+			break
+		}
+		start = nextStart
+	}
+	return out, "", nil
+}
+
+// Undelete writes a new version of a deleted doc, equal to its last non-deleted version
+func (docstore *DocStore) Undelete(collection, sid string) (*id.ID, error) {
+	_id, err := id.FromHex(sid)
+	if err != nil {
+		return nil, ErrDocNotFound
+	}
+	key := fmt.Sprintf(keyFmt, collection, sid)
+	kv, err := docstore.kvStore.Get(context.TODO(), key, -1)
+	if err != nil {
+		if err == vkv.ErrNotFound {
+			return nil, ErrDocNotFound
+		}
+		return nil, err
+	}
+	if len(kv.Data) == 0 || kv.Data[0] != flagDeleted {
+		return nil, ErrNotDeleted
+	}
+
+	// Iterate the versions (most recent first) to find the last non-deleted one
+	var doc map[string]interface{}
+	start := "0"
+VERSIONS:
+	for {
+		kvv, cursor, err := docstore.kvStore.Versions(context.TODO(), key, start, 50)
+		if err != nil {
+			if err == vkv.ErrNotFound {
+				break
+			}
+			return nil, err
+		}
+		for _, v := range kvv.Versions {
+			if len(v.Data) == 0 || v.Data[0] == flagDeleted {
+				continue
+			}
+			doc = map[string]interface{}{}
+			if err := docstore.decodeDoc(sid, v.Data[1:], &doc); err != nil {
+				return nil, err
+			}
+			break VERSIONS
+		}
+		if len(kvv.Versions) < 50 || cursor == "" || cursor == "0" {
+			break
+		}
+		start = cursor
+	}
+	if doc == nil {
+		return nil, ErrDocNotFound
+	}
+
+	// The restored doc must still match the collection schema
+	if err := docstore.validate(collection, doc); err != nil {
+		return nil, err
+	}
+
+	_id.SetFlag(flagNoop)
+	dw := &docWrite{
+		collection: collection,
+		op:         ChangeUndelete,
+		_id:        _id,
+		doc:        doc,
+		version:    -1,
+	}
+	if err := docstore.commit(dw); err != nil {
+		return nil, err
+	}
+	return dw._id, nil
+}
+
+// Purge erases all the versions of the doc.
+//
+// The blobstore is append-only, the blobs of the versions cannot be removed, only the docs of the collections listed
+// in `purgeable_collections` can be purged: they're encrypted using a per-doc key, and the key is deleted (making the
+// blobs unreadable). Returns `ErrNotPurgeable` if any version of the doc is not encrypted (e.g. the doc was written
+// before the collection was made purgeable).
+func (docstore *DocStore) Purge(collection, sid string) (int, error) {
+	if _, err := id.FromHex(sid); err != nil {
+		return 0, ErrDocNotFound
+	}
+	key := fmt.Sprintf(keyFmt, collection, sid)
+
+	// Ensure all the versions can be erased before removing anything
+	if err := docstore.checkErasable(key); err != nil {
+		if err == vkv.ErrNotFound {
+			return 0, ErrDocNotFound
+		}
+		return 0, err
+	}
+
+	var n int
+	if err := docstore.notifyChange(collection, ChangePurge, sid, 0, nil, func() error {
+		if docstore.keys != nil {
+			if err := docstore.keys.delete(sid); err != nil {
+				return err
+			}
+		}
+		var err error
+		n, err = docstore.kvStore.Purge(context.TODO(), key)
+		if err == vkv.ErrNotFound {
+			return ErrDocNotFound
+		}
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	if err := docstore.indexText(collection, sid, nil); err != nil {
+		docstore.logger.Error("failed to update the full-text index", "collection", collection, "_id", sid, "err", err)
+	}
+	return n, nil
+}
+
+// HTTP handler for listing the deleted docs of a collection
+func (docstore *DocStore) deletedHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Read, collection) {
+			return
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		limit, err := q.GetIntDefault("limit", 50)
+		if err != nil {
+			httputil.Error(w, err)
+			return
+		}
+
+		docs, cursor, err := docstore.Deleted(collection, q.Get("cursor"), limit)
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"data": docs,
+			"pagination": map[string]interface{}{
+				"cursor":   cursor,
+				"has_more": cursor != "",
+				"count":    len(docs),
+				"per_page": limit,
+			},
+		})
+	}
+}
+
+// HTTP handler for restoring the last non-deleted version of a deleted doc
+func (docstore *DocStore) docUndeleteHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		sid := vars["_id"]
+		if sid == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing _id in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Write, collection) {
+			return
+		}
+
+		docstore.locker.Lock(sid)
+		defer docstore.locker.Unlock(sid)
+
+		_id, err := docstore.Undelete(collection, sid)
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", _id.VersionString())
+		w.Header().Set("BlobStash-DocStore-Doc-Id", _id.String())
+		w.Header().Set("BlobStash-DocStore-Doc-Version", _id.VersionString())
+		w.Header().Set("BlobStash-DocStore-Doc-CreatedAt", strconv.FormatInt(_id.Ts(), 10))
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"_id":      _id.String(),
+			"_created": time.Unix(0, _id.Ts()).UTC().Format(time.RFC3339),
+			"_version": _id.VersionString(),
+		})
+	}
+}
+
+// HTTP handler for removing all the versions of a doc
+func (docstore *DocStore) docPurgeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		collection := vars["collection"]
+		if collection == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing collection in the URL")
+			return
+		}
+		sid := vars["_id"]
+		if sid == "" {
+			httputil.WriteJSONError(w, http.StatusInternalServerError, "Missing _id in the URL")
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !canCollection(w, r, perms.Destroy, collection) {
+			return
+		}
+
+		docstore.locker.Lock(sid)
+		defer docstore.locker.Unlock(sid)
+
+		n, err := docstore.Purge(collection, sid)
+		if err != nil {
+			writeDocError(w, r, err)
+			return
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"_id":             sid,
+			"purged_versions": n,
+		})
+	}
+}
+
+// checkErasable returns `ErrNotPurgeable` if any version of the doc stored at key is not encrypted
+func (docstore *DocStore) checkErasable(key string) error {
+	start := "0"
+	for {
+		kvv, cursor, err := docstore.kvStore.Versions(context.TODO(), key, start, 50)
+		if err != nil {
+			return err
+		}
+		for _, v := range kvv.Versions {
+			if !isEncrypted(v.Data) {
+				return ErrNotPurgeable
+			}
+		}
+		if len(kvv.Versions) < 50 || cursor == "" || cursor == "0" {
+			return nil
+		}
+		start = cursor
+	}
+}
@@ -0,0 +1,85 @@
+package docstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+func TestPurge(t *testing.T) {
+	docstore, cleanup := newTestDocStore(t, &config.Config{
+		Docstore: &config.DocstoreConfig{PurgeableCollections: []string{"secrets"}},
+	})
+	defer cleanup()
+
+	// The docs of the non-purgeable collections cannot be erased
+	notes := map[string]interface{}{"content": "hello"}
+	noteID, err := docstore.Insert("notes", &notes)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := docstore.Purge("notes", noteID.String()); err != ErrNotPurgeable {
+		t.Errorf("expected ErrNotPurgeable, got %v", err)
+	}
+	if _, _, err := docstore.fetchLatest("notes", noteID.String()); err != nil {
+		t.Errorf("the doc should not have been purged: %v", err)
+	}
+
+	doc := map[string]interface{}{"content": "s3cr3t"}
+	_id, err := docstore.Insert("secrets", &doc)
+	if err != nil {
+		panic(err)
+	}
+	sid := _id.String()
+	dw, err := docstore.prepareUpdate("secrets", sid, map[string]interface{}{"content": "s3cr3t2"}, "")
+	if err != nil {
+		panic(err)
+	}
+	if err := docstore.commit(dw); err != nil {
+		panic(err)
+	}
+
+	// The versions are encrypted
+	key := fmt.Sprintf(keyFmt, "secrets", sid)
+	kvv, _, err := docstore.kvStore.Versions(context.TODO(), key, "0", 10)
+	if err != nil {
+		panic(err)
+	}
+	if len(kvv.Versions) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(kvv.Versions))
+	}
+	for _, v := range kvv.Versions {
+		if !isEncrypted(v.Data) || bytes.Contains(v.Data, []byte("s3cr3t")) {
+			t.Errorf("version is not encrypted: %q", v.Data)
+		}
+	}
+	if _, doc, err := docstore.fetchLatest("secrets", sid); err != nil || doc["content"] != "s3cr3t2" {
+		t.Errorf("bad doc %+v %v", doc, err)
+	}
+
+	n, err := docstore.Purge("secrets", sid)
+	if err != nil {
+		panic(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 purged versions, got %d", n)
+	}
+	if _, _, err := docstore.fetchLatest("secrets", sid); err != ErrDocNotFound {
+		t.Errorf("expected ErrDocNotFound, got %v", err)
+	}
+
+	// The data left in the blobstore cannot be decrypted anymore
+	for _, v := range kvv.Versions {
+		out := map[string]interface{}{}
+		if err := docstore.decodeDoc(sid, v.Data[1:], &out); err != vkv.ErrNotFound {
+			t.Errorf("expected vkv.ErrNotFound, got %v (%+v)", err, out)
+		}
+	}
+	if _, err := docstore.Purge("secrets", sid); err != ErrDocNotFound {
+		t.Errorf("expected ErrDocNotFound, got %v", err)
+	}
+}
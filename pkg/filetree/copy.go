@@ -0,0 +1,303 @@
+package filetree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/client/clientutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+var (
+	errNotDir         = errors.New("not a directory")
+	errNotFound       = errors.New("path not found")
+	errBadDestination = errors.New("invalid destination")
+)
+
+func splitPath(p string) []string {
+	parts := []string{}
+	for _, part := range strings.Split(p, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// SetPath returns a new version of the dir where the node at the given path is replaced by `n` (or removed if `n` is
+// nil), the missing intermediate dirs are created. All the modified dirs are saved, but the new root is not committed.
+// Since the nodes are content-addressed, no content is copied (only the modified dirs are re-encoded).
+func (ft *FileTree) SetPath(ctx context.Context, dir *rnode.RawNode, path string, n *rnode.RawNode, mtime int64) (*rnode.RawNode, error) {
+	parts := splitPath(path)
+	if len(parts) == 0 {
+		return nil, errBadDestination
+	}
+	return ft.setPath(ctx, dir, parts, n, mtime)
+}
+
+func (ft *FileTree) setPath(ctx context.Context, dir *rnode.RawNode, parts []string, n *rnode.RawNode, mtime int64) (*rnode.RawNode, error) {
+	if dir.Type != rnode.Dir {
+		return nil, errNotDir
+	}
+	newDir := *dir
+	refs := []interface{}{}
+	var child *rnode.RawNode
+	for _, ref := range dir.Refs {
+		data, err := ft.blobStore.Get(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		c, err := rnode.NewNodeFromBlob(ref.(string), data)
+		if err != nil {
+			return nil, err
+		}
+		if c.Name == parts[0] {
+			child = c
+			continue
+		}
+		refs = append(refs, ref)
+	}
+
+	if len(parts) == 1 {
+		if n == nil && child == nil {
+			return nil, errNotFound
+		}
+		if n != nil {
+			newChild := *n
+			newChild.Name = parts[0]
+			if err := ft.putNode(ctx, &newChild); err != nil {
+				return nil, err
+			}
+			refs = append(refs, newChild.Hash)
+		}
+		// Only the mtime of the direct parent is updated (like for a regular update)
+		newDir.ModTime = mtime
+		newDir.ChangeTime = 0
+	} else {
+		if child == nil {
+			if n == nil {
+				return nil, errNotFound
+			}
+			child = &rnode.RawNode{
+				Type:    rnode.Dir,
+				Version: rnode.V1,
+				Name:    parts[0],
+				ModTime: mtime,
+			}
+		}
+		newChild, err := ft.setPath(ctx, child, parts[1:], n, mtime)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, newChild.Hash)
+	}
+
+	newDir.Refs = refs
+	if err := ft.putNode(ctx, &newDir); err != nil {
+		return nil, err
+	}
+	return &newDir, nil
+}
+
+func (ft *FileTree) putNode(ctx context.Context, n *rnode.RawNode) error {
+	hash, data := n.Encode()
+	if err := ft.blobStore.Put(ctx, &blob.Blob{Hash: hash, Data: data}); err != nil {
+		return err
+	}
+	n.Hash = hash
+	return nil
+}
+
+// isInside returns true if `p` is `dir` or a sub-path of `dir`
+func isInside(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// parseDestination parses the WebDAV-style `Destination` header (an absolute URL or path pointing to the FS API), and
+// returns the destination FS and path
+func parseDestination(r *http.Request) (string, string, error) {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return "", "", errBadDestination
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", "", errBadDestination
+	}
+	// The API prefix is the part of the request path before the FS route
+	vars := mux.Vars(r)
+	route := "/fs/" + vars["type"] + "/" + vars["name"]
+	i := strings.Index(r.URL.Path, route)
+	if i == -1 {
+		return "", "", errBadDestination
+	}
+	prefix := r.URL.Path[:i] + "/fs/fs/"
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", "", errBadDestination
+	}
+	rest := strings.SplitN(u.Path[len(prefix):], "/", 2)
+	if len(rest) != 2 || rest[0] == "" {
+		return "", "", errBadDestination
+	}
+	p := gopath.Clean("/" + rest[1])
+	if p == "/" {
+		return "", "", errBadDestination
+	}
+	return rest[0], p, nil
+}
+
+// copyMove handles the COPY/MOVE requests: the node is relinked at the destination path (optionally in another
+// FS), a single FS version is created (one per FS for a move across FS). The source can be read from a past version
+// of the FS (using `as_of`) when copying.
+func (ft *FileTree) copyMove(ctx context.Context, w http.ResponseWriter, r *http.Request, fs *FS, path, destName, destPath, prefixFmt string, mtime int64) {
+	if fs.Name == "" {
+		httputil.WriteJSONError(w, http.StatusBadRequest, "Only FS nodes can be copied or moved")
+		return
+	}
+	move := r.Method == "MOVE"
+	if move && path == "/" {
+		httputil.WriteJSONError(w, http.StatusBadRequest, "Cannot move the root")
+		return
+	}
+	if move && fs.AsOf > 0 {
+		httputil.WriteJSONError(w, http.StatusBadRequest, "Cannot move a node from a past version")
+		return
+	}
+	if mtime == 0 {
+		mtime = time.Now().Unix()
+	}
+	overwrite := r.Header.Get("Overwrite") != "F"
+
+	sameFS := destName == fs.Name
+	if sameFS && isInside(destPath, path) {
+		httputil.WriteJSONError(w, http.StatusForbidden, "The destination cannot be inside the source")
+		return
+	}
+	if move && sameFS && isInside(path, destPath) {
+		httputil.WriteJSONError(w, http.StatusForbidden, "Cannot move a node to one of its parents")
+		return
+	}
+	if !sameFS && !auth.Can(
+		w,
+		r,
+		perms.Action(perms.Write, perms.FS),
+		perms.ResourceWithID(perms.Filetree, perms.FS, destName),
+	) {
+		auth.Forbidden(w)
+		return
+	}
+
+	node, _, _, err := fs.Path(ctx, path, 1, false, 0)
+	switch err {
+	case nil:
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	default:
+		panic(err)
+	}
+	if hash := r.Header.Get("If-Match"); hash != "" && node.Hash != hash {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	// The destination is always the latest version
+	destFS, err := ft.FS(ctx, destName, prefixFmt, false, 0)
+	if err != nil {
+		panic(err)
+	}
+	var exists bool
+	if _, _, _, err := destFS.Path(ctx, destPath, 1, false, 0); err == nil {
+		exists = true
+	} else if err != clientutil.ErrBlobNotFound && err != blobsfile.ErrBlobNotFound {
+		panic(err)
+	}
+	if exists && !overwrite {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	destRoot, err := destFS.Root(ctx, true, mtime)
+	if err != nil {
+		panic(err)
+	}
+	newRoot, err := ft.SetPath(ctx, destRoot.Meta, destPath, node.Meta, mtime)
+	if err == nil && move && sameFS {
+		newRoot, err = ft.SetPath(ctx, newRoot, path, nil, mtime)
+	}
+	switch err {
+	case nil:
+	case errNotDir:
+		httputil.WriteJSONError(w, http.StatusConflict, "A parent of the destination is not a directory")
+		return
+	default:
+		panic(err)
+	}
+	_, revision, err := ft.Update(ctx, destRoot, newRoot, prefixFmt, true)
+	if err != nil {
+		panic(err)
+	}
+
+	op := "copied"
+	if move {
+		op = "moved"
+	}
+	events := []*FSUpdateEvent{{
+		Name:      destName,
+		Type:      fmt.Sprintf("%s-%s", node.Type, op),
+		Ref:       node.Hash,
+		Path:      destPath[1:],
+		Time:      time.Now().UTC().Unix(),
+		SessionID: httputil.GetSessionID(r),
+	}}
+
+	// Remove the source (in its own FS version) when moving across FS
+	if move && !sameFS {
+		srcRoot, err := fs.Root(ctx, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		newSrcRoot, err := ft.SetPath(ctx, srcRoot.Meta, path, nil, mtime)
+		if err != nil {
+			panic(err)
+		}
+		if _, _, err := ft.Update(ctx, srcRoot, newSrcRoot, prefixFmt, true); err != nil {
+			panic(err)
+		}
+		events = append(events, &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      fmt.Sprintf("%s-deleted", node.Type),
+			Ref:       node.Hash,
+			Path:      path[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		})
+	}
+
+	for _, updateEvent := range events {
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+	}
+
+	w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,82 @@
+package filetree
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func TestSetPath(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	ft := &FileTree{blobStore: bs}
+	docs := bs.dir("docs", bs.file("a.txt", "a"), bs.dir("sub", bs.file("b.txt", "b")))
+	root := bs.dir("_root", docs, bs.file("c.txt", "c"))
+
+	// Copy the dir to a new path (the intermediate dir is created)
+	newRoot, err := ft.SetPath(context.TODO(), root, "/backup/docs2", docs, 10)
+	if err != nil {
+		panic(err)
+	}
+	// Then remove the source (i.e. a move)
+	newRoot, err = ft.SetPath(context.TODO(), newRoot, "/docs", nil, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	pr := newPathResolver(context.TODO(), ft)
+	for p, expected := range map[string]string{
+		"docs":                   "",
+		"c.txt":                  bs.file("c.txt", "c").Hash,
+		"backup/docs2/a.txt":     bs.file("a.txt", "a").Hash,
+		"backup/docs2/sub/b.txt": bs.file("b.txt", "b").Hash,
+		"backup/docs2/sub":       docs.Refs[1].(string),
+	} {
+		got, err := pr.resolve(newRoot.Hash, splitPath(p))
+		if err != nil {
+			panic(err)
+		}
+		if got != expected {
+			t.Errorf("bad node at %s, got %q, expected %q", p, got, expected)
+		}
+	}
+	backup, err := pr.node(newRoot.Refs[1].(string))
+	if err != nil {
+		panic(err)
+	}
+	if backup.Name != "backup" || backup.Type != rnode.Dir || backup.ModTime != 10 {
+		t.Errorf("bad intermediate dir %+v", backup)
+	}
+
+	// Errors
+	if _, err := ft.SetPath(context.TODO(), root, "/c.txt/d.txt", docs, 10); err != errNotDir {
+		t.Errorf("expected errNotDir, got %v", err)
+	}
+	if _, err := ft.SetPath(context.TODO(), root, "/nope/d.txt", nil, 10); err != errNotFound {
+		t.Errorf("expected errNotFound, got %v", err)
+	}
+}
+
+func TestParseDestination(t *testing.T) {
+	for _, tc := range []struct {
+		dest, fs, path string
+		err            error
+	}{
+		{"http://localhost:8051/api/filetree/fs/fs/other/a/b.txt", "other", "/a/b.txt", nil},
+		{"/api/filetree/fs/fs/myfs/a/../c.txt", "myfs", "/c.txt", nil},
+		{"/api/filetree/fs/fs/myfs/", "", "", errBadDestination},
+		{"/api/docstore/foo", "", "", errBadDestination},
+		{"", "", "", errBadDestination},
+	} {
+		r := httptest.NewRequest("COPY", "/api/filetree/fs/fs/myfs/a.txt", nil)
+		r.Header.Set("Destination", tc.dest)
+		r = mux.SetURLVars(r, map[string]string{"type": "fs", "name": "myfs", "path": "a.txt"})
+		fs, p, err := parseDestination(r)
+		if fs != tc.fs || p != tc.path || err != tc.err {
+			t.Errorf("parseDestination(%q) failed, got %q, %q, %v", tc.dest, fs, p, err)
+		}
+	}
+}
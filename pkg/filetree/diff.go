@@ -0,0 +1,289 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Diff operations
+const (
+	DiffAdded    = "added"
+	DiffRemoved  = "removed"
+	DiffModified = "modified"
+	DiffRenamed  = "renamed"
+)
+
+// DiffEntry represents a single change between two trees
+type DiffEntry struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	OldSize int    `json:"old_size,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	OldRef  string `json:"old_ref,omitempty"`
+}
+
+// differ holds the state of a tree diff
+type differ struct {
+	ctx     context.Context
+	ft      *FileTree
+	entries []*DiffEntry
+}
+
+// Diff returns the changes between the two trees, the trees are walked in parallel, and the subtrees with the same
+// hash are skipped. A removed and an added node with the same content are reported as a rename.
+// The content of the added/removed directories is not listed.
+func (ft *FileTree) Diff(ctx context.Context, from, to *rnode.RawNode) ([]*DiffEntry, error) {
+	d := &differ{ctx: ctx, ft: ft, entries: []*DiffEntry{}}
+	if err := d.diffDir("/", from, to); err != nil {
+		return nil, err
+	}
+	d.detectRenames()
+	sort.Slice(d.entries, func(i, j int) bool {
+		return d.entries[i].Path < d.entries[j].Path
+	})
+	return d.entries, nil
+}
+
+// children fetches the children of the dir, except the ones listed in `skip`
+func (d *differ) children(n *rnode.RawNode, skip map[string]struct{}) (map[string]*rnode.RawNode, error) {
+	out := map[string]*rnode.RawNode{}
+	for _, ref := range n.Refs {
+		if _, ok := skip[ref.(string)]; ok {
+			continue
+		}
+		blob, err := d.ft.blobStore.Get(d.ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		child, err := rnode.NewNodeFromBlob(ref.(string), blob)
+		if err != nil {
+			return nil, err
+		}
+		out[child.Name] = child
+	}
+	return out, nil
+}
+
+func refsSet(n *rnode.RawNode) map[string]struct{} {
+	out := map[string]struct{}{}
+	for _, ref := range n.Refs {
+		out[ref.(string)] = struct{}{}
+	}
+	return out
+}
+
+func (d *differ) diffDir(p string, a, b *rnode.RawNode) error {
+	if a.Hash != "" && a.Hash == b.Hash {
+		return nil
+	}
+
+	// The children with the same hash (same name and same content) are the same in both trees, no need to fetch them
+	aRefs := refsSet(a)
+	bRefs := refsSet(b)
+	aChildren, err := d.children(a, bRefs)
+	if err != nil {
+		return err
+	}
+	bChildren, err := d.children(b, aRefs)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range aChildren {
+		names = append(names, name)
+	}
+	for name := range bChildren {
+		if _, ok := aChildren[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cp := path.Join(p, name)
+		an, aok := aChildren[name]
+		bn, bok := bChildren[name]
+		switch {
+		case !bok:
+			d.add(DiffRemoved, cp, an)
+		case !aok:
+			d.add(DiffAdded, cp, bn)
+		case an.Type != bn.Type:
+			d.add(DiffRemoved, cp, an)
+			d.add(DiffAdded, cp, bn)
+		case an.Type == rnode.Dir:
+			if err := d.diffDir(cp, an, bn); err != nil {
+				return err
+			}
+		default:
+			d.entries = append(d.entries, &DiffEntry{
+				Op:      DiffModified,
+				Path:    cp,
+				Type:    bn.Type,
+				Size:    bn.Size,
+				OldSize: an.Size,
+				Ref:     bn.Hash,
+				OldRef:  an.Hash,
+			})
+		}
+	}
+	return nil
+}
+
+func (d *differ) add(op, p string, n *rnode.RawNode) {
+	d.entries = append(d.entries, &DiffEntry{
+		Op:   op,
+		Path: p,
+		Type: n.Type,
+		Size: n.Size,
+		Ref:  n.Hash,
+	})
+}
+
+// contentKey returns a key identifying the content of the node (the hash of the node depends on its name)
+func (d *differ) contentKey(ref string) (string, bool) {
+	blob, err := d.ft.blobStore.Get(d.ctx, ref)
+	if err != nil {
+		return "", false
+	}
+	n, err := rnode.NewNodeFromBlob(ref, blob)
+	if err != nil {
+		return "", false
+	}
+	// Empty nodes would all be detected as renames
+	if len(n.Refs) == 0 {
+		return "", false
+	}
+	if n.Type == rnode.File {
+		if h, ok := n.Metadata["blake2b-hash"].(string); ok {
+			return "file:" + h, true
+		}
+	}
+	refs := []string{}
+	for _, ref := range n.Refs {
+		refs = append(refs, fmt.Sprintf("%v", ref))
+	}
+	return n.Type + ":" + strings.Join(refs, ","), true
+}
+
+// detectRenames merges the removed and added nodes having the same content into a single rename entry
+func (d *differ) detectRenames() {
+	removed := map[string]*DiffEntry{}
+	for _, e := range d.entries {
+		if e.Op != DiffRemoved {
+			continue
+		}
+		if key, ok := d.contentKey(e.Ref); ok {
+			removed[key] = e
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	renamed := map[*DiffEntry]struct{}{}
+	for _, e := range d.entries {
+		if e.Op != DiffAdded {
+			continue
+		}
+		key, ok := d.contentKey(e.Ref)
+		if !ok {
+			continue
+		}
+		old, ok := removed[key]
+		if !ok {
+			continue
+		}
+		delete(removed, key)
+		renamed[old] = struct{}{}
+		e.Op = DiffRenamed
+		e.OldPath = old.Path
+		e.OldSize = old.Size
+		e.OldRef = old.Ref
+	}
+
+	entries := []*DiffEntry{}
+	for _, e := range d.entries {
+		if _, ok := renamed[e]; !ok {
+			entries = append(entries, e)
+		}
+	}
+	d.entries = entries
+}
+
+// HTTP handler returning the changes between two versions of a FS
+func (ft *FileTree) diffHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Only FS can be diffed")
+			return
+		}
+		fsName := vars["name"]
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		from, err := q.GetInt64Default("from", 0)
+		if err != nil || from <= 0 {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Missing or invalid from version")
+			return
+		}
+		// Default to the latest version
+		to, err := q.GetInt64Default("to", 0)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid to version")
+			return
+		}
+
+		roots := []*rnode.RawNode{}
+		for _, asOf := range []int64{from, to} {
+			fs, err := ft.FS(ctx, fsName, prefixFmt, false, asOf)
+			if err != nil {
+				panic(err)
+			}
+			if fs.Ref == "" {
+				notFound(w)
+				return
+			}
+			root, err := fs.Root(ctx, false, 0)
+			if err != nil {
+				panic(err)
+			}
+			roots = append(roots, root.Meta)
+		}
+
+		entries, err := ft.Diff(ctx, roots[0], roots[1])
+		if err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"from":    roots[0].Hash,
+			"to":      roots[1].Hash,
+			"changes": entries,
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package filetree
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"a4.io/blobstash/pkg/blob"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+type memBlobStore struct {
+	blobs map[string][]byte
+}
+
+func (bs *memBlobStore) Put(_ context.Context, b *blob.Blob) error {
+	bs.blobs[b.Hash] = b.Data
+	return nil
+}
+
+func (bs *memBlobStore) Get(_ context.Context, hash string) ([]byte, error) {
+	return bs.blobs[hash], nil
+}
+
+func (bs *memBlobStore) Stat(_ context.Context, hash string) (bool, error) {
+	_, ok := bs.blobs[hash]
+	return ok, nil
+}
+
+func (bs *memBlobStore) Enumerate(_ context.Context, start, end string, limit int) ([]*blob.SizedBlobRef, string, error) {
+	return nil, "", nil
+}
+
+func (bs *memBlobStore) Close() error { return nil }
+
+func (bs *memBlobStore) file(name, content string) *rnode.RawNode {
+	n := &rnode.RawNode{Type: rnode.File, Name: name, Size: len(content)}
+	n.AddIndexedRef(len(content), "chunk-"+content)
+	n.AddData("blake2b-hash", "hash-"+content)
+	return bs.put(n)
+}
+
+func (bs *memBlobStore) dir(name string, children ...*rnode.RawNode) *rnode.RawNode {
+	n := &rnode.RawNode{Type: rnode.Dir, Name: name}
+	for _, child := range children {
+		n.AddRef(child.Hash)
+	}
+	return bs.put(n)
+}
+
+func (bs *memBlobStore) put(n *rnode.RawNode) *rnode.RawNode {
+	h, data := n.Encode()
+	bs.blobs[h] = data
+	n.Hash = h
+	return n
+}
+
+func TestDiff(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	ft := &FileTree{blobStore: bs}
+
+	from := bs.dir("_root",
+		bs.file("a.txt", "a"),
+		bs.file("b.txt", "b"),
+		bs.dir("docs", bs.file("c.txt", "c"), bs.file("old.txt", "old")),
+		bs.dir("same", bs.file("d.txt", "d")),
+	)
+	to := bs.dir("_root",
+		bs.file("a.txt", "a2"),
+		bs.dir("docs", bs.file("c.txt", "c"), bs.file("new.txt", "old")),
+		bs.dir("same", bs.file("d.txt", "d")),
+		bs.file("e.txt", "e"),
+	)
+
+	entries, err := ft.Diff(context.TODO(), from, to)
+	if err != nil {
+		panic(err)
+	}
+	got := [][]string{}
+	for _, e := range entries {
+		got = append(got, []string{e.Op, e.OldPath, e.Path})
+	}
+	expected := [][]string{
+		{DiffModified, "", "/a.txt"},
+		{DiffRemoved, "", "/b.txt"},
+		{DiffRenamed, "/docs/old.txt", "/docs/new.txt"},
+		{DiffAdded, "", "/e.txt"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad diff, expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,320 @@
+package filetree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// Export formats
+const (
+	ExportTgz = "tgz"
+	ExportTar = "tar"
+	ExportZip = "zip"
+)
+
+var exportContentTypes = map[string]string{
+	ExportTgz: "application/gzip",
+	ExportTar: "application/x-tar",
+	ExportZip: "application/zip",
+}
+
+var exportExts = map[string]string{
+	ExportTgz: ".tar.gz",
+	ExportTar: ".tar",
+	ExportZip: ".zip",
+}
+
+// exporter streams the nodes as a tar/zip archive
+type exporter struct {
+	ctx context.Context
+	ft  *FileTree
+
+	// Glob patterns for filtering the exported paths (see `reader.MatchPatterns`)
+	include []string
+	exclude []string
+
+	gw *gzip.Writer
+	tw *tar.Writer
+	zw *zip.Writer
+}
+
+func newExporter(ctx context.Context, ft *FileTree, w io.Writer, format string) *exporter {
+	e := &exporter{ctx: ctx, ft: ft}
+	switch format {
+	case ExportTgz:
+		e.gw = gzip.NewWriter(w)
+		e.tw = tar.NewWriter(e.gw)
+	case ExportTar:
+		e.tw = tar.NewWriter(w)
+	case ExportZip:
+		// archive/zip switches to zip64 automatically for the large files and archives
+		e.zw = zip.NewWriter(w)
+	default:
+		panic(fmt.Errorf("unknown export format %q", format))
+	}
+	return e
+}
+
+// Close "seals" the archive
+func (e *exporter) Close() error {
+	if e.zw != nil {
+		return e.zw.Close()
+	}
+	if err := e.tw.Close(); err != nil {
+		return err
+	}
+	if e.gw != nil {
+		return e.gw.Close()
+	}
+	return nil
+}
+
+// export recursively adds the node to the archive, `prefix` is the path of the exported root in the archive and `rel`
+// the path (used for the filters) relative to the exported root.
+func (e *exporter) export(n *rnode.RawNode, prefix, rel string) error {
+	if rel != "" && reader.MatchPatterns(e.exclude, rel) {
+		return nil
+	}
+	name := path.Join(prefix, rel)
+
+	if n.Type != rnode.Dir {
+		if rel != "" && len(e.include) > 0 && !reader.MatchPatterns(e.include, rel) {
+			return nil
+		}
+		return e.add(name, n)
+	}
+
+	// Directories are only added when there's no include filters (or there would be empty dirs for everything else)
+	if name != "" && len(e.include) == 0 {
+		if err := e.add(name+"/", n); err != nil {
+			return err
+		}
+	}
+	for _, ref := range n.Refs {
+		blob, err := e.ft.blobStore.Get(e.ctx, ref.(string))
+		if err != nil {
+			return err
+		}
+		child, err := rnode.NewNodeFromBlob(ref.(string), blob)
+		if err != nil {
+			return err
+		}
+		if err := e.export(child, prefix, path.Join(rel, child.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add writes a single entry to the archive (the FIFO and the devices are skipped)
+func (e *exporter) add(name string, n *rnode.RawNode) error {
+	mode := os.FileMode(n.Mode) & os.ModePerm
+	switch n.Type {
+	case rnode.File, rnode.Symlink:
+		if n.Mode == 0 {
+			mode = 0644
+		}
+	case rnode.Dir:
+		if n.Mode == 0 {
+			mode = 0755
+		}
+	default:
+		return nil
+	}
+	var mtime time.Time
+	if n.ModTime > 0 {
+		mtime = time.Unix(n.ModTime, 0)
+	}
+
+	if e.zw != nil {
+		return e.addZip(name, n, mode, mtime)
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode),
+		ModTime: mtime,
+		Uid:     n.Uid,
+		Gid:     n.Gid,
+	}
+	switch n.Type {
+	case rnode.Dir:
+		hdr.Typeflag = tar.TypeDir
+	case rnode.Symlink:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = n.Target
+		hdr.Mode = 0777
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(n.Size)
+	}
+	if err := e.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if n.Type == rnode.File {
+		return e.writeContent(e.tw, n)
+	}
+	return nil
+}
+
+func (e *exporter) addZip(name string, n *rnode.RawNode, mode os.FileMode, mtime time.Time) error {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: mtime,
+	}
+	switch n.Type {
+	case rnode.Dir:
+		hdr.Method = zip.Store
+		hdr.SetMode(os.ModeDir | mode)
+	case rnode.Symlink:
+		hdr.SetMode(os.ModeSymlink | 0777)
+	default:
+		hdr.SetMode(mode)
+	}
+	w, err := e.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	switch n.Type {
+	case rnode.Symlink:
+		// The target of the symlink is stored as the content
+		_, err := w.Write([]byte(n.Target))
+		return err
+	case rnode.File:
+		return e.writeContent(w, n)
+	}
+	return nil
+}
+
+// writeContent writes the content of the file (iter over all the blobs)
+func (e *exporter) writeContent(w io.Writer, n *rnode.RawNode) error {
+	for _, iv := range n.FileRefs() {
+		blob, err := e.ft.blobStore.Get(e.ctx, iv.Value)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HTTP handler exporting a tree (or a subtree) as a tar.gz/tar/zip archive, the format can be set via the `format`
+// query argument, and the exported paths can be filtered using the (repeatable) `include`/`exclude` glob patterns.
+func (ft *FileTree) exportHandler(defaultFormat string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
+		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		fsPath := "/" + vars["path"]
+		refType := vars["type"]
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+		q := httputil.NewQuery(r.URL.Query())
+
+		asOf, err := q.GetInt64Default("as_of", 0)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid as_of")
+			return
+		}
+
+		format := q.GetDefault("format", defaultFormat)
+		if _, ok := exportContentTypes[format]; !ok {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid format")
+			return
+		}
+
+		var fs *FS
+		switch refType {
+		case "ref":
+			fs = &FS{
+				Ref: fsName,
+				ft:  ft,
+			}
+		case "fs":
+			fs, err = ft.FS(ctx, fsName, prefixFmt, false, asOf)
+			if err != nil {
+				panic(err)
+			}
+		default:
+			panic(fmt.Errorf("Unknown type \"%s\"", refType))
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+			node, _, _, err := fs.Path(ctx, fsPath, 1, false, 0)
+			switch err {
+			case nil:
+			case clientutil.ErrBlobNotFound:
+				// Returns a 404 if the blob/children is not found
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case blobsfile.ErrBlobNotFound:
+				// Returns a 404 if the blob/children is not found
+				w.WriteHeader(http.StatusNotFound)
+				return
+			default:
+				panic(fmt.Errorf("failed to get path: %v", err))
+			}
+
+			// When exporting a subtree, the archive contains the exported directory
+			var prefix string
+			name := fsName
+			if fsPath != "/" {
+				name = node.Name
+				prefix = node.Name
+			}
+
+			w.Header().Set("ETag", node.Hash)
+			w.Header().Set("Content-Type", exportContentTypes[format])
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s%s\"", strings.Replace(name, "\"", "", -1), exportExts[format]))
+
+			// Handle HEAD request
+			if r.Method == "HEAD" {
+				return
+			}
+
+			e := newExporter(ctx, ft, w, format)
+			e.include = r.URL.Query()["include"]
+			e.exclude = r.URL.Query()["exclude"]
+			if node.Meta.Type == rnode.Dir {
+				err = e.export(node.Meta, prefix, "")
+			} else {
+				err = e.export(node.Meta, "", node.Name)
+			}
+			if err != nil {
+				panic(err)
+			}
+			if err := e.Close(); err != nil {
+				panic(err)
+			}
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
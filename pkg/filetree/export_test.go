@@ -0,0 +1,105 @@
+package filetree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func TestExport(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	ft := &FileTree{blobStore: bs}
+	for _, content := range []string{"a", "b", "c"} {
+		bs.blobs["chunk-"+content] = []byte(content)
+	}
+	root := bs.dir("_root",
+		bs.file("a.txt", "a"),
+		bs.dir("docs", bs.file("b.txt", "b"), bs.file("c.log", "c")),
+		bs.put(&rnode.RawNode{Type: rnode.Symlink, Name: "link", Target: "a.txt"}),
+	)
+
+	for _, tc := range []struct {
+		format           string
+		include, exclude []string
+		expected         map[string]string
+	}{
+		{ExportTar, nil, nil, map[string]string{
+			"a.txt": "a", "docs/": "", "docs/b.txt": "b", "docs/c.log": "c", "link": "a.txt",
+		}},
+		{ExportZip, nil, []string{"*.log"}, map[string]string{
+			"a.txt": "a", "docs/": "", "docs/b.txt": "b", "link": "a.txt",
+		}},
+		{ExportTgz, []string{"docs"}, []string{"c.log"}, map[string]string{
+			"docs/b.txt": "b",
+		}},
+	} {
+		var buf bytes.Buffer
+		e := newExporter(context.TODO(), ft, &buf, tc.format)
+		e.include = tc.include
+		e.exclude = tc.exclude
+		if err := e.export(root, "", ""); err != nil {
+			panic(err)
+		}
+		if err := e.Close(); err != nil {
+			panic(err)
+		}
+
+		got := map[string]string{}
+		switch tc.format {
+		case ExportZip:
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				panic(err)
+			}
+			for _, f := range zr.File {
+				rc, err := f.Open()
+				if err != nil {
+					panic(err)
+				}
+				data, err := ioutil.ReadAll(rc)
+				if err != nil {
+					panic(err)
+				}
+				got[f.Name] = string(data)
+			}
+		default:
+			var r io.Reader = &buf
+			if tc.format == ExportTgz {
+				gr, err := gzip.NewReader(r)
+				if err != nil {
+					panic(err)
+				}
+				r = gr
+			}
+			tr := tar.NewReader(r)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					panic(err)
+				}
+				data, err := ioutil.ReadAll(tr)
+				if err != nil {
+					panic(err)
+				}
+				if hdr.Typeflag == tar.TypeSymlink {
+					data = []byte(hdr.Linkname)
+				}
+				got[hdr.Name] = string(data)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s export failed, got %+v, expected %+v", tc.format, got, tc.expected)
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package filetree // import "a4.io/blobstash/pkg/filetree"
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"container/list"
 	"context"
 	"encoding/json"
@@ -88,6 +86,15 @@ type FileTree struct {
 
 	remoteFetcher func(string) (string, error)
 
+	// Resumable upload sessions
+	uploads *uploadSessions
+
+	// Persistent search index (nil if disabled)
+	searchIndexer *searchIndexer
+
+	// Active WebDAV locks
+	davLocks *davLocks
+
 	log log.Logger
 }
 
@@ -158,8 +165,17 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 	if err != nil {
 		return nil, err
 	}
+	uploadSessionTTL := defaultUploadSessionTTL
+	if conf.Filetree != nil && conf.Filetree.UploadSessionTTL > 0 {
+		uploadSessionTTL = conf.Filetree.UploadSessionTTL
+	}
+	uploads, err := newUploadSessions(filepath.Join(conf.VarDir(), "filetree_uploads"), time.Duration(uploadSessionTTL)*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	go uploads.sweeper(logger.New("submodule", "uploads"))
 
-	return &FileTree{
+	ft := &FileTree{
 		conf:      conf,
 		kvStore:   kvStore,
 		blobStore: blobStore,
@@ -170,18 +186,31 @@ func New(logger log.Logger, conf *config.Config, authFunc func(*http.Request) bo
 		thumbCache:    thumbscache,
 		metadataCache: metacache,
 		nodeCache:     nodeCache,
+		uploads:       uploads,
+		davLocks:      newDavLocks(),
 		authFunc:      authFunc,
 		shareTTL:      1 * time.Hour,
 		hub:           chub,
 		log:           logger,
 		remoteFetcher: remoteFetcher,
-	}, nil
+	}
+	if conf.Filetree != nil && conf.Filetree.SearchIndex != nil {
+		ft.searchIndexer, err = newSearchIndexer(ft, conf.Filetree.SearchIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ft, nil
 }
 
 // Close closes all the open DB files.
 func (ft *FileTree) Close() error {
+	ft.uploads.close()
 	ft.thumbCache.Close()
 	ft.metadataCache.Close()
+	if ft.searchIndexer != nil {
+		return ft.searchIndexer.Close()
+	}
 	return nil
 }
 
@@ -198,9 +227,26 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	r.Handle("/versions/{type}/{name}", basicAuth(http.HandlerFunc(ft.versionsHandler())))
 
 	r.Handle("/fs", basicAuth(http.HandlerFunc(ft.fsRootHandler())))
-	r.Handle("/fs/{type}/{name}/_tgz", basicAuth(http.HandlerFunc(ft.tgzHandler())))
+	r.Handle("/fs/{type}/{name}/_tgz", basicAuth(http.HandlerFunc(ft.exportHandler(ExportTgz))))
+	r.Handle("/fs/{type}/{name}/_export", basicAuth(http.HandlerFunc(ft.exportHandler(ExportTgz))))
+	r.Handle("/fs/{type}/{name}/_export/{path:.+}", basicAuth(http.HandlerFunc(ft.exportHandler(ExportTgz))))
+	r.Handle("/fs/{type}/{name}/_import", basicAuth(http.HandlerFunc(ft.importHandler())))
+	r.Handle("/fs/{type}/{name}/_import/{path:.+}", basicAuth(http.HandlerFunc(ft.importHandler())))
+	r.Handle("/fs/{type}/{name}/_history/{path:.+}", basicAuth(http.HandlerFunc(ft.historyHandler())))
+	r.Handle("/fs/{type}/{name}/_search", basicAuth(http.HandlerFunc(ft.fsSearchHandler())))
+	r.Handle("/fs/{type}/{name}/_diff", basicAuth(http.HandlerFunc(ft.diffHandler())))
+	r.Handle("/fs/{type}/{name}/_prune", basicAuth(http.HandlerFunc(ft.pruneHandler())))
 	r.Handle("/fs/{type}/{name}/", basicAuth(http.HandlerFunc(ft.fsHandler())))
 	r.Handle("/fs/{type}/{name}/{path:.+}", basicAuth(http.HandlerFunc(ft.fsHandler())))
+
+	// WebDAV server (the `{name}@{as_of}` routes must be registered first)
+	webdavHandler := basicAuth(http.HandlerFunc(ft.webdavHandler()))
+	r.Handle("/webdav/{name}@{as_of:[0-9]+}", webdavHandler)
+	r.Handle("/webdav/{name}@{as_of:[0-9]+}/", webdavHandler)
+	r.Handle("/webdav/{name}@{as_of:[0-9]+}/{path:.+}", webdavHandler)
+	r.Handle("/webdav/{name}", webdavHandler)
+	r.Handle("/webdav/{name}/", webdavHandler)
+	r.Handle("/webdav/{name}/{path:.+}", webdavHandler)
 	// r.Handle("/fs", http.HandlerFunc(ft.fsHandler()))
 	// r.Handle("/fs/{name}", http.HandlerFunc(ft.fsByNameHandler()))
 
@@ -208,6 +254,9 @@ func (ft *FileTree) Register(r *mux.Router, root *mux.Router, basicAuth func(htt
 	root.Handle("/public/{type}/{name}/{path:.+}", http.HandlerFunc(ft.publicHandler()))
 
 	r.Handle("/upload", basicAuth(http.HandlerFunc(ft.uploadHandler())))
+	r.Handle("/upload/_sessions", basicAuth(http.HandlerFunc(ft.uploadSessionsHandler())))
+	r.Handle("/upload/_sessions/{id}", basicAuth(http.HandlerFunc(ft.uploadSessionHandler())))
+	r.Handle("/upload/_sessions/{id}/_finalize", basicAuth(http.HandlerFunc(ft.uploadSessionFinalizeHandler())))
 
 	// Public/semi-private handler
 	fileHandler := http.HandlerFunc(ft.fileHandler())
@@ -226,6 +275,7 @@ type Node struct {
 	ModTime    string  `json:"mtime" msgpack:"mt"`
 	ChangeTime string  `json:"ctime" msgpack:"ct"`
 	Hash       string  `json:"ref" msgpack:"r"`
+	Target     string  `json:"target,omitempty" msgpack:"tg,omitempty"`
 	Children   []*Node `json:"children,omitempty" msgpack:"c,omitempty"`
 
 	// FIXME(ts): rename to Metadata
@@ -419,13 +469,14 @@ func MetaToNode(m *rnode.RawNode) (*Node, error) {
 	//return nil, fmt.Errorf("bad node version \"%s\" for node %+v", m.Version, m)
 	//}
 	n := &Node{
-		Name: m.Name,
-		Type: m.Type,
-		Size: m.Size,
-		Data: m.Metadata,
-		Hash: m.Hash,
-		Mode: int(m.Mode),
-		Meta: m,
+		Name:   m.Name,
+		Type:   m.Type,
+		Size:   m.Size,
+		Data:   m.Metadata,
+		Hash:   m.Hash,
+		Mode:   int(m.Mode),
+		Target: m.Target,
+		Meta:   m,
 	}
 	if m.ModTime > 0 {
 		n.ModTime = time.Unix(m.ModTime, 0).Format(time.RFC3339)
@@ -1329,118 +1380,19 @@ func (ft *FileTree) fsHandler() func(http.ResponseWriter, *http.Request) {
 			w.WriteHeader(http.StatusNoContent)
 			return
 
-		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-	}
-}
-
-func (ft *FileTree) tgzHandler() func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
-		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
-
-		// FIXME(tsileo): handle mtime in the context too, and make it optional
-
-		vars := mux.Vars(r)
-		fsName := vars["name"]
-		path := "/" + vars["path"]
-		refType := vars["type"]
-		prefixFmt := FSKeyFmt
-		if p := r.URL.Query().Get("prefix"); p != "" {
-			prefixFmt = p + ":%s"
-		}
-		var mtime, asOf int64
-		var err error
-		q := httputil.NewQuery(r.URL.Query())
-
-		asOf, err = q.GetInt64Default("as_of", 0)
-		if err != nil {
-			panic(err)
-		}
-
-		var fs *FS
-		switch refType {
-		case "ref":
-			fs = &FS{
-				Ref: fsName,
-				ft:  ft,
-			}
-		case "fs":
-			fs, err = ft.FS(ctx, fsName, prefixFmt, false, asOf)
+		case "COPY", "MOVE":
+			// Relink the node to the path set in the `Destination` header
+			destName, destPath, err := parseDestination(r)
 			if err != nil {
-				panic(err)
-			}
-		default:
-			panic(fmt.Errorf("Unknown type \"%s\"", refType))
-		}
-		switch r.Method {
-		case "GET", "HEAD":
-			node, _, _, err := fs.Path(ctx, path, 1, false, mtime)
-			switch err {
-			case nil:
-			case clientutil.ErrBlobNotFound:
-				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
-				return
-			case blobsfile.ErrBlobNotFound:
-				// Returns a 404 if the blob/children is not found
-				w.WriteHeader(http.StatusNotFound)
-				return
-			default:
-				panic(fmt.Errorf("failed to get path: %v", err))
-			}
-
-			w.Header().Set("ETag", node.Hash)
-			w.Header().Set("Content-Type", "application/gzip")
-
-			// Handle HEAD request
-			if r.Method == "HEAD" {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "Missing or invalid Destination header")
 				return
 			}
+			ft.copyMove(ctx, w, r, fs, path, destName, destPath, prefixFmt, mtime)
+			return
 
-			gzipWriter := gzip.NewWriter(w)
-			tarWriter := tar.NewWriter(gzipWriter)
-
-			// Iter the whole tree
-			ctx := context.TODO()
-			if err := ft.IterTree(ctx, node, func(n *Node, p string) error {
-				// Skip directories (We only want files to be added)
-				if !n.Meta.IsFile() {
-					return nil
-				}
-
-				// Write the tar header
-				hdr := &tar.Header{
-					Name: p[1:],
-					Mode: int64(os.FileMode(n.Mode) | 0600),
-					Size: int64(n.Size),
-				}
-				if err := tarWriter.WriteHeader(hdr); err != nil {
-					panic(err)
-				}
-
-				// write the file content (iter over all the blobs)
-				for _, iv := range n.Meta.FileRefs() {
-					blob, err := ft.blobStore.Get(ctx, iv.Value)
-					if err != nil {
-						panic(err)
-					}
-					if _, err := tarWriter.Write(blob); err != nil {
-						panic(err)
-					}
-				}
-				return nil
-			}); err != nil {
-				panic(err)
-			}
-
-			// "seal" the tarfile
-			tarWriter.Close()
-			gzipWriter.Close()
-
-			// TODO(tsileo): set attachment headder
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
 	}
 }
@@ -1727,6 +1679,11 @@ func (ft *FileTree) nodeSnapshotHandler() func(http.ResponseWriter, *http.Reques
 			panic(err)
 		}
 
+		// Prune the older snapshots according to the retention policy of the FS (if any)
+		if err := ft.applyRetention(ctx, sreq.FS); err != nil {
+			panic(err)
+		}
+
 		// return newRev.Version, nil
 		httputil.MarshalAndWrite(r, w, map[string]interface{}{
 			"version": newRev.Version,
@@ -22,8 +22,14 @@ var (
 )
 
 const (
-	File = "file"
-	Dir  = "dir"
+	File    = "file"
+	Dir     = "dir"
+	Symlink = "symlink"
+
+	// Special files (the device number is stored in `Rdev`)
+	Fifo        = "fifo"
+	CharDevice  = "chardev"
+	BlockDevice = "blockdev"
 )
 
 const (
@@ -46,6 +52,13 @@ type IndexValue struct {
 	Value string `json:"ref" msgpack:"r"`
 }
 
+// Xattr holds an extended attribute
+type Xattr struct {
+	Name  string `msgpack:"n"`
+	Value []byte `msgpack:"v"`
+}
+
+// The extra fields are all optional, so a node without them is encoded exactly like before they were introduced
 type RawNode struct {
 	ModTime    int64                  `msgpack:"mt,omitempty"`
 	ChangeTime int64                  `msgpack:"ct,omitempty"`
@@ -56,6 +69,12 @@ type RawNode struct {
 	Refs       []interface{}          `msgpack:"r"`
 	Version    string                 `msgpack:"v"`
 	Metadata   map[string]interface{} `msgpack:"m,omitempty"`
+	Target     string                 `msgpack:"tg,omitempty"` // Symlink target
+	Link       string                 `msgpack:"hl,omitempty"` // Path (from the root) of the first file of the hardlink group
+	Uid        int                    `msgpack:"u,omitempty"`
+	Gid        int                    `msgpack:"g,omitempty"`
+	Rdev       uint64                 `msgpack:"rd,omitempty"` // Device number (for devices)
+	Xattrs     []*Xattr               `msgpack:"xa,omitempty"` // Sorted by name
 	Hash       string                 `msgpack:"-"`
 }
 
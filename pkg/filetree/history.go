@@ -0,0 +1,219 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// PathVersion represents a distinct version (i.e. content/metadata) of a path across the FS versions
+type PathVersion struct {
+	Ref     string `json:"ref"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	ModTime int64  `json:"mtime,omitempty"`
+
+	// FS versions (in the order of the snapshots) where the path points to this node
+	Versions []int64 `json:"versions"`
+}
+
+// pathResolver looks up a path in many trees, the lookups are memoized by (dir hash, path) so the subtrees shared
+// between the versions are only walked once
+type pathResolver struct {
+	ctx      context.Context
+	ft       *FileTree
+	resolved map[string]string         // dir hash + path => hash of the node ("" if not found)
+	nodes    map[string]*rnode.RawNode // hash => node
+}
+
+func newPathResolver(ctx context.Context, ft *FileTree) *pathResolver {
+	return &pathResolver{
+		ctx:      ctx,
+		ft:       ft,
+		resolved: map[string]string{},
+		nodes:    map[string]*rnode.RawNode{},
+	}
+}
+
+func (pr *pathResolver) node(hash string) (*rnode.RawNode, error) {
+	if n, ok := pr.nodes[hash]; ok {
+		return n, nil
+	}
+	blob, err := pr.ft.blobStore.Get(pr.ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	n, err := rnode.NewNodeFromBlob(hash, blob)
+	if err != nil {
+		return nil, err
+	}
+	pr.nodes[hash] = n
+	return n, nil
+}
+
+// resolve returns the hash of the node at the given path relative to the dir (or an empty string if not found)
+func (pr *pathResolver) resolve(dirHash string, parts []string) (string, error) {
+	if len(parts) == 0 {
+		return dirHash, nil
+	}
+	key := dirHash + "\x00" + strings.Join(parts, "/")
+	if hash, ok := pr.resolved[key]; ok {
+		return hash, nil
+	}
+	dir, err := pr.node(dirHash)
+	if err != nil {
+		return "", err
+	}
+	var hash string
+	if dir.Type == rnode.Dir {
+		for _, ref := range dir.Refs {
+			child, err := pr.node(ref.(string))
+			if err != nil {
+				return "", err
+			}
+			if child.Name == parts[0] {
+				hash, err = pr.resolve(child.Hash, parts[1:])
+				if err != nil {
+					return "", err
+				}
+				break
+			}
+		}
+	}
+	pr.resolved[key] = hash
+	return hash, nil
+}
+
+// PathHistory returns the distinct versions of the path across the given FS snapshots (the versions where the path
+// does not exist are skipped)
+func (ft *FileTree) PathHistory(ctx context.Context, snapshots []*Snapshot, path string) ([]*PathVersion, error) {
+	parts := []string{}
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	pr := newPathResolver(ctx, ft)
+	out := []*PathVersion{}
+	index := map[string]*PathVersion{}
+	for _, snap := range snapshots {
+		hash, err := pr.resolve(snap.Ref, parts)
+		if err != nil {
+			return nil, err
+		}
+		if hash == "" {
+			continue
+		}
+		pv, ok := index[hash]
+		if !ok {
+			n, err := pr.node(hash)
+			if err != nil {
+				return nil, err
+			}
+			pv = &PathVersion{
+				Ref:      hash,
+				Type:     n.Type,
+				Size:     n.Size,
+				ModTime:  n.ModTime,
+				Versions: []int64{},
+			}
+			index[hash] = pv
+			out = append(out, pv)
+		}
+		pv.Versions = append(pv.Versions, snap.CreatedAt)
+	}
+	return out, nil
+}
+
+// HTTP handler returning the history of a single path, a version can be downloaded by setting the `ref` query
+// argument
+func (ft *FileTree) historyHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Only FS have an history")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Read, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		kvv, _, err := ft.kvStore.Versions(ctx, fmt.Sprintf(prefixFmt, fsName), "0", -1)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+		snapshots := []*Snapshot{}
+		for _, kv := range kvv.Versions {
+			snap := &Snapshot{
+				CreatedAt: kv.Version,
+				Ref:       kv.HexHash(),
+			}
+			if err := msgpack.Unmarshal(kv.Data, snap); err != nil {
+				panic(err)
+			}
+			snapshots = append(snapshots, snap)
+		}
+
+		history, err := ft.PathHistory(ctx, snapshots, vars["path"])
+		if err != nil {
+			panic(err)
+		}
+		if len(history) == 0 {
+			notFound(w)
+			return
+		}
+
+		// Download a specific version (only the versions of the path can be requested)
+		if ref := r.URL.Query().Get("ref"); ref != "" {
+			for _, pv := range history {
+				if pv.Ref == ref {
+					if pv.Type != rnode.File {
+						httputil.WriteJSONError(w, http.StatusBadRequest, "Only files can be downloaded")
+						return
+					}
+					ft.serveFile(ctx, w, r, ref, true)
+					return
+				}
+			}
+			notFound(w)
+			return
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"path":     "/" + vars["path"],
+			"versions": history,
+		})
+	}
+}
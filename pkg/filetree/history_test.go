@@ -0,0 +1,69 @@
+package filetree
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// countingBlobStore counts the blob fetches
+type countingBlobStore struct {
+	*memBlobStore
+	gets int
+}
+
+func (bs *countingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	bs.gets++
+	return bs.memBlobStore.Get(ctx, hash)
+}
+
+func TestPathHistory(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	cbs := &countingBlobStore{memBlobStore: bs}
+	ft := &FileTree{blobStore: cbs}
+
+	other := bs.dir("other", bs.file("x.txt", "x"), bs.file("y.txt", "y"))
+	v1 := bs.dir("_root", other, bs.dir("docs", bs.file("a.txt", "a")))
+	v2 := bs.dir("_root", other, bs.dir("docs", bs.file("a.txt", "a"), bs.file("b.txt", "b")))
+	v3 := bs.dir("_root", other, bs.dir("docs", bs.file("a.txt", "c")))
+	v4 := bs.dir("_root", other)
+	snapshots := []*Snapshot{
+		{Ref: v4.Hash, CreatedAt: 4},
+		{Ref: v3.Hash, CreatedAt: 3},
+		{Ref: v2.Hash, CreatedAt: 2},
+		{Ref: v1.Hash, CreatedAt: 1},
+	}
+
+	history, err := ft.PathHistory(context.TODO(), snapshots, "docs/a.txt")
+	if err != nil {
+		panic(err)
+	}
+	got := map[string][]int64{}
+	for _, pv := range history {
+		got[pv.Ref] = pv.Versions
+	}
+	expected := map[string][]int64{
+		bs.file("a.txt", "c").Hash: []int64{3},
+		bs.file("a.txt", "a").Hash: []int64{2, 1},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad history, got %+v, expected %+v", got, expected)
+	}
+	if len(history) != 2 || history[0].Versions[0] != 3 {
+		t.Errorf("the history should be sorted like the snapshots, got %+v", history)
+	}
+
+	// The shared nodes must only be fetched once: 4 roots + "other" + 3 docs dirs + the 2 versions of a.txt (the lookup
+	// stops once the child is found)
+	if cbs.gets != 10 {
+		t.Errorf("expected 10 blob fetches, got %d", cbs.gets)
+	}
+
+	history, err = ft.PathHistory(context.TODO(), snapshots, "/nope/a.txt")
+	if err != nil {
+		panic(err)
+	}
+	if len(history) != 0 {
+		t.Errorf("expected an empty history, got %+v", history)
+	}
+}
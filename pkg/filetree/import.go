@@ -0,0 +1,497 @@
+package filetree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/valyala/gozstd"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// importDir represents a directory of the imported archive
+type importDir struct {
+	meta  *rnode.RawNode        // the dir entry from the archive (if any)
+	dirs  map[string]*importDir // sub-directories
+	nodes map[string]string     // name => hash of the (already uploaded) non-dir nodes
+}
+
+func newImportDir() *importDir {
+	return &importDir{
+		dirs:  map[string]*importDir{},
+		nodes: map[string]string{},
+	}
+}
+
+// dir returns the directory at the given path (the missing ones are created)
+func (d *importDir) dir(parts []string) *importDir {
+	for _, p := range parts {
+		sub, ok := d.dirs[p]
+		if !ok {
+			sub = newImportDir()
+			d.dirs[p] = sub
+			delete(d.nodes, p)
+		}
+		d = sub
+	}
+	return d
+}
+
+// importer uploads the archive entries and builds the resulting tree
+type importer struct {
+	ctx  context.Context
+	ft   *FileTree
+	up   *writer.Uploader
+	root *importDir
+
+	files map[string]string // path => hash of the imported files (for the tar hardlinks)
+
+	// Number of imported entries, and of skipped entries (unsupported file types)
+	count   int
+	skipped int
+}
+
+func newImporter(ctx context.Context, ft *FileTree) *importer {
+	return &importer{
+		ctx:   ctx,
+		ft:    ft,
+		up:    writer.NewUploader(&BlobStore{ft.blobStore, ctx}),
+		root:  newImportDir(),
+		files: map[string]string{},
+	}
+}
+
+// splitImportPath splits the path of an archive entry, the paths escaping the root are rejected
+func splitImportPath(name string) ([]string, error) {
+	parts := []string{}
+	for _, p := range strings.Split(filepath.ToSlash(name), "/") {
+		switch p {
+		case "", ".":
+			continue
+		case "..":
+			return nil, fmt.Errorf("invalid path %q", name)
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// addNode adds an uploaded non-dir node to the tree
+func (im *importer) addNode(parts []string, hash string) {
+	parent := im.root.dir(parts[:len(parts)-1])
+	name := parts[len(parts)-1]
+	delete(parent.dirs, name)
+	parent.nodes[name] = hash
+	im.count++
+}
+
+// mkdev returns the device number for the given major/minor (using the Linux encoding, like the `Rdev` of the
+// uploaded devices)
+func mkdev(major, minor int64) uint64 {
+	dev := (uint64(major) & 0x00000fff) << 8
+	dev |= (uint64(major) & 0xfffff000) << 32
+	dev |= (uint64(minor) & 0x000000ff) << 0
+	dev |= (uint64(minor) & 0xffffff00) << 12
+	return dev
+}
+
+// add imports a single entry, `r` is the content of the file (or the target of the symlink for zip archives), and
+// `rdev` the device number (for devices)
+func (im *importer) add(name string, fi os.FileInfo, uid, gid int, linkname string, rdev uint64, r io.Reader) error {
+	parts, err := splitImportPath(name)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	meta := &rnode.RawNode{
+		Version: rnode.V1,
+		Name:    parts[len(parts)-1],
+		ModTime: fi.ModTime().Unix(),
+		Uid:     uid,
+		Gid:     gid,
+	}
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		meta.Type = rnode.Dir
+		if mode != os.ModeDir|0755 {
+			meta.Mode = uint32(mode)
+		}
+		im.root.dir(parts).meta = meta
+		im.count++
+		return nil
+
+	case mode.IsRegular():
+		meta.Type = rnode.File
+		if mode != 0644 {
+			meta.Mode = uint32(mode)
+		}
+		if err := im.up.PutReaderMeta(meta, r); err != nil {
+			return err
+		}
+		im.files[strings.Join(parts, "/")] = meta.Hash
+
+	case mode&os.ModeSymlink != 0:
+		meta.Type = rnode.Symlink
+		meta.Target = linkname
+		if r != nil {
+			target, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			meta.Target = string(target)
+		}
+		if err := im.up.PutMeta(meta); err != nil {
+			return err
+		}
+
+	case mode&(os.ModeNamedPipe|os.ModeDevice) != 0:
+		switch {
+		case mode&os.ModeNamedPipe != 0:
+			meta.Type = rnode.Fifo
+		case mode&os.ModeCharDevice != 0:
+			meta.Type = rnode.CharDevice
+			meta.Rdev = rdev
+		default:
+			meta.Type = rnode.BlockDevice
+			meta.Rdev = rdev
+		}
+		// The mode is always stored for the special files (like the uploader does)
+		meta.Mode = uint32(mode)
+		if err := im.up.PutMeta(meta); err != nil {
+			return err
+		}
+
+	default:
+		im.skipped++
+		return nil
+	}
+
+	im.addNode(parts, meta.Hash)
+	return nil
+}
+
+// addHardlink imports a tar hardlink as a copy of the file it links to (the content is not duplicated)
+func (im *importer) addHardlink(name, linkname string) error {
+	parts, err := splitImportPath(name)
+	if err != nil {
+		return err
+	}
+	target, err := splitImportPath(linkname)
+	if err != nil {
+		return err
+	}
+	hash, ok := im.files[strings.Join(target, "/")]
+	if !ok || len(parts) == 0 {
+		im.skipped++
+		return nil
+	}
+	blob, err := im.ft.blobStore.Get(im.ctx, hash)
+	if err != nil {
+		return err
+	}
+	meta, err := rnode.NewNodeFromBlob(hash, blob)
+	if err != nil {
+		return err
+	}
+	meta.Name = parts[len(parts)-1]
+	if err := im.up.PutMeta(meta); err != nil {
+		return err
+	}
+	im.files[strings.Join(parts, "/")] = meta.Hash
+	im.addNode(parts, meta.Hash)
+	return nil
+}
+
+// importTar imports a (streamed) tar archive
+func (im *importer) importTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			if err := im.addHardlink(hdr.Name, hdr.Linkname); err != nil {
+				return err
+			}
+			continue
+		}
+		var content io.Reader
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			content = tr
+		}
+		var rdev uint64
+		if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+			rdev = mkdev(hdr.Devmajor, hdr.Devminor)
+		}
+		if err := im.add(hdr.Name, hdr.FileInfo(), hdr.Uid, hdr.Gid, hdr.Linkname, rdev, content); err != nil {
+			return err
+		}
+	}
+}
+
+// importZip imports a zip archive
+func (im *importer) importZip(r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := func() error {
+			var content io.Reader
+			if !f.FileInfo().IsDir() {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				defer rc.Close()
+				content = rc
+			}
+			return im.add(f.Name, f.FileInfo(), 0, 0, "", 0, content)
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importArchive detects the archive format and imports it
+func (im *importer) importArchive(r io.Reader, tmpDir string) error {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, zipMagic):
+		// The zip format requires random access, the archive is spooled to disk
+		f, err := ioutil.TempFile(tmpDir, "filetree_import_")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := io.Copy(f, br)
+		if err != nil {
+			return err
+		}
+		return im.importZip(f, size)
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return im.importTar(gr)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr := gozstd.NewReader(br)
+		defer zr.Release()
+		return im.importTar(zr)
+	default:
+		return im.importTar(br)
+	}
+}
+
+// buildDir uploads the directory (and its sub-directories), the imported nodes are merged with the existing
+// directory (if any)
+func (im *importer) buildDir(d *importDir, existing *rnode.RawNode, name string) (*rnode.RawNode, error) {
+	children := map[string]string{}
+	existingDirs := map[string]*rnode.RawNode{}
+	if existing != nil {
+		for _, ref := range existing.Refs {
+			blob, err := im.ft.blobStore.Get(im.ctx, ref.(string))
+			if err != nil {
+				return nil, err
+			}
+			child, err := rnode.NewNodeFromBlob(ref.(string), blob)
+			if err != nil {
+				return nil, err
+			}
+			children[child.Name] = child.Hash
+			if child.Type == rnode.Dir {
+				existingDirs[child.Name] = child
+			}
+		}
+	}
+	for cname, hash := range d.nodes {
+		children[cname] = hash
+	}
+	for cname, sub := range d.dirs {
+		newSub, err := im.buildDir(sub, existingDirs[cname], cname)
+		if err != nil {
+			return nil, err
+		}
+		children[cname] = newSub.Hash
+	}
+
+	var meta *rnode.RawNode
+	switch {
+	case d.meta != nil:
+		meta = d.meta
+	case existing != nil:
+		m := *existing
+		meta = &m
+	default:
+		meta = &rnode.RawNode{
+			Type:    rnode.Dir,
+			Version: rnode.V1,
+			ModTime: time.Now().Unix(),
+		}
+	}
+	meta.Name = name
+	meta.Refs = nil
+	hashes := []string{}
+	for _, hash := range children {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		meta.AddRef(hash)
+	}
+	if err := im.up.PutMeta(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// HTTP handler for importing a tar (optionally gzipped) or zip archive (sent as the request body) into a FS
+// directory, the archive is merged with the existing directory, and a single FS version is created.
+func (ft *FileTree) importHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Archives can only be imported into a FS")
+			return
+		}
+		fsName := vars["name"]
+		path := "/" + vars["path"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Write, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		mtime, err := q.GetInt64Default("mtime", time.Now().Unix())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid mtime")
+			return
+		}
+
+		// Upload the archive content first
+		im := newImporter(ctx, ft)
+		if err := im.importArchive(r.Body, ft.conf.VarDir()); err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to import the archive: %v", err))
+			return
+		}
+
+		fs, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		node, _, created, err := fs.Path(ctx, path, 1, true, mtime)
+		if err != nil {
+			panic(err)
+		}
+		var existing *rnode.RawNode
+		if !created {
+			if node.Meta.Type != rnode.Dir {
+				httputil.WriteJSONError(w, http.StatusConflict, "Archives can only be imported into a directory")
+				return
+			}
+			existing = node.Meta
+		}
+
+		if hash := r.Header.Get("If-Match"); hash != "" {
+			if node.Hash != hash {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
+
+		if im.root.meta == nil {
+			root := &rnode.RawNode{Type: rnode.Dir, Version: rnode.V1}
+			if existing != nil {
+				m := *existing
+				root = &m
+			}
+			root.ModTime = mtime
+			im.root.meta = root
+		}
+		meta, err := im.buildDir(im.root, existing, node.Name)
+		if err != nil {
+			panic(err)
+		}
+
+		// Update the FS (a single version is created)
+		newNode, revision, err := ft.Update(ctx, node, meta, prefixFmt, true)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+
+		evtType := "dir-updated"
+		if created {
+			evtType = "dir-created"
+		}
+		updateEvent := &FSUpdateEvent{
+			Name:      fs.Name,
+			Type:      evtType,
+			Ref:       newNode.Hash,
+			Path:      path[1:],
+			Time:      time.Now().UTC().Unix(),
+			SessionID: httputil.GetSessionID(r),
+		}
+		if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"node":     newNode,
+			"imported": im.count,
+			"skipped":  im.skipped,
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package filetree
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/valyala/gozstd"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func TestImport(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	ft := &FileTree{blobStore: bs}
+	for _, content := range []string{"a", "b", "c"} {
+		bs.blobs["chunk-"+content] = []byte(content)
+	}
+	root := bs.dir("_root",
+		bs.file("a.txt", "a"),
+		bs.dir("docs", bs.file("b.txt", "b")),
+		bs.put(&rnode.RawNode{Type: rnode.Symlink, Name: "link", Target: "a.txt"}),
+	)
+	// The imported archive is merged with the existing directory
+	existing := bs.dir("_root",
+		bs.file("a.txt", "c"),
+		bs.file("c.txt", "c"),
+		bs.dir("docs", bs.file("c.txt", "c")),
+	)
+	expected := map[string]string{
+		"a.txt": "a", "c.txt": "c", "docs/": "", "docs/b.txt": "b", "docs/c.txt": "c", "link": "a.txt",
+	}
+
+	for _, format := range []string{ExportTgz, ExportZip} {
+		var buf bytes.Buffer
+		e := newExporter(context.TODO(), ft, &buf, format)
+		if err := e.export(root, "", ""); err != nil {
+			panic(err)
+		}
+		if err := e.Close(); err != nil {
+			panic(err)
+		}
+
+		im := newImporter(context.TODO(), ft)
+		if err := im.importArchive(&buf, os.TempDir()); err != nil {
+			t.Fatalf("%s import failed: %v", format, err)
+		}
+		if im.count != 4 {
+			t.Errorf("%s import failed, got %d entries, expected 4", format, im.count)
+		}
+		newRoot, err := im.buildDir(im.root, existing, "_root")
+		if err != nil {
+			panic(err)
+		}
+
+		// Re-export the new tree for checking its content
+		var out bytes.Buffer
+		e = newExporter(context.TODO(), ft, &out, ExportTar)
+		if err := e.export(newRoot, "", ""); err != nil {
+			panic(err)
+		}
+		if err := e.Close(); err != nil {
+			panic(err)
+		}
+		got := map[string]string{}
+		tr := tar.NewReader(&out)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				panic(err)
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				data = []byte(hdr.Linkname)
+			}
+			got[hdr.Name] = string(data)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s import failed, got %+v, expected %+v", format, got, expected)
+		}
+	}
+
+	// The FIFOs and the devices are imported from a zstd-compressed tar
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	for _, hdr := range []*tar.Header{
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+		{Name: "null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	im := newImporter(context.TODO(), ft)
+	if err := im.importArchive(bytes.NewReader(gozstd.Compress(nil, tbuf.Bytes())), os.TempDir()); err != nil {
+		t.Fatalf("zstd import failed: %v", err)
+	}
+	if im.count != 2 || im.skipped != 0 {
+		t.Errorf("zstd import failed, got %d entries (%d skipped), expected 2", im.count, im.skipped)
+	}
+	for name, expected := range map[string]*rnode.RawNode{
+		"fifo": &rnode.RawNode{Type: rnode.Fifo, Mode: uint32(os.ModeNamedPipe | 0600)},
+		"null": &rnode.RawNode{Type: rnode.CharDevice, Mode: uint32(os.ModeDevice | os.ModeCharDevice | 0666), Rdev: 0x103},
+	} {
+		n, err := rnode.NewNodeFromBlob(im.root.nodes[name], bs.blobs[im.root.nodes[name]])
+		if err != nil {
+			panic(err)
+		}
+		if n.Type != expected.Type || n.Mode != expected.Mode || n.Rdev != expected.Rdev {
+			t.Errorf("bad node for %s, got %+v", name, n)
+		}
+	}
+
+	// The paths escaping the root are rejected
+	var buf bytes.Buffer
+	tw = tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644}); err != nil {
+		panic(err)
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := newImporter(context.TODO(), ft).importArchive(&buf, os.TempDir()); err == nil {
+		t.Errorf("import of an invalid path should fail")
+	}
+}
@@ -0,0 +1,344 @@
+package reader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+)
+
+// RestoreResult holds the stats of a restore
+type RestoreResult struct {
+	FilesCount    int
+	DirsCount     int
+	SymlinksCount int
+	Size          int
+}
+
+// Restorer restores a tree to a local directory
+type Restorer struct {
+	bs filereader.BlobStore
+
+	// Patterns (matched against the slash-separated path relative to the root, or the basename) for filtering the
+	// restored files, the exclude patterns take precedence
+	Include []string
+	Exclude []string
+
+	// Number of chunks downloaded in parallel
+	Workers int
+
+	res   *RestoreResult
+	links map[string]string // hardlink group => destination path of the first restored file of the group
+	mu    sync.Mutex        // for guarding res
+}
+
+// OS-specific helpers (only supported on Linux)
+var (
+	// mknod creates a FIFO or a device
+	mknod func(path string, n *node.RawNode) error
+	// setXattrs sets the extended attributes
+	setXattrs func(path string, xattrs []*node.Xattr) error
+)
+
+// NewRestorer initializes a new restorer
+func NewRestorer(bs filereader.BlobStore) *Restorer {
+	return &Restorer{
+		bs:      bs,
+		Workers: 4,
+	}
+}
+
+// MatchPatterns returns true if one of the glob patterns matches the slash-separated path, its basename or one of its
+// parent directories
+func MatchPatterns(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+		// Also match the parent directories
+		for p := rel; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Restorer) included(rel string) bool {
+	return len(r.Include) == 0 || MatchPatterns(r.Include, rel)
+}
+
+func (r *Restorer) excluded(rel string) bool {
+	return MatchPatterns(r.Exclude, rel)
+}
+
+func (r *Restorer) fetchNode(ctx context.Context, hash string) (*node.RawNode, error) {
+	blob, err := r.bs.Get(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node %s: %v", hash, err)
+	}
+	return node.NewNodeFromBlob(hash, blob)
+}
+
+// Restore restores the tree (the root node must be a directory) to the given path, the file contents are verified
+// against the `blake2b-hash` metadata.
+func (r *Restorer) Restore(ctx context.Context, hash, dst string) (*RestoreResult, error) {
+	r.res = &RestoreResult{}
+	r.links = map[string]string{}
+	root, err := r.fetchNode(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if root.Type != node.Dir {
+		return nil, fmt.Errorf("root node %s is not a directory", hash)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+	if err := r.restoreDir(ctx, root, dst, ""); err != nil {
+		return nil, err
+	}
+	return r.res, nil
+}
+
+func (r *Restorer) restoreDir(ctx context.Context, n *node.RawNode, dst, rel string) error {
+	for _, ref := range n.Refs {
+		child, err := r.fetchNode(ctx, ref.(string))
+		if err != nil {
+			return err
+		}
+		crel := path.Join(rel, child.Name)
+		cdst := filepath.Join(dst, child.Name)
+		if r.excluded(crel) {
+			continue
+		}
+
+		switch child.Type {
+		case node.Dir:
+			// Empty directories are only restored when there's no include filters
+			if len(r.Include) == 0 {
+				if err := os.MkdirAll(cdst, 0755); err != nil {
+					return err
+				}
+			}
+			if err := r.restoreDir(ctx, child, cdst, crel); err != nil {
+				return err
+			}
+		case node.Symlink:
+			if !r.included(crel) {
+				continue
+			}
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(child.Target, cdst); err != nil {
+				return err
+			}
+			if err := setOwner(child, cdst); err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.res.SymlinksCount++
+			r.mu.Unlock()
+		case node.Fifo, node.CharDevice, node.BlockDevice:
+			if !r.included(crel) {
+				continue
+			}
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			if mknod == nil {
+				return fmt.Errorf("failed to restore %s: %s not supported", crel, child.Type)
+			}
+			if err := mknod(cdst, child); err != nil {
+				return fmt.Errorf("failed to restore %s: %v", crel, err)
+			}
+			if err := setMeta(child, cdst, 0); err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.res.FilesCount++
+			r.mu.Unlock()
+		default:
+			if !r.included(crel) {
+				continue
+			}
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+			// Re-create the hardlink if a file of the group has already been restored (the group is identified by the
+			// path of its first file)
+			group := child.Link
+			if group == "" {
+				group = crel
+			}
+			if restored, ok := r.links[group]; ok {
+				if err := os.Link(restored, cdst); err != nil {
+					return fmt.Errorf("failed to restore %s: %v", crel, err)
+				}
+				r.mu.Lock()
+				r.res.FilesCount++
+				r.mu.Unlock()
+				continue
+			}
+			if err := r.restoreFile(ctx, child, cdst); err != nil {
+				return fmt.Errorf("failed to restore %s: %v", crel, err)
+			}
+			r.links[group] = cdst
+		}
+	}
+
+	// Set the dir mode/mtime once the children are restored (if it has been created)
+	if _, err := os.Stat(dst); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	r.mu.Lock()
+	r.res.DirsCount++
+	r.mu.Unlock()
+	return setMeta(n, dst, 0755)
+}
+
+// setOwner restores the ownership (only if running as root)
+func setOwner(n *node.RawNode, dst string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(dst, n.Uid, n.Gid)
+}
+
+// setMeta restores the ownership, the extended attributes, the mode and the mtime
+func setMeta(n *node.RawNode, dst string, defaultMode os.FileMode) error {
+	// The ownership must be set first as chown clears the setuid/setgid bits
+	if err := setOwner(n, dst); err != nil {
+		return err
+	}
+	if len(n.Xattrs) > 0 && setXattrs != nil {
+		if err := setXattrs(dst, n.Xattrs); err != nil {
+			return err
+		}
+	}
+
+	mode := defaultMode
+	if n.Mode != 0 {
+		mode = os.FileMode(n.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+	if n.ModTime > 0 {
+		mtime := time.Unix(n.ModTime, 0)
+		if err := os.Chtimes(dst, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk represents a file chunk to download
+type chunk struct {
+	start int64
+	end   int64
+	hash  string
+}
+
+func (r *Restorer) restoreFile(ctx context.Context, n *node.RawNode, dst string) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Download the chunks in parallel, and write them at the right offset
+	chunks := make(chan *chunk)
+	errc := make(chan error, r.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < r.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				data, err := r.bs.Get(ctx, c.hash)
+				if err == nil && int64(len(data)) != c.end-c.start {
+					err = fmt.Errorf("chunk %s has size %d, expected %d", c.hash, len(data), c.end-c.start)
+				}
+				if err == nil {
+					_, err = f.WriteAt(data, c.start)
+				}
+				if err != nil {
+					errc <- err
+					// Drain the remaining chunks
+					for range chunks {
+					}
+					return
+				}
+			}
+		}()
+	}
+	var start int64
+	for _, iv := range n.FileRefs() {
+		chunks <- &chunk{start: start, end: iv.Index, hash: iv.Value}
+		start = iv.Index
+	}
+	close(chunks)
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		return err
+	}
+
+	if err := f.Truncate(int64(n.Size)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := verifyFile(n, dst); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.res.FilesCount++
+	r.res.Size += n.Size
+	r.mu.Unlock()
+
+	return setMeta(n, dst, 0644)
+}
+
+// verifyFile checks the restored file against the `blake2b-hash` metadata (if any)
+func verifyFile(n *node.RawNode, dst string) error {
+	expected, ok := n.Metadata["blake2b-hash"].(string)
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", h.Sum(nil)); !strings.EqualFold(got, expected) {
+		return fmt.Errorf("hash mismatch, got %s, expected %s", got, expected)
+	}
+	return nil
+}
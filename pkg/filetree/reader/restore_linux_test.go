@@ -0,0 +1,86 @@
+package reader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree/writer"
+)
+
+func TestRestoreSpecialFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "blobstash_restore_src")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "blobstash_restore_dst")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := os.Mkdir(filepath.Join(src, "private"), 0700); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "private", "a.txt"), []byte("hello"), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.Link(filepath.Join(src, "private", "a.txt"), filepath.Join(src, "b.txt")); err != nil {
+		panic(err)
+	}
+	if err := os.Symlink("private/a.txt", filepath.Join(src, "link")); err != nil {
+		panic(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "fifo"), 0600); err != nil {
+		panic(err)
+	}
+	withXattr := true
+	if err := syscall.Setxattr(filepath.Join(src, "private", "a.txt"), "user.blobstash", []byte("ok"), 0); err != nil {
+		t.Logf("xattrs not supported: %v", err)
+		withXattr = false
+	}
+
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	root, err := writer.NewUploader(bs).PutDir(src)
+	if err != nil {
+		panic(err)
+	}
+
+	res, err := NewRestorer(bs).Restore(context.Background(), root.Hash, dst)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	t.Logf("res=%+v", res)
+
+	if fi, err := os.Stat(filepath.Join(dst, "private")); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("bad dir mode: %v %v", fi, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "private/a.txt" {
+		t.Errorf("bad symlink %q: %v", target, err)
+	}
+	fi1, err := os.Stat(filepath.Join(dst, "private", "a.txt"))
+	if err != nil {
+		panic(err)
+	}
+	fi2, err := os.Stat(filepath.Join(dst, "b.txt"))
+	if err != nil {
+		panic(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("hardlink not restored")
+	}
+	if fi, err := os.Lstat(filepath.Join(dst, "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("bad fifo: %v %v", fi, err)
+	}
+	if withXattr {
+		buf := make([]byte, 16)
+		sz, err := syscall.Getxattr(filepath.Join(dst, "b.txt"), "user.blobstash", buf)
+		if err != nil || string(buf[:sz]) != "ok" {
+			t.Errorf("xattr not restored: %v", err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package reader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"a4.io/blobstash/pkg/filetree/writer"
+)
+
+type memBlobStore struct {
+	blobs map[string][]byte
+	mu    sync.Mutex
+}
+
+func (bs *memBlobStore) Get(_ context.Context, hash string) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.blobs[hash], nil
+}
+
+func (bs *memBlobStore) Stat(_ context.Context, hash string) (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	_, ok := bs.blobs[hash]
+	return ok, nil
+}
+
+func (bs *memBlobStore) Put(_ context.Context, hash string, data []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.blobs[hash] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "blobstash_restore_src")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "blobstash_restore_dst")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dst)
+
+	big := make([]byte, 5<<20)
+	rand.New(rand.NewSource(42)).Read(big)
+	files := map[string][]byte{
+		"a.txt":        []byte("hello"),
+		"sub/big.bin":  big,
+		"sub/skip.log": []byte("skipped"),
+	}
+	for p, data := range files {
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(p)), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, p), data, 0600); err != nil {
+			panic(err)
+		}
+	}
+
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	root, err := writer.NewUploader(bs).PutDir(src)
+	if err != nil {
+		panic(err)
+	}
+
+	rs := NewRestorer(bs)
+	rs.Exclude = []string{"*.log"}
+	res, err := rs.Restore(context.Background(), root.Hash, dst)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+	if res.FilesCount != 2 || res.Size != len(big)+5 {
+		t.Errorf("unexpected result %+v", res)
+	}
+
+	for p, data := range files {
+		restored, err := ioutil.ReadFile(filepath.Join(dst, p))
+		if filepath.Ext(p) == ".log" {
+			if !os.IsNotExist(err) {
+				t.Errorf("%s should have been excluded", p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", p, err)
+		}
+		if !bytes.Equal(restored, data) {
+			t.Errorf("%s content mismatch", p)
+		}
+		if fi, _ := os.Stat(filepath.Join(dst, p)); fi.Mode().Perm() != 0600 {
+			t.Errorf("%s bad mode %v", p, fi.Mode())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package reader
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+func init() {
+	mknod = func(path string, n *node.RawNode) error {
+		mode := uint32(os.FileMode(n.Mode) & os.ModePerm)
+		switch n.Type {
+		case node.Fifo:
+			mode |= syscall.S_IFIFO
+		case node.CharDevice:
+			mode |= syscall.S_IFCHR
+		case node.BlockDevice:
+			mode |= syscall.S_IFBLK
+		default:
+			return fmt.Errorf("unexpected node type %s", n.Type)
+		}
+		return syscall.Mknod(path, mode, int(n.Rdev))
+	}
+
+	setXattrs = func(path string, xattrs []*node.Xattr) error {
+		for _, xattr := range xattrs {
+			if err := syscall.Setxattr(path, xattr.Name, xattr.Value, 0); err != nil {
+				// The FS may not support them, and some namespaces (like `trusted`) requires privileges
+				if err == syscall.ENOTSUP || err == syscall.EPERM {
+					continue
+				}
+				return fmt.Errorf("failed to set xattr %s: %v", xattr.Name, err)
+			}
+		}
+		return nil
+	}
+}
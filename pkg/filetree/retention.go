@@ -0,0 +1,215 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+	"a4.io/blobstash/pkg/vkv"
+)
+
+// PruneResult holds the snapshots kept and removed by a prune
+type PruneResult struct {
+	DryRun bool        `json:"dry_run"`
+	Kept   []*Snapshot `json:"kept"`
+	Pruned []*Snapshot `json:"pruned"`
+}
+
+// retain returns the versions (sorted most recent first) to keep according to the policy, the most recent version is
+// always kept.
+// For the daily/weekly/monthly rules, the most recent version of each period is kept (for the given number of periods).
+func retain(versions []int64, policy *config.RetentionPolicy) map[int64]bool {
+	keep := map[int64]bool{}
+	if len(versions) == 0 {
+		return keep
+	}
+	keep[versions[0]] = true
+	for i := 0; i < policy.KeepLast && i < len(versions); i++ {
+		keep[versions[i]] = true
+	}
+
+	buckets := []struct {
+		n      int
+		bucket func(time.Time) string
+	}{
+		{policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, b := range buckets {
+		var last string
+		var count int
+		for _, v := range versions {
+			if count == b.n {
+				break
+			}
+			current := b.bucket(time.Unix(0, v).UTC())
+			if current == last {
+				continue
+			}
+			last = current
+			keep[v] = true
+			count++
+		}
+	}
+	return keep
+}
+
+// retentionPolicy returns the retention policy of the FS defined in the config (if any)
+func (ft *FileTree) retentionPolicy(name string) *config.RetentionPolicy {
+	if ft.conf.Filetree == nil || ft.conf.Filetree.Retention == nil {
+		return nil
+	}
+	return ft.conf.Filetree.Retention[name]
+}
+
+// Prune removes the FS snapshots that are not retained by the policy (nothing is removed if `dryRun` is true).
+//
+// Only the kv versions are removed: the GC of a stash won't keep the blobs that are only referenced by the pruned
+// snapshots (see `mark_filetree_fs` in the GC script). The snapshots are pruned from both the stash and the root
+// (`blobstash-uploader` creates the snapshots in a stash and its GC step moves them to the root), the root blobstore
+// is append-only so the blobs of the snapshots pruned from the root stay stored but are not referenced anymore.
+func (ft *FileTree) Prune(ctx context.Context, name, prefixFmt string, policy *config.RetentionPolicy, dryRun bool) (*PruneResult, error) {
+	key := fmt.Sprintf(prefixFmt, name)
+	kvv, _, err := ft.kvStore.Versions(ctx, key, "0", -1)
+	if err != nil {
+		return nil, err
+	}
+
+	// The snapshots moved to the root by the GC may still be stored in the stash
+	kvs := []*vkv.KeyValue{}
+	versions := []int64{}
+	for _, kv := range kvv.Versions {
+		if len(versions) > 0 && versions[len(versions)-1] == kv.Version {
+			continue
+		}
+		kvs = append(kvs, kv)
+		versions = append(versions, kv.Version)
+	}
+	keep := retain(versions, policy)
+
+	res := &PruneResult{DryRun: dryRun, Kept: []*Snapshot{}, Pruned: []*Snapshot{}}
+	for _, kv := range kvs {
+		snap := &Snapshot{
+			CreatedAt: kv.Version,
+			Ref:       kv.HexHash(),
+		}
+		if err := msgpack.Unmarshal(kv.Data, snap); err != nil {
+			return nil, err
+		}
+		if keep[kv.Version] {
+			res.Kept = append(res.Kept, snap)
+			continue
+		}
+		res.Pruned = append(res.Pruned, snap)
+	}
+	if dryRun {
+		return res, nil
+	}
+
+	ns, _ := ctxutil.Namespace(ctx)
+	rootCtx := ctxutil.WithNamespace(ctx, "")
+	for _, snap := range res.Pruned {
+		if err := ft.kvStore.DeleteVersion(rootCtx, key, snap.CreatedAt); err != nil && err != vkv.ErrNotFound {
+			return nil, err
+		}
+		if ns == "" {
+			continue
+		}
+		if err := ft.kvStore.DeleteVersion(ctx, key, snap.CreatedAt); err != nil && err != vkv.ErrNotFound {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// applyRetention prunes the snapshots of the FS if a retention policy is defined in the config, it's called each time
+// a snapshot is created (i.e. on each `blobstash-uploader` run)
+func (ft *FileTree) applyRetention(ctx context.Context, name string) error {
+	policy := ft.retentionPolicy(name)
+	if policy == nil {
+		return nil
+	}
+	res, err := ft.Prune(ctx, name, FSKeyFmt, policy, false)
+	if err != nil {
+		return err
+	}
+	if len(res.Pruned) > 0 {
+		ft.log.Info("snapshots pruned", "fs", name, "pruned", len(res.Pruned))
+	}
+	return nil
+}
+
+// HTTP handler for pruning the FS snapshots, the policy can be sent as JSON (defaults to the one from the config)
+func (ft *FileTree) pruneHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Only FS can be pruned")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Destroy, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+		prefixFmt := FSKeyFmt
+		if p := r.URL.Query().Get("prefix"); p != "" {
+			prefixFmt = p + ":%s"
+		}
+
+		q := httputil.NewQuery(r.URL.Query())
+		dryRun, err := q.GetBoolDefault("dry_run", false)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid dry_run")
+			return
+		}
+
+		policy := ft.retentionPolicy(fsName)
+		if r.ContentLength != 0 {
+			policy = &config.RetentionPolicy{}
+			if err := httputil.Unmarshal(r, policy); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid retention policy")
+				return
+			}
+		}
+		if policy == nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Missing retention policy")
+			return
+		}
+
+		res, err := ft.Prune(ctx, fsName, prefixFmt, policy, dryRun)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			notFound(w)
+			return
+		default:
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, res)
+	}
+}
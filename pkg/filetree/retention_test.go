@@ -0,0 +1,183 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/blobstore"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/kvstore"
+	"a4.io/blobstash/pkg/meta"
+	"a4.io/blobstash/pkg/stash"
+)
+
+func TestRetain(t *testing.T) {
+	ts := func(s string) int64 {
+		tt, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return tt.UnixNano()
+	}
+	// Most recent first
+	versions := []int64{
+		ts("2018-03-10T20:00:00Z"),
+		ts("2018-03-10T08:00:00Z"),
+		ts("2018-03-09T20:00:00Z"),
+		ts("2018-03-08T20:00:00Z"),
+		ts("2018-03-01T20:00:00Z"),
+		ts("2018-02-20T20:00:00Z"),
+		ts("2018-01-20T20:00:00Z"),
+	}
+	for _, tdata := range []struct {
+		policy   *config.RetentionPolicy
+		expected []int
+	}{
+		{&config.RetentionPolicy{}, []int{0}},
+		{&config.RetentionPolicy{KeepLast: 3}, []int{0, 1, 2}},
+		{&config.RetentionPolicy{KeepDaily: 3}, []int{0, 2, 3}},
+		{&config.RetentionPolicy{KeepWeekly: 2}, []int{0, 4}},
+		{&config.RetentionPolicy{KeepMonthly: 12}, []int{0, 5, 6}},
+		{&config.RetentionPolicy{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2}, []int{0, 2, 5}},
+	} {
+		keep := retain(versions, tdata.policy)
+		got := []int{}
+		for i, v := range versions {
+			if keep[v] {
+				got = append(got, i)
+			}
+		}
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, tdata.expected) {
+			t.Errorf("policy %+v: expected %v, got %v", tdata.policy, tdata.expected, got)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_prune_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	h := hub.New(logger.New("app", "hub"))
+	metaHandler, err := meta.New(logger.New("app", "meta"), h)
+	if err != nil {
+		panic(err)
+	}
+	bs, err := blobstore.New(logger.New("app", "blobstore"), true, dir, nil, h)
+	if err != nil {
+		panic(err)
+	}
+	defer bs.Close()
+	kvs, err := kvstore.New(logger.New("app", "kvstore"), dir, bs, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+	defer kvs.Close()
+	s, err := stash.New(filepath.Join(dir, "stash"), metaHandler, bs, kvs, h, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	if _, err := s.NewDataContext("tmp"); err != nil {
+		panic(err)
+	}
+	ft := &FileTree{kvStore: s.KvStore(), conf: &config.Config{}, log: logger}
+
+	rootCtx := context.Background()
+	tmpCtx := ctxutil.WithNamespace(context.Background(), "tmp")
+	putSnapshot := func(ctx context.Context, name string, version int64) {
+		data, err := msgpack.Marshal(&Snapshot{Hostname: "test"})
+		if err != nil {
+			panic(err)
+		}
+		if _, err := s.KvStore().Put(ctx, fmt.Sprintf(FSKeyFmt, name), "", data, version); err != nil {
+			panic(err)
+		}
+	}
+	versions := func(ctx context.Context, name string) int {
+		kvv, _, err := s.KvStore().Versions(ctx, fmt.Sprintf(FSKeyFmt, name), "0", -1)
+		if err != nil {
+			panic(err)
+		}
+		return len(kvv.Versions)
+	}
+	policy := &config.RetentionPolicy{KeepLast: 1}
+
+	// "fs1" was uploaded by `blobstash-uploader` (the previous snapshots were moved to the root by the GC, version 2
+	// is still in the stash too), "fs2" only has snapshots in the stash and "fs3" only in the root
+	for i := int64(2); i < 5; i++ {
+		putSnapshot(tmpCtx, "fs1", i)
+		putSnapshot(tmpCtx, "fs2", i)
+		putSnapshot(rootCtx, "fs3", i)
+	}
+	for i := int64(1); i < 3; i++ {
+		putSnapshot(rootCtx, "fs1", i)
+	}
+
+	res, err := ft.Prune(rootCtx, "fs1", FSKeyFmt, policy, true)
+	if err != nil {
+		panic(err)
+	}
+	if len(res.Pruned) != 1 || len(res.Kept) != 1 {
+		t.Errorf("bad dry run result %+v", res)
+	}
+	if n := versions(rootCtx, "fs1"); n != 2 {
+		t.Errorf("expected 2 snapshots, got %d", n)
+	}
+
+	// The retention policy from the config is applied when a snapshot is created
+	ft.conf.Filetree = &config.FiletreeConfig{Retention: map[string]*config.RetentionPolicy{"fs1": {KeepLast: 3}}}
+	if err := ft.applyRetention(tmpCtx, "fs1"); err != nil {
+		panic(err)
+	}
+	if n := versions(tmpCtx, "fs1"); n != 4 {
+		t.Errorf("expected 4 snapshots (version 2 is in both the root and the stash), got %d", n)
+	}
+	if n := versions(rootCtx, "fs1"); n != 1 {
+		t.Errorf("expected 1 snapshot in the root, got %d", n)
+	}
+	if err := ft.applyRetention(tmpCtx, "fs2"); err != nil {
+		panic(err)
+	}
+	if n := versions(tmpCtx, "fs2"); n != 3 {
+		t.Errorf("the snapshots of a FS without a policy should be kept, got %d", n)
+	}
+
+	res, err = ft.Prune(rootCtx, "fs3", FSKeyFmt, policy, false)
+	if err != nil {
+		panic(err)
+	}
+	if len(res.Pruned) != 2 || len(res.Kept) != 1 || res.Kept[0].CreatedAt != 4 {
+		t.Errorf("bad prune result %+v", res)
+	}
+	if n := versions(rootCtx, "fs3"); n != 1 {
+		t.Errorf("expected 1 snapshot, got %d", n)
+	}
+
+	res, err = ft.Prune(tmpCtx, "fs2", FSKeyFmt, policy, false)
+	if err != nil {
+		panic(err)
+	}
+	if len(res.Pruned) != 2 || len(res.Kept) != 1 || res.Kept[0].CreatedAt != 4 {
+		t.Errorf("bad prune result %+v", res)
+	}
+	if n := versions(tmpCtx, "fs2"); n != 1 {
+		t.Errorf("expected 1 snapshot, got %d", n)
+	}
+}
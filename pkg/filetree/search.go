@@ -0,0 +1,399 @@
+package filetree
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/blob"
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/reader/filereader"
+	"a4.io/blobstash/pkg/filetree/search"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/hub"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Default max size of the text files indexed for the full-text search
+const defaultMaxTextSize = 1 << 20
+
+// searchIndexer keeps the search index in sync with the FS (updated in the background on `FiletreeFSUpdate` events)
+type searchIndexer struct {
+	ft   *FileTree
+	idx  *search.Index
+	conf *config.FiletreeSearchIndexConfig
+
+	pending map[fsRef]struct{} // FS to re-index
+	wake    chan struct{}
+	stop    chan struct{}
+	pmu     sync.Mutex // for guarding pending
+
+	mu sync.Mutex // only one index update at a time
+}
+
+func newSearchIndexer(ft *FileTree, conf *config.FiletreeSearchIndexConfig) (*searchIndexer, error) {
+	idx, err := search.New(filepath.Join(ft.conf.VarDir(), "filetree_search"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the search index: %v", err)
+	}
+	si := &searchIndexer{
+		ft:      ft,
+		idx:     idx,
+		conf:    conf,
+		pending: map[fsRef]struct{}{},
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	if ft.hub != nil {
+		ft.hub.Subscribe(hub.FiletreeFSUpdate, "filetree_search", si.fsUpdateCallback)
+	}
+	go si.worker()
+	return si, nil
+}
+
+// Close stops the worker and closes the index (waiting for the current update)
+func (si *searchIndexer) Close() error {
+	close(si.stop)
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	return si.idx.Close()
+}
+
+// indexed returns true if the FS must be indexed
+func (si *searchIndexer) indexed(name string) bool {
+	if len(si.conf.FS) == 0 {
+		return true
+	}
+	for _, fs := range si.conf.FS {
+		if fs == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fsRef identifies a FS to re-index
+type fsRef struct {
+	ns   string
+	name string
+}
+
+// indexKey returns the name of the FS in the index (the FS are namespaced)
+func indexKey(ns, name string) string {
+	if ns == "" {
+		return name
+	}
+	return ns + ":" + name
+}
+
+// fsUpdateCallback schedules the re-indexing of the updated FS (it must not block the request)
+func (si *searchIndexer) fsUpdateCallback(ctx context.Context, _ *blob.Blob, data interface{}) error {
+	evt := &FSUpdateEvent{}
+	if err := json.Unmarshal([]byte(data.(string)), evt); err != nil {
+		return err
+	}
+	if !si.indexed(evt.Name) {
+		return nil
+	}
+	ns, _ := ctxutil.Namespace(ctx)
+	si.schedule(ns, evt.Name)
+	return nil
+}
+
+// schedule adds the FS to the pending updates and wakes up the worker
+func (si *searchIndexer) schedule(ns, name string) {
+	si.pmu.Lock()
+	si.pending[fsRef{ns, name}] = struct{}{}
+	si.pmu.Unlock()
+	select {
+	case si.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (si *searchIndexer) worker() {
+	for {
+		select {
+		case <-si.stop:
+			return
+		case <-si.wake:
+		}
+		si.pmu.Lock()
+		pending := si.pending
+		si.pending = map[fsRef]struct{}{}
+		si.pmu.Unlock()
+		for ref := range pending {
+			ctx := ctxutil.WithNamespace(context.Background(), ref.ns)
+			if err := si.update(ctx, ref.name); err != nil {
+				si.ft.log.Error("failed to update the search index", "fs", ref.name, "ns", ref.ns, "err", err)
+			}
+		}
+	}
+}
+
+// update brings the index of the FS up to date, only the subtrees that changed since the last update are walked
+func (si *searchIndexer) update(ctx context.Context, name string) error {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	ns, _ := ctxutil.Namespace(ctx)
+	key := indexKey(ns, name)
+
+	fs, err := si.ft.FS(ctx, name, FSKeyFmt, false, 0)
+	if err != nil {
+		return err
+	}
+	if fs.Ref == "" {
+		// The FS has been deleted
+		return si.idx.Drop(key)
+	}
+	indexedRef, err := si.idx.Root(key)
+	if err != nil {
+		return err
+	}
+	if indexedRef == fs.Ref {
+		return nil
+	}
+	root, err := si.fetchNode(ctx, fs.Ref)
+	if err != nil {
+		return err
+	}
+
+	var oldRoot *rnode.RawNode
+	if indexedRef != "" {
+		oldRoot, err = si.fetchNode(ctx, indexedRef)
+		if err != nil {
+			// Rebuild the index from scratch if the previous tree is not available anymore
+			si.ft.log.Warn("failed to fetch the indexed root, rebuilding the search index", "fs", name, "err", err)
+			if err := si.idx.Drop(key); err != nil {
+				return err
+			}
+			oldRoot = nil
+		}
+	}
+
+	if err := si.updateDir(ctx, key, "", oldRoot, root); err != nil {
+		return err
+	}
+	return si.idx.SetRoot(key, fs.Ref)
+}
+
+func (si *searchIndexer) fetchNode(ctx context.Context, hash string) (*rnode.RawNode, error) {
+	blob, err := si.ft.blobStore.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	return rnode.NewNodeFromBlob(hash, blob)
+}
+
+func (si *searchIndexer) children(ctx context.Context, n *rnode.RawNode) (map[string]*rnode.RawNode, error) {
+	out := map[string]*rnode.RawNode{}
+	if n == nil {
+		return out, nil
+	}
+	for _, ref := range n.Refs {
+		child, err := si.fetchNode(ctx, ref.(string))
+		if err != nil {
+			return nil, err
+		}
+		out[child.Name] = child
+	}
+	return out, nil
+}
+
+// updateDir indexes the changes between the two versions of the directory (`old` is nil for a new directory)
+func (si *searchIndexer) updateDir(ctx context.Context, key, p string, old, n *rnode.RawNode) error {
+	oldChildren, err := si.children(ctx, old)
+	if err != nil {
+		return err
+	}
+	newChildren, err := si.children(ctx, n)
+	if err != nil {
+		return err
+	}
+	for name := range oldChildren {
+		if _, ok := newChildren[name]; !ok {
+			if err := si.idx.Remove(key, p+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, child := range newChildren {
+		cp := p + "/" + name
+		oldChild, ok := oldChildren[name]
+		if ok && oldChild.Hash == child.Hash {
+			continue
+		}
+		// Only clear the old entries if it's not a directory update (or everything will be re-indexed)
+		var oldDir *rnode.RawNode
+		if ok {
+			if oldChild.Type == rnode.Dir && child.Type == rnode.Dir {
+				oldDir = oldChild
+			} else if err := si.idx.Remove(key, cp); err != nil {
+				return err
+			}
+		}
+		if err := si.put(ctx, key, cp, child); err != nil {
+			return err
+		}
+		if child.Type == rnode.Dir {
+			if err := si.updateDir(ctx, key, cp, oldDir, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// put indexes a single node
+func (si *searchIndexer) put(ctx context.Context, key, p string, n *rnode.RawNode) error {
+	e := &search.Entry{
+		Path:    p,
+		Ref:     n.Hash,
+		Name:    n.Name,
+		Type:    n.Type,
+		Size:    n.Size,
+		ModTime: n.ModTime,
+	}
+	var text string
+	if n.Type == rnode.File {
+		e.Ext = search.Ext(n.Name)
+		e.Mime = n.ContentType()
+
+		switch e.Ext {
+		case "jpg", "png", "gif":
+			f := filereader.NewFile(ctx, si.ft.blobStore, n, nil)
+			info, err := si.ft.fetchInfo(f, n.Name, n.Hash)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			e.Image = info.Image
+		}
+
+		maxSize := si.conf.MaxTextSize
+		if maxSize == 0 {
+			maxSize = defaultMaxTextSize
+		}
+		if si.conf.FullText && strings.HasPrefix(e.Mime, "text/") && n.Size <= maxSize {
+			f := filereader.NewFile(ctx, si.ft.blobStore, n, nil)
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if utf8.Valid(data) {
+				text = string(data)
+			}
+		}
+	}
+	return si.idx.Put(key, e, text)
+}
+
+// HTTP handler for searching the nodes of a FS using the search index
+func (ft *FileTree) fsSearchHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		vars := mux.Vars(r)
+		if vars["type"] != "fs" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Only FS can be searched")
+			return
+		}
+		fsName := vars["name"]
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(perms.Search, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+		if ft.searchIndexer == nil || !ft.searchIndexer.indexed(fsName) {
+			httputil.WriteJSONError(w, http.StatusNotFound, "FS not indexed")
+			return
+		}
+		ctx := ctxutil.WithNamespace(r.Context(), r.Header.Get(ctxutil.NamespaceHeader))
+
+		q := httputil.NewQuery(r.URL.Query())
+		query := &search.Query{
+			Name: q.Get("name"),
+			Path: q.Get("path"),
+			Type: q.Get("type"),
+			Ext:  q.Get("ext"),
+			Mime: q.Get("mime"),
+			Text: q.Get("q"),
+		}
+		var err error
+		if query.Name != "" {
+			if _, err := path.Match(query.Name, ""); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid name pattern")
+				return
+			}
+		}
+		for _, arg := range []struct {
+			name string
+			dst  *int
+		}{{"min_size", &query.MinSize}, {"max_size", &query.MaxSize}} {
+			if *arg.dst, err = q.GetIntDefault(arg.name, 0); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s", arg.name))
+				return
+			}
+		}
+		for _, arg := range []struct {
+			name string
+			dst  *int64
+		}{{"min_mtime", &query.MinModTime}, {"max_mtime", &query.MaxModTime}} {
+			if *arg.dst, err = q.GetInt64Default(arg.name, 0); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s", arg.name))
+				return
+			}
+		}
+		query.Limit, err = q.GetInt("limit", 50, 1000)
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+
+		// The search is served from the current index, if it's behind the FS, the worker will catch up
+		ns, _ := ctxutil.Namespace(ctx)
+		key := indexKey(ns, fsName)
+		fs, err := ft.FS(ctx, fsName, FSKeyFmt, false, 0)
+		if err != nil {
+			panic(err)
+		}
+		indexedRef, err := ft.searchIndexer.idx.Root(key)
+		if err != nil {
+			panic(err)
+		}
+		stale := indexedRef != fs.Ref
+		if stale {
+			ft.searchIndexer.schedule(ns, fsName)
+		}
+
+		results, err := ft.searchIndexer.idx.Search(key, query)
+		if err != nil {
+			panic(err)
+		}
+		httputil.MarshalAndWrite(r, w, map[string]interface{}{
+			"results":     results,
+			"indexed_ref": indexedRef,
+			"stale":       stale,
+		})
+	}
+}
@@ -0,0 +1,390 @@
+/*
+Package search implements a persistent search index for the filetree nodes.
+
+The index is stored locally (in a `rangedb`) and can always be rebuilt from the trees.
+
+For each indexed FS:
+
+	IndexRoot + {fs} => hash of the indexed root
+	IndexEntry + {fs} + 0x00 + {path} => msgpack encoded `Entry`
+	IndexSize + {fs} + 0x00 + {uint64 BE size} + {path} => empty
+	IndexModTime + {fs} + 0x00 + {uint64 BE mtime} + {path} => empty
+	IndexExt + {fs} + 0x00 + {ext} + 0x00 + {path} => empty
+
+The name (and the extracted text, if any) is full-text indexed using `textsearch` (the FS name is used as the
+collection, and the path as the ID).
+*/
+package search // import "a4.io/blobstash/pkg/filetree/search"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/vmihailenco/msgpack"
+
+	"a4.io/blobstash/pkg/docstore/textsearch"
+	"a4.io/blobstash/pkg/filetree/imginfo"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// Define namespaces for raw key sorted in db.
+const (
+	Empty byte = iota
+	IndexRoot
+	IndexEntry
+	IndexSize
+	IndexModTime
+	IndexExt
+)
+
+// Entry holds the indexed fields of a node
+type Entry struct {
+	Path    string         `msgpack:"p" json:"path"`
+	Ref     string         `msgpack:"r" json:"ref"`
+	Name    string         `msgpack:"n" json:"name"`
+	Type    string         `msgpack:"t" json:"type"`
+	Ext     string         `msgpack:"e,omitempty" json:"ext,omitempty"`
+	Mime    string         `msgpack:"m,omitempty" json:"mime,omitempty"`
+	Size    int            `msgpack:"s" json:"size"`
+	ModTime int64          `msgpack:"mt,omitempty" json:"mtime,omitempty"`
+	Image   *imginfo.Image `msgpack:"i,omitempty" json:"image,omitempty"`
+
+	// Set when returned as a full-text search result
+	Score float64 `msgpack:"-" json:"score,omitempty"`
+}
+
+// Ext returns the normalized extension (lowercased, without the dot) of the name
+func Ext(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// Query holds the search criteria, the zero value of each field matches everything
+type Query struct {
+	// Glob pattern matched against the name
+	Name string
+	// Only match the paths within this directory
+	Path string
+	Type string
+	Ext  string
+	// Prefix of the MIME type (like "image/")
+	Mime string
+
+	// Inclusive ranges (a zero max means no upper bound)
+	MinSize    int
+	MaxSize    int
+	MinModTime int64
+	MaxModTime int64
+
+	// Full-text query matched against the names and the extracted text, the results are sorted by score
+	Text string
+
+	Limit int
+}
+
+// match returns true if the entry matches the query
+func (q *Query) match(e *Entry) bool {
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, e.Name); !ok {
+			return false
+		}
+	}
+	if q.Path != "" && q.Path != "/" && !strings.HasPrefix(e.Path, strings.TrimSuffix(q.Path, "/")+"/") {
+		return false
+	}
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+	if q.Ext != "" && e.Ext != strings.ToLower(strings.TrimPrefix(q.Ext, ".")) {
+		return false
+	}
+	if q.Mime != "" && !strings.HasPrefix(e.Mime, q.Mime) {
+		return false
+	}
+	if e.Size < q.MinSize || (q.MaxSize > 0 && e.Size > q.MaxSize) {
+		return false
+	}
+	if e.ModTime < q.MinModTime || (q.MaxModTime > 0 && e.ModTime > q.MaxModTime) {
+		return false
+	}
+	return true
+}
+
+// Index holds the search index for all the FS
+type Index struct {
+	db   *rangedb.RangeDB
+	text *textsearch.Index
+	mu   sync.Mutex
+}
+
+// New opens (or creates) the index at the given path
+func New(path string) (*Index, error) {
+	db, err := rangedb.New(filepath.Join(path, "nodes"))
+	if err != nil {
+		return nil, err
+	}
+	text, err := textsearch.New(filepath.Join(path, "text"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Index{db: db, text: text}, nil
+}
+
+// Close closes the underlying DBs
+func (idx *Index) Close() error {
+	if err := idx.text.Close(); err != nil {
+		return err
+	}
+	return idx.db.Close()
+}
+
+func encodeKey(ns byte, parts ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(ns)
+	for i, p := range parts {
+		if i > 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(p)
+	}
+	return buf.Bytes()
+}
+
+func encodeUint(ns byte, fs string, v uint64, p string) []byte {
+	k := append(encodeKey(ns, fs), 0)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(append(k, buf[:]...), []byte(p)...)
+}
+
+// Root returns the hash of the indexed root of the FS (or an empty string if the FS is not indexed yet)
+func (idx *Index) Root(fs string) (string, error) {
+	data, err := idx.db.Get(encodeKey(IndexRoot, fs))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// SetRoot sets the hash of the indexed root, must be called once the FS has been (re-)indexed
+func (idx *Index) SetRoot(fs, ref string) error {
+	return idx.db.Set(encodeKey(IndexRoot, fs), []byte(ref))
+}
+
+// Get returns the entry for the given path (or nil if the path is not indexed)
+func (idx *Index) Get(fs, p string) (*Entry, error) {
+	data, err := idx.db.Get(encodeKey(IndexEntry, fs, p))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	e := &Entry{}
+	if err := msgpack.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Put (re-)indexes the entry, `text` is the extracted content of the file (can be empty)
+func (idx *Index) Put(fs string, e *Entry, text string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if err := idx.remove(fs, e.Path); err != nil {
+		return err
+	}
+	encoded, err := msgpack.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := idx.db.Set(encodeKey(IndexEntry, fs, e.Path), encoded); err != nil {
+		return err
+	}
+	if err := idx.db.Set(encodeUint(IndexSize, fs, uint64(e.Size), e.Path), nil); err != nil {
+		return err
+	}
+	if err := idx.db.Set(encodeUint(IndexModTime, fs, uint64(e.ModTime), e.Path), nil); err != nil {
+		return err
+	}
+	if e.Ext != "" {
+		if err := idx.db.Set(encodeKey(IndexExt, fs, e.Ext, e.Path), nil); err != nil {
+			return err
+		}
+	}
+	return idx.text.Index(fs, e.Path, map[string]interface{}{"name": nameText(e.Name), "text": text}, []string{"name", "text"})
+}
+
+// nameText splits the name on the punctuation (as "report.pdf" would be a single word)
+func nameText(name string) string {
+	return strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// remove deletes the entry and its secondary keys, must be called with the lock held
+func (idx *Index) remove(fs, p string) error {
+	e, err := idx.Get(fs, p)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return nil
+	}
+	for _, k := range [][]byte{
+		encodeKey(IndexEntry, fs, p),
+		encodeUint(IndexSize, fs, uint64(e.Size), p),
+		encodeUint(IndexModTime, fs, uint64(e.ModTime), p),
+		encodeKey(IndexExt, fs, e.Ext, p),
+	} {
+		if err := idx.db.Delete(k); err != nil {
+			return err
+		}
+	}
+	return idx.text.Remove(fs, p)
+}
+
+// Remove removes the path and everything below it (if it's a directory) from the index
+func (idx *Index) Remove(fs, p string) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	paths := []string{p}
+	c := idx.db.PrefixRange(encodeKey(IndexEntry, fs, strings.TrimSuffix(p, "/")+"/"), false)
+	defer c.Close()
+	prefixLen := len(encodeKey(IndexEntry, fs)) + 1
+	k, _, err := c.Next()
+	for ; err == nil; k, _, err = c.Next() {
+		paths = append(paths, string(k[prefixLen:]))
+	}
+	if err != io.EOF {
+		return err
+	}
+	for _, cp := range paths {
+		if err := idx.remove(fs, cp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop removes all the index entries for the given FS
+func (idx *Index) Drop(fs string) error {
+	if err := idx.Remove(fs, ""); err != nil {
+		return err
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.text.Drop(fs); err != nil {
+		return err
+	}
+	return idx.db.Delete(encodeKey(IndexRoot, fs))
+}
+
+// Search returns the entries matching the query, the most selective index is used to list the candidates which are
+// then filtered with the remaining criteria
+func (idx *Index) Search(fs string, q *Query) ([]*Entry, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	out := []*Entry{}
+	add := func(e *Entry) bool {
+		if q.match(e) {
+			out = append(out, e)
+		}
+		return q.Limit > 0 && len(out) >= q.Limit
+	}
+
+	if q.Text != "" {
+		results, err := idx.text.Search(fs, q.Text)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range results {
+			e, err := idx.Get(fs, res.ID)
+			if err != nil {
+				return nil, err
+			}
+			if e == nil {
+				continue
+			}
+			e.Score = res.Score
+			if add(e) {
+				break
+			}
+		}
+		return out, nil
+	}
+
+	// The other indexes only contains the path, the entry must be fetched
+	var rg *rangedb.Range
+	var prefixLen int
+	switch {
+	case q.Ext != "":
+		prefix := append(encodeKey(IndexExt, fs, strings.ToLower(strings.TrimPrefix(q.Ext, "."))), 0)
+		prefixLen = len(prefix)
+		rg = idx.db.PrefixRange(prefix, false)
+	case q.MinSize > 0 || q.MaxSize > 0:
+		rg = idx.uintRange(IndexSize, fs, uint64(q.MinSize), uint64(q.MaxSize))
+		prefixLen = len(encodeKey(IndexSize, fs)) + 9
+	case q.MinModTime > 0 || q.MaxModTime > 0:
+		rg = idx.uintRange(IndexModTime, fs, uint64(q.MinModTime), uint64(q.MaxModTime))
+		prefixLen = len(encodeKey(IndexModTime, fs)) + 9
+	default:
+		// Scan the entries (sorted by path)
+		prefix := append(encodeKey(IndexEntry, fs), 0)
+		if q.Path != "" && q.Path != "/" {
+			prefix = append(prefix, []byte(strings.TrimSuffix(q.Path, "/")+"/")...)
+		}
+		c := idx.db.PrefixRange(prefix, false)
+		defer c.Close()
+		_, v, err := c.Next()
+		for ; err == nil; _, v, err = c.Next() {
+			e := &Entry{}
+			if err := msgpack.Unmarshal(v, e); err != nil {
+				return nil, err
+			}
+			if add(e) {
+				return out, nil
+			}
+		}
+		if err != io.EOF {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	defer rg.Close()
+	k, _, err := rg.Next()
+	for ; err == nil; k, _, err = rg.Next() {
+		e, err := idx.Get(fs, string(k[prefixLen:]))
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		if add(e) {
+			return out, nil
+		}
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+// uintRange returns a range over the given uint index (a zero max means no upper bound)
+func (idx *Index) uintRange(ns byte, fs string, min, max uint64) *rangedb.Range {
+	if max == 0 {
+		max = 1<<64 - 1
+	}
+	return idx.db.Range(encodeUint(ns, fs, min, ""), encodeUint(ns, fs, max, "\xff"), false)
+}
@@ -0,0 +1,99 @@
+package search
+
+import (
+	"os"
+	"testing"
+)
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+func paths(entries []*Entry) []string {
+	out := []string{}
+	for _, e := range entries {
+		out = append(out, e.Path)
+	}
+	return out
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx, err := New("db_search")
+	check(err)
+	defer os.RemoveAll("db_search")
+	defer idx.Close()
+
+	for _, e := range []*Entry{
+		{Path: "/docs", Name: "docs", Type: "dir"},
+		{Path: "/docs/notes.txt", Name: "notes.txt", Type: "file", Ext: "txt", Mime: "text/plain", Size: 10, ModTime: 100},
+		{Path: "/docs/report.pdf", Name: "report.pdf", Type: "file", Ext: "pdf", Size: 2000, ModTime: 200},
+		{Path: "/photo.JPG", Name: "photo.JPG", Type: "file", Ext: Ext("photo.JPG"), Mime: "image/jpeg", Size: 5000, ModTime: 300},
+	} {
+		text := ""
+		if e.Ext == "txt" {
+			text = "running with the dogs"
+		}
+		check(idx.Put("fs1", e, text))
+	}
+	check(idx.Put("fs2", &Entry{Path: "/notes.txt", Name: "notes.txt", Type: "file", Ext: "txt"}, ""))
+
+	for _, tc := range []struct {
+		q        *Query
+		expected []string
+	}{
+		{&Query{}, []string{"/docs", "/docs/notes.txt", "/docs/report.pdf", "/photo.JPG"}},
+		{&Query{Name: "*.txt"}, []string{"/docs/notes.txt"}},
+		{&Query{Path: "/docs", Type: "file"}, []string{"/docs/notes.txt", "/docs/report.pdf"}},
+		{&Query{Ext: ".jpg"}, []string{"/photo.JPG"}},
+		{&Query{Mime: "image/"}, []string{"/photo.JPG"}},
+		{&Query{MinSize: 1000}, []string{"/docs/report.pdf", "/photo.JPG"}},
+		{&Query{MinSize: 1000, MaxSize: 3000}, []string{"/docs/report.pdf"}},
+		{&Query{MinModTime: 150, MaxModTime: 250}, []string{"/docs/report.pdf"}},
+		{&Query{Text: "dog"}, []string{"/docs/notes.txt"}},
+		{&Query{Text: "report"}, []string{"/docs/report.pdf"}},
+		{&Query{Type: "file", Limit: 1}, []string{"/docs/notes.txt"}},
+	} {
+		res, err := idx.Search("fs1", tc.q)
+		check(err)
+		if got := paths(res); len(got) != len(tc.expected) || (len(got) > 0 && got[0] != tc.expected[0]) || (len(got) > 1 && got[len(got)-1] != tc.expected[len(tc.expected)-1]) {
+			t.Errorf("query %+v failed, got %v, expected %v", tc.q, got, tc.expected)
+		}
+	}
+
+	// Re-indexing an entry must update the secondary indexes
+	check(idx.Put("fs1", &Entry{Path: "/docs/report.pdf", Name: "report.pdf", Type: "file", Ext: "pdf", Size: 10}, ""))
+	res, err := idx.Search("fs1", &Query{MinSize: 1000})
+	check(err)
+	if got := paths(res); len(got) != 1 || got[0] != "/photo.JPG" {
+		t.Errorf("expected only /photo.JPG, got %v", got)
+	}
+
+	// Removing a dir removes its content
+	check(idx.Remove("fs1", "/docs"))
+	res, err = idx.Search("fs1", &Query{})
+	check(err)
+	if got := paths(res); len(got) != 1 || got[0] != "/photo.JPG" {
+		t.Errorf("expected only /photo.JPG, got %v", got)
+	}
+	res, err = idx.Search("fs1", &Query{Text: "dogs"})
+	check(err)
+	if len(res) != 0 {
+		t.Errorf("expected no results, got %v", paths(res))
+	}
+
+	// Dropping a FS must not affect the other ones
+	check(idx.SetRoot("fs1", "root"))
+	check(idx.Drop("fs1"))
+	root, err := idx.Root("fs1")
+	check(err)
+	if root != "" {
+		t.Errorf("root should be empty after the drop, got %q", root)
+	}
+	res, err = idx.Search("fs2", &Query{Ext: "txt"})
+	check(err)
+	if got := paths(res); len(got) != 1 || got[0] != "/notes.txt" {
+		t.Errorf("expected /notes.txt, got %v", got)
+	}
+}
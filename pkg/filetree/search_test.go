@@ -0,0 +1,86 @@
+package filetree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"a4.io/blobstash/pkg/config"
+	"a4.io/blobstash/pkg/filetree/search"
+)
+
+func TestSearchIndexUpdate(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	ft := &FileTree{blobStore: bs}
+	for _, content := range []string{"a", "b", "c"} {
+		bs.blobs["chunk-"+content] = []byte(content)
+	}
+
+	dir, err := ioutil.TempDir("", "filetree_search")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	idx, err := search.New(filepath.Join(dir, "index"))
+	if err != nil {
+		panic(err)
+	}
+	defer idx.Close()
+	si := &searchIndexer{ft: ft, idx: idx, conf: &config.FiletreeSearchIndexConfig{FullText: true}}
+
+	indexed := func() []string {
+		res, err := idx.Search("fs", &search.Query{})
+		if err != nil {
+			panic(err)
+		}
+		out := []string{}
+		for _, e := range res {
+			out = append(out, e.Path)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	v1 := bs.dir("_root",
+		bs.file("a.txt", "a"),
+		bs.dir("docs", bs.file("b.txt", "b"), bs.dir("old", bs.file("c.txt", "c"))),
+	)
+	if err := si.updateDir(context.TODO(), "fs", "", nil, v1); err != nil {
+		panic(err)
+	}
+	if got, expected := indexed(), []string{"/a.txt", "/docs", "/docs/b.txt", "/docs/old", "/docs/old/c.txt"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad index, got %v, expected %v", got, expected)
+	}
+
+	// The sub-dir is replaced by a file, and a file is modified
+	v2 := bs.dir("_root",
+		bs.file("a.txt", "a"),
+		bs.dir("docs", bs.file("b.txt", "c"), bs.file("old", "a")),
+	)
+	if err := si.updateDir(context.TODO(), "fs", "", v1, v2); err != nil {
+		panic(err)
+	}
+	if got, expected := indexed(), []string{"/a.txt", "/docs", "/docs/b.txt", "/docs/old"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("bad index, got %v, expected %v", got, expected)
+	}
+	e, err := idx.Get("fs", "/docs/old")
+	if err != nil {
+		panic(err)
+	}
+	if e.Type != "file" {
+		t.Errorf("/docs/old should be a file, got %+v", e)
+	}
+
+	// The content of the text files is indexed
+	res, err := idx.Search("fs", &search.Query{Text: "c"})
+	if err != nil {
+		panic(err)
+	}
+	if len(res) != 1 || res[0].Path != "/docs/b.txt" {
+		t.Errorf("full-text search failed, got %+v", res)
+	}
+}
@@ -0,0 +1,579 @@
+package filetree
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/inconshreveable/log15"
+	"golang.org/x/crypto/blake2b"
+
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+)
+
+// ErrUploadSessionNotFound is returned when the upload session does not exist (or has been finalized)
+var ErrUploadSessionNotFound = errors.New("upload session not found")
+
+// Header containing the number of bytes received for an upload session (like tus.io)
+const uploadOffsetHeader = "Upload-Offset"
+
+var contentRangeRe = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+// uploadSession holds the state of a resumable upload.
+//
+// The received data is spooled to disk (this way the file can be read to extract the info at the end), and the
+// content-defined chunks are uploaded as soon as a chunk boundary is found. Both the chunks refs and the blake2b state
+// are saved after each PUT, so the upload can resume after a restart.
+type uploadSession struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Length    int64                  `json:"length,omitempty"` // 0 if the length is not known yet
+	Offset    int64                  `json:"offset"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	CreatedAt int64                  `json:"created_at"`
+	UpdatedAt int64                  `json:"updated_at"`
+
+	// Offset of the end of the last uploaded chunk
+	ChunkedOffset int64               `json:"chunked_offset"`
+	Refs          []*rnode.IndexValue `json:"refs,omitempty"`
+	HashState     []byte              `json:"hash_state"`
+
+	removed bool // true once the session has been finalized or deleted
+	mu      sync.Mutex
+}
+
+// Default number of hours an upload session can stay inactive before being removed
+const defaultUploadSessionTTL = 24
+
+// Interval between the removal of the stale upload sessions
+const uploadSessionsSweepInterval = 1 * time.Hour
+
+// uploadSessions manages the upload sessions stored in the var directory, the sessions inactive for more than `ttl`
+// are removed periodically
+type uploadSessions struct {
+	dir      string
+	ttl      time.Duration
+	sessions map[string]*uploadSession
+	mu       sync.Mutex
+	stop     chan struct{}
+}
+
+func newUploadSessions(dir string, ttl time.Duration) (*uploadSessions, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &uploadSessions{
+		dir:      dir,
+		ttl:      ttl,
+		sessions: map[string]*uploadSession{},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// sweeper removes the stale sessions periodically (until `close` is called)
+func (us *uploadSessions) sweeper(logger log.Logger) {
+	t := time.NewTicker(uploadSessionsSweepInterval)
+	defer t.Stop()
+	for {
+		n, err := us.removeStale(time.Now())
+		if err != nil {
+			logger.Error("failed to remove the stale upload sessions", "err", err)
+		} else if n > 0 {
+			logger.Info("stale upload sessions removed", "count", n)
+		}
+		select {
+		case <-us.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (us *uploadSessions) close() {
+	close(us.stop)
+}
+
+// removeStale removes the sessions that have not been updated since `ttl`, and returns the number of removed
+// sessions.
+// The chunks already uploaded by a removed session are not referenced, they will stay in the blobstore.
+func (us *uploadSessions) removeStale(now time.Time) (int, error) {
+	files, err := ioutil.ReadDir(us.dir)
+	if err != nil {
+		return 0, err
+	}
+	limit := now.Add(-us.ttl)
+	var n int
+	for _, fi := range files {
+		name := fi.Name()
+		switch filepath.Ext(name) {
+		case ".json":
+			s, err := us.lock(strings.TrimSuffix(name, ".json"))
+			if err != nil {
+				if err == ErrUploadSessionNotFound {
+					continue
+				}
+				return n, err
+			}
+			if time.Unix(s.UpdatedAt, 0).Before(limit) {
+				if err := us.remove(s); err != nil {
+					s.mu.Unlock()
+					return n, err
+				}
+				n++
+			}
+			s.mu.Unlock()
+		case ".data", ".tmp":
+			// Leftovers of a session that failed to be created/saved
+			if _, err := os.Stat(us.metaPath(strings.Split(name, ".")[0])); os.IsNotExist(err) && fi.ModTime().Before(limit) {
+				if err := os.Remove(filepath.Join(us.dir, name)); err != nil && !os.IsNotExist(err) {
+					return n, err
+				}
+			}
+		}
+	}
+	return n, nil
+}
+
+func (us *uploadSessions) metaPath(id string) string {
+	return filepath.Join(us.dir, id+".json")
+}
+
+func (us *uploadSessions) dataPath(id string) string {
+	return filepath.Join(us.dir, id+".data")
+}
+
+// create initializes a new session
+func (us *uploadSessions) create(name, namespace string, length int64, data map[string]interface{}) (*uploadSession, error) {
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	hashState, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Unix()
+	s := &uploadSession{
+		ID:        fmt.Sprintf("%x", rawID),
+		Name:      filepath.Base(name),
+		Namespace: namespace,
+		Length:    length,
+		Data:      data,
+		HashState: hashState,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := ioutil.WriteFile(us.dataPath(s.ID), nil, 0600); err != nil {
+		return nil, err
+	}
+	if err := us.save(s); err != nil {
+		return nil, err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.sessions[s.ID] = s
+	return s, nil
+}
+
+// lock returns the locked session, loading it from disk if needed (after a restart)
+func (us *uploadSessions) lock(id string) (*uploadSession, error) {
+	s, err := us.get(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	// The session may have been removed while waiting for the lock
+	if s.removed {
+		s.mu.Unlock()
+		return nil, ErrUploadSessionNotFound
+	}
+	return s, nil
+}
+
+func (us *uploadSessions) get(id string) (*uploadSession, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if s, ok := us.sessions[id]; ok {
+		return s, nil
+	}
+	if !validSessionID(id) {
+		return nil, ErrUploadSessionNotFound
+	}
+	js, err := ioutil.ReadFile(us.metaPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, err
+	}
+	s := &uploadSession{}
+	if err := json.Unmarshal(js, s); err != nil {
+		return nil, err
+	}
+	us.sessions[id] = s
+	return s, nil
+}
+
+// save persists the session state (atomically)
+func (us *uploadSessions) save(s *uploadSession) error {
+	js, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := us.metaPath(s.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, us.metaPath(s.ID))
+}
+
+// remove deletes the session along with the spooled data
+func (us *uploadSessions) remove(s *uploadSession) error {
+	s.removed = true
+	us.mu.Lock()
+	delete(us.sessions, s.ID)
+	us.mu.Unlock()
+	for _, p := range []string{us.metaPath(s.ID), us.dataPath(s.ID)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validSessionID returns true if the ID is a valid hex-encoded ID (as it's used to build a path)
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *uploadSession) hash() (hash.Hash, error) {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.HashState); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// rawNode returns a raw node containing the uploaded chunks
+func (s *uploadSession) rawNode() *rnode.RawNode {
+	meta := &rnode.RawNode{}
+	for _, ref := range s.Refs {
+		meta.AddIndexedRef(int(ref.Index), ref.Value)
+	}
+	return meta
+}
+
+// errReader records the error returned by the underlying reader
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF {
+		er.err = err
+	}
+	return n, err
+}
+
+// write appends the data at the given offset, and uploads the new chunks.
+// If the reader fails (e.g. the client disconnected), the received data is kept so the client can resume.
+func (us *uploadSessions) write(ctx context.Context, bs writer.BlobStorer, s *uploadSession, r io.Reader) error {
+	h, err := s.hash()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(us.dataPath(s.ID), os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Discard any data that has not been acknowledged
+	if err := f.Truncate(s.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(s.Offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	body := &errReader{r: r}
+	n, err := io.Copy(io.MultiWriter(f, h), body)
+	if err != nil && body.err == nil {
+		// The data could not be written
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.Offset += n
+	if s.HashState, err = h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return err
+	}
+
+	// Upload the complete chunks
+	meta := &rnode.RawNode{}
+	chunked, err := writer.NewUploader(bs).PutChunks(ctx, io.NewSectionReader(f, s.ChunkedOffset, s.Offset-s.ChunkedOffset), meta, int(s.ChunkedOffset), false)
+	if err != nil {
+		return err
+	}
+	s.Refs = append(s.Refs, indexValues(meta)...)
+	s.ChunkedOffset = int64(chunked)
+
+	s.UpdatedAt = time.Now().UTC().Unix()
+	return us.save(s)
+}
+
+// indexValues returns the refs added by `PutChunks`
+func indexValues(meta *rnode.RawNode) []*rnode.IndexValue {
+	out := []*rnode.IndexValue{}
+	for _, m := range meta.Refs {
+		ref := m.([]interface{})
+		out = append(out, &rnode.IndexValue{Index: int64(ref[0].(int)), Value: ref[1].(string)})
+	}
+	return out
+}
+
+// parseContentRange parses a `Content-Range` header like "bytes 0-1023/4096" (the total can be "*")
+func parseContentRange(v string) (int64, int64, int64, error) {
+	m := contentRangeRe.FindStringSubmatch(v)
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	start, _ := strconv.ParseInt(m[1], 10, 64)
+	end, _ := strconv.ParseInt(m[2], 10, 64)
+	var total int64
+	if m[3] != "*" {
+		total, _ = strconv.ParseInt(m[3], 10, 64)
+	}
+	if end < start || (total > 0 && end >= total) {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", v)
+	}
+	return start, end, total, nil
+}
+
+func writeUploadSession(w http.ResponseWriter, r *http.Request, s *uploadSession, writeOptions ...func(http.ResponseWriter)) {
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+	httputil.MarshalAndWrite(r, w, map[string]interface{}{
+		"id":         s.ID,
+		"name":       s.Name,
+		"offset":     s.Offset,
+		"length":     s.Length,
+		"created_at": s.CreatedAt,
+		"updated_at": s.UpdatedAt,
+	}, writeOptions...)
+}
+
+// HTTP handler for creating a new upload session
+func (ft *FileTree) uploadSessionsHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		name := q.Get("name")
+		if name == "" {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Missing name")
+			return
+		}
+		length, err := q.GetInt64Default("length", 0)
+		if err != nil || length < 0 {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid length")
+			return
+		}
+		// Optional metadata (JSON encoded in the `data` query argument)
+		var data map[string]interface{}
+		if d := q.Get("data"); d != "" {
+			if err := json.Unmarshal([]byte(d), &data); err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid data")
+				return
+			}
+		}
+
+		s, err := ft.uploads.create(name, r.Header.Get(ctxutil.NamespaceHeader), length, data)
+		if err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Location", r.URL.Path+"/"+s.ID)
+		writeUploadSession(w, r, s, httputil.WithStatusCode(http.StatusCreated))
+	}
+}
+
+// HTTP handler for writing data to an upload session (using the `Content-Range` header), the current offset can be
+// retrieved using a `HEAD` request
+func (ft *FileTree) uploadSessionHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := ft.uploads.lock(mux.Vars(r)["id"])
+		if err != nil {
+			if err == ErrUploadSessionNotFound {
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			panic(err)
+		}
+		defer s.mu.Unlock()
+
+		switch r.Method {
+		case "GET", "HEAD":
+			if r.Method == "HEAD" {
+				w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+				return
+			}
+			writeUploadSession(w, r, s)
+
+		case "PUT":
+			start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+			if err != nil {
+				httputil.WriteJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			// The data must be sent in order, starting at the last acknowledged offset
+			if start != s.Offset {
+				w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+				httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("expected range to start at %d", s.Offset))
+				return
+			}
+			if total > 0 {
+				if s.Length > 0 && s.Length != total {
+					httputil.WriteJSONError(w, http.StatusBadRequest, "Content-Range total does not match the upload length")
+					return
+				}
+				s.Length = total
+			}
+			if s.Length > 0 && end >= s.Length {
+				httputil.WriteJSONError(w, http.StatusBadRequest, "Content-Range exceeds the upload length")
+				return
+			}
+
+			ctx := ctxutil.WithNamespace(r.Context(), s.Namespace)
+			if err := ft.uploads.write(ctx, &BlobStore{ft.blobStore, ctx}, s, io.LimitReader(r.Body, end-start+1)); err != nil {
+				panic(err)
+			}
+
+			writeUploadSession(w, r, s)
+
+		case "DELETE":
+			if err := ft.uploads.remove(s); err != nil {
+				panic(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HTTP handler for completing the upload, returns the file node
+func (ft *FileTree) uploadSessionFinalizeHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s, err := ft.uploads.lock(mux.Vars(r)["id"])
+		if err != nil {
+			if err == ErrUploadSessionNotFound {
+				httputil.WriteJSONError(w, http.StatusNotFound, err.Error())
+				return
+			}
+			panic(err)
+		}
+		defer s.mu.Unlock()
+
+		if s.Length > 0 && s.Offset != s.Length {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(s.Offset, 10))
+			httputil.WriteJSONError(w, http.StatusConflict, fmt.Sprintf("upload is incomplete (%d/%d)", s.Offset, s.Length))
+			return
+		}
+		q := httputil.NewQuery(r.URL.Query())
+		mtime, err := q.GetInt64Default("mtime", time.Now().Unix())
+		if err != nil {
+			httputil.WriteJSONError(w, http.StatusBadRequest, "Invalid mtime")
+			return
+		}
+
+		ctx := ctxutil.WithNamespace(r.Context(), s.Namespace)
+		f, err := os.Open(ft.uploads.dataPath(s.ID))
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+
+		// Upload the trailing chunk
+		uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+		meta := s.rawNode()
+		if _, err := uploader.PutChunks(ctx, io.NewSectionReader(f, s.ChunkedOffset, s.Offset-s.ChunkedOffset), meta, int(s.ChunkedOffset), true); err != nil {
+			panic(err)
+		}
+
+		h, err := s.hash()
+		if err != nil {
+			panic(err)
+		}
+		meta.Name = s.Name
+		meta.Type = rnode.File
+		meta.Size = int(s.Offset)
+		meta.ModTime = mtime
+		for k, v := range s.Data {
+			meta.AddData(k, v)
+		}
+		meta.AddData("blake2b-hash", fmt.Sprintf("%x", h.Sum(nil)))
+		if err := uploader.PutMeta(meta); err != nil {
+			panic(err)
+		}
+
+		info, err := ft.fetchInfo(f, s.Name, meta.Hash)
+		if err != nil {
+			panic(err)
+		}
+		node, err := MetaToNode(meta)
+		if err != nil {
+			panic(err)
+		}
+		node.Info = info
+
+		if err := ft.uploads.remove(s); err != nil {
+			panic(err)
+		}
+
+		httputil.MarshalAndWrite(r, w, node)
+	}
+}
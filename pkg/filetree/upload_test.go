@@ -0,0 +1,72 @@
+package filetree
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUploadSessionsRemoveStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobstash_uploads_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	us, err := newUploadSessions(dir, 1*time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	stale, err := us.create("stale.txt", "", 0, nil)
+	if err != nil {
+		panic(err)
+	}
+	stale.UpdatedAt = time.Now().Add(-2 * time.Hour).Unix()
+	if err := us.save(stale); err != nil {
+		panic(err)
+	}
+	active, err := us.create("active.txt", "", 0, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	n, err := us.removeStale(time.Now())
+	if err != nil {
+		panic(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 removed session, got %d", n)
+	}
+	if _, err := us.lock(stale.ID); err != ErrUploadSessionNotFound {
+		t.Errorf("expected ErrUploadSessionNotFound, got %v", err)
+	}
+	if _, err := os.Stat(us.dataPath(stale.ID)); !os.IsNotExist(err) {
+		t.Errorf("the session data should have been removed: %v", err)
+	}
+	s, err := us.lock(active.ID)
+	if err != nil {
+		t.Fatalf("the active session should not have been removed: %v", err)
+	}
+	s.mu.Unlock()
+
+	// The sessions are also removed after a restart (i.e. when not loaded in memory)
+	us2, err := newUploadSessions(dir, 1*time.Hour)
+	if err != nil {
+		panic(err)
+	}
+	n, err = us2.removeStale(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		panic(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 removed session, got %d", n)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		panic(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files left, got %d", len(files))
+	}
+}
@@ -0,0 +1,547 @@
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"a4.io/blobsfile"
+	"a4.io/blobstash/pkg/auth"
+	"a4.io/blobstash/pkg/client/clientutil"
+	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/filetree/writer"
+	"a4.io/blobstash/pkg/httputil"
+	"a4.io/blobstash/pkg/perms"
+)
+
+// Lock timeout returned to the WebDAV clients
+const davLockTimeout = 3600
+
+// WebDAV XML responses (the "D:" prefix is hardcoded as `encoding/xml` does not support namespace prefixes)
+type davMultistatus struct {
+	XMLName   xml.Name       `xml:"D:multistatus"`
+	XMLNS     string         `xml:"xmlns:D,attr"`
+	Responses []*davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname,omitempty"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+	SupportedLock davInnerXML     `xml:"D:supportedlock"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+type davInnerXML struct {
+	Inner string `xml:",innerxml"`
+}
+
+const davSupportedLock = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+
+// davHref returns the escaped href of the path
+func davHref(base, p string, dir bool) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	href := base + strings.Join(parts, "/")
+	if dir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+// davPropResponse returns the properties of the node
+func davPropResponse(base, p string, n *rnode.RawNode) *davResponse {
+	prop := davProp{
+		DisplayName:   n.Name,
+		ETag:          fmt.Sprintf("\"%s\"", n.Hash),
+		SupportedLock: davInnerXML{davSupportedLock},
+	}
+	if p == "/" {
+		prop.DisplayName = ""
+	}
+	if n.ModTime > 0 {
+		prop.LastModified = time.Unix(n.ModTime, 0).UTC().Format(http.TimeFormat)
+	}
+	if n.Type == rnode.Dir {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = strconv.Itoa(n.Size)
+		prop.ContentType = n.ContentType()
+		if prop.ContentType == "" {
+			prop.ContentType = "application/octet-stream"
+		}
+	}
+	return &davResponse{
+		Href:     davHref(base, p, n.Type == rnode.Dir),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// davPropNames returns the names (as XML elements) of the properties set in a PROPPATCH request
+func davPropNames(r io.Reader) ([]xml.Name, error) {
+	names := []xml.Name{}
+	dec := xml.NewDecoder(r)
+	// Depth of the current element relative to the <prop> element (0 when outside)
+	var depth int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case depth > 0:
+				if depth == 1 {
+					names = append(names, t.Name)
+				}
+				depth++
+			case t.Name.Space == "DAV:" && t.Name.Local == "prop":
+				depth = 1
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+}
+
+// parseDavDestination parses the `Destination` header of a WebDAV COPY/MOVE request, and returns the destination FS
+// and path
+func parseDavDestination(r *http.Request) (string, string, error) {
+	u, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || u.Path == "" {
+		return "", "", errBadDestination
+	}
+	i := strings.Index(r.URL.Path, "/webdav/")
+	if i == -1 {
+		return "", "", errBadDestination
+	}
+	prefix := r.URL.Path[:i] + "/webdav/"
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", "", errBadDestination
+	}
+	rest := strings.SplitN(u.Path[len(prefix):], "/", 2)
+	// The snapshots are read-only
+	if rest[0] == "" || strings.Contains(rest[0], "@") || len(rest) != 2 {
+		return "", "", errBadDestination
+	}
+	p := gopath.Clean("/" + rest[1])
+	if p == "/" {
+		return "", "", errBadDestination
+	}
+	return rest[0], p, nil
+}
+
+func newLockToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// davNode returns the node at the given path (or nil if it does not exist)
+func (ft *FileTree) davNode(ctx context.Context, fs *FS, p string) (*Node, error) {
+	if fs.Ref == "" {
+		// The FS does not exist yet, it's seen as an empty directory
+		if p == "/" {
+			return MetaToNode(&rnode.RawNode{Type: rnode.Dir, Version: rnode.V1, Name: "_root"})
+		}
+		return nil, nil
+	}
+	node, _, _, err := fs.Path(ctx, p, 1, false, 0)
+	switch err {
+	case nil:
+		return node, nil
+	case clientutil.ErrBlobNotFound, blobsfile.ErrBlobNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// HTTP handler implementing a WebDAV server (class 1 and 2) for a FS, the past versions of the FS can be browsed
+// (read-only) using the `{name}@{as_of}` form.
+func (ft *FileTree) webdavHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fsName := vars["name"]
+		p := gopath.Clean("/" + vars["path"])
+
+		var asOf int64
+		if v := vars["as_of"]; v != "" {
+			var err error
+			asOf, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		action := perms.Write
+		switch r.Method {
+		case "OPTIONS", "GET", "HEAD", "PROPFIND":
+			action = perms.Read
+		case "COPY":
+		default:
+			if asOf > 0 {
+				// The snapshots are read-only (but can be copied)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		if !auth.Can(
+			w,
+			r,
+			perms.Action(action, perms.FS),
+			perms.ResourceWithID(perms.Filetree, perms.FS, fsName),
+		) {
+			auth.Forbidden(w)
+			return
+		}
+
+		ctx := ctxutil.WithFileTreeHostname(r.Context(), r.Header.Get(ctxutil.FileTreeHostnameHeader))
+		ctx = ctxutil.WithNamespace(ctx, r.Header.Get(ctxutil.NamespaceHeader))
+		prefixFmt := FSKeyFmt
+		mtime := time.Now().Unix()
+
+		// The base href is the part of the URL before the path
+		i := strings.Index(r.URL.Path, "/webdav/")
+		base := r.URL.Path[:i] + "/webdav/" + fsName
+		if asOf > 0 {
+			base += "@" + vars["as_of"]
+		}
+
+		fs, err := ft.FS(ctx, fsName, prefixFmt, false, asOf)
+		if err != nil {
+			panic(err)
+		}
+		node, err := ft.davNode(ctx, fs, p)
+		if err != nil {
+			panic(err)
+		}
+
+		// The writes must submit the tokens of the locks covering the modified resources (and their parent if the
+		// membership changes)
+		ns, _ := ctxutil.Namespace(ctx)
+		lockFS := indexKey(ns, fsName)
+		tokens := davIfTokens(r)
+		var locked bool
+		switch r.Method {
+		case "PUT", "MKCOL":
+			locked = ft.davLocks.locked(lockFS, p, false, tokens) ||
+				(node == nil && ft.davLocks.locked(lockFS, gopath.Dir(p), false, tokens))
+		case "PROPPATCH":
+			locked = ft.davLocks.locked(lockFS, p, false, tokens)
+		case "DELETE", "MOVE":
+			locked = ft.davLocks.locked(lockFS, p, true, tokens) || ft.davLocks.locked(lockFS, gopath.Dir(p), false, tokens)
+		}
+		if locked {
+			w.WriteHeader(http.StatusLocked)
+			return
+		}
+
+		newEvent := func(typ, ref, p string) {
+			updateEvent := &FSUpdateEvent{
+				Name:      fsName,
+				Type:      typ,
+				Ref:       ref,
+				Path:      p[1:],
+				Time:      time.Now().UTC().Unix(),
+				SessionID: httputil.GetSessionID(r),
+			}
+			if err := ft.hub.FiletreeFSUpdateEvent(ctx, nil, updateEvent.JSON()); err != nil {
+				panic(err)
+			}
+		}
+
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("DAV", "1, 2")
+			w.Header().Set("MS-Author-Via", "DAV")
+			w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK")
+			w.WriteHeader(http.StatusOK)
+
+		case "PROPFIND":
+			if node == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			ms := &davMultistatus{XMLNS: "DAV:", Responses: []*davResponse{davPropResponse(base, p, node.Meta)}}
+			// "infinity" is handled like "1"
+			if r.Header.Get("Depth") != "0" && node.Type == rnode.Dir {
+				for _, child := range node.Children {
+					ms.Responses = append(ms.Responses, davPropResponse(base, gopath.Join(p, child.Name), child.Meta))
+				}
+			}
+			out, err := xml.Marshal(ms)
+			if err != nil {
+				panic(err)
+			}
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write([]byte(xml.Header))
+			w.Write(out)
+
+		case "PROPPATCH":
+			// The dead properties are not stored, but they are reported as set (some clients fails otherwise)
+			if node == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			names, err := davPropNames(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var buf bytes.Buffer
+			buf.WriteString(xml.Header)
+			buf.WriteString(`<D:multistatus xmlns:D="DAV:"><D:response><D:href>`)
+			xml.EscapeText(&buf, []byte(davHref(base, p, node.Type == rnode.Dir)))
+			buf.WriteString(`</D:href><D:propstat><D:prop>`)
+			for i, name := range names {
+				fmt.Fprintf(&buf, `<ns%d:%s xmlns:ns%d="%s"/>`, i, name.Local, i, html.EscapeString(name.Space))
+			}
+			buf.WriteString(`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`)
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusMultiStatus)
+			w.Write(buf.Bytes())
+
+		case "GET", "HEAD":
+			if node == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if node.Type == rnode.File {
+				ft.serveFile(ctx, w, r, node.Hash, true)
+				return
+			}
+			if node.Type != rnode.Dir {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			// Basic listing for the browsers
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if r.Method == "HEAD" {
+				return
+			}
+			fmt.Fprintf(w, "<!doctype html><title>%s</title><ul>\n", html.EscapeString(p))
+			for _, child := range node.Children {
+				fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(davHref(base, gopath.Join(p, child.Name), child.Type == rnode.Dir)), html.EscapeString(child.Name))
+			}
+			fmt.Fprintf(w, "</ul>\n")
+
+		case "PUT":
+			if node != nil && node.Type == rnode.Dir {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			// The parent must exist
+			parent, err := ft.davNode(ctx, fs, gopath.Dir(p))
+			if err != nil {
+				panic(err)
+			}
+			if parent == nil || parent.Type != rnode.Dir {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			current, _, created, err := fs.Path(ctx, p, 1, true, mtime)
+			if err != nil {
+				panic(err)
+			}
+			uploader := writer.NewUploader(&BlobStore{ft.blobStore, ctx})
+			meta, err := uploader.PutReader(gopath.Base(p), r.Body, nil)
+			if err != nil {
+				panic(err)
+			}
+			newNode, revision, err := ft.Update(ctx, current, meta, prefixFmt, true)
+			if err != nil {
+				panic(err)
+			}
+			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+			w.Header().Set("ETag", fmt.Sprintf("\"%s\"", newNode.Hash))
+			if created {
+				newEvent("file-created", newNode.Hash, p)
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			newEvent("file-updated", newNode.Hash, p)
+			w.WriteHeader(http.StatusNoContent)
+
+		case "MKCOL":
+			if r.ContentLength > 0 {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			if node != nil {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			parent, err := ft.davNode(ctx, fs, gopath.Dir(p))
+			if err != nil {
+				panic(err)
+			}
+			if parent == nil || parent.Type != rnode.Dir {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			root, err := fs.Root(ctx, true, mtime)
+			if err != nil {
+				panic(err)
+			}
+			newRoot, err := ft.SetPath(ctx, root.Meta, p, &rnode.RawNode{Type: rnode.Dir, Version: rnode.V1, ModTime: mtime}, mtime)
+			if err != nil {
+				panic(err)
+			}
+			_, revision, err := ft.Update(ctx, root, newRoot, prefixFmt, true)
+			if err != nil {
+				panic(err)
+			}
+			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+			newEvent("dir-created", newRoot.Hash, p)
+			w.WriteHeader(http.StatusCreated)
+
+		case "DELETE":
+			if node == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if p == "/" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			_, revision, err := ft.Delete(ctx, node, prefixFmt, mtime)
+			if err != nil {
+				panic(err)
+			}
+			ft.davLocks.remove(lockFS, p)
+			w.Header().Add("BlobStash-Filetree-FS-Revision", strconv.FormatInt(revision, 10))
+			newEvent(fmt.Sprintf("%s-deleted", node.Type), node.Hash, p)
+			w.WriteHeader(http.StatusNoContent)
+
+		case "COPY", "MOVE":
+			destName, destPath, err := parseDavDestination(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			destLockFS := indexKey(ns, destName)
+			if ft.davLocks.locked(destLockFS, destPath, true, tokens) || ft.davLocks.locked(destLockFS, gopath.Dir(destPath), false, tokens) {
+				w.WriteHeader(http.StatusLocked)
+				return
+			}
+			ft.copyMove(ctx, w, r, fs, p, destName, destPath, prefixFmt, mtime)
+
+			// Release the locks of the moved resources
+			if r.Method == "MOVE" {
+				srcFS, err := ft.FS(ctx, fsName, prefixFmt, false, 0)
+				if err != nil {
+					panic(err)
+				}
+				src, err := ft.davNode(ctx, srcFS, p)
+				if err != nil {
+					panic(err)
+				}
+				if src == nil {
+					ft.davLocks.remove(lockFS, p)
+				}
+			}
+
+		case "LOCK":
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				panic(err)
+			}
+			var lock davLock
+			var ok bool
+			if len(bytes.TrimSpace(body)) == 0 {
+				// A LOCK without body refreshes the lock matching the token of the `If` header
+				for _, token := range tokens {
+					if lock, ok = ft.davLocks.refresh(lockFS, p, token, davTimeout(r)); ok {
+						break
+					}
+				}
+				if !ok {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+			} else {
+				// Only exclusive write locks are supported (the shared locks are handled like exclusive ones)
+				lock, ok = ft.davLocks.create(lockFS, p, r.Header.Get("Depth") != "0", davTimeout(r))
+				if !ok {
+					w.WriteHeader(http.StatusLocked)
+					return
+				}
+				w.Header().Set("Lock-Token", "<"+lock.token+">")
+			}
+			depth := "0"
+			if lock.infinite {
+				depth = "infinity"
+			}
+			var buf bytes.Buffer
+			buf.WriteString(xml.Header)
+			buf.WriteString(`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`)
+			buf.WriteString(`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`)
+			fmt.Fprintf(&buf, `<D:depth>%s</D:depth><D:timeout>Second-%d</D:timeout>`, depth, int(lock.timeout.Seconds()))
+			fmt.Fprintf(&buf, `<D:locktoken><D:href>%s</D:href></D:locktoken>`, lock.token)
+			buf.WriteString(`<D:lockroot><D:href>`)
+			xml.EscapeText(&buf, []byte(davHref(base, p, node != nil && node.Type == rnode.Dir)))
+			buf.WriteString(`</D:href></D:lockroot></D:activelock></D:lockdiscovery></D:prop>`)
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf.Bytes())
+
+		case "UNLOCK":
+			token := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Lock-Token")), "<"), ">")
+			if !davLockTokenRe.MatchString(token) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !ft.davLocks.unlock(lockFS, p, token) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
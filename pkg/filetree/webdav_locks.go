@@ -0,0 +1,159 @@
+package filetree
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format of the lock tokens generated by `newLockToken`
+var davLockTokenRe = regexp.MustCompile(`^opaquelocktoken:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// Coded-URLs of the `If` header (e.g. `(<opaquelocktoken:...>)`)
+var davCodedURLRe = regexp.MustCompile(`<([^>]*)>`)
+
+// davLock is an exclusive write lock on a WebDAV resource
+type davLock struct {
+	fs       string // namespaced FS name (see `indexKey`)
+	root     string // path of the locked resource
+	infinite bool   // true if the descendants are locked too
+	token    string
+	timeout  time.Duration
+	expires  time.Time
+}
+
+// covers returns true if the path is locked by the lock
+func (l *davLock) covers(p string) bool {
+	return l.root == p || (l.infinite && isInside(p, l.root))
+}
+
+// davLocks is the table of the active WebDAV locks (they're kept in memory, and lost on restart)
+type davLocks struct {
+	locks map[string]*davLock // token => lock
+	mu    sync.Mutex
+}
+
+func newDavLocks() *davLocks {
+	return &davLocks{locks: map[string]*davLock{}}
+}
+
+// expire removes the expired locks (must be called with the mutex held)
+func (dl *davLocks) expire(now time.Time) {
+	for token, l := range dl.locks {
+		if now.After(l.expires) {
+			delete(dl.locks, token)
+		}
+	}
+}
+
+// locked returns true if the path is locked by a lock whose token was not submitted, `recursive` must be set if the
+// whole subtree is modified (i.e. the locks of the descendants are checked too)
+func (dl *davLocks) locked(fs, p string, recursive bool, tokens []string) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.expire(time.Now())
+L:
+	for _, l := range dl.locks {
+		if l.fs != fs || !(l.covers(p) || (recursive && isInside(l.root, p))) {
+			continue
+		}
+		for _, token := range tokens {
+			if token == l.token {
+				continue L
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// create locks the path, returns false if it conflicts with an existing lock
+func (dl *davLocks) create(fs, p string, infinite bool, timeout time.Duration) (davLock, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	now := time.Now()
+	dl.expire(now)
+	for _, l := range dl.locks {
+		if l.fs == fs && (l.covers(p) || (infinite && isInside(l.root, p))) {
+			return davLock{}, false
+		}
+	}
+	l := &davLock{
+		fs:       fs,
+		root:     p,
+		infinite: infinite,
+		token:    newLockToken(),
+		timeout:  timeout,
+		expires:  now.Add(timeout),
+	}
+	dl.locks[l.token] = l
+	return *l, true
+}
+
+// refresh resets the timeout of the lock, returns false if the token does not match a lock covering the path
+func (dl *davLocks) refresh(fs, p, token string, timeout time.Duration) (davLock, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	now := time.Now()
+	dl.expire(now)
+	l, ok := dl.locks[token]
+	if !ok || l.fs != fs || !l.covers(p) {
+		return davLock{}, false
+	}
+	l.timeout = timeout
+	l.expires = now.Add(timeout)
+	return *l, true
+}
+
+// unlock removes the lock, returns false if the token does not match a lock covering the path
+func (dl *davLocks) unlock(fs, p, token string) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	l, ok := dl.locks[token]
+	if !ok || l.fs != fs || !l.covers(p) {
+		return false
+	}
+	delete(dl.locks, token)
+	return true
+}
+
+// remove removes the locks of the path and its descendants (once they've been deleted or moved)
+func (dl *davLocks) remove(fs, p string) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for token, l := range dl.locks {
+		if l.fs == fs && isInside(l.root, p) {
+			delete(dl.locks, token)
+		}
+	}
+}
+
+// davIfTokens returns the lock tokens submitted in the `If` header (anything not matching the lock token format, like
+// the resource tags, is ignored)
+func davIfTokens(r *http.Request) []string {
+	tokens := []string{}
+	for _, m := range davCodedURLRe.FindAllStringSubmatch(r.Header.Get("If"), -1) {
+		if davLockTokenRe.MatchString(m[1]) {
+			tokens = append(tokens, m[1])
+		}
+	}
+	return tokens
+}
+
+// davTimeout returns the timeout requested in the `Timeout` header of a LOCK request (capped to `davLockTimeout`)
+func davTimeout(r *http.Request) time.Duration {
+	for _, v := range strings.Split(r.Header.Get("Timeout"), ",") {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "Second-") {
+			continue
+		}
+		if n, err := strconv.Atoi(v[len("Second-"):]); err == nil && n > 0 && n < davLockTimeout {
+			return time.Duration(n) * time.Second
+		}
+		break
+	}
+	return davLockTimeout * time.Second
+}
@@ -0,0 +1,162 @@
+package filetree
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestWebDAVPropfind(t *testing.T) {
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	f := bs.file("hello world.txt", "a")
+	f.ModTime = 1546300800
+	d := bs.dir("docs")
+
+	ms := &davMultistatus{XMLNS: "DAV:", Responses: []*davResponse{
+		davPropResponse("/api/filetree/webdav/myfs", "/docs", d),
+		davPropResponse("/api/filetree/webdav/myfs", "/docs/hello world.txt", f),
+	}}
+	out, err := xml.Marshal(ms)
+	if err != nil {
+		panic(err)
+	}
+	for _, expected := range []string{
+		`<D:multistatus xmlns:D="DAV:">`,
+		`<D:href>/api/filetree/webdav/myfs/docs/</D:href>`,
+		`<D:resourcetype><D:collection></D:collection></D:resourcetype>`,
+		`<D:href>/api/filetree/webdav/myfs/docs/hello%20world.txt</D:href>`,
+		`<D:getcontentlength>1</D:getcontentlength>`,
+		`<D:getcontenttype>`,
+		`<D:getlastmodified>Tue, 01 Jan 2019 00:00:00 GMT</D:getlastmodified>`,
+		`<D:supportedlock><D:lockentry>`,
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("missing %q in %s", expected, out)
+		}
+	}
+}
+
+func TestWebDAVPropNames(t *testing.T) {
+	body := `<?xml version="1.0" encoding="utf-8" ?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:">
+  <D:set><D:prop>
+    <Z:Win32LastModifiedTime>Tue, 01 Jan 2019 00:00:00 GMT</Z:Win32LastModifiedTime>
+    <Z:Win32FileAttributes><nested>1</nested></Z:Win32FileAttributes>
+  </D:prop></D:set>
+</D:propertyupdate>`
+	names, err := davPropNames(strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	if len(names) != 2 || names[0].Local != "Win32LastModifiedTime" || names[1].Local != "Win32FileAttributes" || names[1].Space != "urn:schemas-microsoft-com:" {
+		t.Errorf("bad prop names %+v", names)
+	}
+}
+
+func TestWebDAVRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		url, dest        string
+		vars             map[string]string
+		destFS, destPath string
+		destErr          error
+	}{
+		{"/webdav/myfs/a/b.txt", "http://host/webdav/other/c.txt", map[string]string{"name": "myfs", "path": "a/b.txt"}, "other", "/c.txt", nil},
+		{"/webdav/myfs@1546300800/a.txt", "/webdav/myfs/a.txt", map[string]string{"name": "myfs", "as_of": "1546300800", "path": "a.txt"}, "myfs", "/a.txt", nil},
+		{"/webdav/myfs/", "/webdav/myfs@1546300800/a.txt", map[string]string{"name": "myfs"}, "", "", errBadDestination},
+		{"/webdav/myfs", "/webdav/myfs/", map[string]string{"name": "myfs"}, "", "", errBadDestination},
+	} {
+		var vars map[string]string
+		var destFS, destPath string
+		var destErr error
+		r := mux.NewRouter()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			vars = mux.Vars(req)
+			destFS, destPath, destErr = parseDavDestination(req)
+		})
+		for _, route := range []string{"/webdav/{name}@{as_of:[0-9]+}/{path:.+}", "/webdav/{name}", "/webdav/{name}/", "/webdav/{name}/{path:.+}"} {
+			r.Handle(route, handler)
+		}
+		req := httptest.NewRequest("MOVE", tc.url, nil)
+		req.Header.Set("Destination", tc.dest)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+
+		for k, v := range tc.vars {
+			if vars[k] != v {
+				t.Errorf("%s: bad var %s, got %q, expected %q", tc.url, k, vars[k], v)
+			}
+		}
+		if destFS != tc.destFS || destPath != tc.destPath || destErr != tc.destErr {
+			t.Errorf("%s: bad destination, got %q, %q, %v", tc.url, destFS, destPath, destErr)
+		}
+	}
+}
+
+func TestWebDAVLocks(t *testing.T) {
+	dl := newDavLocks()
+	lock, ok := dl.create("myfs", "/docs", true, time.Hour)
+	if !ok {
+		t.Fatalf("failed to lock /docs")
+	}
+	if !davLockTokenRe.MatchString(lock.token) {
+		t.Errorf("bad lock token %q", lock.token)
+	}
+	for _, tc := range []struct {
+		fs, p     string
+		recursive bool
+		tokens    []string
+		locked    bool
+	}{
+		{"myfs", "/docs", false, nil, true},
+		{"myfs", "/docs/a.txt", false, nil, true},
+		{"myfs", "/docs/a.txt", false, []string{lock.token}, false},
+		{"myfs", "/", false, nil, false},
+		{"myfs", "/", true, nil, true},
+		{"myfs", "/docs2", true, nil, false},
+		{"other", "/docs", false, nil, false},
+	} {
+		if locked := dl.locked(tc.fs, tc.p, tc.recursive, tc.tokens); locked != tc.locked {
+			t.Errorf("%s:%s (recursive=%v) locked=%v, expected %v", tc.fs, tc.p, tc.recursive, locked, tc.locked)
+		}
+	}
+
+	// The locks are exclusive
+	if _, ok := dl.create("myfs", "/docs/a.txt", false, time.Hour); ok {
+		t.Errorf("/docs/a.txt should already be locked")
+	}
+	if _, ok := dl.create("myfs", "/", true, time.Hour); ok {
+		t.Errorf("/ should not be lockable")
+	}
+
+	if _, ok := dl.refresh("myfs", "/docs/a.txt", lock.token, time.Minute); !ok {
+		t.Errorf("failed to refresh the lock")
+	}
+	if dl.unlock("myfs", "/other", lock.token) {
+		t.Errorf("the lock does not cover /other")
+	}
+	if !dl.unlock("myfs", "/docs", lock.token) {
+		t.Errorf("failed to unlock")
+	}
+	if dl.locked("myfs", "/docs", false, nil) {
+		t.Errorf("/docs should not be locked anymore")
+	}
+
+	// The expired locks are ignored
+	if _, ok := dl.create("myfs", "/a.txt", false, -time.Second); !ok {
+		t.Fatalf("failed to lock /a.txt")
+	}
+	if dl.locked("myfs", "/a.txt", false, nil) {
+		t.Errorf("the expired lock should be ignored")
+	}
+
+	// Only the valid lock tokens are extracted from the `If` header
+	r := httptest.NewRequest("PUT", "/webdav/myfs/docs/a.txt", nil)
+	r.Header.Set("If", `<http://host/webdav/myfs/docs> (<`+lock.token+`>) (<opaquelocktoken:</D:href><evil/>>)`)
+	if tokens := davIfTokens(r); len(tokens) != 1 || tokens[0] != lock.token {
+		t.Errorf("bad tokens %+v", tokens)
+	}
+}
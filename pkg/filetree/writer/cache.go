@@ -0,0 +1,60 @@
+package writer
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+	"a4.io/blobstash/pkg/rangedb"
+)
+
+// MetaCache is a local index mapping the path of the already uploaded files to their node hash, so unchanged files
+// can be reused without being read.
+//
+// A file is considered unchanged if its size, mtime, ctime, inode and mode are the same.
+type MetaCache struct {
+	db *rangedb.RangeDB
+}
+
+// NewMetaCache opens (or creates) the cache at the given path
+func NewMetaCache(path string) (*MetaCache, error) {
+	db, err := rangedb.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MetaCache{db}, nil
+}
+
+// Close closes the underlying DB
+func (c *MetaCache) Close() error {
+	return c.db.Close()
+}
+
+// fingerprint returns a key that changes when the file is modified
+func fingerprint(fstat os.FileInfo) string {
+	m := &rnode.RawNode{}
+	setMtime(m, fstat)
+	return fmt.Sprintf("%d:%d:%d:%d:%d", fstat.Size(), fstat.ModTime().UnixNano(), m.ChangeTime, inode(fstat), fstat.Mode())
+}
+
+// Get returns the node hash of the file if it has not changed since the last upload
+func (c *MetaCache) Get(path string, fstat os.FileInfo) (string, bool, error) {
+	v, err := c.db.Get([]byte(path))
+	if err != nil {
+		return "", false, err
+	}
+	if v == nil {
+		return "", false, nil
+	}
+	parts := strings.SplitN(string(v), " ", 2)
+	if len(parts) != 2 || parts[0] != fingerprint(fstat) {
+		return "", false, nil
+	}
+	return parts[1], true, nil
+}
+
+// Set stores the node hash of the file
+func (c *MetaCache) Set(path string, fstat os.FileInfo, hash string) error {
+	return c.db.Set([]byte(path), []byte(fingerprint(fstat)+" "+hash))
+}
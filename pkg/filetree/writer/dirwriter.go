@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 
 	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
@@ -24,16 +25,18 @@ type node struct {
 	path string
 	fi   os.FileInfo
 
+	// Path of the first file of the hardlink group (if the file is hardlink and not the first one)
+	link string
+
 	// Children (if the node is a directory)
 	children []*node
 	parent   *node
 
 	// Upload result is stored in the node
-	// wr   *WriteResult
 	meta *rnode.RawNode
 	err  error
 
-	// Used to sync access to the WriteResult/Meta
+	// Used to sync access to the Meta
 	mu   sync.Mutex
 	cond sync.Cond
 }
@@ -53,31 +56,54 @@ func (up *Uploader) DirExplorer(path string, pnode *node, nodes chan<- *node) {
 	}
 	for _, fi := range dirdata {
 		abspath := filepath.Join(path, fi.Name())
-		// relpath, err := filepath.Rel(up.Root, abspath)
-		// if err != nil {
-		// 	panic(err)
-		// }
-		// if up.Ignorer != nil && up.Ignorer.MatchesPath(relpath) {
-		// 	log.Printf("Uploader: %v excluded", relpath)
-		// 	continue
-		// }
+		if up.Ignorer != nil {
+			relpath, err := filepath.Rel(up.Root, abspath)
+			if err != nil {
+				panic(err)
+			}
+			if up.Ignorer.Match(strings.Split(relpath, string(filepath.Separator)), fi.IsDir()) {
+				if !fi.IsDir() {
+					up.addResult(&WriteResult{FilesExcluded: 1})
+				}
+				continue
+			}
+		}
 		n := &node{path: abspath, fi: fi, parent: pnode}
 		n.cond.L = &n.mu
-		if fi.IsDir() {
+		switch {
+		case fi.IsDir():
 			up.DirExplorer(abspath, n, nodes)
 			nodes <- n
 			pnode.children = append(pnode.children, n)
-		} else {
-			if fi.Mode()&os.ModeSymlink == 0 {
-				nodes <- n
-				pnode.children = append(pnode.children, n)
+		case fi.Mode()&os.ModeSocket != 0:
+			// Sockets cannot be restored
+		default:
+			if fi.Mode().IsRegular() && nlink(fi) > 1 {
+				n.link = up.hardlink(abspath, fi)
 			}
+			nodes <- n
+			pnode.children = append(pnode.children, n)
 		}
 	}
 	pnode.cond.Broadcast()
 	return
 }
 
+// hardlink returns the path (relative to the root) of the first file of the hardlink group (the file with the given
+// FileInfo belongs to), or an empty string if it's the first one
+func (up *Uploader) hardlink(path string, fi os.FileInfo) string {
+	relpath, err := filepath.Rel(up.Root, path)
+	if err != nil {
+		panic(err)
+	}
+	key := fmt.Sprintf("%d:%d", dev(fi), inode(fi))
+	if first, ok := up.links[key]; ok {
+		return first
+	}
+	up.links[key] = filepath.ToSlash(relpath)
+	return ""
+}
+
 // DirWriterNode reads the directory and upload it.
 func (up *Uploader) DirWriterNode(node *node) {
 	node.mu.Lock()
@@ -85,11 +111,9 @@ func (up *Uploader) DirWriterNode(node *node) {
 
 	ctx := context.TODO()
 
-	// node.wr = NewWriteResult()
 	hashes := []string{}
 
 	// Wait for all children node to finish
-	node.skipped = true
 	for _, cnode := range node.children {
 		cnode.mu.Lock()
 		for !cnode.done {
@@ -100,10 +124,6 @@ func (up *Uploader) DirWriterNode(node *node) {
 				return
 			}
 		}
-		node.skipped = node.skipped && cnode.skipped
-		// node.wr.Add(cnode.wr)
-		// cnode.wr.free()
-		// cnode.wr = nil
 
 		// If a permission error prevented the uploader from reading the file, just ignore this node
 		// (but only for children of dir)
@@ -124,41 +144,38 @@ func (up *Uploader) DirWriterNode(node *node) {
 	for _, hash := range hashes {
 		node.meta.AddRef(hash)
 	}
-	// if node.skipped {
-	// 	node.wr.DirsSkipped++
-	// } else {
-	// 	node.wr.DirsUploaded++
-	// }
-	// node.wr.DirsCount++
-	// TODO WriteResult exisiting handling
 	node.meta.Name = filepath.Base(node.path)
 	node.meta.Type = "dir"
-	// node.meta.Size = node.wr.Size
+	if node.fi != nil {
+		if err := setExtraMeta(node.meta, node.path, node.fi, os.ModeDir|0755); err != nil {
+			node.err = err
+			return
+		}
+		// The ctime is updated each time the dir content changes
+		node.meta.ChangeTime = 0
+	}
 	mhash, mjs := node.meta.Encode()
 	node.meta.Hash = mhash
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
+	wr := &WriteResult{DirsCount: 1}
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
 		node.err = err
 		return
 	}
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			node.err = err
-			return
-		}
-		// node.wr.BlobsCount++
-		// node.wr.BlobsUploaded++
-		// node.wr.SizeUploaded += len(mjs)
-	} // else {
-	// node.wr.SizeSkipped += len(mjs)
-	// }
+	// The dir is skipped if it was already stored
+	node.skipped = wr.BlobsUploaded == 0
+	if node.skipped {
+		wr.DirsSkipped++
+	} else {
+		wr.DirsUploaded++
+	}
+	up.addResult(wr)
 	node.done = true
 	node.cond.Broadcast()
 	return
 }
 
-// PutDir upload a directory, it returns the saved Meta,
-// a WriteResult containing infos about uploaded blobs.
+// PutDir upload a directory, it returns the saved Meta (see `Stats` for infos about the uploaded blobs).
+// The paths matching the patterns from the `.blobstashignore` file and the extra patterns are excluded.
 func (up *Uploader) PutDir(path string) (*rnode.RawNode, error) {
 	//log.Printf("PutDir %v\n", path)
 	abspath, err := filepath.Abs(path)
@@ -166,13 +183,10 @@ func (up *Uploader) PutDir(path string) (*rnode.RawNode, error) {
 		return nil, err
 	}
 	up.Root = path
-	// if _, err := os.Stat(filepath.Join(path, ".blobsnapignore")); err == nil {
-	// 	ignorer, err := gignore.CompileIgnoreFile(filepath.Join(path, ".blobsnapignore"))
-	// 	if err != nil {
-	// 		return nil, nil, fmt.Errorf("failed to parse .blobsnapignore file: %v", err)
-	// 	}
-	// 	up.Ignorer = ignorer
-	// }
+	up.links = map[string]string{}
+	if err := up.loadIgnorer(path); err != nil {
+		return nil, err
+	}
 	nodes := make(chan *node)
 	fi, _ := os.Stat(abspath)
 	n := &node{root: true, path: abspath, fi: fi}
@@ -208,15 +222,16 @@ func (up *Uploader) PutDir(path string) (*rnode.RawNode, error) {
 				} else {
 					node.mu.Lock()
 					defer node.mu.Unlock()
-					node.meta, node.err = up.PutFile(node.path)
+					if node.fi.Mode().IsRegular() {
+						node.meta, node.err = up.putFile(node.path, filepath.Base(node.path), node.link, true)
+					} else {
+						node.meta, node.err = up.putSpecial(node.path, node.fi)
+					}
 					if node.err != nil {
 						if !os.IsPermission(node.err) {
 							n.err = fmt.Errorf("error PutFile with node %v", node)
 						}
 					}
-					// if node.wr.FilesSkipped == 1 {
-					// 	node.skipped = true
-					// }
 					node.done = true
 					node.cond.Broadcast()
 				}
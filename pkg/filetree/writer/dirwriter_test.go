@@ -0,0 +1,141 @@
+package writer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPutDirIgnoreDryRun(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobstash_uploader")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		IgnoreFile:          "*.log\nbuild/\n",
+		"a.txt":             "a",
+		"debug.log":         "excluded",
+		"keep.log":          "re-included",
+		"build/out.bin":     "excluded",
+		"sub/b.txt":         "b",
+		"sub/c.tmp":         "excluded by flag",
+		"sub/dup/b_dup.txt": "b",
+	}
+	for p, data := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(data), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	up := NewUploader(bs)
+	up.Patterns = []string{"*.tmp", "!keep.log"}
+	up.DryRun = true
+	uploaded := map[string]bool{}
+	var mu sync.Mutex
+	up.OnFile = func(path string, up bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		rel, _ := filepath.Rel(root, path)
+		uploaded[rel] = up
+	}
+	if _, err := up.PutDir(root); err != nil {
+		panic(err)
+	}
+	if len(bs.blobs) != 0 {
+		t.Errorf("dry run uploaded %d blobs", len(bs.blobs))
+	}
+
+	stats := up.Stats()
+	t.Logf("stats=%s", stats)
+	// .blobstashignore, a.txt, keep.log, sub/b.txt, sub/dup/b_dup.txt
+	if stats.FilesCount != 5 || stats.FilesExcluded != 2 {
+		t.Errorf("unexpected stats %s", stats)
+	}
+	for _, p := range []string{"debug.log", "build/out.bin", "sub/c.tmp"} {
+		if _, ok := uploaded[p]; ok {
+			t.Errorf("%s should have been excluded", p)
+		}
+	}
+	if !uploaded["keep.log"] {
+		t.Errorf("keep.log should have been re-included")
+	}
+
+	// Uploading for real should upload the same blobs
+	up2 := NewUploader(bs)
+	up2.Patterns = up.Patterns
+	if _, err := up2.PutDir(root); err != nil {
+		panic(err)
+	}
+	if len(bs.blobs) != stats.BlobsUploaded {
+		t.Errorf("expected %d blobs, got %d", stats.BlobsUploaded, len(bs.blobs))
+	}
+}
+
+func TestPutDirCache(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobstash_uploader")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+	for p, data := range map[string]string{"a.txt": "a", "sub/b.txt": "b"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, p), []byte(data), 0644); err != nil {
+			panic(err)
+		}
+	}
+
+	cache, err := NewMetaCache(filepath.Join(root, ".cache"))
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+
+	bs := &memBlobStore{blobs: map[string][]byte{}}
+	up := NewUploader(bs)
+	up.Cache = cache
+	up.Patterns = []string{".cache/"}
+	first, err := up.PutDir(root)
+	if err != nil {
+		panic(err)
+	}
+
+	// Nothing changed, the files must not be read
+	up2 := NewUploader(bs)
+	up2.Cache = cache
+	up2.Patterns = up.Patterns
+	second, err := up2.PutDir(root)
+	if err != nil {
+		panic(err)
+	}
+	if second.Hash != first.Hash {
+		t.Errorf("root hash mismatch %s/%s", first.Hash, second.Hash)
+	}
+	if stats := up2.Stats(); stats.FilesSkipped != 2 || stats.BlobsCount != 2 {
+		// Only the 2 dir nodes should have been encoded
+		t.Errorf("unexpected stats %s", stats)
+	}
+
+	// Modify a file
+	if err := ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("updated"), 0644); err != nil {
+		panic(err)
+	}
+	up3 := NewUploader(bs)
+	up3.Cache = cache
+	up3.Patterns = up.Patterns
+	if _, err := up3.PutDir(root); err != nil {
+		panic(err)
+	}
+	if stats := up3.Stats(); stats.FilesUploaded != 1 || stats.FilesSkipped != 1 {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
@@ -19,9 +19,8 @@ var (
 	Pol = chunker.Pol(0x3c657535c4d6f5)
 )
 
-func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*WriteResult, error) {
+func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode, wr *WriteResult) error {
 	ctx := context.TODO()
-	// writeResult := NewWriteResult()
 	// Init the rolling checksum
 
 	// reuse this buffer
@@ -41,24 +40,10 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 		if err == io.EOF {
 			break
 		}
-		chunkHash := hashutil.Compute(chunk.Data)
 		size += chunk.Length
-
-		exists, err := up.bs.Stat(ctx, chunkHash)
+		chunkHash, err := up.putChunk(ctx, wr, chunk.Data)
 		if err != nil {
-			panic(fmt.Sprintf("DB error: %v", err))
-		}
-		if !exists {
-			if rstorer, ok := up.bs.(BlobRemoteStorer); ok {
-				if err := rstorer.PutRemote(ctx, chunkHash, chunk.Data); err != nil {
-					panic(fmt.Errorf("failed to PUT blob to remote %v", err))
-				}
-
-			} else {
-				if err := up.bs.Put(ctx, chunkHash, chunk.Data); err != nil {
-					panic(fmt.Errorf("failed to PUT blob %v", err))
-				}
-			}
+			return err
 		}
 
 		// Save the location and the blob hash into a sorted list (with the offset as index)
@@ -67,26 +52,94 @@ func (up *Uploader) writeReader(f io.Reader, meta *rnode.RawNode) error { // (*W
 	meta.Size = int(size)
 	meta.AddData("blake2b-hash", fmt.Sprintf("%x", fullHash.Sum(nil)))
 	return nil
-	// writeResult.Hash = fmt.Sprintf("%x", fullHash.Sum(nil))
-	// if writeResult.BlobsUploaded > 0 {
-	// 	writeResult.FilesCount++
-	// 	writeResult.FilesUploaded++
-	// }
-	// return writeResult, nil
+}
+
+// putChunk uploads the chunk (if it does not exist yet) and returns its hash
+func (up *Uploader) putChunk(ctx context.Context, wr *WriteResult, data []byte) (string, error) {
+	chunkHash := hashutil.Compute(data)
+	if err := up.putBlob(ctx, wr, chunkHash, data); err != nil {
+		return "", err
+	}
+	return chunkHash, nil
+}
+
+// PutChunks uploads the content-defined chunks of the reader, which starts at `offset` in the file, and adds the
+// chunk refs to the meta. Unless `final` is true, the trailing chunk is not uploaded as more data may follow (it may
+// not end at a chunk boundary). Returns the offset of the end of the last uploaded chunk, this is where the next call
+// must start (the chunk boundaries only depend on the data since the previous boundary).
+func (up *Uploader) PutChunks(ctx context.Context, r io.Reader, meta *rnode.RawNode, offset int, final bool) (int, error) {
+	buf := make([]byte, 8*1024*1024)
+	chunkSplitter := chunker.New(r, Pol)
+	wr := &WriteResult{}
+	defer up.addResult(wr)
+	var pending []byte
+	for {
+		chunk, err := chunkSplitter.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return offset, err
+		}
+		// The previous chunk is not the trailing one, it can be uploaded
+		if pending != nil {
+			chunkHash, err := up.putChunk(ctx, wr, pending)
+			if err != nil {
+				return offset, err
+			}
+			offset += len(pending)
+			meta.AddIndexedRef(offset, chunkHash)
+		}
+		pending = append(pending[:0], chunk.Data...)
+	}
+	if final && pending != nil {
+		chunkHash, err := up.putChunk(ctx, wr, pending)
+		if err != nil {
+			return offset, err
+		}
+		offset += len(pending)
+		meta.AddIndexedRef(offset, chunkHash)
+	}
+	return offset, nil
 }
 
 // PutFileRename uploads and renames the file at the given path
-func (up *Uploader) PutFileRename(path, filename string, extraMeta bool) (*rnode.RawNode, error) { // , *WriteResult, error) {
-	return up.putFile(path, filename, extraMeta)
+func (up *Uploader) PutFileRename(path, filename string, extraMeta bool) (*rnode.RawNode, error) {
+	return up.putFile(path, filename, "", extraMeta)
 }
 
 // PutFile uploads the file at the given path
-func (up *Uploader) PutFile(path string) (*rnode.RawNode, error) { // , *WriteResult, error) {
+func (up *Uploader) PutFile(path string) (*rnode.RawNode, error) {
 	_, filename := filepath.Split(path)
-	return up.putFile(path, filename, true)
+	return up.putFile(path, filename, "", true)
+}
+
+// setExtraMeta sets the mode (if it's not the default one), the times, the ownership and the extended attributes
+func setExtraMeta(meta *rnode.RawNode, path string, fstat os.FileInfo, defaultMode os.FileMode) error {
+	if fstat.Mode() != defaultMode {
+		meta.Mode = uint32(fstat.Mode())
+	}
+
+	// Mtime/Ctime handling
+	meta.ModTime = fstat.ModTime().Unix()
+	setMtime(meta, fstat)
+	setOwner(meta, fstat)
+
+	// The extended attributes of the target would be returned for a symlink
+	if fstat.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	xa, err := xattrs(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the extended attributes of %s: %v", path, err)
+	}
+	meta.Xattrs = xa
+	return nil
 }
 
-func (up *Uploader) putFile(path, filename string, extraMeta bool) (*rnode.RawNode, error) { // , *WriteResult, error) {
+// putFile uploads the file, `link` is the path of the first file of the hardlink group (if the file is a hardlink
+// and it's not the first one)
+func (up *Uploader) putFile(path, filename, link string, extraMeta bool) (*rnode.RawNode, error) {
 	ctx := context.TODO()
 	up.StartUpload()
 	defer up.UploadDone()
@@ -102,55 +155,137 @@ func (up *Uploader) putFile(path, filename string, extraMeta bool) (*rnode.RawNo
 	meta.Name = filename
 	meta.Size = int(fstat.Size())
 	meta.Type = "file"
+	meta.Link = link
 
 	if extraMeta {
-		// Only set the mode if it's not the default one
-		mode := uint32(fstat.Mode())
-		if mode != 0644 {
-			meta.Mode = mode
+		if err := setExtraMeta(meta, path, fstat, 0644); err != nil {
+			return nil, err
 		}
+	}
+
+	wr := &WriteResult{}
 
-		// Mtime/Ctime handling
-		meta.ModTime = fstat.ModTime().Unix()
-		setMtime(meta, fstat)
-		//if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
-		//	meta.ChangeTime = stat.Ctim.Sec
-		//}
+	// Reuse the previous node if the file has not changed since the last upload (the cache is keyed by path, so it
+	// cannot be used when the file is renamed)
+	var cachePath string
+	if up.Cache != nil && extraMeta && filename == filepath.Base(path) {
+		cachePath, err = filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		hash, ok, err := up.Cache.Get(cachePath, fstat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query the cache: %v", err)
+		}
+		if ok {
+			// Ensure the node is still stored
+			exists, err := up.bs.Stat(ctx, hash)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat blob %v: %v", hash, err)
+			}
+			if exists {
+				// The refs are not loaded, only the hash is needed for building the parent dir
+				meta.Hash = hash
+				wr.FilesCount++
+				wr.FilesSkipped++
+				wr.Size += meta.Size
+				up.addResult(wr)
+				if up.OnFile != nil {
+					up.OnFile(path, false)
+				}
+				return meta, nil
+			}
+		}
 	}
 
-	// wr := NewWriteResult()
 	if fstat.Size() > 0 {
 		f, err := os.Open(path)
 		if err != nil {
 			return nil, err
 		}
 		defer f.Close()
-		if err := up.writeReader(f, meta); err != nil {
+		if err := up.writeReader(f, meta, wr); err != nil {
 			return nil, err
 		}
-		// if err != nil {
-		// 	return nil, nil, fmt.Errorf("FileWriter error: %v", err)
-		// }
-		// wr.free()
-		// wr = cwr
 	}
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
-		return nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
+		return nil, err
 	}
-	// wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
+	meta.Hash = mhash
+
+	if cachePath != "" && !up.DryRun {
+		if err := up.Cache.Set(cachePath, fstat, mhash); err != nil {
+			return nil, fmt.Errorf("failed to update the cache: %v", err)
 		}
-		// wr.BlobsCount++
-		// wr.BlobsUploaded++
-		// wr.SizeUploaded += len(mjs)
-	} // else {
-	// wr.SizeSkipped += len(mjs)
-	// }
+	}
+
+	// The file is skipped if all its blobs were already stored
+	uploaded := wr.BlobsUploaded > 0
+	wr.FilesCount++
+	wr.Size += meta.Size
+	if uploaded {
+		wr.FilesUploaded++
+	} else {
+		wr.FilesSkipped++
+	}
+	up.addResult(wr)
+	if up.OnFile != nil {
+		up.OnFile(path, uploaded)
+	}
+	return meta, nil
+}
+
+// putSpecial uploads the node for a symlink, a FIFO or a device (the FileInfo must come from `os.Lstat`)
+func (up *Uploader) putSpecial(path string, fstat os.FileInfo) (*rnode.RawNode, error) {
+	ctx := context.TODO()
+	meta := &rnode.RawNode{
+		Name: filepath.Base(path),
+	}
+	// The mode is always stored for the special files as it contains the file type
+	defaultMode := os.FileMode(0)
+	mode := fstat.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		meta.Type = rnode.Symlink
+		meta.Target = target
+		// The permissions of a symlink are not used
+		defaultMode = mode
+	case mode&os.ModeNamedPipe != 0:
+		meta.Type = rnode.Fifo
+	case mode&os.ModeCharDevice != 0:
+		meta.Type = rnode.CharDevice
+		meta.Rdev = rdev(fstat)
+	case mode&os.ModeDevice != 0:
+		meta.Type = rnode.BlockDevice
+		meta.Rdev = rdev(fstat)
+	default:
+		return nil, fmt.Errorf("unsupported file type %v for %s", mode, path)
+	}
+	if err := setExtraMeta(meta, path, fstat, defaultMode); err != nil {
+		return nil, err
+	}
+
+	mhash, mjs := meta.Encode()
+	wr := &WriteResult{FilesCount: 1}
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
+		return nil, err
+	}
 	meta.Hash = mhash
+	uploaded := wr.BlobsUploaded > 0
+	if uploaded {
+		wr.FilesUploaded++
+	} else {
+		wr.FilesSkipped++
+	}
+	up.addResult(wr)
+	if up.OnFile != nil {
+		up.OnFile(path, uploaded)
+	}
 	return meta, nil
 }
 
@@ -158,21 +293,11 @@ func (up *Uploader) putFile(path, filename string, extraMeta bool) (*rnode.RawNo
 func (up *Uploader) PutMeta(meta *rnode.RawNode) error {
 	ctx := context.TODO()
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
-		return fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	wr := &WriteResult{}
+	defer up.addResult(wr)
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
+		return err
 	}
-	// wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return fmt.Errorf("failed to put blob %v: %v", mhash, err)
-		}
-		// wr.BlobsCount++
-		// wr.BlobsUploaded++
-		// wr.SizeUploaded += len(mjs)
-	} // else {
-	// wr.SizeSkipped += len(mjs)
-	// }
 	meta.Hash = mhash
 	return nil
 }
@@ -182,27 +307,17 @@ func (up *Uploader) RenameMeta(meta *rnode.RawNode, name string) error {
 	ctx := context.TODO()
 	meta.Name = filepath.Base(name)
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
-		return fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	wr := &WriteResult{}
+	defer up.addResult(wr)
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
+		return err
 	}
-	// wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return fmt.Errorf("failed to put blob %v: %v", mhash, err)
-		}
-		// wr.BlobsCount++
-		// wr.BlobsUploaded++
-		// wr.SizeUploaded += len(mjs)
-	} // else {
-	// wr.SizeSkipped += len(mjs)
-	// }
 	meta.Hash = mhash
 	return nil
 }
 
 // PutReader uploads a reader
-func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]interface{}) (*rnode.RawNode, error) { // *WriteResult, error) {
+func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]interface{}) (*rnode.RawNode, error) {
 	ctx := context.TODO()
 	up.StartUpload()
 	defer up.UploadDone()
@@ -216,26 +331,30 @@ func (up *Uploader) PutReader(name string, reader io.Reader, data map[string]int
 			meta.AddData(k, v)
 		}
 	}
-	// wr := NewWriteResult()
-	if err := up.writeReader(reader, meta); err != nil {
+	if err := up.putReaderMeta(ctx, meta, reader); err != nil {
 		return nil, err
 	}
+	return meta, nil
+}
+
+// PutReaderMeta uploads the content of the reader and the given file node (its name, times and mode must already be
+// set)
+func (up *Uploader) PutReaderMeta(meta *rnode.RawNode, reader io.Reader) error {
+	up.StartUpload()
+	defer up.UploadDone()
+	return up.putReaderMeta(context.TODO(), meta, reader)
+}
+
+func (up *Uploader) putReaderMeta(ctx context.Context, meta *rnode.RawNode, reader io.Reader) error {
+	wr := &WriteResult{}
+	defer up.addResult(wr)
+	if err := up.writeReader(reader, meta, wr); err != nil {
+		return err
+	}
 	mhash, mjs := meta.Encode()
-	mexists, err := up.bs.Stat(ctx, mhash)
-	if err != nil {
-		return nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	if err := up.putBlob(ctx, wr, mhash, mjs); err != nil {
+		return err
 	}
-	// wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(ctx, mhash, mjs); err != nil {
-			return nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
-		}
-		// wr.BlobsCount++
-		// wr.BlobsUploaded++
-		// wr.SizeUploaded += len(mjs)
-	} // else {
-	// wr.SizeSkipped += len(mjs)
-	// }
 	meta.Hash = mhash
-	return meta, nil
+	return nil
 }
@@ -0,0 +1,64 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+type memBlobStore struct {
+	blobs map[string][]byte
+	mu    sync.Mutex
+}
+
+func (bs *memBlobStore) Stat(_ context.Context, hash string) (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	_, ok := bs.blobs[hash]
+	return ok, nil
+}
+
+func (bs *memBlobStore) Put(_ context.Context, hash string, data []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.blobs[hash] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestPutChunks(t *testing.T) {
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	up := NewUploader(&memBlobStore{blobs: map[string][]byte{}})
+	expected := &rnode.RawNode{}
+	if err := up.writeReader(bytes.NewReader(data), expected, &WriteResult{}); err != nil {
+		panic(err)
+	}
+
+	// Feed the data in parts, as it would be done for resumable uploads
+	meta := &rnode.RawNode{}
+	var offset int
+	var err error
+	for _, end := range []int{3 << 20, 3<<20 + 10, 11 << 20, len(data)} {
+		offset, err = up.PutChunks(context.TODO(), bytes.NewReader(data[offset:end]), meta, offset, false)
+		if err != nil {
+			panic(err)
+		}
+	}
+	offset, err = up.PutChunks(context.TODO(), bytes.NewReader(data[offset:]), meta, offset, true)
+	if err != nil {
+		panic(err)
+	}
+
+	if offset != len(data) {
+		t.Errorf("expected offset to be %d, got %d", len(data), offset)
+	}
+	if !reflect.DeepEqual(meta.Refs, expected.Refs) {
+		t.Errorf("chunks mismatch, expected %v, got %v", expected.Refs, meta.Refs)
+	}
+}
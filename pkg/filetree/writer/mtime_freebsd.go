@@ -12,3 +12,38 @@ func setMtime(m *rnode.RawNode, fstat os.FileInfo) {
 		m.ChangeTime, _ = stat.Ctimespec.Unix()
 	}
 }
+
+func inode(fstat os.FileInfo) uint64 {
+	if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+func setOwner(m *rnode.RawNode, fstat os.FileInfo) {
+	if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
+		m.Uid = int(stat.Uid)
+		m.Gid = int(stat.Gid)
+	}
+}
+
+func rdev(fstat os.FileInfo) uint64 {
+	if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Rdev)
+	}
+	return 0
+}
+
+func nlink(fstat os.FileInfo) uint64 {
+	if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink)
+	}
+	return 0
+}
+
+func dev(fstat os.FileInfo) uint64 {
+	if stat, ok := fstat.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
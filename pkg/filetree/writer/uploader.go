@@ -1,6 +1,20 @@
 package writer
 
-import "context"
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+)
+
+// IgnoreFile is the name of the file containing the gitignore-style exclude patterns (located at the root of the
+// uploaded directory)
+const IgnoreFile = ".blobstashignore"
 
 var (
 	uploader    = 25 // concurrent upload uploaders
@@ -24,8 +38,28 @@ type Uploader struct {
 	uploader    chan struct{}
 	dirUploader chan struct{}
 
-	// Ignorer *gignore.GitIgnore
-	Root string
+	Ignorer gitignore.Matcher
+	Root    string
+
+	// Extra gitignore-style patterns (they take precedence over the ones from the ignore file)
+	Patterns []string
+
+	// If DryRun is set to true, the blobs that would be uploaded are only reported
+	DryRun bool
+	seen   map[string]struct{} // blobs that would have been uploaded
+
+	// Cache (if set) is used to skip the unchanged files (see MetaCache)
+	Cache *MetaCache
+
+	// OnFile is called (if set) after each file is processed, `uploaded` is false if the file was already stored
+	// (it may be called concurrently)
+	OnFile func(path string, uploaded bool)
+
+	// Path of the first file of each hardlink group (only accessed by the dir explorer)
+	links map[string]string
+
+	wr *WriteResult
+	mu sync.Mutex // for guarding wr/seen
 }
 
 func NewUploader(bs BlobStorer) *Uploader {
@@ -34,7 +68,99 @@ func NewUploader(bs BlobStorer) *Uploader {
 		// kvs:         kvs,
 		uploader:    make(chan struct{}, uploader),
 		dirUploader: make(chan struct{}, dirUploader),
+		seen:        map[string]struct{}{},
+		wr:          &WriteResult{},
+	}
+}
+
+// Stats returns a copy of the stats of the uploads performed so far
+func (up *Uploader) Stats() *WriteResult {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	wr := &WriteResult{}
+	wr.Add(up.wr)
+	return wr
+}
+
+func (up *Uploader) addResult(wr *WriteResult) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	up.wr.Add(wr)
+}
+
+// putBlob uploads the blob if it does not exist yet, and updates the write result
+func (up *Uploader) putBlob(ctx context.Context, wr *WriteResult, hash string, data []byte) error {
+	wr.BlobsCount++
+	exists, err := up.bs.Stat(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("failed to stat blob %v: %v", hash, err)
+	}
+	if !exists && up.DryRun {
+		up.mu.Lock()
+		_, exists = up.seen[hash]
+		up.seen[hash] = struct{}{}
+		up.mu.Unlock()
+		if !exists {
+			wr.BlobsUploaded++
+			wr.SizeUploaded += len(data)
+		} else {
+			wr.SizeSkipped += len(data)
+		}
+		return nil
+	}
+	if exists {
+		wr.SizeSkipped += len(data)
+		return nil
+	}
+	if rstorer, ok := up.bs.(BlobRemoteStorer); ok {
+		if err := rstorer.PutRemote(ctx, hash, data); err != nil {
+			return fmt.Errorf("failed to PUT blob to remote %v", err)
+		}
+	} else {
+		if err := up.bs.Put(ctx, hash, data); err != nil {
+			return fmt.Errorf("failed to put blob %v: %v", hash, err)
+		}
+	}
+	wr.BlobsUploaded++
+	wr.SizeUploaded += len(data)
+	return nil
+}
+
+// ParsePatterns parses the gitignore-style patterns (empty lines and comments are skipped)
+func ParsePatterns(lines []string) []gitignore.Pattern {
+	ps := []gitignore.Pattern{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, nil))
+	}
+	return ps
+}
+
+// loadIgnorer setups the ignorer from the ignore file in the root directory (if any) and the extra patterns
+func (up *Uploader) loadIgnorer(root string) error {
+	lines := []string{}
+	f, err := os.Open(filepath.Join(root, IgnoreFile))
+	switch {
+	case err == nil:
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read %s: %v", IgnoreFile, err)
+		}
+	case os.IsNotExist(err):
+	default:
+		return err
+	}
+	lines = append(lines, up.Patterns...)
+	if ps := ParsePatterns(lines); len(ps) > 0 {
+		up.Ignorer = gitignore.NewMatcher(ps)
 	}
+	return nil
 }
 
 // Block until the client can start the upload, thus limiting the number of file descriptor used.
@@ -0,0 +1,49 @@
+package writer
+
+import "fmt"
+
+// WriteResult holds the stats of an upload
+type WriteResult struct {
+	FilesCount    int `json:"files_count"`
+	FilesUploaded int `json:"files_uploaded"`
+	FilesSkipped  int `json:"files_skipped"`
+	FilesExcluded int `json:"files_excluded"`
+
+	DirsCount    int `json:"dirs_count"`
+	DirsUploaded int `json:"dirs_uploaded"`
+	DirsSkipped  int `json:"dirs_skipped"`
+
+	BlobsCount    int `json:"blobs_count"`
+	BlobsUploaded int `json:"blobs_uploaded"`
+
+	// Size of the files content that has been scanned
+	Size int `json:"size"`
+	// Size of the blobs uploaded/already present
+	SizeUploaded int `json:"size_uploaded"`
+	SizeSkipped  int `json:"size_skipped"`
+}
+
+// Add adds the stats of the other result
+func (wr *WriteResult) Add(o *WriteResult) {
+	wr.FilesCount += o.FilesCount
+	wr.FilesUploaded += o.FilesUploaded
+	wr.FilesSkipped += o.FilesSkipped
+	wr.FilesExcluded += o.FilesExcluded
+	wr.DirsCount += o.DirsCount
+	wr.DirsUploaded += o.DirsUploaded
+	wr.DirsSkipped += o.DirsSkipped
+	wr.BlobsCount += o.BlobsCount
+	wr.BlobsUploaded += o.BlobsUploaded
+	wr.Size += o.Size
+	wr.SizeUploaded += o.SizeUploaded
+	wr.SizeSkipped += o.SizeSkipped
+}
+
+func (wr *WriteResult) String() string {
+	return fmt.Sprintf("files=%d (uploaded=%d, skipped=%d, excluded=%d), dirs=%d (uploaded=%d, skipped=%d), "+
+		"blobs=%d (uploaded=%d), size=%d, uploaded=%d, skipped=%d",
+		wr.FilesCount, wr.FilesUploaded, wr.FilesSkipped, wr.FilesExcluded,
+		wr.DirsCount, wr.DirsUploaded, wr.DirsSkipped,
+		wr.BlobsCount, wr.BlobsUploaded,
+		wr.Size, wr.SizeUploaded, wr.SizeSkipped)
+}
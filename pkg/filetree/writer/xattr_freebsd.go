@@ -0,0 +1,8 @@
+package writer
+
+import rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+
+// xattrs is only supported on Linux
+func xattrs(path string) ([]*rnode.Xattr, error) {
+	return nil, nil
+}
@@ -0,0 +1,55 @@
+package writer
+
+import (
+	"bytes"
+	"sort"
+	"syscall"
+
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
+)
+
+// xattrs returns the extended attributes of the file (sorted by name)
+func xattrs(path string) ([]*rnode.Xattr, error) {
+	sz, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sz == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, sz)
+	sz, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*rnode.Xattr
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsz, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			// The attribute may have been removed in the meantime
+			if err == syscall.ENODATA {
+				continue
+			}
+			return nil, err
+		}
+		value := make([]byte, vsz)
+		if vsz > 0 {
+			vsz, err = syscall.Getxattr(path, string(name), value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, &rnode.Xattr{Name: string(name), Value: value[:vsz]})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
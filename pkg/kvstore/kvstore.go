@@ -115,6 +115,18 @@ func (kv *KvStore) Versions(ctx context.Context, key, start string, limit int) (
 	return res, strconv.FormatInt(cursor, 10), nil
 }
 
+// Purge removes all the versions of the given key (the meta blobs are not removed from the blob store)
+func (kv *KvStore) Purge(ctx context.Context, key string) (int, error) {
+	kv.log.Info("OP Purge", "key", key)
+	return kv.vkv.Purge(key)
+}
+
+// DeleteVersion removes a single version of the given key (the meta blob is not removed from the blob store)
+func (kv *KvStore) DeleteVersion(ctx context.Context, key string, version int64) error {
+	kv.log.Info("OP DeleteVersion", "key", key, "version", version)
+	return kv.vkv.DeleteVersion(key, version)
+}
+
 func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
 	return kv.vkv.ReverseKeys(start, end, limit)
 }
@@ -38,6 +38,26 @@ func setupKvStore(L *lua.LState, kvs store.KvStore, ctx context.Context) func(*l
 				L.Push(lua.LString(cursor))
 				return 2
 			},
+			"versions": func(L *lua.LState) int {
+				start := L.OptString(2, "0")
+				limit := L.OptInt(3, 100)
+				kvv, cursor, err := kvs.Versions(ctx, L.ToString(1), start, limit)
+				if err != nil {
+					if err == vkv.ErrNotFound {
+						L.Push(L.CreateTable(0, 0))
+						L.Push(lua.LString(""))
+						return 2
+					}
+					panic(err)
+				}
+				tbl := L.CreateTable(len(kvv.Versions), 0)
+				for _, kv := range kvv.Versions {
+					tbl.Append(convertKv(L, kv))
+				}
+				L.Push(tbl)
+				L.Push(lua.LString(cursor))
+				return 2
+			},
 			"get_meta_blob": func(L *lua.LState) int {
 				version, err := strconv.ParseInt(L.ToString(2), 10, 0)
 				if err != nil {
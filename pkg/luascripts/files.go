@@ -5,6 +5,6 @@ package luascripts
 var files = map[string]string{
 	"docstore_query.lua":       "-- Python-like string.split implementation http://lua-users.org/wiki/SplitJoin\nfunction string:split(sSeparator, nMax, bRegexp)\n   assert(sSeparator ~= '')\n   assert(nMax == nil or nMax >= 1)\n\n   local aRecord = {}\n\n   if self:len() > 0 then\n      local bPlain = not bRegexp\n      nMax = nMax or -1\n\n      local nField, nStart = 1, 1\n      local nFirst,nLast = self:find(sSeparator, nStart, bPlain)\n      while nFirst and nMax ~= 0 do\n         aRecord[nField] = self:sub(nStart, nFirst-1)\n         nField = nField+1\n         nStart = nLast+1\n         nFirst,nLast = self:find(sSeparator, nStart, bPlain)\n         nMax = nMax-1\n      end\n      aRecord[nField] = self:sub(nStart)\n   end\n\n   return aRecord\nend\nfunction get_path (doc, q)\n  q = q:gsub('%[%d', '.%1')\n  local parts = q:split('.')\n  p = doc\n  for _, part in ipairs(parts) do\n    if type(p) ~= 'table' then\n      return nil\n    end\n    if part:sub(1, 1) == '[' then\n      part = part:sub(2, 2)\n    end\n    if tonumber(part) ~= nil then\n      p = p[tonumber(part)]\n    else\n      p = p[part]\n    end\n    if p == nil then\n      return nil\n    end\n  end\n  return p\nend\n_G.get_path = get_path\nfunction in_list (doc, path, value, q)\n  local p = get_path(doc, path)\n  if type(p) ~= 'table' then\n    return false\n  end\n  for _, item in ipairs(p) do\n    if q == nil then\n      if item == value then return true end\n    else\n      if get_path(item, q) == value then return true end\n    end\n  end\n  return false\nend\n_G.in_list = in_list\n\nfunction match (doc, path, op, value)\n  p = get_path(doc, path)\n  if type(p) ~= type(value) then return false end\n  if op == 'EQ' then\n    return p == value\n  elseif op == 'NE' then\n    return p ~= value\n  elseif op == 'GT' then\n    return p > value\n  elseif op == 'GE' then\n    return p >= value\n  elseif op == 'LT' then\n    return p < value\n  elseif op == 'LE' then\n    return p <= value\n  end\n  return false\nend\n_G.match = match\n",
 	"filetree_expr_search.lua": "-- Used as a \"match func\" when searching within a FileTree tree\nreturn function(node, contents)\n  if {{.expr}} then return true else return false end\nend\n",
-	"stash_gc.lua":             "local msgpack = require('msgpack')\nlocal kvstore = require('kvstore')\nlocal blobstore = require('blobstore')\nlocal node = require('node')\n \n-- Setup the `mark_kv` and `mark_filetree` global helper for the GC API\nfunction mark_kv (key, version)\n  local h = kvstore.get_meta_blob(key, version)\n  if h ~= nil then\n    mark(h)\n    local _, ref, _ = kvstore.get(key, version)\n    if ref ~= '' then\n      mark(ref)\n    end\n  end\n end\n _G.mark_kv = mark_kv\n\nfunction mark_filetree_node (ref)\n  local data = blobstore.get(ref)\n  local cnode = node.decode(data)\n  mark(ref)\n  if cnode.t == 'dir' then\n    if cnode.r then\n      for _, childRef in ipairs(cnode.r) do\n        mark_filetree_node(childRef)\n      end\n    end\n  else\n    if cnode.r then\n      for _, contentRef in ipairs(cnode.r) do\n        mark(contentRef[2])\n      end\n    end\n  end\nend\n_G.mark_filetree_node = mark_filetree_node\n",
+	"stash_gc.lua":             "local msgpack = require('msgpack')\nlocal kvstore = require('kvstore')\nlocal blobstore = require('blobstore')\nlocal node = require('node')\n \n-- Setup the `mark_kv` and `mark_filetree` global helper for the GC API\nfunction mark_kv (key, version)\n  local h = kvstore.get_meta_blob(key, version)\n  if h ~= nil then\n    mark(h)\n    local _, ref, _ = kvstore.get(key, version)\n    if ref ~= '' then\n      mark(ref)\n    end\n  end\n end\n _G.mark_kv = mark_kv\n\nfunction mark_filetree_node (ref)\n  local data = blobstore.get(ref)\n  local cnode = node.decode(data)\n  mark(ref)\n  if cnode.t == 'dir' then\n    if cnode.r then\n      for _, childRef in ipairs(cnode.r) do\n        mark_filetree_node(childRef)\n      end\n    end\n  else\n    if cnode.r then\n      for _, contentRef in ipairs(cnode.r) do\n        mark(contentRef[2])\n      end\n    end\n  end\nend\n_G.mark_filetree_node = mark_filetree_node\n\n-- Mark all the snapshots of a FS, the pruned snapshots are not listed anymore so the blobs only referenced by them\n-- won't be kept\nfunction mark_filetree_fs (name)\n  local key = '_filetree:fs:' .. name\n  local cursor = '0'\n  while true do\n    local versions, next_cursor = kvstore.versions(key, cursor, 100)\n    for _, kv in ipairs(versions) do\n      mark_kv(key, kv.version)\n      mark_filetree_node(kv.ref)\n    end\n    if #versions < 100 or next_cursor == '' or next_cursor == '0' then\n      break\n    end\n    cursor = next_cursor\n  end\nend\n_G.mark_filetree_fs = mark_filetree_fs\n\n-- Mark the pointers found in a docstore document, `@blobstash/doc:` pointers are followed\nfunction mark_doc_pointers (doc, seen)\n  for _, v in pairs(doc) do\n    if type(v) == 'table' then\n      mark_doc_pointers(v, seen)\n    elseif type(v) == 'string' then\n      if v:sub(1, 15) == '@blobstash/doc:' then\n        local collection, _id = v:sub(16):match('^([^/]+)/(.+)$')\n        if collection ~= nil then\n          mark_doc(collection, _id, '0', seen)\n        end\n      elseif v:sub(1, 12) == '@blobs/json:' then\n        mark(v:sub(13))\n      elseif v:sub(1, 14) == '@filetree/ref:' then\n        mark_filetree_node(v:sub(15))\n      end\n    end\n  end\nend\n\n-- Mark a docstore document version (version '0' is the latest), and the documents it references\nfunction mark_doc (collection, _id, version, seen)\n  seen = seen or {}\n  local key = 'docstore:' .. collection .. ':' .. _id\n  local ok, data, _, doc_version = pcall(kvstore.get, key, version)\n  if not ok then\n    -- The referenced doc may have been purged, any other error must abort the GC (or blobs may not be marked)\n    if tostring(data):find('key not found', 1, true) then\n      return\n    end\n    error(data)\n  end\n  if seen[key .. '@' .. doc_version] then\n    return\n  end\n  seen[key .. '@' .. doc_version] = true\n  mark_kv(key, doc_version)\n  -- Deleted doc (flagDeleted)\n  if data:byte(1) == 1 then\n    return\n  end\n  -- Encrypted doc (purgeable collection), the pointers cannot be read without the key\n  if data:byte(2) == 0xc1 then\n    return\n  end\n  mark_doc_pointers(msgpack.decode(data:sub(2)), seen)\nend\n_G.mark_doc = mark_doc\n",
 	"test.lua":                 "return function()\n    return {{.expr}}\nend\n",
 }
@@ -24,17 +24,21 @@ const (
 	Search   ActionType = "search"
 	GC       ActionType = "gc"
 	Destroy  ActionType = "destroy"
+	Rename   ActionType = "rename"
+	Query    ActionType = "query"
+	Admin    ActionType = "admin" // Manage the settings of an object (e.g. the JSON Schema of a collection)
 )
 
 // Object types
 const (
-	Blob      ObjectType = "blob"
-	KVEntry   ObjectType = "kv"
-	FS        ObjectType = "fs"
-	Node      ObjectType = "node"
-	GitRepo   ObjectType = "git-repo"
-	GitNs     ObjectType = "git-ns"
-	Namespace ObjectType = "namespace"
+	Blob       ObjectType = "blob"
+	KVEntry    ObjectType = "kv"
+	FS         ObjectType = "fs"
+	Node       ObjectType = "node"
+	GitRepo    ObjectType = "git-repo"
+	GitNs      ObjectType = "git-ns"
+	Namespace  ObjectType = "namespace"
+	Collection ObjectType = "collection"
 )
 
 // Services
@@ -118,6 +122,25 @@ func init() {
 			},
 		},
 	})
+	SetupRole(&config.Role{
+		Template:     "docstore-ro",
+		Managed:      true,
+		ArgsRequired: []string{"collection"},
+		Perms: []*config.Perm{
+			&config.Perm{
+				Action:   Action(Read, Collection),
+				Resource: ResourceWithID(DocStore, Collection, "{{.collection}}"),
+			},
+			&config.Perm{
+				Action:   Action(Query, Collection),
+				Resource: ResourceWithID(DocStore, Collection, "{{.collection}}"),
+			},
+			&config.Perm{
+				Action:   Action(Stat, Collection),
+				Resource: ResourceWithID(DocStore, Collection, "{{.collection}}"),
+			},
+		},
+	})
 	SetupRole(&config.Role{
 		Name: "git-admin",
 		Perms: []*config.Perm{
@@ -54,3 +54,36 @@ func TestRedefineAdmin(t *testing.T) {
 		t.Errorf("err should not be nil, got %v", err)
 	}
 }
+
+func TestManagedRole(t *testing.T) {
+	if err := SetupRole(&config.Role{
+		Name:     "notes-ro",
+		Template: "docstore-ro",
+		Args:     map[string]interface{}{"collection": "notes"},
+	}); err != nil {
+		panic(err)
+	}
+
+	role, err := GetRole("notes-ro")
+	if err != nil {
+		panic(err)
+	}
+	for _, tdata := range []struct {
+		action     string
+		collection string
+		expected   bool
+	}{
+		{Action(Read, Collection), "notes", true},
+		{Action(Query, Collection), "notes", true},
+		{Action(Write, Collection), "notes", false},
+		{Action(Read, Collection), "notes2", false},
+	} {
+		res, err := role.Can(tdata.action, ResourceWithID(DocStore, Collection, tdata.collection))
+		if err != nil {
+			panic(err)
+		}
+		if res != tdata.expected {
+			t.Errorf("%s on %s: expected %v, got %v", tdata.action, tdata.collection, tdata.expected, res)
+		}
+	}
+}
@@ -52,7 +52,21 @@ func (q *Queue) Remove() error {
 
 // Enqueue the given `item`. Must be JSON serializable.
 func (q *Queue) Enqueue(item interface{}) (*id.ID, error) {
-	id, err := id.New(time.Now().Unix())
+	return q.enqueue(item, time.Now().Unix())
+}
+
+// EnqueueAt enqueues the given `item` after the items enqueued before `t` (the items are ordered by second, `t` is
+// rounded up so the item is never dequeued before the ones enqueued until `t`). Must be JSON serializable.
+func (q *Queue) EnqueueAt(item interface{}, t time.Time) (*id.ID, error) {
+	ts := t.Unix()
+	if t.After(time.Unix(ts, 0)) {
+		ts++
+	}
+	return q.enqueue(item, ts)
+}
+
+func (q *Queue) enqueue(item interface{}, ts int64) (*id.ID, error) {
+	id, err := id.New(ts)
 	if err != nil {
 		return nil, err
 	}
@@ -77,3 +77,32 @@ func TestQueue(t *testing.T) {
 		t.Errorf("no item should have been dequeued, got \"%s\"", deq3.Val)
 	}
 }
+
+func TestEnqueueAt(t *testing.T) {
+	q, err := New("queue_test_at")
+	defer func() {
+		q.Close()
+		os.Remove("queue_test_at")
+	}()
+	if err != nil {
+		t.Fatalf("Error creating db %v", err)
+	}
+	_, err = q.EnqueueAt(&Item{"later"}, time.Now().Add(10*time.Millisecond))
+	check(err)
+	_, err = q.Enqueue(&Item{"now"})
+	check(err)
+
+	// The delayed item is dequeued after the ones enqueued before its due time
+	for _, expected := range []string{"now", "later"} {
+		deq := &Item{}
+		ok, deqFunc, err := q.Dequeue(deq)
+		check(err)
+		if !ok {
+			t.Fatalf("an item should have been dequeued")
+		}
+		deqFunc(true)
+		if deq.Val != expected {
+			t.Errorf("dequeued value should be %q, got %q", expected, deq.Val)
+		}
+	}
+}
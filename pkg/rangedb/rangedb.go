@@ -55,6 +55,10 @@ func (db *RangeDB) Get(k []byte) ([]byte, error) {
 	return v, nil
 }
 
+func (db *RangeDB) Delete(k []byte) error {
+	return db.db.Delete(k, nil)
+}
+
 func (db *RangeDB) Has(k []byte) (bool, error) {
 	e, err := db.db.Has(k, nil)
 	if err != nil {
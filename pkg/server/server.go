@@ -20,6 +20,7 @@ import (
 	"a4.io/blobstash/pkg/capabilities"
 	"a4.io/blobstash/pkg/config"
 	"a4.io/blobstash/pkg/docstore"
+	docstoreLua "a4.io/blobstash/pkg/docstore/lua"
 	"a4.io/blobstash/pkg/expvarserver"
 	"a4.io/blobstash/pkg/filetree"
 	"a4.io/blobstash/pkg/gitserver"
@@ -152,6 +153,9 @@ func New(conf *config.Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize docstore app: %v", err)
 	}
+	if err := docstoreLua.SetupHooks(docstore); err != nil {
+		return nil, fmt.Errorf("failed to load the docstore post-commit hooks: %v", err)
+	}
 	docstore.Register(s.router.PathPrefix("/api/docstore").Subrouter(), basicAuth)
 
 	git, err := gitserver.New(logger.New("app", "gitserver"), conf, kvstore, blobstore, hub)
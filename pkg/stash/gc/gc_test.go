@@ -7,10 +7,12 @@ import (
 	"testing"
 
 	log "github.com/inconshreveable/log15"
+	"github.com/vmihailenco/msgpack"
 
 	"a4.io/blobstash/pkg/blob"
 	bstore "a4.io/blobstash/pkg/blobstore"
 	"a4.io/blobstash/pkg/ctxutil"
+	rnode "a4.io/blobstash/pkg/filetree/filetreeutil/node"
 	"a4.io/blobstash/pkg/hashutil"
 	"a4.io/blobstash/pkg/hub"
 	kstore "a4.io/blobstash/pkg/kvstore"
@@ -112,3 +114,198 @@ func TestDataContextMerge(t *testing.T) {
 	// t.Errorf("bad GCed blob, expected %s, got %s", lastBlob.Hash, blobsRoot[0].Hash)
 	// }
 }
+
+func mustMarshal(v interface{}) []byte {
+	encoded, err := msgpack.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+func TestMarkDoc(t *testing.T) {
+	dir := "stashtest3"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashtest4"
+	if err := os.MkdirAll(dir2, 0700); err != nil {
+		panic(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+	}()
+	logger := log.New()
+	hub := hub.New(logger.New("app", "hub"))
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := bstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := stash.New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	tmpDataContext, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+
+	// Doc "a" references doc "b" (which references doc "a" too), doc "c" is not referenced
+	for _, d := range []struct {
+		key string
+		doc map[string]interface{}
+	}{
+		{"docstore:col1:a", map[string]interface{}{"ref": "@blobstash/doc:col2/b"}},
+		{"docstore:col2:b", map[string]interface{}{"refs": []interface{}{"@blobstash/doc:col1/a", "@blobstash/doc:col1/nope"}}},
+		{"docstore:col1:c", map[string]interface{}{"hello": "world"}},
+	} {
+		encoded, err := msgpack.Marshal(d.doc)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := tmpDataContext.KvStore().Put(context.TODO(), d.key, "", append([]byte{0}, encoded...), 10); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := GC(ctxutil.WithNamespace(context.Background(), "tmp"), nil, s, "mark_doc('col1', 'a', '0')", nil); err != nil {
+		panic(err)
+	}
+
+	blobsRoot, _, err := s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	if err != nil {
+		panic(err)
+	}
+	if len(blobsRoot) != 2 {
+		t.Errorf("root blobstore should contains 2 blobs, got %d", len(blobsRoot))
+	}
+
+	// The pointers of the encrypted docs (purgeable collections) are not walked
+	for _, d := range []struct {
+		key  string
+		data []byte
+	}{
+		{"docstore:col1:d", append([]byte{0}, mustMarshal(map[string]interface{}{"ref": "@blobstash/doc:secrets/s"})...)},
+		{"docstore:secrets:s", append([]byte{0, 0xc1}, []byte("nonce and ciphertext")...)},
+	} {
+		if _, err := tmpDataContext.KvStore().Put(context.TODO(), d.key, "", d.data, 10); err != nil {
+			panic(err)
+		}
+	}
+	if err := GC(ctxutil.WithNamespace(context.Background(), "tmp"), nil, s, "mark_doc('col1', 'd', '0')", nil); err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	blobsRoot, _, err = s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	if err != nil {
+		panic(err)
+	}
+	if len(blobsRoot) != 4 {
+		t.Errorf("root blobstore should contains 4 blobs, got %d", len(blobsRoot))
+	}
+
+	// Only the missing docs are skipped, the other errors must abort the GC
+	if err := GC(ctxutil.WithNamespace(context.Background(), "tmp"), nil, s, "mark_doc('col1', 'a', 'v1')", nil); err == nil {
+		t.Errorf("mark_doc with an invalid version should have failed")
+	}
+}
+
+func TestMarkFiletreeFS(t *testing.T) {
+	dir := "stashtest5"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+	dir2 := "stashtest6"
+	if err := os.MkdirAll(dir2, 0700); err != nil {
+		panic(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		os.RemoveAll(dir2)
+	}()
+	logger := log.New()
+	hub := hub.New(logger.New("app", "hub"))
+	metaHandler, err := meta.New(logger.New("app", "meta"), hub)
+	if err != nil {
+		panic(err)
+	}
+	bsRoot, err := bstore.New(logger.New("app", "blobstore"), true, dir, nil, hub)
+	if err != nil {
+		panic(err)
+	}
+	kvsRoot, err := kstore.New(logger.New("app", "kvstore"), dir, bsRoot, metaHandler)
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := stash.New(dir2, metaHandler, bsRoot, kvsRoot, hub, logger)
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	tmpDataContext, err := s.NewDataContext("tmp")
+	if err != nil {
+		panic(err)
+	}
+	ctx := ctxutil.WithNamespace(context.Background(), "tmp")
+
+	putNode := func(n *rnode.RawNode) string {
+		h, data := n.Encode()
+		if err := tmpDataContext.BlobStoreProxy().Put(ctx, &blob.Blob{Hash: h, Data: data}); err != nil {
+			panic(err)
+		}
+		return h
+	}
+
+	// Two snapshots of the same FS, each one with a single file
+	for i := 1; i <= 2; i++ {
+		chunk := makeBlob([]byte(fmt.Sprintf("content%d", i)))
+		if err := tmpDataContext.BlobStoreProxy().Put(ctx, chunk); err != nil {
+			panic(err)
+		}
+		file := &rnode.RawNode{Type: rnode.File, Name: "file.txt", Size: len(chunk.Data)}
+		file.AddIndexedRef(len(chunk.Data), chunk.Hash)
+		root := &rnode.RawNode{Type: rnode.Dir, Name: "_root"}
+		root.AddRef(putNode(file))
+		if _, err := tmpDataContext.KvStore().Put(ctx, "_filetree:fs:test", putNode(root), nil, int64(i*10)); err != nil {
+			panic(err)
+		}
+	}
+
+	// Prune the first snapshot
+	if err := tmpDataContext.KvStore().DeleteVersion(ctx, "_filetree:fs:test", 10); err != nil {
+		panic(err)
+	}
+	kv, err := tmpDataContext.KvStore().Get(ctx, "_filetree:fs:test", -1)
+	if err != nil {
+		panic(err)
+	}
+	if kv.Version != 20 {
+		t.Errorf("expected latest version to be 20, got %d", kv.Version)
+	}
+
+	if err := GC(ctx, nil, s, "mark_filetree_fs('test')", nil); err != nil {
+		panic(err)
+	}
+
+	blobsRoot, _, err := s.Root().BlobStore().Enumerate(context.Background(), "", "\xff", 0)
+	if err != nil {
+		panic(err)
+	}
+	// The meta blob, the root node, the file node and the chunk of the second snapshot
+	if len(blobsRoot) != 4 {
+		t.Errorf("root blobstore should contains 4 blobs, got %d", len(blobsRoot))
+	}
+}
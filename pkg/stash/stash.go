@@ -403,6 +403,22 @@ func (kv *KvStore) Keys(ctx context.Context, start, end string, limit int) ([]*v
 	return dataContext.KvStoreProxy().Keys(ctx, start, end, limit)
 }
 
+func (kv *KvStore) Purge(ctx context.Context, key string) (int, error) {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return dataContext.KvStoreProxy().Purge(ctx, key)
+}
+
+func (kv *KvStore) DeleteVersion(ctx context.Context, key string, version int64) error {
+	dataContext, err := kv.s.dataContext(ctx)
+	if err != nil {
+		return err
+	}
+	return dataContext.KvStoreProxy().DeleteVersion(ctx, key, version)
+}
+
 func (kv *KvStore) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
 	dataContext, err := kv.s.dataContext(ctx)
 	if err != nil {
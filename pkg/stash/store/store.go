@@ -2,6 +2,7 @@ package store // import "a4.io/blobstash/pkg/stash/store"
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
@@ -84,6 +85,8 @@ type KvStore interface {
 	Versions(ctx context.Context, key, start string, limit int) (*vkv.KeyValueVersions, string, error)
 	Keys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error)
 	ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error)
+	Purge(ctx context.Context, key string) (int, error)
+	DeleteVersion(ctx context.Context, key string, version int64) error
 	Close() error
 }
 
@@ -202,6 +205,31 @@ func (p *KvStoreProxy) Versions(ctx context.Context, key, start string, limit in
 	return res, mcursor.Encode(vkv.NextVersionCursor), nil
 }
 
+// ErrPurgeFromRoot is returned when trying to purge a key from the root stash via a proxy
+var ErrPurgeFromRoot = errors.New("cannot purge a key from the root stash")
+
+func (p *KvStoreProxy) Purge(ctx context.Context, key string) (int, error) {
+	// The root stash is read-only
+	if _, err := p.ReadSrc.Get(ctx, key, -1); err != vkv.ErrNotFound {
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrPurgeFromRoot
+	}
+	return p.KvStore.Purge(ctx, key)
+}
+
+func (p *KvStoreProxy) DeleteVersion(ctx context.Context, key string, version int64) error {
+	// The root stash is read-only
+	if _, err := p.ReadSrc.Get(ctx, key, version); err != vkv.ErrNotFound {
+		if err != nil {
+			return err
+		}
+		return ErrPurgeFromRoot
+	}
+	return p.KvStore.DeleteVersion(ctx, key, version)
+}
+
 func (p *KvStoreProxy) ReverseKeys(ctx context.Context, start, end string, limit int) ([]*vkv.KeyValue, string, error) {
 	var tmp []*sortHelper
 	var out []*vkv.KeyValue
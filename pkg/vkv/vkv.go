@@ -358,6 +358,84 @@ func (db *DB) Versions(key string, start, end int64, limit int) (*KeyValueVersio
 	return res, nstart, nil
 }
 
+// Purge removes the key and all its versions, returns the number of removed versions.
+// The meta blob references are kept, this way the versions won't be re-applied when re-scanning the blobs.
+func (db *DB) Purge(key string) (int, error) {
+	kvkey := append([]byte{FlagKey}, []byte(key)...)
+	prefix := buildVkey(kvkey, 0)
+	prefix = prefix[:len(prefix)-8]
+
+	vkeys := [][]byte{}
+	c := db.rdb.PrefixRange(prefix, false)
+	defer c.Close()
+	k, _, err := c.Next()
+	for ; err == nil; k, _, err = c.Next() {
+		// Skip the versions of the keys having `key` as prefix
+		if len(k) != len(prefix)+8 {
+			continue
+		}
+		vkeys = append(vkeys, k)
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+
+	if len(vkeys) == 0 {
+		return 0, ErrNotFound
+	}
+
+	for _, vkey := range vkeys {
+		if err := db.rdb.Delete(vkey); err != nil {
+			return 0, err
+		}
+	}
+	if err := db.rdb.Delete(kvkey); err != nil {
+		return 0, err
+	}
+
+	return len(vkeys), nil
+}
+
+// DeleteVersion removes a single version of the key, if it's the latest one, the previous version becomes the latest.
+// Like for `Purge`, the meta blob reference is kept.
+func (db *DB) DeleteVersion(key string, version int64) error {
+	kvkey := append([]byte{FlagKey}, []byte(key)...)
+	vkey := buildVkey(kvkey, version)
+	data, err := db.rdb.Get(vkey)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrNotFound
+	}
+	if err := db.rdb.Delete(vkey); err != nil {
+		return err
+	}
+
+	ckv, err := db.get(key)
+	if err != nil {
+		return err
+	}
+	if ckv.Version != version {
+		return nil
+	}
+
+	// The latest version has been removed, update the key with the previous version (if any)
+	kvv, _, err := db.Versions(key, 0, version, 1)
+	switch err {
+	case nil:
+		encoded, err := kvv.Versions[0].Dump()
+		if err != nil {
+			return err
+		}
+		return db.rdb.Set(kvkey, encoded)
+	case ErrNotFound:
+		return db.rdb.Delete(kvkey)
+	default:
+		return err
+	}
+}
+
 func UnserializeBlob(blob []byte) (*KeyValue, error) {
 	kv := &KeyValue{}
 	if err := msgpack.Unmarshal(blob, kv); err != nil {